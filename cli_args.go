@@ -7,6 +7,7 @@ import (
 	_ "github.com/rfjakob/gocryptfs/v2/internal/ensurefds012"
 
 	"fmt"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
@@ -19,6 +20,7 @@ import (
 	"github.com/hanwen/go-fuse/v2/fuse"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/v2/internal/stupidgcm"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
@@ -29,36 +31,74 @@ type argContainer struct {
 	debug, init, zerokey, fusedebug, openssl, passwd, fg, version,
 	plaintextnames, quiet, nosyslog, wpanic,
 	longnames, allow_other, reverse, aessiv, nonempty, raw64,
-	noprealloc, speed, hkdf, serialize_reads, hh, info,
-	sharedstorage, fsck, one_file_system, deterministic_names,
-	xchacha bool
+	noprealloc, speed, speed_kdf, hkdf, serialize_reads, hh, info,
+	sharedstorage, fsck, one_file_system, deterministic_names, consistent_reads, writable,
+	xchacha, add_key, remove_key, list_keys, rotate_key, rekey, argon2id,
+	keyfile_generate, keyfile_password, write_auth, export_reader_key, export, gcmsiv, offline, repair, json bool
 	// Mount options with opposites
 	dev, nodev, suid, nosuid, exec, noexec, rw, ro, kernel_cache, acl bool
 	masterkey, mountpoint, cipherdir, cpuprofile,
-	memprofile, ko, ctlsock, fsname, force_owner, trace string
+	memprofile, ko, ctlsock, fsname, force_owner, trace, reader_key string
 	// FIDO2
 	fido2 string
 	fido2_assert_options []string
+	// External key management service
+	kms_endpoint, kms_keyid string
+	// Key slots
+	key_name, keyfile, new_keyfile, new_fido2 string
 	// -extpass, -badname, -passfile can be passed multiple times
-	extpass, badname, passfile []string
+	extpass, badname, passfile, masterkey_shares []string
 	// For reverse mode, several ways to specify exclusions. All can be specified multiple times.
 	exclude, excludeWildcard, excludeFrom []string
+	// -exclude-older-than and -exclude-newer-than (timestamps)
+	excludeOlderThan, excludeNewerThan string
+	// -exclude-larger-than (bytes)
+	excludeLargerThan int64
+	// -exclude-special and -exclude-ignore-files
+	excludeSpecial, excludeIgnoreFiles bool
 	// Configuration file name override
 	config             string
 	notifypid, scryptn int
+	// -jobs (files to check in parallel with -fsck)
+	jobs int
 	// Idle time before autounmount
 	idle time.Duration
 	// -longnamemax (hash encrypted names that are longer than this)
 	longnamemax uint8
+	// -blocksize (plaintext block size in bytes)
+	blocksize uint32
+	// -compress (compression algorithm, reverse mode only)
+	compress string
+	// -masterkey-split K/N and where to write the shares
+	masterkey_split, masterkey_split_dir string
+	// -repair-from (backup copy of CIPHERDIR for -fsck -repair)
+	repair_from string
+	// -fsck-state (state file for incremental -fsck)
+	fsck_state string
+	// -metrics (address of the metrics HTTP listener)
+	metrics string
+	// Argon2id cost parameters, 0 means default
+	argon2id_memory, argon2id_iterations uint32
+	argon2id_parallelism                 uint8
 	// Helper variables that are NOT cli options all start with an underscore
 	// _configCustom is true when the user sets a custom config file name.
 	_configCustom bool
 	// _ctlsockFd stores the control socket file descriptor (ctlsock stores the path)
 	_ctlsockFd net.Listener
+	// _metricsListener is the listener for -metrics
+	_metricsListener net.Listener
+	// _excludeOlderThan and _excludeNewerThan are parsed from the
+	// -exclude-older-than and -exclude-newer-than strings
+	_excludeOlderThan, _excludeNewerThan time.Time
 	// _forceOwner is, if non-nil, a parsed, validated Owner (as opposed to the string above)
 	_forceOwner *fuse.Owner
+	// _splitK and _splitN are parsed from "-masterkey-split K/N"
+	_splitK, _splitN int
 	// _explicitScryptn is true then the user passed "-scryptn=xyz"
 	_explicitScryptn bool
+	// _keySlot is the index of the key slot that unlocked the masterkey,
+	// or -1. Set by loadConfig().
+	_keySlot int
 }
 
 var flagSet *flag.FlagSet
@@ -179,15 +219,31 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 	flagSet.BoolVar(&args.raw64, "raw64", true, "Use unpadded base64 for file names")
 	flagSet.BoolVar(&args.noprealloc, "noprealloc", false, "Disable preallocation before writing")
 	flagSet.BoolVar(&args.speed, "speed", false, "Run crypto speed test")
+	flagSet.BoolVar(&args.speed_kdf, "speed-kdf", false, "Run password hash speed test")
 	flagSet.BoolVar(&args.hkdf, "hkdf", true, "Use HKDF as an additional key derivation step")
 	flagSet.BoolVar(&args.serialize_reads, "serialize_reads", false, "Try to serialize read operations")
 	flagSet.BoolVar(&args.hh, "hh", false, "Show this long help text")
 	flagSet.BoolVar(&args.info, "info", false, "Display information about CIPHERDIR")
 	flagSet.BoolVar(&args.sharedstorage, "sharedstorage", false, "Make concurrent access to a shared CIPHERDIR safer")
 	flagSet.BoolVar(&args.fsck, "fsck", false, "Run a filesystem check on CIPHERDIR")
+	flagSet.BoolVar(&args.offline, "offline", false, "With -fsck: check CIPHERDIR directly instead of mounting it")
+	flagSet.BoolVar(&args.repair, "repair", false, "With -fsck: repair the problems that are found. Implies -offline")
+	flagSet.BoolVar(&args.json, "json", false, "With -fsck -offline: print a JSON report instead of text")
 	flagSet.BoolVar(&args.one_file_system, "one-file-system", false, "Don't cross filesystem boundaries")
+	flagSet.BoolVar(&args.consistent_reads, "consistent-reads", false, "Fail reads of files that change while open (reverse mode)")
+	flagSet.BoolVar(&args.writable, "writable", false, "Allow restoring ciphertext into the plaintext directory (reverse mode)")
 	flagSet.BoolVar(&args.deterministic_names, "deterministic-names", false, "Disable diriv file name randomisation")
 	flagSet.BoolVar(&args.xchacha, "xchacha", false, "Use XChaCha20-Poly1305 file content encryption")
+	flagSet.BoolVar(&args.gcmsiv, "gcmsiv", false, "Use AES-GCM-SIV file content encryption")
+	flagSet.BoolVar(&args.add_key, "add-key", false, "Add a key slot")
+	flagSet.BoolVar(&args.remove_key, "remove-key", false, "Remove the key slot given by -key-name")
+	flagSet.BoolVar(&args.list_keys, "list-keys", false, "List key slots")
+	flagSet.BoolVar(&args.rotate_key, "rotate-key", false, "Add a new content key epoch")
+	flagSet.BoolVar(&args.argon2id, "argon2id", false, "Hash the password using Argon2id instead of scrypt")
+	flagSet.BoolVar(&args.rekey, "rekey", false, "Re-encrypt all files using the newest content key")
+	flagSet.BoolVar(&args.write_auth, "write-auth", false, "Sign file contents so that the reader key cannot write (with -init)")
+	flagSet.BoolVar(&args.export_reader_key, "export-reader-key", false, "Print the read-only reader key of a -write-auth filesystem")
+	flagSet.BoolVar(&args.export, "export", false, "Write the encrypted reverse-mode view of PLAINDIR to DESTDIR")
 
 	// Mount options with opposites
 	flagSet.BoolVar(&args.dev, "dev", false, "Allow device files")
@@ -202,16 +258,28 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 	flagSet.BoolVar(&args.acl, "acl", false, "Enforce ACLs")
 
 	flagSet.StringVar(&args.masterkey, "masterkey", "", "Mount with explicit master key")
+	flagSet.StringVar(&args.reader_key, "reader-key", "", "Mount read-only with the reader key of a -write-auth filesystem")
+	flagSet.StringVar(&args.masterkey_split, "masterkey-split", "", "Split the master key into Shamir shares, K/N means any K of N shares (with -init)")
+	flagSet.StringVar(&args.masterkey_split_dir, "masterkey-split-dir", "", "Write the shares from -masterkey-split to files in this directory")
 	flagSet.StringVar(&args.cpuprofile, "cpuprofile", "", "Write cpu profile to specified file")
 	flagSet.StringVar(&args.memprofile, "memprofile", "", "Write memory profile to specified file")
 	flagSet.StringVar(&args.config, "config", "", "Use specified config file instead of CIPHERDIR/gocryptfs.conf")
 	flagSet.StringVar(&args.ko, "ko", "", "Pass additional options directly to the kernel, comma-separated list")
 	flagSet.StringVar(&args.ctlsock, "ctlsock", "", "Create control socket at specified path")
+	flagSet.StringVar(&args.metrics, "metrics", "", "Serve Prometheus metrics over HTTP at HOST:PORT or unix:PATH")
 	flagSet.StringVar(&args.fsname, "fsname", "", "Override the filesystem name")
 	flagSet.StringVar(&args.force_owner, "force_owner", "", "uid:gid pair to coerce ownership")
 	flagSet.StringVar(&args.trace, "trace", "", "Write execution trace to file")
 	flagSet.StringVar(&args.fido2, "fido2", "", "Protect the masterkey using a FIDO2 token instead of a password")
 	flagSet.StringArrayVar(&args.fido2_assert_options, "fido2-assert-option", nil, "Options to be passed with `fido2-assert -t`")
+	flagSet.StringVar(&args.kms_endpoint, "kms-endpoint", "", "Wrap the masterkey using the key management service at this URL")
+	flagSet.StringVar(&args.kms_keyid, "kms-keyid", "", "Key ID to use with -kms-endpoint")
+	flagSet.StringVar(&args.key_name, "key-name", "", "Name of the key slot to add, remove or use")
+	flagSet.StringVar(&args.keyfile, "keyfile", "", "Unlock using a key file")
+	flagSet.BoolVar(&args.keyfile_generate, "keyfile-generate", false, "Write a new random key file to the -keyfile path (with -init)")
+	flagSet.BoolVar(&args.keyfile_password, "keyfile-password", false, "Require a password in addition to the key file (with -init or -add-key)")
+	flagSet.StringVar(&args.new_keyfile, "new-keyfile", "", "Protect the new key slot using a key file (with -add-key)")
+	flagSet.StringVar(&args.new_fido2, "new-fido2", "", "Protect the new key slot using a FIDO2 token (with -add-key)")
 
 	// Exclusion options
 	flagSet.StringArrayVar(&args.exclude, "e", nil, "Alias for -exclude")
@@ -219,20 +287,35 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 	flagSet.StringArrayVar(&args.excludeWildcard, "ew", nil, "Alias for -exclude-wildcard")
 	flagSet.StringArrayVar(&args.excludeWildcard, "exclude-wildcard", nil, "Exclude path from reverse view, supporting wildcards")
 	flagSet.StringArrayVar(&args.excludeFrom, "exclude-from", nil, "File from which to read exclusion patterns (with -exclude-wildcard syntax)")
+	flagSet.Int64Var(&args.excludeLargerThan, "exclude-larger-than", 0, "Exclude regular files larger than this many bytes from reverse view")
+	flagSet.BoolVar(&args.excludeSpecial, "exclude-special", false, "Exclude sockets, FIFOs and device nodes from reverse view")
+	flagSet.StringVar(&args.excludeOlderThan, "exclude-older-than", "", "Exclude files modified before this time from reverse view")
+	flagSet.StringVar(&args.excludeNewerThan, "exclude-newer-than", "", "Exclude files modified after this time from reverse view")
+	flagSet.BoolVar(&args.excludeIgnoreFiles, "exclude-ignore-files", false, "Read exclusion patterns from .gocryptfs-ignore files in each directory")
 
 	// multipleStrings options ([]string)
 	flagSet.StringArrayVar(&args.extpass, "extpass", nil, "Use external program for the password prompt")
 	flagSet.StringArrayVar(&args.badname, "badname", nil, "Glob pattern invalid file names that should be shown")
 	flagSet.StringArrayVar(&args.passfile, "passfile", nil, "Read password from file")
+	flagSet.StringArrayVar(&args.masterkey_shares, "masterkey-shares", nil, "Reconstruct the master key from Shamir shares in files (or \"stdin\")")
 
 	flagSet.Uint8Var(&args.longnamemax, "longnamemax", 255, "Hash encrypted names that are longer than this")
+	flagSet.Uint32Var(&args.blocksize, "blocksize", contentenc.DefaultBS, "Plaintext block size in bytes, power of two between 4096 and 1048576")
+	flagSet.StringVar(&args.repair_from, "repair-from", "", "With -fsck -repair: restore missing gocryptfs.diriv files from this backup copy of CIPHERDIR")
+	flagSet.StringVar(&args.fsck_state, "fsck-state", "", "With -fsck -offline: skip files that are unchanged since the run that wrote this state file")
+	flagSet.StringVar(&args.compress, "compress", "", "Compress file contents in reverse mode, the only algorithm is \"lz4\" (with -init)")
 
+	flagSet.IntVar(&args.jobs, "jobs", 1, "With -fsck: number of files to check in parallel")
 	flagSet.IntVar(&args.notifypid, "notifypid", 0, "Send USR1 to the specified process after "+
 		"successful mount - used internally for daemonization")
 	const scryptn = "scryptn"
 	flagSet.IntVar(&args.scryptn, scryptn, configfile.ScryptDefaultLogN, "scrypt cost parameter logN. Possible values: 10-28. "+
 		"A lower value speeds up mounting and reduces its memory needs, but makes the password susceptible to brute-force attacks")
 
+	flagSet.Uint32Var(&args.argon2id_memory, "argon2id-memory", 0, "Argon2id memory cost in MiB (0 = default 64)")
+	flagSet.Uint32Var(&args.argon2id_iterations, "argon2id-iterations", 0, "Argon2id time cost (0 = default 3)")
+	flagSet.Uint8Var(&args.argon2id_parallelism, "argon2id-parallelism", 0, "Argon2id parallelism (0 = default 4)")
+
 	flagSet.DurationVar(&args.idle, "i", 0, "Alias for -idle")
 	flagSet.DurationVar(&args.idle, "idle", 0, "Auto-unmount after specified idle duration (ignored in reverse mode). "+
 		"Durations are specified like \"500s\" or \"2h45m\". 0 means stay mounted indefinitely.")
@@ -276,6 +359,28 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 			os.Exit(exitcodes.Usage)
 		}
 	}
+	if args.excludeLargerThan < 0 {
+		tlog.Fatal.Printf("-exclude-larger-than: invalid value %d", args.excludeLargerThan)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.excludeOlderThan != "" {
+		args._excludeOlderThan, err = parseTimestamp(args.excludeOlderThan)
+		if err != nil {
+			tlog.Fatal.Printf("-exclude-older-than: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.excludeNewerThan != "" {
+		args._excludeNewerThan, err = parseTimestamp(args.excludeNewerThan)
+		if err != nil {
+			tlog.Fatal.Printf("-exclude-newer-than: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.gcmsiv && (args.aessiv || args.xchacha) {
+		tlog.Fatal.Printf("The option -gcmsiv cannot be combined with -aessiv or -xchacha")
+		os.Exit(exitcodes.Usage)
+	}
 	if len(args.extpass) > 0 && len(args.passfile) != 0 {
 		tlog.Fatal.Printf("The options -extpass and -passfile cannot be used at the same time")
 		os.Exit(exitcodes.Usage)
@@ -288,10 +393,133 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 		tlog.Fatal.Printf("The options -extpass and -masterkey cannot be used at the same time")
 		os.Exit(exitcodes.Usage)
 	}
+	if len(args.masterkey_shares) > 0 && (args.masterkey != "" || args.zerokey || len(args.passfile) != 0 ||
+		(len(args.extpass) > 0 && !args.init)) {
+		tlog.Fatal.Printf("The option -masterkey-shares cannot be combined with -masterkey, -zerokey, -passfile or -extpass")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.masterkey_split_dir != "" && args.masterkey_split == "" {
+		tlog.Fatal.Printf("The option -masterkey-split-dir requires -masterkey-split")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.masterkey_split != "" {
+		if !args.init {
+			tlog.Fatal.Printf("The option -masterkey-split requires -init")
+			os.Exit(exitcodes.Usage)
+		}
+		if _, err := fmt.Sscanf(args.masterkey_split, "%d/%d", &args._splitK, &args._splitN); err != nil ||
+			args._splitK < 2 || args._splitN < args._splitK || args._splitN > 255 {
+			tlog.Fatal.Printf("-masterkey-split: invalid value %q, want K/N with 2 <= K <= N <= 255", args.masterkey_split)
+			os.Exit(exitcodes.Usage)
+		}
+	}
 	if len(args.extpass) > 0 && args.fido2 != "" {
 		tlog.Fatal.Printf("The options -extpass and -fido2 cannot be used at the same time")
 		os.Exit(exitcodes.Usage)
 	}
+	if args.kms_keyid != "" && args.kms_endpoint == "" && args.init {
+		tlog.Fatal.Printf("The option -kms-keyid requires -kms-endpoint")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.kms_endpoint != "" && (args.fido2 != "" || len(args.extpass) > 0 || len(args.passfile) != 0) {
+		tlog.Fatal.Printf("The option -kms-endpoint cannot be combined with -fido2, -extpass or -passfile")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.new_keyfile != "" && args.new_fido2 != "" {
+		tlog.Fatal.Printf("The options -new-keyfile and -new-fido2 cannot be used at the same time")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.keyfile != "" && args.fido2 != "" {
+		tlog.Fatal.Printf("The options -keyfile and -fido2 cannot be used at the same time")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.keyfile_generate && (!args.init || args.keyfile == "") {
+		tlog.Fatal.Printf("The option -keyfile-generate requires -init and -keyfile")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.keyfile_password && !(args.init && args.keyfile != "") && !(args.add_key && args.new_keyfile != "") {
+		tlog.Fatal.Printf("The option -keyfile-password requires -init -keyfile or -add-key -new-keyfile")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.init && args.keyfile != "" && (args.kms_endpoint != "" || args.masterkey != "") {
+		tlog.Fatal.Printf("The option -keyfile cannot be combined with -kms-endpoint or -masterkey on -init")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.argon2id && args._explicitScryptn {
+		tlog.Fatal.Printf("The options -argon2id and -scryptn cannot be used at the same time")
+		os.Exit(exitcodes.Usage)
+	}
+	if !args.argon2id && (isFlagPassed(flagSet, "argon2id-memory") ||
+		isFlagPassed(flagSet, "argon2id-iterations") || isFlagPassed(flagSet, "argon2id-parallelism")) {
+		tlog.Fatal.Printf("The options -argon2id-memory, -argon2id-iterations and -argon2id-parallelism require -argon2id")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.argon2id_memory > math.MaxUint32/1024 {
+		tlog.Fatal.Printf("-argon2id-memory: value %d MiB is too large, the maximum is %d MiB",
+			args.argon2id_memory, math.MaxUint32/1024)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.argon2id && args.kms_endpoint != "" && args.init {
+		tlog.Fatal.Printf("The options -argon2id and -kms-endpoint cannot be used at the same time")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.write_auth && (!args.init || args.reverse) {
+		tlog.Fatal.Printf("The option -write-auth requires -init and is not supported in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.writable && args.ro {
+		tlog.Fatal.Printf("The options -writable and -ro cannot be used at the same time")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.compress != "" {
+		if args.compress != contentenc.CompressionLZ4 {
+			tlog.Fatal.Printf("-compress: unsupported algorithm %q, the only supported one is %q",
+				args.compress, contentenc.CompressionLZ4)
+			os.Exit(exitcodes.Usage)
+		}
+		if args.init && !args.reverse {
+			tlog.Fatal.Printf("The option -compress is only supported in reverse mode")
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.offline && !args.fsck {
+		tlog.Fatal.Printf("The option -offline requires -fsck")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.repair && !args.fsck {
+		tlog.Fatal.Printf("The option -repair requires -fsck")
+		os.Exit(exitcodes.Usage)
+	}
+	if (args.json || args.fsck_state != "") && !args.fsck {
+		tlog.Fatal.Printf("The options -json and -fsck-state require -fsck")
+		os.Exit(exitcodes.Usage)
+	}
+	if (args.json || args.fsck_state != "") && !args.offline && !args.repair {
+		tlog.Fatal.Printf("The options -json and -fsck-state are only supported with -offline or -repair")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.jobs < 1 {
+		tlog.Fatal.Printf("The option -jobs must be at least 1")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.jobs != 1 && !args.fsck {
+		tlog.Fatal.Printf("The option -jobs requires -fsck")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.repair_from != "" && !args.repair {
+		tlog.Fatal.Printf("The option -repair-from requires -repair")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.reader_key != "" {
+		if args.masterkey != "" || args.zerokey || len(args.masterkey_shares) > 0 || len(args.passfile) != 0 ||
+			len(args.extpass) > 0 || args.reverse || args.rw {
+			tlog.Fatal.Printf("The option -reader-key cannot be combined with -masterkey, -zerokey, -masterkey-shares, " +
+				"-passfile, -extpass, -reverse or -rw")
+			os.Exit(exitcodes.Usage)
+		}
+		// The reader key cannot produce valid ciphertext
+		args.ro = true
+	}
 	if args.idle < 0 {
 		tlog.Fatal.Printf("Idle timeout cannot be less than 0")
 		os.Exit(exitcodes.Usage)
@@ -308,6 +536,11 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 		tlog.Fatal.Printf("-longnamemax: value %d is outside allowed range 62 ... 255", args.longnamemax)
 		os.Exit(exitcodes.Usage)
 	}
+	if !contentenc.ValidBlockSize(uint64(args.blocksize)) {
+		tlog.Fatal.Printf("-blocksize: value %d is not a power of two in the allowed range %d ... %d",
+			args.blocksize, contentenc.MinBS, contentenc.MaxBS)
+		os.Exit(exitcodes.Usage)
+	}
 
 	return args
 }
@@ -335,6 +568,27 @@ func countOpFlags(args *argContainer) int {
 	if args.fsck {
 		count++
 	}
+	if args.add_key {
+		count++
+	}
+	if args.remove_key {
+		count++
+	}
+	if args.list_keys {
+		count++
+	}
+	if args.rotate_key {
+		count++
+	}
+	if args.rekey {
+		count++
+	}
+	if args.export_reader_key {
+		count++
+	}
+	if args.export {
+		count++
+	}
 	return count
 }
 
@@ -349,3 +603,25 @@ func isFlagPassed(flagSet *flag.FlagSet, name string) bool {
 	})
 	return found
 }
+
+// parseTimestamp parses the argument of -exclude-older-than and
+// -exclude-newer-than. Accepted are RFC 3339 timestamps, "YYYY-MM-DD",
+// "YYYY-MM-DD HH:MM:SS" (both in local time) and "@SECONDS" since the epoch.
+func parseTimestamp(s string) (time.Time, error) {
+	if strings.HasPrefix(s, "@") {
+		sec, err := strconv.ParseInt(s[1:], 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+		}
+		return time.Unix(sec, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q, want YYYY-MM-DD, YYYY-MM-DD HH:MM:SS, RFC 3339 or @SECONDS", s)
+}
@@ -118,9 +118,11 @@ func TestParseCliOpts(t *testing.T) {
 	defaultArgs := argContainer{
 		longnames:   true,
 		longnamemax: 255,
+		blocksize:   4096,
 		raw64:       true,
 		hkdf:        true,
 		openssl:     stupidgcm.PreferOpenSSLAES256GCM(), // depends on CPU and build flags
+		jobs:        1,
 		scryptn:     16,
 	}
 
@@ -6,6 +6,7 @@
 package ctlsock
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -19,6 +20,8 @@ func (r *ResponseStruct) Error() string {
 // CtlSock encapsulates a control socket
 type CtlSock struct {
 	Conn net.Conn
+	// r reads the newline-terminated responses from Conn
+	r *bufio.Reader
 }
 
 // There was at least one user who hit the earlier 1 second timeout. Raise to 10
@@ -45,12 +48,15 @@ func (c *CtlSock) Query(req *RequestStruct) (*ResponseStruct, error) {
 	if err != nil {
 		return nil, err
 	}
-	buf := make([]byte, 5000)
-	n, err := c.Conn.Read(buf)
+	// Responses can be bigger than a single read (CmdOpenFiles), and the
+	// server terminates each one with a newline.
+	if c.r == nil {
+		c.r = bufio.NewReader(c.Conn)
+	}
+	buf, err := c.r.ReadBytes('\n')
 	if err != nil {
 		return nil, err
 	}
-	buf = buf[:n]
 	var resp ResponseStruct
 	json.Unmarshal(buf, &resp)
 	if resp.ErrNo != 0 {
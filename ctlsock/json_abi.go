@@ -1,5 +1,46 @@
 package ctlsock
 
+// CurrentVersion is the version of the control socket API described in this
+// file. Requests without a Version (Version = 0) are the original path
+// translation requests that use EncryptPath or DecryptPath. Requests with
+// Version >= 1 use Command instead.
+//
+// Version 2 adds CmdEncryptPaths and CmdDecryptPaths, version 3 adds
+// CmdMetrics.
+const CurrentVersion = 3
+
+// Commands for versioned requests
+const (
+	// CmdEncryptPath encrypts Path. The result is in Result.
+	CmdEncryptPath = "EncryptPath"
+	// CmdDecryptPath decrypts Path. The result is in Result.
+	CmdDecryptPath = "DecryptPath"
+	// CmdStatus returns the mount status and statistics in Status.
+	CmdStatus = "Status"
+	// CmdOpenFiles lists the open files in OpenFiles.
+	CmdOpenFiles = "OpenFiles"
+	// CmdFlushDirCache drops the cached directory file descriptors and IVs.
+	// Not supported in reverse mode.
+	CmdFlushDirCache = "FlushDirCache"
+	// CmdSetDebug enables or disables debug logging, see Debug.
+	CmdSetDebug = "SetDebug"
+	// CmdUnmount unmounts the filesystem. The response is sent after the
+	// unmount has succeeded or failed.
+	CmdUnmount = "Unmount"
+	// CmdFeatureFlags returns the feature flags of the config file in
+	// FeatureFlags.
+	CmdFeatureFlags = "FeatureFlags"
+	// CmdEncryptPaths encrypts each of Paths. The results are in Results, in
+	// the same order. Since version 2.
+	CmdEncryptPaths = "EncryptPaths"
+	// CmdDecryptPaths decrypts each of Paths, see CmdEncryptPaths. Since
+	// version 2.
+	CmdDecryptPaths = "DecryptPaths"
+	// CmdMetrics returns the mount statistics in the Prometheus text
+	// exposition format in Metrics. Since version 3.
+	CmdMetrics = "Metrics"
+)
+
 // RequestStruct is sent by a client (encoded as JSON).
 // You cannot perform both encryption and decryption in the same request.
 type RequestStruct struct {
@@ -7,6 +48,17 @@ type RequestStruct struct {
 	EncryptPath string
 	// DecryptPath is the path that should be decrypted.
 	DecryptPath string
+	// Version is the API version the client uses. Set it to CurrentVersion
+	// to use Command.
+	Version int `json:",omitempty"`
+	// Command is one of the Cmd* constants.
+	Command string `json:",omitempty"`
+	// Path is the input path for CmdEncryptPath and CmdDecryptPath.
+	Path string `json:",omitempty"`
+	// Paths are the input paths for CmdEncryptPaths and CmdDecryptPaths.
+	Paths []string `json:",omitempty"`
+	// Debug is the new debug logging state for CmdSetDebug.
+	Debug bool `json:",omitempty"`
 }
 
 // ResponseStruct is sent by the server in response to a request
@@ -23,4 +75,56 @@ type ResponseStruct struct {
 	// WarnText contains warnings that may have been encountered while
 	// processing the message.
 	WarnText string
+	// Version is the API version of the server. Only set in responses to
+	// versioned requests.
+	Version int `json:",omitempty"`
+	// Status is the result of CmdStatus.
+	Status *MountStatus `json:",omitempty"`
+	// OpenFiles is the result of CmdOpenFiles.
+	OpenFiles []OpenFile `json:",omitempty"`
+	// FeatureFlags is the result of CmdFeatureFlags.
+	FeatureFlags []string `json:",omitempty"`
+	// Results is the result of CmdEncryptPaths and CmdDecryptPaths. A path
+	// that fails does not fail the request, its error is in its PathResult.
+	Results []PathResult `json:",omitempty"`
+	// Metrics is the result of CmdMetrics.
+	Metrics string `json:",omitempty"`
+}
+
+// PathResult is the result for one of the paths of a batch request. The
+// fields have the same meaning as in ResponseStruct.
+type PathResult struct {
+	Result   string
+	ErrNo    int32
+	ErrText  string
+	WarnText string
+}
+
+// MountStatus describes a running mount
+type MountStatus struct {
+	// GocryptfsVersion is the version of the gocryptfs binary
+	GocryptfsVersion string
+	// PID of the gocryptfs process
+	PID        int
+	Cipherdir  string
+	Mountpoint string
+	Reverse    bool
+	ReadOnly   bool
+	// MountTime is the time of the mount in seconds since the Unix epoch
+	MountTime int64
+	// Debug is true if debug logging is enabled
+	Debug bool
+	// OpenFiles is the number of open files
+	OpenFiles int
+	// WriteOps counts the write operations since the mount
+	WriteOps uint64
+}
+
+// OpenFile is an open file, identified by the device and inode number of the
+// backing (ciphertext) file
+type OpenFile struct {
+	Dev uint64
+	Ino uint64
+	// RefCount is the number of open file descriptors
+	RefCount int
 }
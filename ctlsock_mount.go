@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/v2/internal/metrics"
+	"github.com/rfjakob/gocryptfs/v2/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// ctlMount implements the versioned control socket commands
+type ctlMount struct {
+	args      *argContainer
+	rootNode  fs.InodeEmbedder
+	srv       *fuse.Server
+	mountTime time.Time
+	// featureFlags from the config file, nil if there is none
+	// (-masterkey, -zerokey)
+	featureFlags []string
+}
+
+var _ ctlsocksrv.Mount = &ctlMount{} // Verify that interface is implemented.
+
+func newCtlMount(args *argContainer, rootNode fs.InodeEmbedder, srv *fuse.Server) *ctlMount {
+	m := &ctlMount{
+		args:      args,
+		rootNode:  rootNode,
+		srv:       srv,
+		mountTime: time.Now(),
+	}
+	if cf, err := configfile.Load(args.config); err == nil {
+		m.featureFlags = cf.FeatureFlags
+	}
+	return m
+}
+
+// Status implements ctlsocksrv.Mount
+func (m *ctlMount) Status() ctlsock.MountStatus {
+	return ctlsock.MountStatus{
+		GocryptfsVersion: GitVersion,
+		PID:              os.Getpid(),
+		Cipherdir:        m.args.cipherdir,
+		Mountpoint:       m.args.mountpoint,
+		Reverse:          m.args.reverse,
+		ReadOnly:         m.args.ro || (m.args.reverse && !m.args.writable),
+		MountTime:        m.mountTime.Unix(),
+		Debug:            tlog.Debug.Enabled,
+		OpenFiles:        openfiletable.CountOpenFiles(),
+		WriteOps:         openfiletable.WriteOpCount(),
+	}
+}
+
+// OpenFiles implements ctlsocksrv.Mount
+func (m *ctlMount) OpenFiles() []ctlsock.OpenFile {
+	var l []ctlsock.OpenFile
+	for _, f := range openfiletable.List() {
+		l = append(l, ctlsock.OpenFile{Dev: f.QIno.Dev, Ino: f.QIno.Ino, RefCount: f.RefCount})
+	}
+	return l
+}
+
+// FlushDirCache implements ctlsocksrv.Mount
+func (m *ctlMount) FlushDirCache() error {
+	rn, ok := m.rootNode.(*fusefrontend.RootNode)
+	if !ok {
+		// Reverse mode has no directory cache
+		return syscall.ENOTSUP
+	}
+	rn.FlushDirCache()
+	return nil
+}
+
+// SetDebug implements ctlsocksrv.Mount
+func (m *ctlMount) SetDebug(enable bool) {
+	tlog.Info.Printf("ctlsock: debug logging enabled: %v", enable)
+	tlog.Debug.Enabled = enable
+}
+
+// Unmount implements ctlsocksrv.Mount
+func (m *ctlMount) Unmount() error {
+	tlog.Info.Printf("ctlsock: unmount requested")
+	err := m.srv.Unmount()
+	if err != nil {
+		tlog.Info.Printf("ctlsock: unmount failed: %v", err)
+	}
+	return err
+}
+
+// FeatureFlags implements ctlsocksrv.Mount
+func (m *ctlMount) FeatureFlags() []string {
+	return m.featureFlags
+}
+
+// Metrics implements ctlsocksrv.Mount
+func (m *ctlMount) Metrics() string {
+	var b strings.Builder
+	metrics.Write(&b)
+	return b.String()
+}
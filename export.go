@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend_reverse"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// exportTree - write the encrypted view a reverse mount of PLAINDIR
+// (args.cipherdir) would present to "dest", without using FUSE.
+// Calls os.Exit on errors.
+func exportTree(args *argContainer, dest string) {
+	dest, _ = filepath.Abs(dest)
+	if err := isDir(dest); err != nil {
+		tlog.Fatal.Printf("Invalid destination directory: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	frontendArgs, cEnc, nameTransform, cryptoBackend := initCrypto(args)
+	defer cEnc.Wipe()
+	if !cryptoBackend.MisuseResistant() {
+		log.Panic("reverse mode must use AES-SIV or AES-GCM-SIV, everything else is insecure")
+	}
+	rn := fusefrontend_reverse.NewRootNode(frontendArgs, cEnc, nameTransform)
+	stats, err := rn.Export(dest)
+	if err != nil {
+		tlog.Fatal.Printf("export: %v", err)
+		os.Exit(exitcodes.Export)
+	}
+	tlog.Info.Printf("Exported %q to %q: %d files written, %d unchanged, %d stale entries removed",
+		args.cipherdir, dest, stats.Written, stats.Unchanged, stats.Removed)
+	if stats.Errors > 0 {
+		tlog.Fatal.Printf("%d entries could not be exported", stats.Errors)
+		os.Exit(exitcodes.Export)
+	}
+}
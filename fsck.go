@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,12 +11,14 @@ import (
 	"path/filepath"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/v2/internal/offlinefsck"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
@@ -28,14 +31,22 @@ type fsckObj struct {
 	corruptList []string
 	// List of skipped files
 	skippedList []string
-	// Protects corruptList
+	// Protects corruptList, skippedList and seenInodes
 	listLock sync.Mutex
-	// stop a running watchMitigatedCorruptions thread
+	// watchCh registers and unregisters watches with the
+	// watchMitigatedCorruptions thread
+	watchCh chan watch
+	// stop the running watchMitigatedCorruptions thread
 	watchDone chan struct{}
 	// Inode numbers of hard-linked files (Nlink > 1) that we have already checked
 	seenInodes map[uint64]struct{}
 	// abort the running fsck operation? Checked in a few long-running loops.
-	abort bool
+	// Accessed atomically.
+	abort int32
+	// Files to check, read by the threads started by startWorkers().
+	// nil if we check serially (-jobs=1).
+	jobs    chan string
+	workers sync.WaitGroup
 }
 
 func runsAsRoot() bool {
@@ -54,32 +65,138 @@ func (ck *fsckObj) markSkipped(path string) {
 	ck.listLock.Unlock()
 }
 
+func (ck *fsckObj) aborted() bool {
+	return atomic.LoadInt32(&ck.abort) != 0
+}
+
 func (ck *fsckObj) abs(relPath string) (absPath string) {
 	return filepath.Join(ck.mnt, relPath)
 }
 
-// Watch for mitigated corruptions that occur during OpenDir()
-func (ck *fsckObj) watchMitigatedCorruptionsOpenDir(path string) {
+// Operations that mitigated corruptions are attributed to
+const (
+	watchOpenDir = iota
+	watchRead
+	watchListXAttr
+)
+
+// watch attributes the mitigated corruptions that are reported for inode
+// "ino" to "path"
+type watch struct {
+	ino  uint64
+	path string
+	op   int
+	// done unregisters the watch for "ino"
+	done bool
+}
+
+// watchMitigatedCorruptions reads all mitigated corruptions and attributes
+// them to the file or directory that is being checked.
+// Corruptions are reported from within the syscall that finds them, so a
+// watch that is registered before and unregistered after the syscall catches
+// all of them. As the watches and the corruptions are both handled by this
+// thread, the ordering is preserved even when several files are checked at
+// once.
+func (ck *fsckObj) watchMitigatedCorruptions() {
+	watches := make(map[uint64]watch)
 	for {
 		select {
+		case w := <-ck.watchCh:
+			if w.done {
+				delete(watches, w.ino)
+			} else {
+				watches[w.ino] = w
+			}
 		case item := <-ck.rootNode.MitigatedCorruptions:
-			fmt.Printf("fsck: corrupt entry in dir %q: %q\n", path, item)
-			ck.markCorrupt(filepath.Join(path, item))
+			w, ok := watches[item.Ino]
+			if !ok {
+				fmt.Printf("fsck: corrupt item %q in inode %d\n", item.Item, item.Ino)
+				ck.markCorrupt(fmt.Sprintf("inode %d: %s", item.Ino, item.Item))
+				continue
+			}
+			switch w.op {
+			case watchOpenDir:
+				fmt.Printf("fsck: corrupt entry in dir %q: %q\n", w.path, item.Item)
+				ck.markCorrupt(filepath.Join(w.path, item.Item))
+			case watchRead:
+				fmt.Printf("fsck: corrupt file %q (inode %s)\n", w.path, item.Item)
+				ck.markCorrupt(w.path)
+			case watchListXAttr:
+				fmt.Printf("fsck: corrupt xattr name on file %q: %q\n", w.path, item.Item)
+				ck.markCorrupt(w.path + " xattr:" + item.Item)
+			}
 		case <-ck.watchDone:
 			return
 		}
 	}
 }
 
+// watch registers a watch for inode "ino" and returns the function that
+// unregisters it
+func (ck *fsckObj) watch(ino uint64, relPath string, op int) (unwatch func()) {
+	ck.watchCh <- watch{ino: ino, path: relPath, op: op}
+	return func() {
+		ck.watchCh <- watch{ino: ino, done: true}
+	}
+}
+
+// watchPath is like watch, but gets the inode number from the file or
+// directory at "relPath"
+func (ck *fsckObj) watchPath(relPath string, op int) (unwatch func()) {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(ck.abs(relPath), &st); err != nil {
+		// The operation that we want to watch will fail as well and report
+		// the error.
+		return func() {}
+	}
+	return ck.watch(st.Ino, relPath, op)
+}
+
+// startWorkers starts "n" threads that check the files passed to
+// checkFile(). With n <= 1, checkFile() checks the file itself.
+func (ck *fsckObj) startWorkers(n int) {
+	if n <= 1 {
+		return
+	}
+	ck.jobs = make(chan string, n)
+	for i := 0; i < n; i++ {
+		ck.workers.Add(1)
+		go func() {
+			defer ck.workers.Done()
+			for relPath := range ck.jobs {
+				ck.file(relPath)
+			}
+		}()
+	}
+}
+
+// stopWorkers waits until all files passed to checkFile() have been checked
+func (ck *fsckObj) stopWorkers() {
+	if ck.jobs == nil {
+		return
+	}
+	close(ck.jobs)
+	ck.workers.Wait()
+}
+
+// checkFile checks the file at "relPath", in a worker thread if there are any
+func (ck *fsckObj) checkFile(relPath string) {
+	if ck.jobs == nil {
+		ck.file(relPath)
+		return
+	}
+	ck.jobs <- relPath
+}
+
 // Recursively check dir for corruption
 func (ck *fsckObj) dir(relPath string) {
 	tlog.Debug.Printf("ck.dir %q\n", relPath)
 	ck.xattrs(relPath)
 	// Run OpenDir and catch transparently mitigated corruptions
-	go ck.watchMitigatedCorruptionsOpenDir(relPath)
+	unwatch := ck.watchPath(relPath, watchOpenDir)
 	f, err := os.Open(ck.abs(relPath))
-	ck.watchDone <- struct{}{}
 	if err != nil {
+		unwatch()
 		fmt.Printf("fsck: error opening dir %q: %v\n", relPath, err)
 		if err == os.ErrPermission && !runsAsRoot() {
 			ck.markSkipped(relPath)
@@ -88,9 +205,9 @@ func (ck *fsckObj) dir(relPath string) {
 		}
 		return
 	}
-	go ck.watchMitigatedCorruptionsOpenDir(relPath)
 	entries, err := f.Readdirnames(0)
-	ck.watchDone <- struct{}{}
+	unwatch()
+	f.Close()
 	if err != nil {
 		fmt.Printf("fsck: error reading dir %q: %v\n", relPath, err)
 		ck.markCorrupt(relPath)
@@ -99,7 +216,7 @@ func (ck *fsckObj) dir(relPath string) {
 	// Sort alphabetically to make fsck runs deterministic
 	sort.Strings(entries)
 	for _, entry := range entries {
-		if ck.abort {
+		if ck.aborted() {
 			return
 		}
 		if entry == "." || entry == ".." {
@@ -118,7 +235,7 @@ func (ck *fsckObj) dir(relPath string) {
 		case syscall.S_IFDIR:
 			ck.dir(nextPath)
 		case syscall.S_IFREG:
-			ck.file(nextPath)
+			ck.checkFile(nextPath)
 		case syscall.S_IFLNK:
 			ck.symlink(nextPath)
 		case syscall.S_IFIFO, syscall.S_IFSOCK, syscall.S_IFBLK, syscall.S_IFCHR:
@@ -137,21 +254,11 @@ func (ck *fsckObj) symlink(relPath string) {
 	}
 }
 
-// Watch for mitigated corruptions that occur during Read()
-func (ck *fsckObj) watchMitigatedCorruptionsRead(path string) {
-	for {
-		select {
-		case item := <-ck.rootNode.MitigatedCorruptions:
-			fmt.Printf("fsck: corrupt file %q (inode %s)\n", path, item)
-			ck.markCorrupt(path)
-		case <-ck.watchDone:
-			return
-		}
-	}
-}
-
 // Check file for corruption
 func (ck *fsckObj) file(relPath string) {
+	if ck.aborted() {
+		return
+	}
 	tlog.Debug.Printf("ck.file %q\n", relPath)
 	var st syscall.Stat_t
 	err := syscall.Lstat(ck.abs(relPath), &st)
@@ -162,11 +269,14 @@ func (ck *fsckObj) file(relPath string) {
 	}
 	if st.Nlink > 1 {
 		// Due to hard links, we may have already checked this file.
-		if _, ok := ck.seenInodes[st.Ino]; ok {
+		ck.listLock.Lock()
+		_, seen := ck.seenInodes[st.Ino]
+		ck.seenInodes[st.Ino] = struct{}{}
+		ck.listLock.Unlock()
+		if seen {
 			tlog.Debug.Printf("ck.file : skipping %q (inode number %d already seen)\n", relPath, st.Ino)
 			return
 		}
-		ck.seenInodes[st.Ino] = struct{}{}
 	}
 	ck.xattrs(relPath)
 	f, err := os.Open(ck.abs(relPath))
@@ -185,10 +295,9 @@ func (ck *fsckObj) file(relPath string) {
 	buf := make([]byte, fuse.MAX_KERNEL_WRITE)
 	var off int64
 	// Read() through the whole file and catch transparently mitigated corruptions
-	go ck.watchMitigatedCorruptionsRead(relPath)
-	defer func() { ck.watchDone <- struct{}{} }()
+	defer ck.watch(st.Ino, relPath, watchRead)()
 	for {
-		if ck.abort {
+		if ck.aborted() {
 			return
 		}
 		tlog.Debug.Printf("ck.file: read %d bytes from offset %d\n", len(buf), off)
@@ -217,25 +326,12 @@ func (ck *fsckObj) file(relPath string) {
 	}
 }
 
-// Watch for mitigated corruptions that occur during ListXAttr()
-func (ck *fsckObj) watchMitigatedCorruptionsListXAttr(path string) {
-	for {
-		select {
-		case item := <-ck.rootNode.MitigatedCorruptions:
-			fmt.Printf("fsck: corrupt xattr name on file %q: %q\n", path, item)
-			ck.markCorrupt(path + " xattr:" + item)
-		case <-ck.watchDone:
-			return
-		}
-	}
-}
-
 // Check xattrs on file/dir at path
 func (ck *fsckObj) xattrs(relPath string) {
 	// Run ListXAttr() and catch transparently mitigated corruptions
-	go ck.watchMitigatedCorruptionsListXAttr(relPath)
+	unwatch := ck.watchPath(relPath, watchListXAttr)
 	attrs, err := syscallcompat.Llistxattr(ck.abs(relPath))
-	ck.watchDone <- struct{}{}
+	unwatch()
 	if err != nil {
 		fmt.Printf("fsck: error listing xattrs on %q: %v\n", relPath, err)
 		ck.markCorrupt(relPath)
@@ -261,6 +357,9 @@ func fsck(args *argContainer) (exitcode int) {
 		tlog.Fatal.Printf("Running -fsck with -reverse is not supported")
 		os.Exit(exitcodes.Usage)
 	}
+	if args.offline || args.repair {
+		return fsckOffline(args)
+	}
 	args.allow_other = false
 	args.ro = true
 	var err error
@@ -271,10 +370,11 @@ func fsck(args *argContainer) (exitcode int) {
 	}
 	pfs, wipeKeys := initFuseFrontend(args)
 	rn := pfs.(*fusefrontend.RootNode)
-	rn.MitigatedCorruptions = make(chan string)
+	rn.MitigatedCorruptions = make(chan fusefrontend.MitigatedCorruption)
 	ck := fsckObj{
 		mnt:        args.mountpoint,
 		rootNode:   rn,
+		watchCh:    make(chan watch),
 		watchDone:  make(chan struct{}),
 		seenInodes: make(map[uint64]struct{}),
 	}
@@ -292,7 +392,7 @@ func fsck(args *argContainer) (exitcode int) {
 	signal.Notify(ch, syscall.SIGTERM)
 	go func() {
 		<-ch
-		ck.abort = true
+		atomic.StoreInt32(&ck.abort, 1)
 	}()
 	defer func() {
 		err = srv.Unmount()
@@ -306,10 +406,14 @@ func fsck(args *argContainer) (exitcode int) {
 	}()
 	// Recursively check the root dir
 	tlog.Info.Println(tlog.ColorGreen + "Checking filesystem..." + tlog.ColorReset)
+	go ck.watchMitigatedCorruptions()
+	ck.startWorkers(args.jobs)
 	ck.dir("")
+	ck.stopWorkers()
+	ck.watchDone <- struct{}{}
 	// Report results
 	wipeKeys()
-	if ck.abort {
+	if ck.aborted() {
 		tlog.Info.Printf("fsck: aborted")
 		return exitcodes.Other
 	}
@@ -324,6 +428,98 @@ func fsck(args *argContainer) (exitcode int) {
 	return exitcodes.FsckErrors
 }
 
+// fsckOffline checks CIPHERDIR directly, without mounting it. With -repair,
+// it also fixes the problems it finds.
+func fsckOffline(args *argContainer) (exitcode int) {
+	if args.json {
+		// Only the report goes to stdout
+		tlog.Info.Enabled = false
+	}
+	var prevState *offlinefsck.State
+	if args.fsck_state != "" {
+		var err error
+		prevState, err = offlinefsck.LoadState(args.fsck_state)
+		if err != nil {
+			tlog.Fatal.Printf("fsck: loading state file: %v", err)
+			os.Exit(exitcodes.Other)
+		}
+	}
+	frontendArgs, cEnc, nameTransform, _ := initCrypto(args)
+	defer cEnc.Wipe()
+	ck := offlinefsck.New(frontendArgs, cEnc, nameTransform)
+	ck.Repair = args.repair
+	ck.RepairFrom = args.repair_from
+	ck.Jobs = args.jobs
+	if prevState != nil {
+		ck.PrevState = prevState
+		ck.NewState = offlinefsck.NewState()
+	}
+	var entries []offlinefsck.Entry
+	if args.json {
+		// The problems are part of the report
+		ck.Checked = func(e offlinefsck.Entry) {
+			entries = append(entries, e)
+		}
+	} else {
+		ck.Report = func(p offlinefsck.Problem) {
+			fmt.Printf("fsck: %s\n", p.String())
+		}
+	}
+	// Handle SIGINT & SIGTERM
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt)
+	signal.Notify(ch, syscall.SIGTERM)
+	go func() {
+		<-ch
+		ck.Abort()
+	}()
+	if ck.Repair {
+		tlog.Info.Println(tlog.ColorGreen + "Checking and repairing filesystem (offline)..." + tlog.ColorReset)
+	} else {
+		tlog.Info.Println(tlog.ColorGreen + "Checking filesystem (offline)..." + tlog.ColorReset)
+	}
+	ck.Run()
+	if ck.NewState != nil && !ck.Aborted() {
+		if err := ck.NewState.Save(args.fsck_state); err != nil {
+			tlog.Warn.Printf("fsck: saving state file: %v", err)
+		}
+	}
+	if args.json {
+		js, err := json.MarshalIndent(ck.NewReport(entries), "", "\t")
+		if err != nil {
+			tlog.Fatal.Printf("fsck: %v", err)
+			return exitcodes.Other
+		}
+		fmt.Println(string(js))
+		if ck.Aborted() {
+			return exitcodes.Other
+		} else if len(ck.Problems) > 0 || len(ck.Skipped) > 0 {
+			return exitcodes.FsckErrors
+		}
+		return 0
+	}
+	if ck.Aborted() {
+		tlog.Info.Printf("fsck: aborted")
+		return exitcodes.Other
+	}
+	if ck.Unchanged > 0 {
+		tlog.Info.Printf("fsck: %d unchanged files skipped", ck.Unchanged)
+	}
+	if len(ck.Problems) == 0 && len(ck.Skipped) == 0 {
+		tlog.Info.Printf("fsck summary: no problems found\n")
+		return 0
+	}
+	if len(ck.Skipped) > 0 {
+		tlog.Warn.Printf("fsck: re-run this program as root to check all files!\n")
+	}
+	if ck.Repair {
+		fmt.Printf("fsck summary: %d problems, %d repaired, %d files skipped\n", len(ck.Problems), ck.Repaired(), len(ck.Skipped))
+	} else {
+		fmt.Printf("fsck summary: %d problems, %d files skipped\n", len(ck.Problems), len(ck.Skipped))
+	}
+	return exitcodes.FsckErrors
+}
+
 func inum(f *os.File) uint64 {
 	var st syscall.Stat_t
 	err := syscall.Fstat(int(f.Fd()), &st)
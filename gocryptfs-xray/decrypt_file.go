@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+)
+
+// badBlock is a block that failed authentication
+type badBlock struct {
+	blockNo uint64
+	// off is the ciphertext offset
+	off uint64
+	err error
+}
+
+// decryptFile decrypts the ciphertext file "cFile", which belongs to the
+// encrypted directory "dir", to stdout or to the file given by "-o".
+// With "-force-decode", blocks that fail authentication are replaced by
+// zeros and decryption continues. The bad blocks are listed on stderr.
+// Does not return (calls os.Exit).
+func decryptFile(dir string, cFile string, args *argContainer) {
+	in, err := os.Open(cFile)
+	if err != nil {
+		errExit(err)
+	}
+	defer in.Close()
+	c := openCipherdir(dir, args, true)
+	out := os.Stdout
+	if *args.output != "" {
+		out, err = os.OpenFile(*args.output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			errExit(err)
+		}
+	}
+	w := bufio.NewWriter(out)
+	bad, err := c.decryptContent(in, w, *args.forceDecode)
+	if err2 := w.Flush(); err == nil {
+		err = err2
+	}
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	for _, b := range bad {
+		fmt.Fprintf(os.Stderr, "bad block %d at offset %d: %v\n", b.blockNo, b.off, b.err)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fatal: %v\n", err)
+		os.Exit(1)
+	}
+	if len(bad) > 0 {
+		fmt.Fprintf(os.Stderr, "%d bad blocks were replaced by zeros\n", len(bad))
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// decryptContent writes the plaintext of the ciphertext file "in" to "w".
+// Without "force", decryption stops at the first bad block, which is returned
+// as an error.
+func (c *cipherdir) decryptContent(in *os.File, w io.Writer, force bool) (bad []badBlock, err error) {
+	fi, err := in.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := uint64(fi.Size())
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, contentenc.HeaderLen)
+	if _, err = in.ReadAt(buf, 0); err != nil {
+		if err == io.EOF {
+			err = fmt.Errorf("incomplete file header: file has %d bytes, want %d", size, contentenc.HeaderLen)
+		}
+		return nil, err
+	}
+	h, err := contentenc.ParseHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	ce, err := c.contentEnc.ForEpoch(h.Epoch)
+	if err != nil {
+		return nil, err
+	}
+	if h.Version == contentenc.CompressedVersion {
+		return decryptCompressed(in, w, size, ce, h, force)
+	}
+	cipherBS := ce.CipherBS()
+	block := make([]byte, cipherBS)
+	for blockNo := uint64(0); ; blockNo++ {
+		off := contentenc.HeaderLen + blockNo*cipherBS
+		n, err := in.ReadAt(block, int64(off))
+		if err != nil && err != io.EOF {
+			return bad, err
+		}
+		if n == 0 {
+			return bad, nil
+		}
+		plain, err := ce.DecryptBlock(block[:n], blockNo, h.ID)
+		if err != nil {
+			if !force {
+				return bad, fmt.Errorf("block %d at offset %d: %v (use -force-decode to continue)", blockNo, off, err)
+			}
+			bad = append(bad, badBlock{blockNo: blockNo, off: off, err: err})
+			// Keep the plaintext length, so the following data stays in place
+			plain = make([]byte, uint64(n)-contentenc.MinUint64(uint64(n), ce.BlockOverhead()))
+		}
+		if _, err = w.Write(plain); err != nil {
+			return bad, err
+		}
+	}
+}
+
+// decryptCompressed is decryptContent for compressed files
+func decryptCompressed(in *os.File, w io.Writer, size uint64, ce *contentenc.ContentEnc, h *contentenc.FileHeader, force bool) (bad []badBlock, err error) {
+	index, err := ce.ReadBlockIndex(in, size)
+	if err != nil {
+		return nil, err
+	}
+	for i, l := range index.CipherLen {
+		blockNo := uint64(i)
+		off := index.BlockCipherOff(blockNo)
+		plainLen := ce.BlockPlainLen(index.PlainSize, blockNo)
+		block := make([]byte, l)
+		if _, err := in.ReadAt(block, int64(off)); err != nil {
+			return bad, err
+		}
+		plain, err := ce.DecryptCompressedBlock(block, blockNo, h.ID, plainLen)
+		if err != nil {
+			if !force {
+				return bad, fmt.Errorf("block %d at offset %d: %v (use -force-decode to continue)", blockNo, off, err)
+			}
+			bad = append(bad, badBlock{blockNo: blockNo, off: off, err: err})
+			plain = make([]byte, plainLen)
+		}
+		if _, err = w.Write(plain); err != nil {
+			return bad, err
+		}
+	}
+	return bad, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// layout describes how the blocks of an encrypted file are laid out
+type layout struct {
+	algo    cryptocore.AEADTypeEnum
+	plainBS int
+	// sigLen is the length of the write authentication signature at the
+	// end of each block
+	sigLen int
+	// conf is the config file the layout was read from, or "" if the
+	// layout is assumed from the command line flags
+	conf string
+	// ce is set if the key was supplied
+	ce *contentenc.ContentEnc
+}
+
+// cipherBS is the ciphertext block size including overheads
+func (l *layout) cipherBS() int {
+	return blockSize(l.algo, l.plainBS) + l.sigLen
+}
+
+// findConf returns the gocryptfs.conf that belongs to the encrypted file
+// "fn": the one given by "-config", or the first one found in the parent
+// directories of "fn". Returns "" if there is none.
+func findConf(fn string, args *argContainer) string {
+	if *args.config != "" {
+		return *args.config
+	}
+	dir, err := filepath.Abs(filepath.Dir(fn))
+	if err != nil {
+		return ""
+	}
+	for {
+		conf := filepath.Join(dir, configfile.ConfDefaultName)
+		if _, err := os.Stat(conf); err == nil {
+			return conf
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// haveKey returns true if the user supplied the password or the master key
+func haveKey(args *argContainer) bool {
+	return *args.verify || *args.masterkey != "" || *args.passfile != "" ||
+		*args.extpass != "" || *args.fido2 != ""
+}
+
+// detectLayout determines the layout of the encrypted file "fn" from its
+// gocryptfs.conf. Flags given on the command line take precedence.
+// If the key was supplied, it is unlocked to verify the blocks.
+// Calls os.Exit on failure.
+func detectLayout(fn string, args *argContainer) *layout {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	l := &layout{algo: cryptocore.BackendGoGCM, plainBS: *args.blocksize}
+	if conf := findConf(fn, args); conf != "" {
+		cf := loadConf(conf)
+		algo, err := cf.ContentEncryption()
+		if err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(exitcodes.DeprecatedFS)
+		}
+		l.conf = conf
+		l.algo = algo
+		if !explicit["blocksize"] {
+			l.plainBS = int(cf.PlainBS())
+		}
+		if cf.IsFeatureFlagSet(configfile.FlagWriteAuth) {
+			l.sigLen = contentenc.SignatureLen
+		}
+		if haveKey(args) {
+			var c cipherdir
+			c.unlock(cf, args, true)
+			l.ce = c.contentEnc
+		}
+	} else if haveKey(args) {
+		tlog.Fatal.Printf("gocryptfs.conf not found, cannot verify blocks. Use -config.")
+		os.Exit(exitcodes.LoadConf)
+	}
+	if explicit["aessiv"] || explicit["xchacha"] {
+		// The user knows better
+		l.conf = ""
+		if *args.aessiv {
+			l.algo = cryptocore.BackendAESSIV
+		} else if *args.xchacha {
+			l.algo = cryptocore.BackendXChaCha20Poly1305
+		}
+	}
+	return l
+}
@@ -8,29 +8,130 @@ import (
 	"github.com/rfjakob/gocryptfs/v2/ctlsock"
 )
 
-func decryptPaths(socketPath string, sep0 bool) {
-	var req ctlsock.RequestStruct
-	transformPaths(socketPath, &req, &req.DecryptPath, sep0)
+// batchSize is the maximum number of paths that are translated together
+const batchSize = 1000
+
+// pathResult is the result of encrypting or decrypting a single path.
+// "warnText" is printed to stderr when not empty.
+type pathResult struct {
+	result   string
+	warnText string
+	err      error
 }
 
-func encryptPaths(socketPath string, sep0 bool) {
-	var req ctlsock.RequestStruct
-	transformPaths(socketPath, &req, &req.EncryptPath, sep0)
+// transformFunc encrypts or decrypts a batch of paths
+type transformFunc func(in []string) []pathResult
+
+// decryptPaths decrypts the paths read from stdin. "target" is either the
+// control socket of a mounted filesystem or, for offline use, the CIPHERDIR.
+func decryptPaths(target string, args *argContainer) {
+	if isDir(target) {
+		transformPaths(openCipherdir(target, args, false).decryptPaths, *args.sep0)
+	}
+	transformPaths(ctlsockTransform(target, false), *args.sep0)
 }
 
-func transformPaths(socketPath string, req *ctlsock.RequestStruct, in *string, sep0 bool) {
-	errorCount := 0
+// encryptPaths encrypts the paths read from stdin, see decryptPaths.
+func encryptPaths(target string, args *argContainer) {
+	if isDir(target) {
+		transformPaths(openCipherdir(target, args, false).encryptPaths, *args.sep0)
+	}
+	transformPaths(ctlsockTransform(target, true), *args.sep0)
+}
+
+// ctlsockTransform returns a transformFunc that queries the control socket at
+// "socketPath". Servers that support it get batch requests, older ones one
+// request per path.
+func ctlsockTransform(socketPath string, encrypt bool) transformFunc {
 	c, err := ctlsock.New(socketPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "fatal: %v\n", err)
 		os.Exit(1)
 	}
+	// Unversioned servers answer with an error, version 1 servers do not
+	// know the batch commands
+	resp, err := c.Query(&ctlsock.RequestStruct{Version: ctlsock.CurrentVersion, Command: ctlsock.CmdFeatureFlags})
+	if err == nil && resp.Version >= 2 {
+		cmd := ctlsock.CmdDecryptPaths
+		if encrypt {
+			cmd = ctlsock.CmdEncryptPaths
+		}
+		return func(in []string) []pathResult {
+			return ctlsockBatch(c, cmd, in)
+		}
+	}
+	return func(in []string) []pathResult {
+		res := make([]pathResult, len(in))
+		for i, p := range in {
+			var req ctlsock.RequestStruct
+			if encrypt {
+				req.EncryptPath = p
+			} else {
+				req.DecryptPath = p
+			}
+			resp, err := c.Query(&req)
+			if err != nil {
+				res[i].err = err
+				continue
+			}
+			res[i].result, res[i].warnText = resp.Result, resp.WarnText
+		}
+		return res
+	}
+}
+
+// ctlsockBatch translates "in" with a single batch request
+func ctlsockBatch(c *ctlsock.CtlSock, cmd string, in []string) []pathResult {
+	res := make([]pathResult, len(in))
+	resp, err := c.Query(&ctlsock.RequestStruct{Version: ctlsock.CurrentVersion, Command: cmd, Paths: in})
+	if err == nil && len(resp.Results) != len(in) {
+		err = fmt.Errorf("got %d results for %d paths", len(resp.Results), len(in))
+	}
+	if err != nil {
+		for i := range res {
+			res[i].err = err
+		}
+		return res
+	}
+	for i, r := range resp.Results {
+		res[i].result, res[i].warnText = r.Result, r.WarnText
+		if r.ErrNo != 0 {
+			res[i].err = &ctlsock.ResponseStruct{ErrNo: r.ErrNo, ErrText: r.ErrText}
+		}
+	}
+	return res
+}
+
+func transformPaths(transform transformFunc, sep0 bool) {
+	errorCount := 0
 	line := 1
 	var separator byte = '\n'
 	if sep0 {
 		separator = '\000'
 	}
-	r := bufio.NewReader(os.Stdin)
+	w := bufio.NewWriter(os.Stdout)
+	var batch []string
+	// firstLine is the input line of batch[0]
+	firstLine := line
+	// flush translates and prints the paths in "batch"
+	flush := func() {
+		for i, res := range transform(batch) {
+			in := batch[i]
+			if res.err != nil {
+				fmt.Fprintf(os.Stderr, "error at input line %d %q: %v\n", firstLine+i, in, res.err)
+				errorCount++
+				continue
+			}
+			if res.warnText != "" {
+				fmt.Fprintf(os.Stderr, "warning at input line %d %q: %v\n", firstLine+i, in, res.warnText)
+			}
+			fmt.Fprintf(w, "%s%c", res.result, separator)
+		}
+		w.Flush()
+		batch = batch[:0]
+	}
+	// The big buffer lets us batch many paths from a pipe or file
+	r := bufio.NewReaderSize(os.Stdin, 1024*1024)
 	for eof := false; !eof; line++ {
 		val, err := r.ReadBytes(separator)
 		if len(val) == 0 {
@@ -43,17 +144,17 @@ func transformPaths(socketPath string, req *ctlsock.RequestStruct, in *string, s
 			// drop trailing separator
 			val = val[:len(val)-1]
 		}
-		*in = string(val)
-		resp, err := c.Query(req)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error at input line %d %q: %v\n", line, *in, err)
-			errorCount++
-			continue
+		if len(batch) == 0 {
+			firstLine = line
 		}
-		if resp.WarnText != "" {
-			fmt.Fprintf(os.Stderr, "warning at input line %d %q: %v\n", line, *in, resp.WarnText)
+		batch = append(batch, string(val))
+		// Don't keep interactive users waiting for more input
+		if len(batch) >= batchSize || r.Buffered() == 0 {
+			flush()
 		}
-		fmt.Printf("%s%c", resp.Result, separator)
+	}
+	if len(batch) > 0 {
+		flush()
 	}
 	if errorCount == 0 {
 		os.Exit(0)
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/fido2"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// cipherdir gives access to the file names of an encrypted directory without
+// mounting it
+type cipherdir struct {
+	// rootFd is the CIPHERDIR
+	rootFd         int
+	plaintextNames bool
+	nameTransform  *nametransform.NameTransform
+	// translator is created on first use by translatePaths
+	translator *nametransform.PathTranslator
+	// contentEnc is only set when openCipherdir was asked for it
+	contentEnc *contentenc.ContentEnc
+}
+
+func isDir(fn string) bool {
+	fi, err := os.Stat(fn)
+	return err == nil && fi.IsDir()
+}
+
+// unlockMasterKey returns the master key given via "-masterkey" or decrypts
+// it from "cf" using the key management service, the password or the FIDO2
+// token.
+// Calls os.Exit on failure.
+func unlockMasterKey(cf *configfile.ConfFile, args *argContainer) []byte {
+	if *args.masterkey != "" {
+		key, err := hex.DecodeString(strings.Replace(*args.masterkey, "-", "", -1))
+		if err != nil {
+			tlog.Fatal.Printf("Could not parse master key: %v", err)
+			os.Exit(exitcodes.MasterKey)
+		}
+		if len(key) != cryptocore.KeyLen {
+			tlog.Fatal.Printf("Master key has length %d but we require length %d", len(key), cryptocore.KeyLen)
+			os.Exit(exitcodes.MasterKey)
+		}
+		return key
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagExternalKMS) {
+		kp, err := configfile.NewKeyProvider(cf.KMS)
+		if err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(exitcodes.KMS)
+		}
+		masterkey, err := cf.DecryptMasterKeyKMS(kp)
+		if err != nil {
+			tlog.Fatal.Println(err)
+			exitcodes.Exit(err)
+		}
+		return masterkey
+	}
+	var pw []byte
+	var err error
+	if cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
+		if *args.fido2 == "" {
+			tlog.Fatal.Printf("Masterkey encrypted using FIDO2 token; need to use the --fido2 option.")
+			os.Exit(exitcodes.Usage)
+		}
+		pw = fido2.Secret(*args.fido2, cf.FIDO2.AssertOptions, cf.FIDO2.CredentialID, cf.FIDO2.HMACSalt)
+	} else {
+		var extpass, passfile []string
+		if *args.extpass != "" {
+			extpass = []string{*args.extpass}
+		}
+		if *args.passfile != "" {
+			passfile = []string{*args.passfile}
+		}
+		pw, err = readpassword.Once(extpass, passfile, "")
+		if err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(exitcodes.ReadPassword)
+		}
+	}
+	masterkey, err := cf.DecryptMasterKey(pw)
+	// Purge password from memory
+	for i := range pw {
+		pw[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.LoadConf)
+	}
+	return masterkey
+}
+
+// loadConf loads the config file "confPath". Calls os.Exit on failure.
+func loadConf(confPath string) *configfile.ConfFile {
+	tlog.Info.Enabled = false
+	cf, err := configfile.Load(confPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exitcodes.Exit(err)
+	}
+	return cf
+}
+
+// openCipherdir loads the config file of the encrypted directory "dir",
+// unlocks the master key and sets up the name encryption, and, if "content"
+// is set, the content encryption.
+// Calls os.Exit on failure.
+func openCipherdir(dir string, args *argContainer, content bool) *cipherdir {
+	confPath := *args.config
+	if confPath == "" {
+		confPath = filepath.Join(dir, configfile.ConfDefaultName)
+	}
+	cf := loadConf(confPath)
+	c := &cipherdir{
+		plaintextNames: cf.IsFeatureFlagSet(configfile.FlagPlaintextNames),
+	}
+	var err error
+	c.rootFd, err = syscallcompat.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.CipherDir)
+	}
+	if c.plaintextNames && !content {
+		return c
+	}
+	c.unlock(cf, args, content)
+	return c
+}
+
+// unlock unlocks the master key of "cf" and sets up the name encryption, and,
+// if "content" is set, the content encryption.
+// Calls os.Exit on failure.
+func (c *cipherdir) unlock(cf *configfile.ConfFile, args *argContainer, content bool) {
+	backend, err := cf.ContentEncryption()
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.DeprecatedFS)
+	}
+	IVBits := backend.NonceSize * 8
+	useHKDF := cf.IsFeatureFlagSet(configfile.FlagHKDF)
+	masterkey := unlockMasterKey(cf, args)
+	cEnc, cCore, err := configfile.NewContentEnc(cf, masterkey, false, backend, IVBits, useHKDF, cf.PlainBS())
+	// Purge masterkey from memory
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Println(err)
+		exitcodes.Exit(err)
+	}
+	c.nameTransform = nametransform.New(cCore.EMECipher, cf.IsFeatureFlagSet(configfile.FlagLongNames),
+		cf.LongNameMax, cf.IsFeatureFlagSet(configfile.FlagRaw64), nil, !cf.IsFeatureFlagSet(configfile.FlagDirIV))
+	if content {
+		c.contentEnc = cEnc
+	}
+}
+
+// sanitize canonicalizes "in" like the control socket does
+func sanitize(in string) (clean string, warnText string, err error) {
+	clean = ctlsocksrv.SanitizePath(in)
+	if in != clean {
+		warnText = fmt.Sprintf("Non-canonical input path '%s' has been interpreted as '%s'.", in, clean)
+	}
+	if clean == "" {
+		err = errors.New("Empty input after canonicalization")
+	}
+	return
+}
+
+// encryptPaths implements transformFunc
+func (c *cipherdir) encryptPaths(in []string) []pathResult {
+	return c.translatePaths(in, true)
+}
+
+// decryptPaths implements transformFunc
+func (c *cipherdir) decryptPaths(in []string) []pathResult {
+	return c.translatePaths(in, false)
+}
+
+// translatePaths encrypts or decrypts "in". The PathTranslator is kept across
+// calls, so each directory IV is only read once.
+func (c *cipherdir) translatePaths(in []string, encrypt bool) []pathResult {
+	res := make([]pathResult, len(in))
+	for i, p := range in {
+		clean, warnText, err := sanitize(p)
+		res[i].warnText = warnText
+		if err != nil || c.plaintextNames {
+			res[i].result, res[i].err = clean, err
+			continue
+		}
+		if c.translator == nil {
+			c.translator = c.nameTransform.NewPathTranslator(c.rootFd)
+		}
+		if encrypt {
+			res[i].result, res[i].err = c.translator.Encrypt(clean)
+		} else {
+			res[i].result, res[i].err = c.translator.Decrypt(clean)
+		}
+	}
+	return res
+}
+
+// dumpTree prints the plaintext and the ciphertext path of every file and
+// directory in the encrypted directory "dir", separated by a tab (or \0 with
+// "-0"). Entries whose names cannot be decrypted are reported on stderr and
+// are not descended into.
+// Does not return (calls os.Exit).
+func dumpTree(dir string, args *argContainer) {
+	c := openCipherdir(dir, args, false)
+	sep := byte('\n')
+	fieldSep := byte('\t')
+	if *args.sep0 {
+		sep = 0
+		fieldSep = 0
+	}
+	errorCount := c.dumpDir(c.rootFd, "", "", fieldSep, sep)
+	if errorCount == 0 {
+		os.Exit(0)
+	}
+	os.Exit(1)
+}
+
+// dumpDir prints the contents of the directory "dirfd", which has the plaintext
+// path "pDir" and the ciphertext path "cDir", recursively. Returns the number
+// of errors.
+func (c *cipherdir) dumpDir(dirfd int, pDir string, cDir string, fieldSep byte, sep byte) (errorCount int) {
+	entries, err := syscallcompat.Getdents(dirfd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %q: %v\n", cDir, err)
+		return 1
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	var iv []byte
+	if !c.plaintextNames {
+		iv, err = c.nameTransform.ReadDirIVAt(dirfd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %q: %v\n", cDir, err)
+			return 1
+		}
+	}
+	for _, e := range entries {
+		cName := e.Name
+		if cDir == "" && cName == configfile.ConfDefaultName {
+			continue
+		}
+		if !c.plaintextNames && (cName == nametransform.DirIVFilename ||
+			nametransform.NameType(cName) == nametransform.LongNameFilename) {
+			continue
+		}
+		cPath := filepath.Join(cDir, cName)
+		pName, err := c.decryptName(dirfd, cName, iv)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %q: %v\n", cPath, err)
+			errorCount++
+			continue
+		}
+		pPath := filepath.Join(pDir, pName)
+		fmt.Printf("%s%c%s%c", pPath, fieldSep, cPath, sep)
+		if e.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			continue
+		}
+		subFd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %q: %v\n", cPath, err)
+			errorCount++
+			continue
+		}
+		errorCount += c.dumpDir(subFd, pPath, cPath, fieldSep, sep)
+		syscall.Close(subFd)
+	}
+	return errorCount
+}
+
+// decryptName decrypts the name "cName" in the directory "dirfd", which has
+// the IV "iv"
+func (c *cipherdir) decryptName(dirfd int, cName string, iv []byte) (string, error) {
+	if c.plaintextNames {
+		return cName, nil
+	}
+	if nametransform.IsLongContent(cName) {
+		longName, err := nametransform.ReadLongNameAt(dirfd, cName)
+		if err != nil {
+			return "", err
+		}
+		cName = longName
+	}
+	return c.nameTransform.DecryptName(cName, iv)
+}
@@ -12,8 +12,6 @@ import (
 	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
-	"github.com/rfjakob/gocryptfs/v2/internal/fido2"
-	"github.com/rfjakob/gocryptfs/v2/internal/readpassword"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
@@ -28,8 +26,8 @@ const (
 )
 
 // blockSize is the ciphertext block size including overheads
-func blockSize(alg cryptocore.AEADTypeEnum) int {
-	return alg.NonceSize + contentenc.DefaultBS + cryptocore.AuthTagLen
+func blockSize(alg cryptocore.AEADTypeEnum, plainBS int) int {
+	return alg.NonceSize + plainBS + cryptocore.AuthTagLen
 }
 
 func errExit(err error) {
@@ -37,9 +35,13 @@ func errExit(err error) {
 	os.Exit(1)
 }
 
-func prettyPrintHeader(h *contentenc.FileHeader, algo cryptocore.AEADTypeEnum) {
+func prettyPrintHeader(h *contentenc.FileHeader, l *layout) {
 	id := hex.EncodeToString(h.ID)
-	fmt.Printf("Header: Version: %d, Id: %s, assuming %s mode\n", h.Version, id, algo.Algo)
+	if l.conf != "" {
+		fmt.Printf("Header: Version: %d, Id: %s, %s mode according to %s\n", h.Version, id, l.algo.Algo, configfile.ConfDefaultName)
+		return
+	}
+	fmt.Printf("Header: Version: %d, Id: %s, assuming %s mode\n", h.Version, id, l.algo.Algo)
 }
 
 // printVersion prints a version string like this:
@@ -55,14 +57,18 @@ func usage() {
 	printVersion()
 	fmt.Printf("\n")
 	fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] FILE\n"+
+		"       %s -decrypt-file [OPTIONS] CIPHERDIR FILE\n"+
 		"\n"+
-		"Options:\n", myName)
+		"Options:\n", myName, myName)
 	flag.PrintDefaults()
 	fmt.Fprintf(os.Stderr, "\n"+
 		"Examples:\n"+
 		"  gocryptfs-xray myfs/mCXnISiv7nEmyc0glGuhTQ\n"+
 		"  gocryptfs-xray -dumpmasterkey myfs/gocryptfs.conf\n"+
-		"  gocryptfs-xray -encrypt-paths myfs.sock\n")
+		"  gocryptfs-xray -encrypt-paths myfs.sock\n"+
+		"  gocryptfs-xray -decrypt-paths -passfile pw.txt myfs\n"+
+		"  gocryptfs-xray -dump-tree myfs\n"+
+		"  gocryptfs-xray -decrypt-file -o file.txt myfs myfs/mCXnISiv7nEmyc0glGuhTQ\n")
 }
 
 // sum counts the number of true values
@@ -82,20 +88,40 @@ type argContainer struct {
 	aessiv        *bool
 	xchacha       *bool
 	sep0          *bool
+	dumpTree      *bool
+	decryptFile   *bool
+	output        *string
+	forceDecode   *bool
 	fido2         *string
+	masterkey     *string
+	passfile      *string
+	extpass       *string
+	config        *string
 	version       *bool
+	blocksize     *int
+	verify        *bool
 }
 
 func main() {
 	var args argContainer
 	args.dumpmasterkey = flag.Bool("dumpmasterkey", false, "Decrypt and dump the master key")
-	args.decryptPaths = flag.Bool("decrypt-paths", false, "Decrypt file paths using gocryptfs control socket")
-	args.encryptPaths = flag.Bool("encrypt-paths", false, "Encrypt file paths using gocryptfs control socket")
+	args.decryptPaths = flag.Bool("decrypt-paths", false, "Decrypt file paths using gocryptfs control socket or CIPHERDIR")
+	args.encryptPaths = flag.Bool("encrypt-paths", false, "Encrypt file paths using gocryptfs control socket or CIPHERDIR")
+	args.decryptFile = flag.Bool("decrypt-file", false, "Decrypt the ciphertext file FILE of CIPHERDIR")
+	args.output = flag.String("o", "", "Write the plaintext of -decrypt-file to this file instead of stdout")
+	args.forceDecode = flag.Bool("force-decode", false, "Replace blocks that fail authentication by zeros in -decrypt-file")
+	args.dumpTree = flag.Bool("dump-tree", false, "Print the plaintext and ciphertext path of all files in CIPHERDIR")
 	args.sep0 = flag.Bool("0", false, "Use \\0 instead of \\n as separator")
-	args.aessiv = flag.Bool("aessiv", false, "Assume AES-SIV mode instead of AES-GCM")
-	args.xchacha = flag.Bool("xchacha", false, "Assume XChaCha20-Poly1305 mode instead of AES-GCM")
+	args.aessiv = flag.Bool("aessiv", false, "Assume AES-SIV mode instead of what gocryptfs.conf says")
+	args.xchacha = flag.Bool("xchacha", false, "Assume XChaCha20-Poly1305 mode instead of what gocryptfs.conf says")
+	args.verify = flag.Bool("verify", false, "Ask for the password and verify the blocks of FILE")
 	args.fido2 = flag.String("fido2", "", "Protect the masterkey using a FIDO2 token instead of a password")
+	args.masterkey = flag.String("masterkey", "", "Use explicit master key instead of the password")
+	args.passfile = flag.String("passfile", "", "Read password from file")
+	args.extpass = flag.String("extpass", "", "Use external program for the password prompt")
+	args.config = flag.String("config", "", "Use specified config file instead of CIPHERDIR/gocryptfs.conf")
 	args.version = flag.Bool("version", false, "Print version information")
+	args.blocksize = flag.Int("blocksize", contentenc.DefaultBS, "Assume this plaintext block size instead of what gocryptfs.conf says")
 
 	flag.Usage = usage
 	flag.Parse()
@@ -105,21 +131,35 @@ func main() {
 		os.Exit(0)
 	}
 
-	s := sum(args.dumpmasterkey, args.decryptPaths, args.encryptPaths)
+	if !contentenc.ValidBlockSize(uint64(*args.blocksize)) {
+		fmt.Fprintf(os.Stderr, "fatal: invalid block size %d\n", *args.blocksize)
+		os.Exit(1)
+	}
+	s := sum(args.dumpmasterkey, args.decryptPaths, args.encryptPaths, args.dumpTree, args.decryptFile)
 	if s > 1 {
 		fmt.Fprintf(os.Stderr, "fatal: %d operations were requested\n", s)
 		os.Exit(1)
 	}
+	if *args.decryptFile {
+		if flag.NArg() != 2 {
+			usage()
+			os.Exit(1)
+		}
+		decryptFile(flag.Arg(0), flag.Arg(1), &args)
+	}
 	if flag.NArg() != 1 {
 		usage()
 		os.Exit(1)
 	}
 	fn := flag.Arg(0)
 	if *args.decryptPaths {
-		decryptPaths(fn, *args.sep0)
+		decryptPaths(fn, &args)
 	}
 	if *args.encryptPaths {
-		encryptPaths(fn, *args.sep0)
+		encryptPaths(fn, &args)
+	}
+	if *args.dumpTree {
+		dumpTree(fn, &args)
 	}
 	f, err := os.Open(fn)
 	if err != nil {
@@ -127,42 +167,20 @@ func main() {
 	}
 	defer f.Close()
 	if *args.dumpmasterkey {
-		dumpMasterKey(fn, *args.fido2)
+		dumpMasterKey(fn, &args)
 	} else {
-		inspectCiphertext(&args, f)
+		inspectCiphertext(&args, fn, f)
 	}
 }
 
-func dumpMasterKey(fn string, fido2Path string) {
+func dumpMasterKey(fn string, args *argContainer) {
 	tlog.Info.Enabled = false
 	cf, err := configfile.Load(fn)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		exitcodes.Exit(err)
 	}
-	var pw []byte
-	if cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
-		if fido2Path == "" {
-			tlog.Fatal.Printf("Masterkey encrypted using FIDO2 token; need to use the --fido2 option.")
-			os.Exit(exitcodes.Usage)
-		}
-		pw = fido2.Secret(fido2Path, cf.FIDO2.AssertOptions, cf.FIDO2.CredentialID, cf.FIDO2.HMACSalt)
-	} else {
-		pw, err = readpassword.Once(nil, nil, "")
-		if err != nil {
-			tlog.Fatal.Println(err)
-			os.Exit(exitcodes.ReadPassword)
-		}
-	}
-	masterkey, err := cf.DecryptMasterKey(pw)
-	// Purge password from memory
-	for i := range pw {
-		pw[i] = 0
-	}
-	if err != nil {
-		tlog.Fatal.Println(err)
-		os.Exit(exitcodes.LoadConf)
-	}
+	masterkey := unlockMasterKey(cf, args)
 	fmt.Println(hex.EncodeToString(masterkey))
 	// Purge masterkey from memory
 	for i := range masterkey {
@@ -170,13 +188,9 @@ func dumpMasterKey(fn string, fido2Path string) {
 	}
 }
 
-func inspectCiphertext(args *argContainer, fd *os.File) {
-	algo := cryptocore.BackendGoGCM
-	if *args.aessiv {
-		algo = cryptocore.BackendAESSIV
-	} else if *args.xchacha {
-		algo = cryptocore.BackendXChaCha20Poly1305
-	}
+func inspectCiphertext(args *argContainer, fn string, fd *os.File) {
+	l := detectLayout(fn, args)
+	algo := l.algo
 	headerBytes := make([]byte, contentenc.HeaderLen)
 	n, err := fd.ReadAt(headerBytes, 0)
 	if err == io.EOF && n == 0 {
@@ -192,11 +206,23 @@ func inspectCiphertext(args *argContainer, fd *os.File) {
 	if err != nil {
 		errExit(err)
 	}
-	prettyPrintHeader(header, algo)
+	prettyPrintHeader(header, l)
+	var ce *contentenc.ContentEnc
+	if l.ce != nil {
+		ce, err = l.ce.ForEpoch(header.Epoch)
+		if err != nil {
+			errExit(err)
+		}
+	}
+	if header.Version == contentenc.CompressedVersion {
+		inspectCompressed(fd, header, ce)
+		return
+	}
 	var i int64
-	buf := make([]byte, blockSize(algo))
+	bs := l.cipherBS()
+	buf := make([]byte, bs)
 	for i = 0; ; i++ {
-		off := contentenc.HeaderLen + i*int64(blockSize(algo))
+		off := contentenc.HeaderLen + i*int64(bs)
 		n, err := fd.ReadAt(buf, off)
 		if err != nil && err != io.EOF {
 			errExit(err)
@@ -205,17 +231,73 @@ func inspectCiphertext(args *argContainer, fd *os.File) {
 			break
 		}
 		// A block contains at least the IV, the Auth Tag and 1 data byte
-		if n < algo.NonceSize+cryptocore.AuthTagLen+1 {
+		if n < algo.NonceSize+cryptocore.AuthTagLen+l.sigLen+1 {
 			errExit(fmt.Errorf("corrupt block: truncated data, len=%d", n))
 		}
 		data := buf[:n]
 		// Parse block data
 		iv := data[:algo.NonceSize]
-		tag := data[len(data)-cryptocore.AuthTagLen:]
-		if *args.aessiv {
+		tag := data[len(data)-l.sigLen-cryptocore.AuthTagLen : len(data)-l.sigLen]
+		if algo == cryptocore.BackendAESSIV {
 			tag = data[algo.NonceSize : algo.NonceSize+cryptocore.AuthTagLen]
 		}
-		fmt.Printf("Block %2d: IV: %s, Tag: %s, Offset: %5d Len: %d\n",
-			i, hex.EncodeToString(iv), hex.EncodeToString(tag), off, len(data))
+		fmt.Printf("Block %2d: IV: %s, Tag: %s, Offset: %5d Len: %d%s\n",
+			i, hex.EncodeToString(iv), hex.EncodeToString(tag), off, len(data),
+			blockStatus(ce, data, uint64(i), header.ID))
+	}
+}
+
+// blockStatus verifies the block "data" and returns a status suffix for the
+// block line, or "" if the key is not known ("ce" is nil).
+func blockStatus(ce *contentenc.ContentEnc, data []byte, blockNo uint64, fileID []byte) string {
+	if ce == nil {
+		return ""
+	}
+	if uint64(len(data)) == ce.CipherBS() && isZero(data) {
+		return ", Status: hole"
+	}
+	if _, err := ce.DecryptBlock(data, blockNo, fileID); err != nil {
+		return ", Status: auth failed"
+	}
+	return ", Status: OK"
+}
+
+// inspectCompressed prints the blocks of a compressed file, whose positions
+// are stored in the block index
+func inspectCompressed(fd *os.File, header *contentenc.FileHeader, ce *contentenc.ContentEnc) {
+	if ce == nil {
+		errExit(fmt.Errorf("compressed file: the block index can only be parsed with the key (use -passfile, -extpass or -masterkey)"))
+	}
+	fi, err := fd.Stat()
+	if err != nil {
+		errExit(err)
+	}
+	index, err := ce.ReadBlockIndex(fd, uint64(fi.Size()))
+	if err != nil {
+		errExit(err)
+	}
+	fmt.Printf("Index: PlainSize: %d, Blocks: %d\n", index.PlainSize, len(index.CipherLen))
+	for i, l := range index.CipherLen {
+		blockNo := uint64(i)
+		off := index.BlockCipherOff(blockNo)
+		block := make([]byte, l)
+		if _, err := fd.ReadAt(block, int64(off)); err != nil {
+			errExit(err)
+		}
+		status := "OK"
+		if _, err := ce.DecryptCompressedBlock(block, blockNo, header.ID, ce.BlockPlainLen(index.PlainSize, blockNo)); err != nil {
+			status = "auth failed"
+		}
+		fmt.Printf("Block %2d: Offset: %5d Len: %d, Status: %s\n", i, off, l, status)
+	}
+}
+
+// isZero returns true if "buf" only contains zero bytes
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
 	}
+	return true
 }
@@ -4,7 +4,11 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
@@ -108,3 +112,265 @@ func TestEncryptPaths(t *testing.T) {
 		}
 	}
 }
+
+// xray runs gocryptfs-xray with "args" and "stdin" and returns stdout
+func xray(t *testing.T, stdin string, args ...string) string {
+	cmd := exec.Command("../gocryptfs-xray", args...)
+	cmd.Stdin = bytes.NewBufferString(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("gocryptfs-xray %v: %v\n%s", args, err, stderr.String())
+	}
+	return string(out)
+}
+
+// TestOfflinePaths compares the offline path translation with the results
+// of a running mount
+func TestOfflinePaths(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+
+	long := strings.Repeat("x", 200)
+	plain := []string{"dir1", "dir1/file1", "dir1/" + long, "dir1/" + long + "/file2"}
+	if err := os.Mkdir(pDir+"/dir1", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pDir+"/dir1/file1", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(pDir+"/dir1/"+long, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pDir+"/dir1/"+long+"/file2", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	in := strings.Join(plain, "\n") + "\n"
+	online := xray(t, in, "-encrypt-paths", sock)
+	offline := xray(t, in, "-encrypt-paths", "-extpass", "echo test", cDir)
+	if offline != online {
+		t.Fatalf("encrypt-paths mismatch:\nonline:\n%s\noffline:\n%s", online, offline)
+	}
+	cipher := strings.Split(strings.TrimSuffix(offline, "\n"), "\n")
+	for _, c := range cipher {
+		if _, err := os.Lstat(cDir + "/" + c); err != nil {
+			t.Error(err)
+		}
+	}
+	decrypted := xray(t, offline, "-decrypt-paths", "-extpass", "echo test", cDir)
+	if decrypted != in {
+		t.Errorf("decrypt-paths: want\n%s\nhave\n%s", in, decrypted)
+	}
+	// The master key works as well
+	masterkey := strings.TrimSpace(xray(t, "test", "-dumpmasterkey", cDir+"/gocryptfs.conf"))
+	decrypted = xray(t, offline, "-decrypt-paths", "-masterkey", masterkey, cDir)
+	if decrypted != in {
+		t.Errorf("decrypt-paths -masterkey: want\n%s\nhave\n%s", in, decrypted)
+	}
+	// -dump-tree lists the same mapping
+	var want []string
+	for i := range plain {
+		want = append(want, plain[i]+"\t"+cipher[i])
+	}
+	sort.Slice(want, func(i, j int) bool {
+		return strings.Split(want[i], "\t")[1] < strings.Split(want[j], "\t")[1]
+	})
+	tree := strings.Split(strings.TrimSuffix(xray(t, "", "-dump-tree", "-extpass", "echo test", cDir), "\n"), "\n")
+	sort.Slice(tree, func(i, j int) bool {
+		return strings.Split(tree[i], "\t")[1] < strings.Split(tree[j], "\t")[1]
+	})
+	if strings.Join(tree, "\n") != strings.Join(want, "\n") {
+		t.Errorf("dump-tree: want\n%s\nhave\n%s", strings.Join(want, "\n"), strings.Join(tree, "\n"))
+	}
+}
+
+// TestPathsBatch translates more paths than fit into a single batch,
+// with an error in the middle
+func TestPathsBatch(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+
+	var lines []string
+	for d := 0; d < 5; d++ {
+		dir := fmt.Sprintf("dir%d", d)
+		if err := os.Mkdir(pDir+"/"+dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		for f := 0; f < 500; f++ {
+			lines = append(lines, fmt.Sprintf("%s/file%d", dir, f))
+		}
+	}
+	const badLine = 1234
+	lines[badLine-1] = "not-existing-dir/xyz"
+	in := strings.Join(lines, "\n") + "\n"
+	for _, target := range []string{sock, cDir} {
+		cmd := exec.Command("../gocryptfs-xray", "-encrypt-paths", "-extpass", "echo test", target)
+		cmd.Stdin = strings.NewReader(in)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err == nil {
+			t.Errorf("%s: expected an error exit code", target)
+		}
+		if !strings.Contains(stderr.String(), fmt.Sprintf("error at input line %d ", badLine)) {
+			t.Errorf("%s: error for line %d missing:\n%s", target, badLine, stderr.String())
+		}
+		cipher := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+		if len(cipher) != len(lines)-1 {
+			t.Fatalf("%s: got %d results for %d good paths", target, len(cipher), len(lines)-1)
+		}
+		// The files do not exist, but their directories do
+		if _, err := os.Stat(cDir + "/" + filepath.Dir(cipher[len(cipher)-1])); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// TestDecryptFile decrypts a copy of a ciphertext file without mounting
+func TestDecryptFile(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+
+	content := make([]byte, 10000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	if err := os.WriteFile(pDir+"/file", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cName := strings.TrimSpace(xray(t, "file", "-encrypt-paths", "-extpass", "echo test", cDir))
+	cData, err := os.ReadFile(cDir + "/" + cName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Work on a copy, like a file restored from a backup
+	backup := cDir + ".backup"
+	if err := os.WriteFile(backup, cData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	out := xray(t, "", "-decrypt-file", "-extpass", "echo test", cDir, backup)
+	if out != string(content) {
+		t.Fatalf("wrong content: have %d bytes, want %d", len(out), len(content))
+	}
+	outFile := cDir + ".out"
+	xray(t, "", "-decrypt-file", "-extpass", "echo test", "-o", outFile, cDir, backup)
+	if have, _ := os.ReadFile(outFile); !bytes.Equal(have, content) {
+		t.Fatalf("wrong content in -o file: have %d bytes, want %d", len(have), len(content))
+	}
+	// Corrupt block 1
+	cData[18+4096+32+100] ^= 1
+	if err := os.WriteFile(backup, cData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("../gocryptfs-xray", "-decrypt-file", "-extpass", "echo test", cDir, backup)
+	if err := cmd.Run(); test_helpers.ExtractCmdExitCode(err) != 1 {
+		t.Fatalf("corrupt file: want exit code 1, have %v", err)
+	}
+	cmd = exec.Command("../gocryptfs-xray", "-decrypt-file", "-force-decode", "-extpass", "echo test", cDir, backup)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	have, err := cmd.Output()
+	if test_helpers.ExtractCmdExitCode(err) != 1 {
+		t.Fatalf("-force-decode: want exit code 1, have %v", err)
+	}
+	if !strings.Contains(stderr.String(), "bad block 1 ") {
+		t.Errorf("block 1 not reported: %s", stderr.String())
+	}
+	want := append([]byte{}, content...)
+	for i := 4096; i < 8192; i++ {
+		want[i] = 0
+	}
+	if !bytes.Equal(have, want) {
+		t.Errorf("-force-decode: wrong content")
+	}
+}
+
+// TestAessivAutodetect checks that the cipher is read from gocryptfs.conf
+// when -aessiv is not passed
+func TestAessivAutodetect(t *testing.T) {
+	expected, err := ioutil.ReadFile("aessiv_fs.xray.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := xray(t, "", "aessiv_fs/klepPXQJIaEDaIx-yurAqQ")
+	// Only the header line differs
+	want := strings.SplitN(string(expected), "\n", 2)
+	have := strings.SplitN(out, "\n", 2)
+	if have[1] != want[1] {
+		t.Errorf("wrong blocks:\n%s", out)
+	}
+	if !strings.Contains(have[0], "AES-SIV-512 mode according to gocryptfs.conf") {
+		t.Errorf("wrong header: %s", have[0])
+	}
+}
+
+// TestXrayVerify checks the block status that is shown when the password is
+// supplied
+func TestXrayVerify(t *testing.T) {
+	dir := test_helpers.TmpDir + "/TestXrayVerify"
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"gocryptfs.conf", "VnvoeSetPaOFjZDaZAh0lA"} {
+		data, err := os.ReadFile("aesgcm_fs/" + f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f != "gocryptfs.conf" {
+			// Corrupt block 1
+			data[4146+100] ^= 1
+		}
+		if err := os.WriteFile(dir+"/"+f, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := xray(t, "", "-extpass", "echo test", dir+"/VnvoeSetPaOFjZDaZAh0lA")
+	lines := strings.Split(out, "\n")
+	if !strings.HasSuffix(lines[1], "Status: OK") {
+		t.Errorf("block 0: %s", lines[1])
+	}
+	if !strings.HasSuffix(lines[2], "Status: auth failed") {
+		t.Errorf("block 1: %s", lines[2])
+	}
+}
+
+// TestOfflinePathsKMS translates paths offline on a filesystem whose master
+// key is wrapped by a key management service
+func TestOfflinePathsKMS(t *testing.T) {
+	kms := test_helpers.StartKMSStub("")
+	defer kms.Close()
+	cDir, err := ioutil.TempDir(test_helpers.TmpDir, "TestOfflinePathsKMS.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-init",
+		"-kms-endpoint", kms.URL, "-kms-keyid", "xray", cDir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir)
+	if err := os.WriteFile(pDir+"/file1", []byte("content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	cipher := strings.TrimSpace(xray(t, "file1\n", "-encrypt-paths", cDir))
+	if _, err := os.Lstat(cDir + "/" + cipher); err != nil {
+		t.Fatal(err)
+	}
+	if out := xray(t, "", "-decrypt-file", cDir, cDir+"/"+cipher); out != "content" {
+		t.Errorf("-decrypt-file: want %q, have %q", "content", out)
+	}
+}
@@ -7,7 +7,8 @@ import (
 )
 
 const tUsage = "" +
-	"Usage: " + tlog.ProgramName + " -init|-passwd|-info [OPTIONS] CIPHERDIR\n" +
+	"Usage: " + tlog.ProgramName + " -init|-passwd|-info|-add-key|-remove-key|-list-keys|-rotate-key|-rekey|-export-reader-key [OPTIONS] CIPHERDIR\n" +
+	"  or   " + tlog.ProgramName + " -export [OPTIONS] PLAINDIR DESTDIR\n" +
 	"  or   " + tlog.ProgramName + " [OPTIONS] CIPHERDIR MOUNTPOINT\n"
 
 // helpShort is what gets displayed when passed "-h" or on syntax error.
@@ -40,6 +41,7 @@ Common Options (use -hh to show all):
   -reverse           Enable reverse mode
   -ro                Mount read-only
   -speed             Run crypto speed test
+  -speed-kdf         Run password hash speed test
   -version           Print version information
   --                 Stop option parsing
 `)
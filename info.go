@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/hex"
 	"fmt"
 	"os"
 	"strings"
@@ -24,7 +25,32 @@ func info(filename string) {
 	fmt.Printf("Creator:           %s\n", cf.Creator)
 	fmt.Printf("FeatureFlags:      %s\n", strings.Join(cf.FeatureFlags, " "))
 	fmt.Printf("EncryptedKey:      %dB\n", len(cf.EncryptedKey))
-	fmt.Printf("ScryptObject:      Salt=%dB N=%d R=%d P=%d KeyLen=%d\n",
-		len(s.Salt), s.N, s.R, s.P, s.KeyLen)
+	if cf.IsFeatureFlagSet(configfile.FlagKeySlots) {
+		for i, ks := range cf.KeySlots {
+			fmt.Printf("KeySlot %-2d         Name=%q Type=%s EncryptedKey=%dB\n",
+				i, ks.Name, ks.Type, len(ks.EncryptedKey))
+		}
+	} else if cf.KMS != nil {
+		fmt.Printf("KMS:               Endpoint=%s KeyID=%s\n", cf.KMS.Endpoint, cf.KMS.KeyID)
+	} else if a := cf.Argon2idObject; a != nil {
+		fmt.Printf("Argon2idObject:    Salt=%dB Memory=%dKiB Iterations=%d Parallelism=%d KeyLen=%d\n",
+			len(a.Salt), a.Memory, a.Iterations, a.Parallelism, a.KeyLen)
+	} else {
+		fmt.Printf("ScryptObject:      Salt=%dB N=%d R=%d P=%d KeyLen=%d\n",
+			len(s.Salt), s.N, s.R, s.P, s.KeyLen)
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagKeyEpochs) {
+		var epochs []string
+		for _, e := range cf.KeyEpochs {
+			epochs = append(epochs, fmt.Sprint(e.Epoch))
+		}
+		fmt.Printf("KeyEpochs:         %s (retired below %d)\n", strings.Join(epochs, " "), cf.RetiredKeyEpoch)
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagWriteAuth) {
+		fmt.Printf("WriteAuth:         Ed25519 PublicKey=%s\n", hex.EncodeToString(cf.WriteAuth.PublicKey))
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagBlockSize) {
+		fmt.Printf("BlockSize:         %d\n", cf.BlockSize)
+	}
 	fmt.Printf("contentEncryption: %s\n", algo.Algo) // lowercase because not in JSON
 }
@@ -75,16 +75,46 @@ func initDir(args *argContainer) {
 		}
 	}
 	// Choose password for config file
-	if len(args.extpass) == 0 && args.fido2 == "" {
+	if len(args.extpass) == 0 && args.fido2 == "" && args.kms_endpoint == "" &&
+		(args.keyfile == "" || args.keyfile_password) {
 		tlog.Info.Printf("Choose a password for protecting your files.")
 	}
 	{
-		var password []byte
+		var password, keyfile []byte
 		var fido2CredentialID, fido2HmacSalt []byte
-		if args.fido2 != "" {
+		var kms *configfile.KMSParams
+		if args.kms_endpoint != "" {
+			if args.kms_keyid == "" {
+				tlog.Fatal.Printf("-kms-endpoint requires -kms-keyid on -init")
+				os.Exit(exitcodes.Usage)
+			}
+			kms = &configfile.KMSParams{
+				Endpoint: args.kms_endpoint,
+				KeyID:    args.kms_keyid,
+			}
+		} else if args.fido2 != "" {
 			fido2CredentialID = fido2.Register(args.fido2, filepath.Base(args.cipherdir))
 			fido2HmacSalt = cryptocore.RandBytes(32)
 			password = fido2.Secret(args.fido2, args.fido2_assert_options, fido2CredentialID, fido2HmacSalt)
+		} else if args.keyfile != "" {
+			if args.keyfile_generate {
+				if err = readpassword.GenerateKeyfile(args.keyfile); err != nil {
+					tlog.Fatal.Println(err)
+					os.Exit(exitcodes.Init)
+				}
+			}
+			keyfile, err = readpassword.Keyfile(args.keyfile)
+			if err != nil {
+				tlog.Fatal.Println(err)
+				os.Exit(exitcodes.ReadPassword)
+			}
+			if args.keyfile_password {
+				password, err = readpassword.Twice([]string(args.extpass), []string(args.passfile))
+				if err != nil {
+					tlog.Fatal.Println(err)
+					os.Exit(exitcodes.ReadPassword)
+				}
+			}
 		} else {
 			// normal password entry
 			password, err = readpassword.Twice([]string(args.extpass), []string(args.passfile))
@@ -95,6 +125,15 @@ func initDir(args *argContainer) {
 			fido2CredentialID = nil
 			fido2HmacSalt = nil
 		}
+		masterkey := handleArgsMasterkey(args)
+		if args.masterkey_split != "" {
+			if masterkey == nil {
+				masterkey = cryptocore.RandBytes(cryptocore.KeyLen)
+			}
+			// Write the shares before the config file so that we never
+			// create a filesystem whose shares were lost
+			splitMasterkey(args, masterkey)
+		}
 		creator := tlog.ProgramName + " " + GitVersion
 		err = configfile.Create(&configfile.CreateArgs{
 			Filename:           args.config,
@@ -108,17 +147,29 @@ func initDir(args *argContainer) {
 			Fido2AssertOptions: args.fido2_assert_options,
 			DeterministicNames: args.deterministic_names,
 			XChaCha20Poly1305:  args.xchacha,
+			AESGCMSIV:          args.gcmsiv,
 			LongNameMax:        args.longnamemax,
-			Masterkey:          handleArgsMasterkey(args),
+			BlockSize:          args.blocksize,
+			Compression:        args.compress,
+			Masterkey:          masterkey,
+			KMS:                kms,
+			Argon2id:           argon2idArgs(args),
+			Keyfile:            keyfile,
+			HideMasterkey:      args.masterkey_split != "",
+			WriteAuth:          args.write_auth,
 		})
 		if err != nil {
 			tlog.Fatal.Println(err)
+			if _, ok := err.(exitcodes.Err); ok {
+				exitcodes.Exit(err)
+			}
 			os.Exit(exitcodes.WriteConf)
 		}
 		for i := range password {
 			password[i] = 0
 		}
-		// password runs out of scope here
+		wipe(keyfile)
+		// password and keyfile run out of scope here
 	}
 	// Forward mode with filename encryption enabled needs a gocryptfs.diriv file
 	// in the root dir
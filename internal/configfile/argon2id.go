@@ -0,0 +1,101 @@
+package configfile
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/argon2"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+const (
+	// Argon2idDefaultMemory is the default Argon2id memory cost in KiB.
+	// Together with Argon2idDefaultIterations and Argon2idDefaultParallelism
+	// this is the second recommended option from RFC 9106, section 4.
+	Argon2idDefaultMemory = 64 * 1024
+	// Argon2idDefaultIterations is the default Argon2id time cost
+	Argon2idDefaultIterations = 3
+	// Argon2idDefaultParallelism is the default number of Argon2id lanes
+	Argon2idDefaultParallelism = 4
+	// 8 MiB with a single iteration takes about 10ms on a current desktop CPU.
+	// This should be fast enough for all purposes. We reject lower values.
+	argon2idMinMemory     = 8 * 1024
+	argon2idMinIterations = 1
+	argon2idMinParallism  = 1
+	// We always generate 32-byte salts. Anything smaller than that is rejected.
+	argon2idMinSaltLen = 32
+)
+
+// Argon2idKDF is an instance of the Argon2id key deriviation function
+// (RFC 9106).
+type Argon2idKDF struct {
+	// Salt is the random salt that is passed to Argon2id
+	Salt []byte
+	// Memory is the memory cost in KiB
+	Memory uint32
+	// Iterations is the time cost (number of passes over the memory)
+	Iterations uint32
+	// Parallelism is the number of lanes
+	Parallelism uint8
+	// KeyLen is the output data length
+	KeyLen int
+}
+
+// NewArgon2idKDF returns a new instance of Argon2idKDF. Zero values select
+// the defaults.
+func NewArgon2idKDF(memory uint32, iterations uint32, parallelism uint8) Argon2idKDF {
+	a := Argon2idKDF{
+		Salt:        cryptocore.RandBytes(cryptocore.KeyLen),
+		Memory:      memory,
+		Iterations:  iterations,
+		Parallelism: parallelism,
+		KeyLen:      cryptocore.KeyLen,
+	}
+	if a.Memory == 0 {
+		a.Memory = Argon2idDefaultMemory
+	}
+	if a.Iterations == 0 {
+		a.Iterations = Argon2idDefaultIterations
+	}
+	if a.Parallelism == 0 {
+		a.Parallelism = Argon2idDefaultParallelism
+	}
+	return a
+}
+
+// DeriveKey returns a new key from a supplied password.
+func (a *Argon2idKDF) DeriveKey(pw []byte) []byte {
+	if err := a.validateParams(); err != nil {
+		tlog.Fatal.Println(err.Error())
+		os.Exit(exitcodes.ScryptParams)
+	}
+	return argon2.IDKey(pw, a.Salt, a.Iterations, a.Memory, a.Parallelism, uint32(a.KeyLen))
+}
+
+// validateParams checks that all parameters are at or above hardcoded limits.
+// This makes sure we do not get weak parameters passed through a
+// rougue gocryptfs.conf.
+func (a *Argon2idKDF) validateParams() error {
+	if a.Memory < argon2idMinMemory {
+		return fmt.Errorf("Fatal: argon2id parameter Memory below minimum: value=%d KiB, min=%d KiB",
+			a.Memory, argon2idMinMemory)
+	}
+	if a.Iterations < argon2idMinIterations {
+		return fmt.Errorf("Fatal: argon2id parameter Iterations below minimum: value=%d, min=%d",
+			a.Iterations, argon2idMinIterations)
+	}
+	if a.Parallelism < argon2idMinParallism {
+		return fmt.Errorf("Fatal: argon2id parameter Parallelism below minimum: value=%d, min=%d",
+			a.Parallelism, argon2idMinParallism)
+	}
+	if len(a.Salt) < argon2idMinSaltLen {
+		return fmt.Errorf("Fatal: argon2id salt length below minimum: value=%d, min=%d", len(a.Salt), argon2idMinSaltLen)
+	}
+	if a.KeyLen < cryptocore.KeyLen {
+		return fmt.Errorf("Fatal: argon2id parameter KeyLen below minimum: value=%d, min=%d", a.KeyLen, cryptocore.KeyLen)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package configfile
+
+import (
+	"testing"
+)
+
+func TestCreateConfArgon2id(t *testing.T) {
+	err := Create(&CreateArgs{
+		Filename: "config_test/tmp.conf",
+		Password: testPw,
+		Creator:  "test",
+		Argon2id: &Argon2idKDF{Memory: argon2idMinMemory, Iterations: 1, Parallelism: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagArgon2id) || c.Argon2idObject.Memory != argon2idMinMemory {
+		t.Fatalf("Argon2id not used: %v %#v", c.FeatureFlags, c.Argon2idObject)
+	}
+	if _, err = c.DecryptMasterKey([]byte("wrong")); err == nil {
+		t.Error("wrong password was accepted")
+	}
+	// Switch back to scrypt
+	c.EncryptKey(key, testPw, 10)
+	if err = c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if c.IsFeatureFlagSet(FlagArgon2id) || c.Argon2idObject != nil {
+		t.Error("Argon2id still set after EncryptKey")
+	}
+	if _, err = c.DecryptMasterKey(testPw); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestArgon2idValidateParams(t *testing.T) {
+	good := NewArgon2idKDF(argon2idMinMemory, 1, 1)
+	if err := good.validateParams(); err != nil {
+		t.Fatal(err)
+	}
+	bad := []Argon2idKDF{good, good, good, good, good}
+	bad[0].Memory = argon2idMinMemory - 1
+	bad[1].Iterations = 0
+	bad[2].Parallelism = 0
+	bad[3].Salt = bad[3].Salt[:16]
+	bad[4].KeyLen = 16
+	for i, a := range bad {
+		if a.validateParams() == nil {
+			t.Errorf("case %d: weak parameters were accepted: %#v", i, a)
+		}
+	}
+}
@@ -47,6 +47,9 @@ type ConfFile struct {
 	EncryptedKey []byte
 	// ScryptObject stores parameters for scrypt hashing (key derivation)
 	ScryptObject ScryptKDF
+	// Argon2idObject replaces ScryptObject when the Argon2id feature flag is
+	// set
+	Argon2idObject *Argon2idKDF `json:",omitempty"`
 	// Version is the On-Disk-Format version this filesystem uses
 	Version uint16
 	// FeatureFlags is a list of feature flags this filesystem has enabled.
@@ -56,8 +59,22 @@ type ConfFile struct {
 	FeatureFlags []string
 	// FIDO2 parameters
 	FIDO2 *FIDO2Params `json:",omitempty"`
+	// KMS parameters, only set when the ExternalKMS feature flag is set
+	KMS *KMSParams `json:",omitempty"`
+	// KeySlots, only set when the KeySlots feature flag is set
+	KeySlots []KeySlot `json:",omitempty"`
+	// KeyEpochs, only set when the KeyEpochs feature flag is set
+	KeyEpochs []KeyEpoch `json:",omitempty"`
+	// RetiredKeyEpoch is set by "-rekey": no file uses an epoch below it
+	RetiredKeyEpoch uint32 `json:",omitempty"`
+	// WriteAuth, only set when the WriteAuth feature flag is set
+	WriteAuth *WriteAuthParams `json:",omitempty"`
 	// LongNameMax corresponds to the -longnamemax flag
 	LongNameMax uint8 `json:",omitempty"`
+	// BlockSize corresponds to the -blocksize flag
+	BlockSize uint32 `json:",omitempty"`
+	// Compression corresponds to the -compress flag
+	Compression string `json:",omitempty"`
 	// Filename is the name of the config file. Not exported to JSON.
 	filename string
 }
@@ -75,13 +92,32 @@ type CreateArgs struct {
 	Fido2AssertOptions []string
 	DeterministicNames bool
 	XChaCha20Poly1305  bool
+	AESGCMSIV          bool
 	LongNameMax        uint8
+	BlockSize          uint32
+	Compression        string
 	Masterkey          []byte
+	// KMS, if not nil, wraps the master key using an external key
+	// management service instead of Password.
+	KMS *KMSParams
+	// Argon2id, if not nil, hashes Password using Argon2id with these cost
+	// parameters instead of scrypt. The salt is generated by Create.
+	Argon2id *Argon2idKDF
+	// Keyfile, if not nil, holds the contents of a key file that protects
+	// the master key. The filesystem gets a single key slot called "default"
+	// that needs the key file, plus Password if it is not empty.
+	Keyfile []byte
+	// HideMasterkey suppresses printing the master key, because the
+	// caller has taken care of it (for example by splitting it into shares).
+	HideMasterkey bool
+	// WriteAuth enables signed file content blocks. Writing then needs the
+	// master key, while the reader key only allows reading.
+	WriteAuth bool
 }
 
 // Create - create a new config with a random key encrypted with
 // "Password" and write it to "Filename".
-// Uses scrypt with cost parameter "LogN".
+// Uses scrypt with cost parameter "LogN", or Argon2id if "Argon2id" is set.
 func Create(args *CreateArgs) error {
 	cf := ConfFile{
 		filename: args.Filename,
@@ -93,7 +129,8 @@ func Create(args *CreateArgs) error {
 	if args.XChaCha20Poly1305 {
 		cf.setFeatureFlag(FlagXChaCha20Poly1305)
 	} else {
-		// 128-bit IVs are mandatory for AES-GCM (default is 96!) and AES-SIV,
+		// 128-bit IVs are mandatory for AES-GCM (default is 96!), AES-SIV and
+		// AES-GCM-SIV,
 		// XChaCha20Poly1305 uses even an even longer IV of 192 bits.
 		cf.setFeatureFlag(FlagGCMIV128)
 	}
@@ -113,9 +150,21 @@ func Create(args *CreateArgs) error {
 		cf.setFeatureFlag(FlagLongNames)
 		cf.setFeatureFlag(FlagRaw64)
 	}
+	// 0 means to use the default, and the default does not have to be saved
+	if args.BlockSize != 0 && args.BlockSize != contentenc.DefaultBS {
+		cf.BlockSize = args.BlockSize
+		cf.setFeatureFlag(FlagBlockSize)
+	}
 	if args.AESSIV {
 		cf.setFeatureFlag(FlagAESSIV)
 	}
+	if args.AESGCMSIV {
+		cf.setFeatureFlag(FlagAESGCMSIV)
+	}
+	if args.Compression != "" {
+		cf.Compression = args.Compression
+		cf.setFeatureFlag(FlagCompression)
+	}
 	if len(args.Fido2CredentialID) > 0 {
 		cf.setFeatureFlag(FlagFIDO2)
 		cf.FIDO2 = &FIDO2Params{
@@ -124,10 +173,34 @@ func Create(args *CreateArgs) error {
 			AssertOptions:    args.Fido2AssertOptions,
 		}
 	}
-	// Catch bugs and invalid cli flag combinations early
-	cf.ScryptObject = NewScryptKDF(args.LogN)
-	if err := cf.Validate(); err != nil {
-		return err
+	var kp KeyProvider
+	if args.KMS != nil {
+		cf.setFeatureFlag(FlagExternalKMS)
+		cf.KMS = args.KMS
+	} else if args.Keyfile != nil {
+		// The key slot is created below, once we have the master key
+		cf.setFeatureFlag(FlagKeySlots)
+	} else if args.Argon2id != nil {
+		cf.setFeatureFlag(FlagArgon2id)
+		a := NewArgon2idKDF(args.Argon2id.Memory, args.Argon2id.Iterations, args.Argon2id.Parallelism)
+		cf.Argon2idObject = &a
+	} else {
+		cf.ScryptObject = NewScryptKDF(args.LogN)
+	}
+	// Catch bugs and invalid cli flag combinations early. A key file
+	// filesystem is only complete once its key slot exists, so it is
+	// validated after the key slot has been added.
+	if args.Keyfile == nil {
+		if err := cf.Validate(); err != nil {
+			return err
+		}
+	}
+	if args.KMS != nil {
+		var err error
+		kp, err = NewKeyProvider(args.KMS)
+		if err != nil {
+			return err
+		}
 	}
 	{
 		key := args.Masterkey
@@ -135,15 +208,48 @@ func Create(args *CreateArgs) error {
 			// Generate new random master key
 			key = cryptocore.RandBytes(cryptocore.KeyLen)
 		}
-		tlog.PrintMasterkeyReminder(key)
-		// Encrypt it using the password
-		// This sets ScryptObject and EncryptedKey
-		// Note: this looks at the FeatureFlags, so call it AFTER setting them.
-		cf.EncryptKey(key, args.Password, args.LogN)
+		if !args.HideMasterkey {
+			tlog.PrintMasterkeyReminder(key)
+		}
+		if args.WriteAuth {
+			cf.enableWriteAuth(key)
+		}
+		var err error
+		if kp != nil {
+			// Let the KMS wrap it. This sets EncryptedKey.
+			err = cf.EncryptKeyKMS(key, kp)
+		} else if args.Keyfile != nil {
+			ks := KeySlotSecret{
+				Name:     "default",
+				Type:     KeySlotKeyfile,
+				Secret:   args.Keyfile,
+				LogN:     args.LogN,
+				Argon2id: args.Argon2id,
+			}
+			if len(args.Password) > 0 {
+				ks.Type = KeySlotKeyfilePassword
+				ks.Password = args.Password
+			}
+			err = cf.AddKeySlot(key, &ks)
+			if err == nil {
+				err = cf.Validate()
+			}
+		} else if args.Argon2id != nil {
+			// This sets Argon2idObject and EncryptedKey
+			cf.EncryptKeyArgon2id(key, args.Password, *cf.Argon2idObject)
+		} else {
+			// Encrypt it using the password
+			// This sets ScryptObject and EncryptedKey
+			// Note: this looks at the FeatureFlags, so call it AFTER setting them.
+			cf.EncryptKey(key, args.Password, args.LogN)
+		}
 		for i := range key {
 			key[i] = 0
 		}
 		// key runs out of scope here
+		if err != nil {
+			return err
+		}
 	}
 	// Write file to disk
 	return cf.WriteFile()
@@ -214,11 +320,31 @@ func (cf *ConfFile) setFeatureFlag(flag flagIota) {
 	cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[flag])
 }
 
+func (cf *ConfFile) clearFeatureFlag(flag flagIota) {
+	flagString := knownFlags[flag]
+	var out []string
+	for _, f := range cf.FeatureFlags {
+		if f != flagString {
+			out = append(out, f)
+		}
+	}
+	cf.FeatureFlags = out
+}
+
 // DecryptMasterKey decrypts the masterkey stored in cf.EncryptedKey using
-// password.
+// password. On filesystems with key slots, all password key slots are tried.
 func (cf *ConfFile) DecryptMasterKey(password []byte) (masterkey []byte, err error) {
+	if cf.IsFeatureFlagSet(FlagKeySlots) {
+		masterkey, _, err = cf.DecryptMasterKeySlots(KeySlotPassword, password)
+		return masterkey, err
+	}
 	// Generate derived key from password
-	scryptHash := cf.ScryptObject.DeriveKey(password)
+	var scryptHash []byte
+	if cf.IsFeatureFlagSet(FlagArgon2id) {
+		scryptHash = cf.Argon2idObject.DeriveKey(password)
+	} else {
+		scryptHash = cf.ScryptObject.DeriveKey(password)
+	}
 
 	// Unlock master key using password-based key
 	useHKDF := cf.IsFeatureFlagSet(FlagHKDF)
@@ -246,24 +372,69 @@ func (cf *ConfFile) DecryptMasterKey(password []byte) (masterkey []byte, err err
 // EncryptKey - encrypt "key" using an scrypt hash generated from "password"
 // and store it in cf.EncryptedKey.
 // Uses scrypt with cost parameter logN and stores the scrypt parameters in
-// cf.ScryptObject.
+// cf.ScryptObject. Switches the filesystem from Argon2id back to scrypt.
 func (cf *ConfFile) EncryptKey(key []byte, password []byte, logN int) {
 	// Generate scrypt-derived key from password
 	cf.ScryptObject = NewScryptKDF(logN)
-	scryptHash := cf.ScryptObject.DeriveKey(password)
+	cf.clearFeatureFlag(FlagArgon2id)
+	cf.Argon2idObject = nil
+	cf.encryptKeyWith(key, cf.ScryptObject.DeriveKey(password))
+}
 
+// EncryptKeyArgon2id - encrypt "key" using an Argon2id hash generated from
+// "password" and store it in cf.EncryptedKey.
+// Uses the cost parameters from "params" with a new random salt and stores
+// them in cf.Argon2idObject.
+func (cf *ConfFile) EncryptKeyArgon2id(key []byte, password []byte, params Argon2idKDF) {
+	a := NewArgon2idKDF(params.Memory, params.Iterations, params.Parallelism)
+	cf.Argon2idObject = &a
+	cf.ScryptObject = ScryptKDF{}
+	cf.setFeatureFlag(FlagArgon2id)
+	cf.encryptKeyWith(key, a.DeriveKey(password))
+}
+
+// encryptKeyWith encrypts "key" using the password hash "pwHash", stores it
+// in cf.EncryptedKey and wipes "pwHash".
+func (cf *ConfFile) encryptKeyWith(key []byte, pwHash []byte) {
 	// Lock master key using password-based key
 	useHKDF := cf.IsFeatureFlagSet(FlagHKDF)
-	ce := getKeyEncrypter(scryptHash, useHKDF)
-	cf.EncryptedKey = ce.EncryptBlock(key, 0, nil)
+	ce := getKeyEncrypter(pwHash, useHKDF)
+	// The key encrypter does not sign, so there is no error
+	cf.EncryptedKey, _ = ce.EncryptBlock(key, 0, nil)
 
-	// Purge scrypt-derived key
-	for i := range scryptHash {
-		scryptHash[i] = 0
+	// Purge password-derived key
+	for i := range pwHash {
+		pwHash[i] = 0
 	}
-	scryptHash = nil
 	ce.Wipe()
-	ce = nil
+}
+
+// DecryptMasterKeyKMS asks the KeyProvider "kp" to unwrap the masterkey
+// stored in cf.EncryptedKey.
+func (cf *ConfFile) DecryptMasterKeyKMS(kp KeyProvider) (masterkey []byte, err error) {
+	masterkey, err = kp.Unwrap(cf.EncryptedKey)
+	if err != nil {
+		return nil, exitcodes.NewErr(err.Error(), exitcodes.KMS)
+	}
+	if len(masterkey) != cryptocore.KeyLen {
+		for i := range masterkey {
+			masterkey[i] = 0
+		}
+		return nil, exitcodes.NewErr(fmt.Sprintf("kms: unwrapped key has wrong length %d", len(masterkey)),
+			exitcodes.KMS)
+	}
+	return masterkey, nil
+}
+
+// EncryptKeyKMS - wrap "key" using the KeyProvider "kp" and store it in
+// cf.EncryptedKey.
+func (cf *ConfFile) EncryptKeyKMS(key []byte, kp KeyProvider) error {
+	wrapped, err := kp.Wrap(key)
+	if err != nil {
+		return exitcodes.NewErr(err.Error(), exitcodes.KMS)
+	}
+	cf.EncryptedKey = wrapped
+	return nil
 }
 
 // WriteFile - write out config in JSON format to file "filename.tmp"
@@ -319,6 +490,14 @@ func getKeyEncrypter(scryptHash []byte, useHKDF bool) *contentenc.ContentEnc {
 	return ce
 }
 
+// PlainBS returns the plaintext block size of the filesystem.
+func (cf *ConfFile) PlainBS() uint64 {
+	if cf.BlockSize == 0 {
+		return contentenc.DefaultBS
+	}
+	return uint64(cf.BlockSize)
+}
+
 // ContentEncryption tells us which content encryption algorithm is selected
 func (cf *ConfFile) ContentEncryption() (algo cryptocore.AEADTypeEnum, err error) {
 	if err := cf.Validate(); err != nil {
@@ -330,6 +509,10 @@ func (cf *ConfFile) ContentEncryption() (algo cryptocore.AEADTypeEnum, err error
 	if cf.IsFeatureFlagSet(FlagAESSIV) {
 		return cryptocore.BackendAESSIV, nil
 	}
-	// If neither AES-SIV nor XChaCha are selected, we must be using AES-GCM
+	if cf.IsFeatureFlagSet(FlagAESGCMSIV) {
+		return cryptocore.BackendAESGCMSIV, nil
+	}
+	// If neither AES-SIV, AES-GCM-SIV nor XChaCha are selected, we must be
+	// using AES-GCM
 	return cryptocore.BackendGoGCM, nil
 }
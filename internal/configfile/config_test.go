@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
@@ -131,6 +132,62 @@ func TestCreateConfFileAESSIV(t *testing.T) {
 	}
 }
 
+func TestCreateConfFileAESGCMSIV(t *testing.T) {
+	err := Create(&CreateArgs{
+		Filename:  "config_test/tmp.conf",
+		Password:  testPw,
+		LogN:      10,
+		Creator:   "test",
+		AESGCMSIV: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	algo, err := c.ContentEncryption()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algo != cryptocore.BackendAESGCMSIV {
+		t.Errorf("wrong content encryption %v", algo)
+	}
+	c.setFeatureFlag(FlagAESSIV)
+	if c.Validate() == nil {
+		t.Error("AESGCMSIV together with AESSIV should be rejected")
+	}
+}
+
+func TestCreateConfFileCompression(t *testing.T) {
+	err := Create(&CreateArgs{
+		Filename:    "config_test/tmp.conf",
+		Password:    testPw,
+		LogN:        10,
+		Creator:     "test",
+		AESSIV:      true,
+		Compression: "lz4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagCompression) || c.Compression != "lz4" {
+		t.Errorf("compression not set: %q %v", c.Compression, c.FeatureFlags)
+	}
+	c.Compression = "zstd"
+	if c.Validate() == nil {
+		t.Error("unknown compression algorithm should be rejected")
+	}
+	c.Compression = "lz4"
+	c.clearFeatureFlag(FlagAESSIV)
+	if c.Validate() == nil {
+		t.Error("compression without AESSIV or AESGCMSIV should be rejected")
+	}
+}
+
 func TestCreateConfLongNameMax(t *testing.T) {
 	args := &CreateArgs{
 		Filename:    "config_test/tmp.conf",
@@ -175,3 +232,36 @@ func TestIsFeatureFlagKnown(t *testing.T) {
 		t.Errorf("flag %q should be NOT known", f)
 	}
 }
+
+func TestBlockSize(t *testing.T) {
+	for _, bs := range []uint32{0, 4096, 65536} {
+		err := Create(&CreateArgs{
+			Filename:  "config_test/tmp.conf",
+			Password:  testPw,
+			LogN:      10,
+			Creator:   "test",
+			BlockSize: bs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := uint64(bs)
+		if bs == 0 {
+			want = 4096
+		}
+		if c.PlainBS() != want {
+			t.Errorf("bs=%d: PlainBS=%d, want %d", bs, c.PlainBS(), want)
+		}
+		// The default is not stored
+		if c.IsFeatureFlagSet(FlagBlockSize) != (want != 4096) {
+			t.Errorf("bs=%d: wrong BlockSize flag: %v", bs, c.FeatureFlags)
+		}
+		c.BlockSize = 5000
+		if c.IsFeatureFlagSet(FlagBlockSize) && c.Validate() == nil {
+			t.Errorf("bs=%d: invalid block size should be rejected", bs)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package configfile
+
+import (
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// NewContentEnc sets up the file content encryption of a filesystem that was
+// unlocked using "key". It returns the ContentEnc and the CryptoCore that file
+// names are encrypted with.
+//
+// "key" is the master key, or, if "isReaderKey" is set, the reader key of a
+// "-write-auth" filesystem. On "-write-auth" filesystems, file contents and
+// names are encrypted using the reader key, and file contents are signed.
+// The content keys of all key epochs are added.
+//
+// "cf" supplies the write authentication public key and the key epochs. It
+// may be nil if there is no config file ("-zerokey", "-masterkey").
+// "key" is not wiped.
+func NewContentEnc(cf *ConfFile, key []byte, isReaderKey bool, backend cryptocore.AEADTypeEnum,
+	IVBits int, useHKDF bool, plainBS uint64) (*contentenc.ContentEnc, *cryptocore.CryptoCore, error) {
+	var wa *contentenc.WriteAuth
+	if cf != nil && cf.IsFeatureFlagSet(FlagWriteAuth) {
+		if isReaderKey {
+			wa = cf.ReaderWriteAuth()
+		} else {
+			readerKey, masterWA, err := cf.WriteAuthKeys(key)
+			if err != nil {
+				return nil, nil, err
+			}
+			defer wipeBytes(readerKey)
+			key = readerKey
+			wa = masterWA
+		}
+	} else if isReaderKey {
+		return nil, nil, exitcodes.NewErr("This filesystem has no reader key", exitcodes.Usage)
+	}
+	cCore := cryptocore.New(key, backend, IVBits, useHKDF)
+	var cEnc *contentenc.ContentEnc
+	if wa != nil {
+		cEnc = contentenc.NewWriteAuth(cCore, plainBS, wa)
+	} else {
+		cEnc = contentenc.New(cCore, plainBS)
+	}
+	if cf != nil && cf.IsFeatureFlagSet(FlagKeyEpochs) {
+		keys, err := cf.DecryptKeyEpochs(key)
+		if err != nil {
+			cEnc.Wipe()
+			return nil, nil, err
+		}
+		for epoch, k := range keys {
+			cEnc.AddKeyEpoch(epoch, cryptocore.New(k, backend, IVBits, useHKDF))
+			wipeBytes(k)
+		}
+		tlog.Debug.Printf("NewContentEnc: %d key epochs, writing epoch %d", len(keys), cEnc.WriteEpoch())
+	}
+	return cEnc, cCore, nil
+}
@@ -27,13 +27,37 @@ const (
 	// instead of directly using the master key (GCM and EME) or the SHA-512
 	// hashed master key (SIV).
 	// Note that this flag does not change the password hashing algorithm
-	// which always is scrypt.
+	// which is scrypt, or Argon2id if FlagArgon2id is set.
 	FlagHKDF
 	// FlagFIDO2 means that "-fido2" was used when creating the filesystem.
 	// The masterkey is protected using a FIDO2 token instead of a password.
 	FlagFIDO2
 	// FlagXChaCha20Poly1305 means we use XChaCha20-Poly1305 file content encryption
 	FlagXChaCha20Poly1305
+	// FlagExternalKMS means that the masterkey is wrapped by an external key
+	// management service (see KMSParams) instead of a password.
+	FlagExternalKMS
+	// FlagKeySlots means that the masterkey is stored in one or more key
+	// slots (see KeySlot) instead of the top-level EncryptedKey field.
+	FlagKeySlots
+	// FlagKeyEpochs means that file contents may be encrypted using content
+	// keys of several key epochs (see KeyEpoch). The epoch is stored in the
+	// file header, which uses a new header version for epochs above 0.
+	FlagKeyEpochs
+	// FlagArgon2id means that the password is hashed using Argon2id (see
+	// Argon2idKDF) instead of scrypt.
+	FlagArgon2id
+	// FlagWriteAuth means that file content blocks are signed (see
+	// WriteAuthParams), so that the reader key is not enough to write.
+	FlagWriteAuth
+	// FlagBlockSize means that file contents use a non-default plaintext
+	// block size, stored in the BlockSize field.
+	FlagBlockSize
+	// FlagAESGCMSIV selects the AES-256-GCM-SIV crypto backend.
+	FlagAESGCMSIV
+	// FlagCompression means that reverse mode compresses file contents using
+	// the algorithm stored in the Compression field.
+	FlagCompression
 )
 
 // knownFlags stores the known feature flags and their string representation
@@ -49,6 +73,14 @@ var knownFlags = map[flagIota]string{
 	FlagHKDF:              "HKDF",
 	FlagFIDO2:             "FIDO2",
 	FlagXChaCha20Poly1305: "XChaCha20Poly1305",
+	FlagExternalKMS:       "ExternalKMS",
+	FlagKeySlots:          "KeySlots",
+	FlagKeyEpochs:         "KeyEpochs",
+	FlagArgon2id:          "Argon2id",
+	FlagWriteAuth:         "WriteAuth",
+	FlagBlockSize:         "BlockSize",
+	FlagAESGCMSIV:         "AESGCMSIV",
+	FlagCompression:       "Compression",
 }
 
 // isFeatureFlagKnown verifies that we understand a feature flag.
@@ -0,0 +1,107 @@
+package configfile
+
+import (
+	"fmt"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// KeyEpoch stores the file content key of one key epoch. Epoch 0 is the
+// master key itself and is not stored. The content keys of later epochs are
+// random and encrypted using the master key.
+type KeyEpoch struct {
+	// Epoch is the epoch number, it is stored in the file headers
+	Epoch uint32
+	// EncryptedKey is the content key, encrypted using the master key
+	EncryptedKey []byte
+}
+
+// AddKeyEpoch generates a new random content key, encrypts it using
+// "masterkey" and stores it as a new key epoch. New files will use the new
+// epoch. Returns the new epoch number.
+func (cf *ConfFile) AddKeyEpoch(masterkey []byte) uint32 {
+	epoch := cf.NewestKeyEpoch() + 1
+	key := cryptocore.RandBytes(cryptocore.KeyLen)
+	ce := getKeyEncrypter(masterkey, cf.IsFeatureFlagSet(FlagHKDF))
+	// The epoch number is used as associated data so that encrypted keys
+	// cannot be swapped between epochs. The key encrypter does not sign, so
+	// there is no error.
+	cKey, _ := ce.EncryptBlock(key, uint64(epoch), nil)
+	cf.KeyEpochs = append(cf.KeyEpochs, KeyEpoch{
+		Epoch:        epoch,
+		EncryptedKey: cKey,
+	})
+	ce.Wipe()
+	for i := range key {
+		key[i] = 0
+	}
+	cf.setFeatureFlag(FlagKeyEpochs)
+	return epoch
+}
+
+// NewestKeyEpoch returns the highest key epoch, or 0 if the filesystem does
+// not use key epochs.
+func (cf *ConfFile) NewestKeyEpoch() uint32 {
+	if len(cf.KeyEpochs) == 0 {
+		return 0
+	}
+	return cf.KeyEpochs[len(cf.KeyEpochs)-1].Epoch
+}
+
+// DecryptKeyEpochs decrypts the content keys of all key epochs using
+// "masterkey". The caller should wipe the returned keys after use.
+func (cf *ConfFile) DecryptKeyEpochs(masterkey []byte) (map[uint32][]byte, error) {
+	ce := getKeyEncrypter(masterkey, cf.IsFeatureFlagSet(FlagHKDF))
+	defer ce.Wipe()
+	keys := make(map[uint32][]byte)
+	for _, e := range cf.KeyEpochs {
+		tlog.Warn.Enabled = false // Silence DecryptBlock() error messages on wrong master key
+		key, err := ce.DecryptBlock(e.EncryptedKey, uint64(e.Epoch), nil)
+		tlog.Warn.Enabled = true
+		if err != nil {
+			return nil, exitcodes.NewErr(fmt.Sprintf("Could not decrypt the key of key epoch %d: %v", e.Epoch, err),
+				exitcodes.PasswordIncorrect)
+		}
+		keys[e.Epoch] = key
+	}
+	return keys, nil
+}
+
+// RetireKeyEpochs drops the content keys of all epochs below "epoch". Files
+// that still use a dropped epoch become unreadable, so this must only be
+// called after all files have been rewritten (see "gocryptfs -rekey").
+// Epoch 0 is the master key and cannot be dropped.
+func (cf *ConfFile) RetireKeyEpochs(epoch uint32) {
+	var keep []KeyEpoch
+	for _, e := range cf.KeyEpochs {
+		if e.Epoch >= epoch {
+			keep = append(keep, e)
+		}
+	}
+	cf.KeyEpochs = keep
+	cf.RetiredKeyEpoch = epoch
+}
+
+// validateKeyEpochs checks the key epochs of a filesystem that has the
+// KeyEpochs feature flag set.
+func (cf *ConfFile) validateKeyEpochs() error {
+	if len(cf.KeyEpochs) == 0 {
+		return fmt.Errorf("KeyEpochs feature flag is set but there are no key epochs")
+	}
+	var prev uint32
+	for _, e := range cf.KeyEpochs {
+		if e.Epoch <= prev {
+			return fmt.Errorf("Key epochs are not strictly increasing: %d after %d", e.Epoch, prev)
+		}
+		if len(e.EncryptedKey) == 0 {
+			return fmt.Errorf("Key epoch %d: EncryptedKey is empty", e.Epoch)
+		}
+		prev = e.Epoch
+	}
+	if cf.RetiredKeyEpoch > cf.KeyEpochs[0].Epoch {
+		return fmt.Errorf("Key epoch %d is present but retired", cf.KeyEpochs[0].Epoch)
+	}
+	return nil
+}
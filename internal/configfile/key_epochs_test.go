@@ -0,0 +1,64 @@
+package configfile
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeyEpochs(t *testing.T) {
+	masterkey := bytes.Repeat([]byte{0x11}, 32)
+	err := Create(&CreateArgs{
+		Filename:  "config_test/tmp.conf",
+		Password:  testPw,
+		LogN:      10,
+		Creator:   "test",
+		Masterkey: append([]byte{}, masterkey...),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := Load("config_test/tmp.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := cf.AddKeyEpoch(masterkey); e != 1 {
+		t.Fatalf("first epoch should be 1, got %d", e)
+	}
+	if e := cf.AddKeyEpoch(masterkey); e != 2 {
+		t.Fatalf("second epoch should be 2, got %d", e)
+	}
+	if err = cf.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	_, cf, err = LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(FlagKeyEpochs) || cf.NewestKeyEpoch() != 2 {
+		t.Fatalf("unexpected key epochs: %#v", cf.KeyEpochs)
+	}
+	keys, err := cf.DecryptKeyEpochs(masterkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || bytes.Equal(keys[1], keys[2]) {
+		t.Errorf("bad keys: %x", keys)
+	}
+	// The wrong master key is rejected
+	if _, err = cf.DecryptKeyEpochs(bytes.Repeat([]byte{0x22}, 32)); err == nil {
+		t.Error("decrypting with the wrong master key should fail")
+	}
+	// Swapping the encrypted keys between epochs is detected
+	cf.KeyEpochs[0].EncryptedKey, cf.KeyEpochs[1].EncryptedKey = cf.KeyEpochs[1].EncryptedKey, cf.KeyEpochs[0].EncryptedKey
+	if _, err = cf.DecryptKeyEpochs(masterkey); err == nil {
+		t.Error("swapped keys should fail to decrypt")
+	}
+	cf.KeyEpochs[0].EncryptedKey, cf.KeyEpochs[1].EncryptedKey = cf.KeyEpochs[1].EncryptedKey, cf.KeyEpochs[0].EncryptedKey
+	cf.RetireKeyEpochs(2)
+	if len(cf.KeyEpochs) != 1 || cf.KeyEpochs[0].Epoch != 2 || cf.RetiredKeyEpoch != 2 {
+		t.Errorf("RetireKeyEpochs: %#v", cf.KeyEpochs)
+	}
+	if err = cf.Validate(); err != nil {
+		t.Error(err)
+	}
+}
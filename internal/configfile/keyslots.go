@@ -0,0 +1,352 @@
+package configfile
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+const (
+	// KeySlotPassword is a key slot unlocked by a password hashed with scrypt
+	KeySlotPassword = "password"
+	// KeySlotFIDO2 is a key slot unlocked by a FIDO2 hmac-secret, which is
+	// then hashed with scrypt like a password.
+	KeySlotFIDO2 = "fido2"
+	// KeySlotKeyfile is a key slot unlocked by the contents of a key file.
+	// Key files are high-entropy, so they are passed through HKDF instead of
+	// scrypt.
+	KeySlotKeyfile = "keyfile"
+	// KeySlotKeyfilePassword is a key slot that needs both a key file and a
+	// password. The password is hashed with scrypt or Argon2id, and the hash
+	// is mixed into HKDF together with the key file contents.
+	KeySlotKeyfilePassword = "keyfile+password"
+
+	// KeyfileMinLen is the minimum length of a key file in bytes
+	KeyfileMinLen = 32
+	// hkdfInfoKeyfile is the HKDF info string for key file slots
+	hkdfInfoKeyfile = "gocryptfs key slot key file"
+	// hkdfInfoKeyfilePassword is the HKDF info string for key file +
+	// password slots
+	hkdfInfoKeyfilePassword = "gocryptfs key slot key file and password"
+)
+
+// KeySlot wraps the master key using one credential. A filesystem with the
+// KeySlots feature flag has one or more key slots that all wrap the same
+// master key.
+type KeySlot struct {
+	// Name is a unique, human-readable label, like the name of the operator
+	Name string
+	// Type is one of KeySlotPassword, KeySlotFIDO2, KeySlotKeyfile,
+	// KeySlotKeyfilePassword
+	Type string
+	// EncryptedKey holds the master key, encrypted with the key derived from
+	// the credential
+	EncryptedKey []byte
+	// ScryptObject is used by the password, fido2 and keyfile+password
+	// types, unless Argon2idObject is set
+	ScryptObject *ScryptKDF `json:",omitempty"`
+	// Argon2idObject replaces ScryptObject
+	Argon2idObject *Argon2idKDF `json:",omitempty"`
+	// FIDO2 is used by the fido2 type
+	FIDO2 *FIDO2Params `json:",omitempty"`
+	// KeyfileSalt is the HKDF salt used by the keyfile and keyfile+password
+	// types
+	KeyfileSalt []byte `json:",omitempty"`
+}
+
+// validate checks that the key slot is complete and consistent.
+func (s *KeySlot) validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("key slot with empty name")
+	}
+	if len(s.EncryptedKey) == 0 {
+		return fmt.Errorf("key slot %q: EncryptedKey is empty", s.Name)
+	}
+	switch s.Type {
+	case KeySlotPassword, KeySlotFIDO2, KeySlotKeyfilePassword:
+		var err error
+		switch {
+		case s.ScryptObject != nil && s.Argon2idObject != nil:
+			return fmt.Errorf("key slot %q: can't have both ScryptObject and Argon2idObject", s.Name)
+		case s.ScryptObject != nil:
+			err = s.ScryptObject.validateParams()
+		case s.Argon2idObject != nil:
+			err = s.Argon2idObject.validateParams()
+		default:
+			return fmt.Errorf("key slot %q: ScryptObject is missing", s.Name)
+		}
+		if err != nil {
+			return fmt.Errorf("key slot %q: %v", s.Name, err)
+		}
+		if (s.Type == KeySlotFIDO2) != (s.FIDO2 != nil) {
+			return fmt.Errorf("key slot %q: FIDO2 parameters do not match type %q", s.Name, s.Type)
+		}
+		if s.Type == KeySlotKeyfilePassword && len(s.KeyfileSalt) < cryptocore.KeyLen {
+			return fmt.Errorf("key slot %q: KeyfileSalt too short", s.Name)
+		}
+	case KeySlotKeyfile:
+		if s.ScryptObject != nil || s.Argon2idObject != nil {
+			return fmt.Errorf("key slot %q: key file slots do not use a password hash", s.Name)
+		}
+		if len(s.KeyfileSalt) < cryptocore.KeyLen {
+			return fmt.Errorf("key slot %q: KeyfileSalt too short", s.Name)
+		}
+	default:
+		return fmt.Errorf("key slot %q: unknown type %q", s.Name, s.Type)
+	}
+	return nil
+}
+
+// deriveKEK derives the key encryption key for slot "s" from "secret".
+// For the keyfile+password type, "secret" is the key file and "password" the
+// password, otherwise "password" is ignored.
+func (s *KeySlot) deriveKEK(secret []byte, password []byte) ([]byte, error) {
+	if s.Type != KeySlotKeyfile && s.Type != KeySlotKeyfilePassword {
+		return s.passwordHash(secret), nil
+	}
+	if len(secret) < KeyfileMinLen {
+		return nil, fmt.Errorf("key file too short: %d bytes, need at least %d", len(secret), KeyfileMinLen)
+	}
+	ikm := secret
+	info := hkdfInfoKeyfile
+	if s.Type == KeySlotKeyfilePassword {
+		pwHash := s.passwordHash(password)
+		ikm = append(append([]byte{}, secret...), pwHash...)
+		info = hkdfInfoKeyfilePassword
+		defer func() {
+			for i := range ikm {
+				ikm[i] = 0
+			}
+			for i := range pwHash {
+				pwHash[i] = 0
+			}
+		}()
+	}
+	kek := make([]byte, cryptocore.KeyLen)
+	h := hkdf.New(sha256.New, ikm, s.KeyfileSalt, []byte(info))
+	if _, err := io.ReadFull(h, kek); err != nil {
+		return nil, err
+	}
+	return kek, nil
+}
+
+// passwordHash hashes "pw" using the password hash of slot "s".
+func (s *KeySlot) passwordHash(pw []byte) []byte {
+	if s.Argon2idObject != nil {
+		return s.Argon2idObject.DeriveKey(pw)
+	}
+	return s.ScryptObject.DeriveKey(pw)
+}
+
+// setPasswordKDF sets a new password hash with a random salt on slot "s".
+// Uses Argon2id if "argon2id" is not nil and scrypt with cost parameter
+// "logN" otherwise.
+func (s *KeySlot) setPasswordKDF(logN int, argon2id *Argon2idKDF) {
+	if argon2id != nil {
+		a := NewArgon2idKDF(argon2id.Memory, argon2id.Iterations, argon2id.Parallelism)
+		s.Argon2idObject = &a
+		s.ScryptObject = nil
+		return
+	}
+	scrypt := NewScryptKDF(logN)
+	s.ScryptObject = &scrypt
+	s.Argon2idObject = nil
+}
+
+// KeySlotSecret is the credential for a new key slot, see AddKeySlot.
+type KeySlotSecret struct {
+	// Name of the new key slot
+	Name string
+	// Type is one of KeySlotPassword, KeySlotFIDO2, KeySlotKeyfile,
+	// KeySlotKeyfilePassword
+	Type string
+	// Secret is the password, the FIDO2 hmac-secret or the key file contents
+	Secret []byte
+	// Password is the password for the keyfile+password type
+	Password []byte
+	// LogN is the scrypt cost parameter for the password and fido2 types
+	LogN int
+	// Argon2id, if not nil, selects Argon2id with these cost parameters
+	// instead of scrypt for the password and fido2 types
+	Argon2id *Argon2idKDF
+	// FIDO2 parameters for the fido2 type
+	FIDO2 *FIDO2Params
+}
+
+// AddKeySlot wraps "masterkey" using "ks" and appends the resulting key slot.
+// If the filesystem does not use key slots yet, the existing password or
+// FIDO2 credential is converted into a key slot named "default" first.
+func (cf *ConfFile) AddKeySlot(masterkey []byte, ks *KeySlotSecret) error {
+	if cf.IsFeatureFlagSet(FlagExternalKMS) {
+		return exitcodes.NewErr("Key slots are not supported on filesystems using an external KMS", exitcodes.Usage)
+	}
+	if !cf.IsFeatureFlagSet(FlagKeySlots) {
+		cf.convertToKeySlots()
+	}
+	if cf.KeySlotIndex(ks.Name) >= 0 {
+		return exitcodes.NewErr(fmt.Sprintf("Key slot %q already exists", ks.Name), exitcodes.Usage)
+	}
+	slot := KeySlot{
+		Name:  ks.Name,
+		Type:  ks.Type,
+		FIDO2: ks.FIDO2,
+	}
+	if ks.Type == KeySlotKeyfile || ks.Type == KeySlotKeyfilePassword {
+		slot.KeyfileSalt = cryptocore.RandBytes(cryptocore.KeyLen)
+	}
+	if ks.Type != KeySlotKeyfile {
+		slot.setPasswordKDF(ks.LogN, ks.Argon2id)
+	}
+	if err := slot.wrap(masterkey, ks.Secret, ks.Password, cf.IsFeatureFlagSet(FlagHKDF)); err != nil {
+		return err
+	}
+	if err := slot.validate(); err != nil {
+		return err
+	}
+	cf.KeySlots = append(cf.KeySlots, slot)
+	return nil
+}
+
+// wrap encrypts "masterkey" using the key derived from "secret" (and
+// "password") and stores it in s.EncryptedKey.
+func (s *KeySlot) wrap(masterkey []byte, secret []byte, password []byte, useHKDF bool) error {
+	kek, err := s.deriveKEK(secret, password)
+	if err != nil {
+		return exitcodes.NewErr(err.Error(), exitcodes.Usage)
+	}
+	ce := getKeyEncrypter(kek, useHKDF)
+	s.EncryptedKey, err = ce.EncryptBlock(masterkey, 0, nil)
+	for i := range kek {
+		kek[i] = 0
+	}
+	ce.Wipe()
+	return err
+}
+
+// RekeySlot replaces the credential of the existing key slot number "i".
+// Used for password changes. The password is hashed using Argon2id if
+// "argon2id" is not nil, and using scrypt with cost parameter "logN"
+// otherwise.
+func (cf *ConfFile) RekeySlot(i int, masterkey []byte, secret []byte, logN int, argon2id *Argon2idKDF) error {
+	s := &cf.KeySlots[i]
+	if s.Type == KeySlotKeyfilePassword {
+		return exitcodes.NewErr(fmt.Sprintf("Key slot %q needs a key file and a password and cannot be changed", s.Name),
+			exitcodes.Usage)
+	}
+	if s.Type == KeySlotKeyfile {
+		s.KeyfileSalt = cryptocore.RandBytes(cryptocore.KeyLen)
+	} else {
+		s.setPasswordKDF(logN, argon2id)
+	}
+	return s.wrap(masterkey, secret, nil, cf.IsFeatureFlagSet(FlagHKDF))
+}
+
+// RemoveKeySlot removes the key slot called "name". The last key slot cannot
+// be removed.
+func (cf *ConfFile) RemoveKeySlot(name string) error {
+	i := cf.KeySlotIndex(name)
+	if i < 0 {
+		return exitcodes.NewErr(fmt.Sprintf("Key slot %q does not exist", name), exitcodes.Usage)
+	}
+	if len(cf.KeySlots) == 1 {
+		return exitcodes.NewErr("Refusing to remove the last key slot", exitcodes.Usage)
+	}
+	cf.KeySlots = append(cf.KeySlots[:i], cf.KeySlots[i+1:]...)
+	return nil
+}
+
+// KeySlotIndex returns the index of the key slot called "name", or -1.
+func (cf *ConfFile) KeySlotIndex(name string) int {
+	for i := range cf.KeySlots {
+		if cf.KeySlots[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// DecryptMasterKeySlot decrypts the masterkey stored in key slot number "i"
+// using "secret".
+func (cf *ConfFile) DecryptMasterKeySlot(i int, secret []byte) (masterkey []byte, err error) {
+	return cf.decryptMasterKeySlot(i, secret, nil)
+}
+
+// DecryptMasterKeySlotPassword decrypts the masterkey stored in the
+// keyfile+password key slot number "i" using the key file contents
+// "keyfile" and "password".
+func (cf *ConfFile) DecryptMasterKeySlotPassword(i int, keyfile []byte, password []byte) (masterkey []byte, err error) {
+	return cf.decryptMasterKeySlot(i, keyfile, password)
+}
+
+func (cf *ConfFile) decryptMasterKeySlot(i int, secret []byte, password []byte) (masterkey []byte, err error) {
+	s := &cf.KeySlots[i]
+	kek, err := s.deriveKEK(secret, password)
+	if err != nil {
+		return nil, exitcodes.NewErr(err.Error(), exitcodes.PasswordIncorrect)
+	}
+	ce := getKeyEncrypter(kek, cf.IsFeatureFlagSet(FlagHKDF))
+	tlog.Warn.Enabled = false // Silence DecryptBlock() error messages on incorrect password
+	masterkey, err = ce.DecryptBlock(s.EncryptedKey, 0, nil)
+	tlog.Warn.Enabled = true
+	for i := range kek {
+		kek[i] = 0
+	}
+	ce.Wipe()
+	if err != nil {
+		return nil, exitcodes.NewErr("Password incorrect.", exitcodes.PasswordIncorrect)
+	}
+	return masterkey, nil
+}
+
+// DecryptMasterKeySlots tries all key slots of type "slotType" with "secret".
+// Returns the masterkey and the index of the key slot that matched.
+func (cf *ConfFile) DecryptMasterKeySlots(slotType string, secret []byte) (masterkey []byte, slot int, err error) {
+	err = exitcodes.NewErr(fmt.Sprintf("No key slot of type %q", slotType), exitcodes.PasswordIncorrect)
+	for i := range cf.KeySlots {
+		if cf.KeySlots[i].Type != slotType {
+			continue
+		}
+		masterkey, err = cf.DecryptMasterKeySlot(i, secret)
+		if err == nil {
+			return masterkey, i, nil
+		}
+	}
+	if slotType == KeySlotKeyfile {
+		err = exitcodes.NewErr("Key file incorrect.", exitcodes.PasswordIncorrect)
+	}
+	return nil, -1, err
+}
+
+// convertToKeySlots moves the password or FIDO2 credential stored in the
+// top-level fields into a key slot called "default".
+func (cf *ConfFile) convertToKeySlots() {
+	scrypt := cf.ScryptObject
+	slot := KeySlot{
+		Name:         "default",
+		Type:         KeySlotPassword,
+		EncryptedKey: cf.EncryptedKey,
+		ScryptObject: &scrypt,
+	}
+	if cf.IsFeatureFlagSet(FlagArgon2id) {
+		slot.ScryptObject = nil
+		slot.Argon2idObject = cf.Argon2idObject
+		cf.clearFeatureFlag(FlagArgon2id)
+		cf.Argon2idObject = nil
+	}
+	if cf.IsFeatureFlagSet(FlagFIDO2) {
+		slot.Type = KeySlotFIDO2
+		slot.FIDO2 = cf.FIDO2
+		cf.clearFeatureFlag(FlagFIDO2)
+		cf.FIDO2 = nil
+	}
+	cf.EncryptedKey = nil
+	cf.ScryptObject = ScryptKDF{}
+	cf.KeySlots = []KeySlot{slot}
+	cf.setFeatureFlag(FlagKeySlots)
+}
@@ -0,0 +1,135 @@
+package configfile
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeySlots(t *testing.T) {
+	masterkey := bytes.Repeat([]byte{0x11}, 32)
+	err := Create(&CreateArgs{
+		Filename:  "config_test/tmp.conf",
+		Password:  testPw,
+		LogN:      10,
+		Creator:   "test",
+		Masterkey: append([]byte{}, masterkey...),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := Load("config_test/tmp.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyfile := bytes.Repeat([]byte{0x22}, 64)
+	err = cf.AddKeySlot(masterkey, &KeySlotSecret{Name: "backup", Type: KeySlotKeyfile, Secret: keyfile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cf.AddKeySlot(masterkey, &KeySlotSecret{Name: "alice", Type: KeySlotPassword, Secret: []byte("alice"), LogN: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(FlagKeySlots) || len(cf.KeySlots) != 3 || cf.KeySlots[0].Name != "default" {
+		t.Fatalf("unexpected key slots: %#v", cf.KeySlots)
+	}
+	// Duplicate names are rejected
+	if err = cf.AddKeySlot(masterkey, &KeySlotSecret{Name: "alice", Type: KeySlotKeyfile, Secret: keyfile}); err == nil {
+		t.Error("adding a duplicate key slot should have failed")
+	}
+	if err = cf.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	// Every credential unlocks the same masterkey
+	key, cf, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil || !bytes.Equal(key, masterkey) {
+		t.Fatalf("default password: err=%v key=%x", err, key)
+	}
+	key, err = cf.DecryptMasterKey([]byte("alice"))
+	if err != nil || !bytes.Equal(key, masterkey) {
+		t.Fatalf("alice password: err=%v key=%x", err, key)
+	}
+	key, slot, err := cf.DecryptMasterKeySlots(KeySlotKeyfile, keyfile)
+	if err != nil || !bytes.Equal(key, masterkey) || slot != 1 {
+		t.Fatalf("keyfile: err=%v key=%x slot=%d", err, key, slot)
+	}
+	if _, _, err = cf.DecryptMasterKeySlots(KeySlotKeyfile, bytes.Repeat([]byte{0x23}, 64)); err == nil {
+		t.Error("wrong keyfile should fail")
+	}
+	// Revoke alice
+	if err = cf.RemoveKeySlot("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cf.DecryptMasterKey([]byte("alice")); err == nil {
+		t.Error("removed key slot still unlocks")
+	}
+	if err = cf.RemoveKeySlot("default"); err != nil {
+		t.Fatal(err)
+	}
+	if err = cf.RemoveKeySlot("backup"); err == nil {
+		t.Error("removing the last key slot should fail")
+	}
+}
+
+func TestKeySlotsValidate(t *testing.T) {
+	cf := ConfFile{Version: 2}
+	cf.setFeatureFlag(FlagGCMIV128)
+	cf.setFeatureFlag(FlagKeySlots)
+	if err := cf.Validate(); err == nil {
+		t.Error("KeySlots flag without key slots should fail")
+	}
+	cf.KeySlots = []KeySlot{{Name: "x", Type: "bogus", EncryptedKey: []byte{1}}}
+	if err := cf.Validate(); err == nil {
+		t.Error("unknown key slot type should fail")
+	}
+}
+
+// A filesystem created with a key file and a password needs both
+func TestCreateConfKeyfilePassword(t *testing.T) {
+	keyfile := bytes.Repeat([]byte{0x33}, 64)
+	err := Create(&CreateArgs{
+		Filename: "config_test/tmp.conf",
+		Password: testPw,
+		LogN:     10,
+		Creator:  "test",
+		Keyfile:  keyfile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := Load("config_test/tmp.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cf.KeySlots) != 1 || cf.KeySlots[0].Type != KeySlotKeyfilePassword {
+		t.Fatalf("unexpected key slots: %#v", cf.KeySlots)
+	}
+	if _, err = cf.DecryptMasterKeySlotPassword(0, keyfile, testPw); err != nil {
+		t.Error(err)
+	}
+	if _, err = cf.DecryptMasterKeySlotPassword(0, keyfile, []byte("wrong")); err == nil {
+		t.Error("wrong password was accepted")
+	}
+	if _, err = cf.DecryptMasterKeySlotPassword(0, bytes.Repeat([]byte{0x34}, 64), testPw); err == nil {
+		t.Error("wrong key file was accepted")
+	}
+	if _, err = cf.DecryptMasterKey(testPw); err == nil {
+		t.Error("password alone was accepted")
+	}
+	// Without a password, we get a plain key file slot
+	err = Create(&CreateArgs{
+		Filename: "config_test/tmp.conf",
+		Creator:  "test",
+		Keyfile:  keyfile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err = Load("config_test/tmp.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = cf.DecryptMasterKeySlots(KeySlotKeyfile, keyfile); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,178 @@
+package configfile
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// KMSTokenEnv is the environment variable that may hold a bearer token
+// that is sent to the key management service with every request. The token
+// is deliberately not stored in gocryptfs.conf.
+const KMSTokenEnv = "GOCRYPTFS_KMS_TOKEN"
+
+// kmsTimeout limits how long we wait for the key management service.
+const kmsTimeout = 30 * time.Second
+
+// KMSParams is a structure for storing the parameters of the external key
+// management service that wraps the master key.
+type KMSParams struct {
+	// Endpoint is the URL of the key management service. Supported are
+	// "http://", "https://" and "unix:" (HTTP over a Unix socket) URLs.
+	Endpoint string
+	// KeyID identifies the key encryption key inside the key management
+	// service. It is passed to the service verbatim.
+	KeyID string
+}
+
+// KeyProvider wraps and unwraps the master key using a key that never leaves
+// an external key manager.
+type KeyProvider interface {
+	// Wrap encrypts "plaintext" and returns an opaque ciphertext.
+	Wrap(plaintext []byte) (ciphertext []byte, err error)
+	// Unwrap decrypts a ciphertext previously returned by Wrap.
+	Unwrap(ciphertext []byte) (plaintext []byte, err error)
+}
+
+// kmsRequest is the JSON request sent to the "/wrap" and "/unwrap" endpoints.
+// []byte values are base64-encoded by encoding/json.
+type kmsRequest struct {
+	KeyID      string
+	Plaintext  []byte `json:",omitempty"`
+	Ciphertext []byte `json:",omitempty"`
+}
+
+// kmsResponse is the JSON response we expect from the key management service.
+type kmsResponse struct {
+	Plaintext  []byte `json:",omitempty"`
+	Ciphertext []byte `json:",omitempty"`
+	Error      string `json:",omitempty"`
+}
+
+// httpKeyProvider talks to the key management service using a simple
+// JSON-over-HTTP protocol:
+//
+//	POST <endpoint>/wrap   {"KeyID": "...", "Plaintext": "<base64>"}  -> {"Ciphertext": "<base64>"}
+//	POST <endpoint>/unwrap {"KeyID": "...", "Ciphertext": "<base64>"} -> {"Plaintext": "<base64>"}
+//
+// KMIP servers can be used through a gateway that speaks this protocol.
+type httpKeyProvider struct {
+	params  KMSParams
+	baseURL string
+	client  *http.Client
+	token   string
+}
+
+// NewKeyProvider returns the KeyProvider for the key management service
+// described by "p".
+func NewKeyProvider(p *KMSParams) (KeyProvider, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	kp := &httpKeyProvider{
+		params: *p,
+		client: &http.Client{Timeout: kmsTimeout},
+		token:  os.Getenv(KMSTokenEnv),
+	}
+	if strings.HasPrefix(p.Endpoint, "unix:") {
+		sock := strings.TrimPrefix(p.Endpoint, "unix:")
+		// Accept both "unix:/run/kms.sock" and "unix:///run/kms.sock"
+		sock = "/" + strings.TrimLeft(sock, "/")
+		kp.client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sock)
+			},
+		}
+		// The host part is ignored by the custom dialer
+		kp.baseURL = "http://kms"
+	} else {
+		kp.baseURL = strings.TrimRight(p.Endpoint, "/")
+	}
+	return kp, nil
+}
+
+// Wrap implements KeyProvider.
+func (kp *httpKeyProvider) Wrap(plaintext []byte) ([]byte, error) {
+	resp, err := kp.call("wrap", kmsRequest{KeyID: kp.params.KeyID, Plaintext: plaintext})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Ciphertext) == 0 {
+		return nil, fmt.Errorf("kms: wrap: empty ciphertext in response")
+	}
+	return resp.Ciphertext, nil
+}
+
+// Unwrap implements KeyProvider.
+func (kp *httpKeyProvider) Unwrap(ciphertext []byte) ([]byte, error) {
+	resp, err := kp.call("unwrap", kmsRequest{KeyID: kp.params.KeyID, Ciphertext: ciphertext})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Plaintext) == 0 {
+		return nil, fmt.Errorf("kms: unwrap: empty plaintext in response")
+	}
+	return resp.Plaintext, nil
+}
+
+// call sends "req" to the "op" endpoint and parses the response.
+func (kp *httpKeyProvider) call(op string, req kmsRequest) (*kmsResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	hreq, err := http.NewRequest(http.MethodPost, kp.baseURL+"/"+op, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	if kp.token != "" {
+		hreq.Header.Set("Authorization", "Bearer "+kp.token)
+	}
+	hresp, err := kp.client.Do(hreq)
+	if err != nil {
+		return nil, fmt.Errorf("kms: %s: %v", op, err)
+	}
+	defer hresp.Body.Close()
+	// Responses only contain a key, anything bigger is bogus
+	js, err := ioutil.ReadAll(io.LimitReader(hresp.Body, 64*1024))
+	if err != nil {
+		return nil, fmt.Errorf("kms: %s: %v", op, err)
+	}
+	var resp kmsResponse
+	if err := json.Unmarshal(js, &resp); err != nil {
+		return nil, fmt.Errorf("kms: %s: HTTP %d, invalid response: %v", op, hresp.StatusCode, err)
+	}
+	if hresp.StatusCode != http.StatusOK || resp.Error != "" {
+		return nil, fmt.Errorf("kms: %s: HTTP %d: %s", op, hresp.StatusCode, resp.Error)
+	}
+	return &resp, nil
+}
+
+// validate checks that the parameters are complete.
+func (p *KMSParams) validate() error {
+	if p == nil {
+		return fmt.Errorf("ExternalKMS feature flag is set but KMS parameters are missing")
+	}
+	if p.KeyID == "" {
+		return fmt.Errorf("KMS KeyID is empty")
+	}
+	switch {
+	case strings.HasPrefix(p.Endpoint, "http://"),
+		strings.HasPrefix(p.Endpoint, "https://"),
+		strings.HasPrefix(p.Endpoint, "unix:"):
+		return nil
+	case p.Endpoint == "":
+		return fmt.Errorf("KMS Endpoint is empty")
+	}
+	return fmt.Errorf("KMS Endpoint %q: unsupported scheme (want http://, https:// or unix:)", p.Endpoint)
+}
@@ -0,0 +1,98 @@
+package configfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// xorKMS is a trivial stand-in for a key management service
+func xorKMS(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req kmsRequest
+		var resp kmsResponse
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		if req.KeyID != "k1" {
+			w.WriteHeader(http.StatusNotFound)
+			resp.Error = "unknown key"
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+		switch r.URL.Path {
+		case "/wrap":
+			for _, b := range req.Plaintext {
+				resp.Ciphertext = append(resp.Ciphertext, b^0x55)
+			}
+		case "/unwrap":
+			for _, b := range req.Ciphertext {
+				resp.Plaintext = append(resp.Plaintext, b^0x55)
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+}
+
+func TestCreateConfKMS(t *testing.T) {
+	srv := xorKMS(t)
+	defer srv.Close()
+	masterkey := bytes.Repeat([]byte{0xaa}, 32)
+	err := Create(&CreateArgs{
+		Filename:  "config_test/tmp.conf",
+		Creator:   "test",
+		Masterkey: append([]byte{}, masterkey...),
+		KMS:       &KMSParams{Endpoint: srv.URL, KeyID: "k1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := Load("config_test/tmp.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(FlagExternalKMS) {
+		t.Error("ExternalKMS flag should be set")
+	}
+	kp, err := NewKeyProvider(cf.KMS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := cf.DecryptMasterKeyKMS(kp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, masterkey) {
+		t.Errorf("wrong masterkey: %x", key)
+	}
+	// Unknown key ID must fail
+	kp, _ = NewKeyProvider(&KMSParams{Endpoint: srv.URL, KeyID: "k2"})
+	if _, err = cf.DecryptMasterKeyKMS(kp); err == nil {
+		t.Error("unwrapping with unknown key ID should have failed")
+	}
+}
+
+func TestKMSParamsValidate(t *testing.T) {
+	good := []KMSParams{
+		{Endpoint: "http://127.0.0.1:1234", KeyID: "x"},
+		{Endpoint: "https://kms.example.com/v1/", KeyID: "x"},
+		{Endpoint: "unix:///run/kms.sock", KeyID: "x"},
+	}
+	for _, p := range good {
+		if err := p.validate(); err != nil {
+			t.Errorf("%#v: %v", p, err)
+		}
+	}
+	bad := []KMSParams{
+		{Endpoint: "http://127.0.0.1:1234"},
+		{KeyID: "x"},
+		{Endpoint: "ftp://foo", KeyID: "x"},
+	}
+	for _, p := range bad {
+		if err := p.validate(); err == nil {
+			t.Errorf("%#v: should have failed validation", p)
+		}
+	}
+}
@@ -11,9 +11,66 @@ func (cf *ConfFile) Validate() error {
 	if cf.Version != contentenc.CurrentVersion {
 		return fmt.Errorf("Unsupported on-disk format %d", cf.Version)
 	}
-	// scrypt params ok?
-	if err := cf.ScryptObject.validateParams(); err != nil {
-		return err
+	// Key wrapping
+	if cf.IsFeatureFlagSet(FlagKeySlots) {
+		if err := cf.validateKeySlots(); err != nil {
+			return err
+		}
+	} else if len(cf.KeySlots) > 0 {
+		return fmt.Errorf("Key slots present but the KeySlots feature flag is NOT set")
+	} else if cf.IsFeatureFlagSet(FlagExternalKMS) {
+		// The master key is wrapped by the KMS, scrypt is not used
+		if err := cf.KMS.validate(); err != nil {
+			return err
+		}
+		if cf.IsFeatureFlagSet(FlagFIDO2) {
+			return fmt.Errorf("Can't have both ExternalKMS and FIDO2 feature flags")
+		}
+		if cf.IsFeatureFlagSet(FlagArgon2id) {
+			return fmt.Errorf("Can't have both ExternalKMS and Argon2id feature flags")
+		}
+	} else {
+		if cf.KMS != nil {
+			return fmt.Errorf("KMS parameters present but the ExternalKMS feature flag is NOT set")
+		}
+		if cf.IsFeatureFlagSet(FlagArgon2id) {
+			if cf.Argon2idObject == nil {
+				return fmt.Errorf("Argon2id feature flag is set but Argon2idObject is missing")
+			}
+			// argon2id params ok?
+			if err := cf.Argon2idObject.validateParams(); err != nil {
+				return err
+			}
+		} else {
+			// scrypt params ok?
+			if err := cf.ScryptObject.validateParams(); err != nil {
+				return err
+			}
+		}
+	}
+	if cf.Argon2idObject != nil && !cf.IsFeatureFlagSet(FlagArgon2id) {
+		return fmt.Errorf("Argon2idObject present but the Argon2id feature flag is NOT set")
+	}
+	// Key epochs
+	if cf.IsFeatureFlagSet(FlagKeyEpochs) {
+		if err := cf.validateKeyEpochs(); err != nil {
+			return err
+		}
+	} else if len(cf.KeyEpochs) > 0 || cf.RetiredKeyEpoch != 0 {
+		return fmt.Errorf("Key epochs present but the KeyEpochs feature flag is NOT set")
+	}
+	// Write authentication
+	if cf.IsFeatureFlagSet(FlagWriteAuth) {
+		if err := cf.WriteAuth.validate(); err != nil {
+			return err
+		}
+		if cf.IsFeatureFlagSet(FlagKeyEpochs) {
+			// The content keys of key epochs are encrypted using the master
+			// key, which readers do not have
+			return fmt.Errorf("WriteAuth conflicts with KeyEpochs feature flag")
+		}
+	} else if cf.WriteAuth != nil {
+		return fmt.Errorf("WriteAuth parameters present but the WriteAuth feature flag is NOT set")
 	}
 	// All feature flags that are in the config file are known?
 	for _, flag := range cf.FeatureFlags {
@@ -30,6 +87,20 @@ func (cf *ConfFile) Validate() error {
 
 			return fmt.Errorf("AESSIV requires GCMIV128 feature flag")
 		}
+		if cf.IsFeatureFlagSet(FlagAESGCMSIV) {
+			if cf.IsFeatureFlagSet(FlagAESSIV) {
+				return fmt.Errorf("Can't have both AESGCMSIV and AESSIV feature flags")
+			}
+			if cf.IsFeatureFlagSet(FlagXChaCha20Poly1305) {
+				return fmt.Errorf("Can't have both AESGCMSIV and XChaCha20Poly1305 feature flags")
+			}
+			if !cf.IsFeatureFlagSet(FlagGCMIV128) {
+				return fmt.Errorf("AESGCMSIV requires GCMIV128 feature flag")
+			}
+			if !cf.IsFeatureFlagSet(FlagHKDF) {
+				return fmt.Errorf("AESGCMSIV requires HKDF feature flag")
+			}
+		}
 		if cf.IsFeatureFlagSet(FlagXChaCha20Poly1305) {
 			if cf.IsFeatureFlagSet(FlagGCMIV128) {
 				return fmt.Errorf("XChaCha20Poly1305 conflicts with GCMIV128 feature flag")
@@ -45,6 +116,30 @@ func (cf *ConfFile) Validate() error {
 			}
 		}
 	}
+	// Block size
+	if cf.IsFeatureFlagSet(FlagBlockSize) {
+		if !contentenc.ValidBlockSize(uint64(cf.BlockSize)) {
+			return fmt.Errorf("BlockSize=%d is not a power of two between %d and %d",
+				cf.BlockSize, contentenc.MinBS, contentenc.MaxBS)
+		}
+	} else if cf.BlockSize != 0 {
+		return fmt.Errorf("BlockSize=%d but the BlockSize feature flag is NOT set", cf.BlockSize)
+	}
+	// Compression
+	if cf.IsFeatureFlagSet(FlagCompression) {
+		if cf.Compression != contentenc.CompressionLZ4 {
+			return fmt.Errorf("Unsupported compression algorithm %q", cf.Compression)
+		}
+		if !cf.IsFeatureFlagSet(FlagAESSIV) && !cf.IsFeatureFlagSet(FlagAESGCMSIV) {
+			// Compressed files are only created by reverse mode
+			return fmt.Errorf("Compression requires AESSIV or AESGCMSIV feature flag")
+		}
+		if cf.IsFeatureFlagSet(FlagKeyEpochs) || cf.IsFeatureFlagSet(FlagWriteAuth) {
+			return fmt.Errorf("Compression conflicts with KeyEpochs and WriteAuth feature flags")
+		}
+	} else if cf.Compression != "" {
+		return fmt.Errorf("Compression=%q but the Compression feature flag is NOT set", cf.Compression)
+	}
 	// Filename encryption
 	{
 		if cf.IsFeatureFlagSet(FlagPlaintextNames) {
@@ -76,3 +171,36 @@ func (cf *ConfFile) Validate() error {
 	}
 	return nil
 }
+
+// validateKeySlots checks the key slots of a filesystem that has the KeySlots
+// feature flag set.
+func (cf *ConfFile) validateKeySlots() error {
+	if cf.IsFeatureFlagSet(FlagExternalKMS) {
+		return fmt.Errorf("Can't have both KeySlots and ExternalKMS feature flags")
+	}
+	if cf.IsFeatureFlagSet(FlagFIDO2) {
+		return fmt.Errorf("KeySlots conflicts with FIDO2 feature flag")
+	}
+	if cf.IsFeatureFlagSet(FlagArgon2id) {
+		// Every key slot has its own password hash parameters
+		return fmt.Errorf("KeySlots conflicts with Argon2id feature flag")
+	}
+	if len(cf.EncryptedKey) > 0 || cf.FIDO2 != nil || cf.KMS != nil || cf.Argon2idObject != nil {
+		return fmt.Errorf("KeySlots feature flag is set but top-level key fields are present")
+	}
+	if len(cf.KeySlots) == 0 {
+		return fmt.Errorf("KeySlots feature flag is set but there are no key slots")
+	}
+	names := make(map[string]bool)
+	for i := range cf.KeySlots {
+		s := &cf.KeySlots[i]
+		if err := s.validate(); err != nil {
+			return err
+		}
+		if names[s.Name] {
+			return fmt.Errorf("Duplicate key slot name %q", s.Name)
+		}
+		names[s.Name] = true
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package configfile
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+)
+
+// WriteAuthParams is stored in the config file when the WriteAuth feature
+// flag is set. File content blocks are then signed using an Ed25519 key that
+// is derived from the master key, and the content and file name keys are
+// derived from the reader key (see cryptocore.DeriveWriteAuthKeys).
+type WriteAuthParams struct {
+	// PublicKey verifies the block signatures
+	PublicKey []byte
+}
+
+// validate checks that the public key has the right length.
+func (p *WriteAuthParams) validate() error {
+	if p == nil {
+		return fmt.Errorf("WriteAuth feature flag is set but WriteAuth parameters are missing")
+	}
+	if len(p.PublicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("WriteAuth: public key has %d bytes, want %d", len(p.PublicKey), ed25519.PublicKeySize)
+	}
+	return nil
+}
+
+// enableWriteAuth sets the WriteAuth feature flag and stores the public key
+// belonging to "masterkey".
+func (cf *ConfFile) enableWriteAuth(masterkey []byte) {
+	readerKey, signingKey := cryptocore.DeriveWriteAuthKeys(masterkey)
+	cf.WriteAuth = &WriteAuthParams{
+		PublicKey: signingKey.Public().(ed25519.PublicKey),
+	}
+	wipeBytes(readerKey)
+	wipeBytes(signingKey)
+	cf.setFeatureFlag(FlagWriteAuth)
+}
+
+// WriteAuthKeys derives the reader key and the signing key from "masterkey".
+// The reader key must be used in place of the master key for file content and
+// file name encryption. Returns an error if the signing key does not belong
+// to the public key in the config file, which means that "masterkey" is
+// wrong.
+func (cf *ConfFile) WriteAuthKeys(masterkey []byte) (readerKey []byte, wa *contentenc.WriteAuth, err error) {
+	readerKey, signingKey := cryptocore.DeriveWriteAuthKeys(masterkey)
+	pub := signingKey.Public().(ed25519.PublicKey)
+	if !bytes.Equal(pub, cf.WriteAuth.PublicKey) {
+		wipeBytes(readerKey)
+		wipeBytes(signingKey)
+		return nil, nil, exitcodes.NewErr("The master key does not match the write authentication public key",
+			exitcodes.PasswordIncorrect)
+	}
+	wa = &contentenc.WriteAuth{
+		PublicKey:  pub,
+		PrivateKey: signingKey,
+	}
+	return readerKey, wa, nil
+}
+
+// ReaderWriteAuth returns the WriteAuth for a filesystem that was unlocked
+// using the reader key. It can only verify signatures.
+func (cf *ConfFile) ReaderWriteAuth() *contentenc.WriteAuth {
+	return &contentenc.WriteAuth{
+		PublicKey: ed25519.PublicKey(cf.WriteAuth.PublicKey),
+	}
+}
+
+func wipeBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,50 @@
+package configfile
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteAuth(t *testing.T) {
+	masterkey := bytes.Repeat([]byte{0x11}, 32)
+	err := Create(&CreateArgs{
+		Filename:  "config_test/tmp.conf",
+		Password:  testPw,
+		LogN:      10,
+		Creator:   "test",
+		Masterkey: append([]byte{}, masterkey...),
+		WriteAuth: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cf, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(FlagWriteAuth) || cf.WriteAuth == nil {
+		t.Fatal("WriteAuth is not set")
+	}
+	readerKey, wa, err := cf.WriteAuthKeys(masterkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(readerKey) != 32 || bytes.Equal(readerKey, masterkey) {
+		t.Errorf("bad reader key %x", readerKey)
+	}
+	if !bytes.Equal(wa.PublicKey, cf.ReaderWriteAuth().PublicKey) || wa.PrivateKey == nil {
+		t.Error("WriteAuthKeys and ReaderWriteAuth disagree")
+	}
+	if cf.ReaderWriteAuth().PrivateKey != nil {
+		t.Error("ReaderWriteAuth must not have the signing key")
+	}
+	// The wrong master key is rejected
+	if _, _, err = cf.WriteAuthKeys(bytes.Repeat([]byte{0x22}, 32)); err == nil {
+		t.Error("the wrong master key should be rejected")
+	}
+	// The reader key cannot decrypt the key epochs
+	cf.AddKeyEpoch(masterkey)
+	if err = cf.Validate(); err == nil {
+		t.Error("WriteAuth and KeyEpochs should conflict")
+	}
+}
@@ -11,8 +11,8 @@ type bPool struct {
 	sliceLen int
 }
 
-func newBPool(sliceLen int) bPool {
-	return bPool{
+func newBPool(sliceLen int) *bPool {
+	return &bPool{
 		Pool: sync.Pool{
 			New: func() interface{} { return make([]byte, sliceLen) },
 		},
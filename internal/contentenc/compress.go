@@ -0,0 +1,257 @@
+package contentenc
+
+// Compressed files
+//
+// On filesystems with the Compression feature flag, reverse mode presents
+// files in a compressed format that has a version 4 header, followed by a
+// block index and the variable-length blocks:
+//
+// Format: [ header ] [ "PlainSize" uint64 big endian ] [ ciphertext block length, uint32 big endian ]... [ blocks ]
+//
+// There is one block length per plaintext block, ceil(PlainSize / plainBS) in
+// total. Each block is the encryption of
+//
+// [ compression method byte ] [ data ]
+//
+// using the block number and file ID as associated data, like in
+// uncompressed files. The compression method is authenticated as part of
+// the block. The index is not encrypted, like the size of uncompressed files
+// is not hidden either. Decryption fails for a block whose length has been
+// tampered with, and the length of the decompressed data is checked against
+// PlainSize.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/lz4"
+	"github.com/rfjakob/gocryptfs/v2/internal/metrics"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+const (
+	// CompressionLZ4 is the name of the LZ4 compression algorithm as stored
+	// in gocryptfs.conf
+	CompressionLZ4 = "lz4"
+
+	// Compression method of a block, stored as the first plaintext byte
+	methodNone = 0
+	methodLZ4  = 1
+
+	indexPlainSizeLen = 8 // uint64
+	indexEntryLen     = 4 // uint32
+)
+
+// BlockIndex describes the layout of a compressed file.
+type BlockIndex struct {
+	// PlainSize is the plaintext size of the file
+	PlainSize uint64
+	// CipherLen holds the ciphertext length of each block
+	CipherLen []uint32
+	// off[i] is the ciphertext offset of block i, and off[len(CipherLen)] is
+	// the ciphertext size of the file
+	off []uint64
+}
+
+// BlockCount returns the number of blocks of a file with "plainSize" bytes
+// of plaintext.
+func (be *ContentEnc) BlockCount(plainSize uint64) uint64 {
+	return (plainSize + be.plainBS - 1) / be.plainBS
+}
+
+// indexLen returns the length of the block index of a file with "plainSize"
+// bytes of plaintext.
+func (be *ContentEnc) indexLen(plainSize uint64) uint64 {
+	return indexPlainSizeLen + be.BlockCount(plainSize)*indexEntryLen
+}
+
+// NewBlockIndex creates a BlockIndex for the given block lengths.
+func (be *ContentEnc) NewBlockIndex(plainSize uint64, cipherLen []uint32) *BlockIndex {
+	if uint64(len(cipherLen)) != be.BlockCount(plainSize) {
+		log.Panicf("BUG: %d block lengths for plainSize=%d", len(cipherLen), plainSize)
+	}
+	bi := &BlockIndex{
+		PlainSize: plainSize,
+		CipherLen: cipherLen,
+		off:       make([]uint64, len(cipherLen)+1),
+	}
+	bi.off[0] = HeaderLen + be.indexLen(plainSize)
+	for i, l := range cipherLen {
+		bi.off[i+1] = bi.off[i] + uint64(l)
+	}
+	return bi
+}
+
+// Pack serializes the index (without the file header).
+func (bi *BlockIndex) Pack() []byte {
+	buf := make([]byte, indexPlainSizeLen+len(bi.CipherLen)*indexEntryLen)
+	binary.BigEndian.PutUint64(buf, bi.PlainSize)
+	for i, l := range bi.CipherLen {
+		binary.BigEndian.PutUint32(buf[indexPlainSizeLen+i*indexEntryLen:], l)
+	}
+	return buf
+}
+
+// CipherSize returns the total ciphertext size of the file, including the
+// header and the index. Empty files stay empty.
+func (bi *BlockIndex) CipherSize() uint64 {
+	if bi.PlainSize == 0 {
+		return 0
+	}
+	return bi.off[len(bi.CipherLen)]
+}
+
+// BlockCipherOff returns the ciphertext offset of block "blockNo".
+func (bi *BlockIndex) BlockCipherOff(blockNo uint64) uint64 {
+	return bi.off[blockNo]
+}
+
+// CipherOffToBlockNo returns the block that contains ciphertext offset
+// "off", which must be behind the index.
+func (bi *BlockIndex) CipherOffToBlockNo(off uint64) uint64 {
+	// Binary search for the last block that starts at or before "off"
+	lo, hi := 0, len(bi.CipherLen)
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		if bi.off[mid] <= off {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return uint64(lo)
+}
+
+// ReadBlockIndex reads the block index of the compressed file "r", which
+// has a ciphertext size of "cipherSize".
+func (be *ContentEnc) ReadBlockIndex(r io.ReaderAt, cipherSize uint64) (*BlockIndex, error) {
+	buf := make([]byte, indexPlainSizeLen)
+	if _, err := r.ReadAt(buf, HeaderLen); err != nil {
+		return nil, fmt.Errorf("ReadBlockIndex: %w", err)
+	}
+	plainSize := binary.BigEndian.Uint64(buf)
+	// Check against the file size before allocating anything
+	if plainSize == 0 || plainSize > math.MaxInt64 || HeaderLen+be.indexLen(plainSize) > cipherSize {
+		return nil, fmt.Errorf("ReadBlockIndex: invalid plainSize=%d for cipherSize=%d", plainSize, cipherSize)
+	}
+	buf = make([]byte, be.BlockCount(plainSize)*indexEntryLen)
+	if _, err := r.ReadAt(buf, HeaderLen+indexPlainSizeLen); err != nil {
+		return nil, fmt.Errorf("ReadBlockIndex: %w", err)
+	}
+	cipherLen := make([]uint32, len(buf)/indexEntryLen)
+	for i := range cipherLen {
+		cipherLen[i] = binary.BigEndian.Uint32(buf[i*indexEntryLen:])
+		if uint64(cipherLen[i]) > be.cipherBS+1 {
+			return nil, fmt.Errorf("ReadBlockIndex: block %d: invalid length %d", i, cipherLen[i])
+		}
+	}
+	bi := be.NewBlockIndex(plainSize, cipherLen)
+	if bi.CipherSize() != cipherSize {
+		return nil, fmt.Errorf("ReadBlockIndex: index describes %d bytes, but the file has %d",
+			bi.CipherSize(), cipherSize)
+	}
+	return bi, nil
+}
+
+// CompressedPlainSize returns the plaintext size stored in the index of "r",
+// or ok=false if "r" is not a compressed file.
+func CompressedPlainSize(r io.ReaderAt) (plainSize uint64, ok bool) {
+	buf := make([]byte, HeaderLen+indexPlainSizeLen)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return 0, false
+	}
+	h, err := ParseHeader(buf[:HeaderLen])
+	if err != nil || h.Version != CompressedVersion {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(buf[HeaderLen:]), true
+}
+
+// BlockPlainLen returns the plaintext length of block "blockNo" in a file
+// of "plainSize" bytes.
+func (be *ContentEnc) BlockPlainLen(plainSize uint64, blockNo uint64) uint64 {
+	return MinUint64(be.plainBS, plainSize-blockNo*be.plainBS)
+}
+
+// compressPayload returns the compression method byte and the compressed
+// data. If compression does not save space, the data is stored as-is.
+func compressPayload(plaintext []byte) []byte {
+	out := make([]byte, 1, 1+lz4.CompressBound(len(plaintext)))
+	out[0] = methodLZ4
+	out = lz4.Compress(out, plaintext)
+	if len(out) > len(plaintext) {
+		out = append(out[:0], methodNone)
+		out = append(out, plaintext...)
+	}
+	return out
+}
+
+// CompressedBlockLen returns the ciphertext length of "plaintext" stored in
+// a compressed file.
+func (be *ContentEnc) CompressedBlockLen(plaintext []byte) uint32 {
+	return uint32(len(compressPayload(plaintext))) + uint32(be.BlockOverhead())
+}
+
+// EncryptCompressedBlock compresses and encrypts "plaintext" for a
+// compressed file using the nonce chosen by the caller. This function can
+// only be used in AES-SIV and AES-GCM-SIV mode.
+func (be *ContentEnc) EncryptCompressedBlock(plaintext []byte, blockNo uint64, fileID []byte, nonce []byte) []byte {
+	if !be.cryptoCore.AEADBackend.MisuseResistant() {
+		log.Panic("deterministic nonces are only secure in SIV mode")
+	}
+	if be.writeAuth != nil {
+		log.Panic("BUG: compressed files cannot be signed")
+	}
+	if len(nonce) != be.cryptoCore.IVLen {
+		log.Panic("wrong nonce length")
+	}
+	payload := compressPayload(plaintext)
+	metrics.BlocksEncrypted.Inc()
+	out := make([]byte, len(nonce), len(payload)+int(be.BlockOverhead()))
+	copy(out, nonce)
+	return be.cryptoCore.AEADCipher.Seal(out, nonce, payload, concatAD(blockNo, fileID))
+}
+
+// DecryptCompressedBlock decrypts and decompresses a block of a compressed
+// file. "plainLen" is the expected plaintext length (see BlockPlainLen).
+func (be *ContentEnc) DecryptCompressedBlock(ciphertext []byte, blockNo uint64, fileID []byte, plainLen uint64) ([]byte, error) {
+	if len(ciphertext) < int(be.BlockOverhead())+1 {
+		return nil, errors.New("Block is too short")
+	}
+	nonce := ciphertext[:be.cryptoCore.IVLen]
+	if bytes.Equal(nonce, be.allZeroNonce) {
+		return nil, errors.New("all-zero nonce")
+	}
+	payload, err := be.cryptoCore.AEADCipher.Open(nil, nonce, ciphertext[be.cryptoCore.IVLen:], concatAD(blockNo, fileID))
+	if err != nil {
+		metrics.AuthFailures.Inc()
+		tlog.Debug.Printf("DecryptCompressedBlock: %s, len=%d", err.Error(), len(ciphertext))
+		return nil, err
+	}
+	metrics.BlocksDecrypted.Inc()
+	data := payload[1:]
+	switch payload[0] {
+	case methodNone:
+		if uint64(len(data)) != plainLen {
+			return nil, fmt.Errorf("block has %d bytes, want %d", len(data), plainLen)
+		}
+		return data, nil
+	case methodLZ4:
+		out := make([]byte, plainLen)
+		n, err := lz4.Decompress(out, data)
+		if err != nil {
+			return nil, err
+		}
+		if uint64(n) != plainLen {
+			return nil, fmt.Errorf("block decompressed to %d bytes, want %d", n, plainLen)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unknown compression method %d", payload[0])
+	}
+}
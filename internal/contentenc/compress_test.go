@@ -0,0 +1,79 @@
+package contentenc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+)
+
+// Build a compressed file and read it back through the block index
+func TestCompressedFile(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendAESSIV, DefaultIVBits, true)
+	be := New(cc, DefaultBS)
+	plaintext := bytes.Repeat([]byte("compressible "), 1000)
+	rand.Read(plaintext[5000:9000])
+	h := FileHeader{Version: CompressedVersion, ID: cryptocore.RandBytes(headerIDLen)}
+	nonce := make([]byte, cc.IVLen)
+	nonce[0] = 1
+	var blocks [][]byte
+	var cipherLen []uint32
+	for off := 0; off < len(plaintext); off += DefaultBS {
+		end := off + DefaultBS
+		if end > len(plaintext) {
+			end = len(plaintext)
+		}
+		blockNo := uint64(len(blocks))
+		b := be.EncryptCompressedBlock(plaintext[off:end], blockNo, h.ID, nonce)
+		if uint32(len(b)) != be.CompressedBlockLen(plaintext[off:end]) {
+			t.Fatalf("block %d: CompressedBlockLen mismatch", blockNo)
+		}
+		blocks = append(blocks, b)
+		cipherLen = append(cipherLen, uint32(len(b)))
+	}
+	index := be.NewBlockIndex(uint64(len(plaintext)), cipherLen)
+	file := append(h.Pack(), index.Pack()...)
+	for _, b := range blocks {
+		file = append(file, b...)
+	}
+	if uint64(len(file)) != index.CipherSize() {
+		t.Fatalf("CipherSize=%d, file has %d bytes", index.CipherSize(), len(file))
+	}
+	if len(file) >= len(plaintext) {
+		t.Errorf("not compressed: %d bytes", len(file))
+	}
+	if plainSize, ok := CompressedPlainSize(bytes.NewReader(file)); !ok || plainSize != uint64(len(plaintext)) {
+		t.Errorf("CompressedPlainSize=%d, ok=%v", plainSize, ok)
+	}
+	index2, err := be.ReadBlockIndex(bytes.NewReader(file), uint64(len(file)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []byte
+	for i := range blocks {
+		blockNo := uint64(i)
+		off := index2.BlockCipherOff(blockNo)
+		if index2.CipherOffToBlockNo(off) != blockNo || index2.CipherOffToBlockNo(off+1) != blockNo {
+			t.Errorf("CipherOffToBlockNo(%d) != %d", off, blockNo)
+		}
+		p, err := be.DecryptCompressedBlock(file[off:off+uint64(index2.CipherLen[i])], blockNo, h.ID,
+			be.BlockPlainLen(index2.PlainSize, blockNo))
+		if err != nil {
+			t.Fatalf("block %d: %v", i, err)
+		}
+		out = append(out, p...)
+	}
+	if !bytes.Equal(out, plaintext) {
+		t.Error("content mismatch")
+	}
+	// A wrong plaintext size must be detected
+	if _, err := be.DecryptCompressedBlock(blocks[0], 0, h.ID, DefaultBS-1); err == nil {
+		t.Error("wrong length was not detected")
+	}
+	// Truncated file
+	if _, err := be.ReadBlockIndex(bytes.NewReader(file), uint64(len(file)-1)); err == nil {
+		t.Error("truncated file was not detected")
+	}
+}
@@ -13,12 +13,17 @@ import (
 	"github.com/hanwen/go-fuse/v2/fuse"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/metrics"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
 const (
 	// DefaultBS is the default plaintext block size
 	DefaultBS = 4096
+	// MinBS and MaxBS limit the plaintext block sizes that can be selected
+	// using "-blocksize". The block size must be a power of two.
+	MinBS = 4096
+	MaxBS = 1024 * 1024
 	// DefaultIVBits is the default length of IV, in bits.
 	// We always use 128-bit IVs for file content, but the
 	// master key in the config file is encrypted with a 96-bit IV for
@@ -43,34 +48,54 @@ type ContentEnc struct {
 
 	// Ciphertext block "sync.Pool" pool. Always returns cipherBS-sized byte
 	// slices (usually 4128 bytes).
-	cBlockPool bPool
+	cBlockPool *bPool
 	// Plaintext block pool. Always returns plainBS-sized byte slices
 	// (usually 4096 bytes).
-	pBlockPool bPool
-	// Ciphertext request data pool. Always returns byte slices of size
-	// fuse.MAX_KERNEL_WRITE + encryption overhead.
+	pBlockPool *bPool
+	// Ciphertext request data pool. Always returns byte slices large enough
+	// for the blocks touched by a fuse.MAX_KERNEL_WRITE-sized request,
+	// including the encryption overhead.
 	// Used by Read() to temporarily store the ciphertext as it is read from
 	// disk.
-	CReqPool bPool
-	// Plaintext request data pool. Slice have size fuse.MAX_KERNEL_WRITE.
-	PReqPool bPool
+	CReqPool *bPool
+	// Plaintext request data pool. Slices have the plaintext size of the
+	// blocks touched by a fuse.MAX_KERNEL_WRITE-sized request.
+	PReqPool *bPool
+
+	// keyEpochs maps key epochs to ContentEnc instances that share the pools
+	// with this one but use the epoch's key. nil if key epochs are not in use.
+	// See AddKeyEpoch().
+	keyEpochs map[uint32]*ContentEnc
+	// writeEpoch is the key epoch used for new files
+	writeEpoch uint32
+	// writeAuth is set when blocks are signed. See NewWriteAuth().
+	writeAuth *WriteAuth
 }
 
 // New returns an initialized ContentEnc instance.
 func New(cc *cryptocore.CryptoCore, plainBS uint64) *ContentEnc {
-	tlog.Debug.Printf("contentenc.New: plainBS=%d", plainBS)
+	return newContentEnc(cc, plainBS, 0)
+}
+
+// newContentEnc is the backend for New and NewWriteAuth. "extraOverhead" is
+// added to the per-block overhead of the crypto backend.
+func newContentEnc(cc *cryptocore.CryptoCore, plainBS uint64, extraOverhead uint64) *ContentEnc {
+	tlog.Debug.Printf("contentenc.New: plainBS=%d, extraOverhead=%d", plainBS, extraOverhead)
 
-	if fuse.MAX_KERNEL_WRITE%plainBS != 0 {
-		log.Panicf("unaligned MAX_KERNEL_WRITE=%d", fuse.MAX_KERNEL_WRITE)
+	if !ValidBlockSize(plainBS) {
+		log.Panicf("unsupported block size %d", plainBS)
 	}
-	cipherBS := plainBS + uint64(cc.IVLen) + cryptocore.AuthTagLen
-	// Take IV and GHASH overhead into account.
-	cReqSize := int(fuse.MAX_KERNEL_WRITE / plainBS * cipherBS)
+	cipherBS := plainBS + uint64(cc.IVLen) + cryptocore.AuthTagLen + extraOverhead
+	// Number of blocks a request can touch. Blocks larger than
+	// MAX_KERNEL_WRITE are read and written as a whole.
+	reqBlocks := (fuse.MAX_KERNEL_WRITE + plainBS - 1) / plainBS
 	// Unaligned reads (happens during fsck, could also happen with O_DIRECT?)
 	// touch one additional ciphertext and plaintext block. Reserve space for the
 	// extra block.
-	cReqSize += int(cipherBS)
-	pReqSize := fuse.MAX_KERNEL_WRITE + int(plainBS)
+	reqBlocks++
+	// Take IV and GHASH overhead into account.
+	cReqSize := int(reqBlocks * cipherBS)
+	pReqSize := int(reqBlocks * plainBS)
 	c := &ContentEnc{
 		cryptoCore:   cc,
 		plainBS:      plainBS,
@@ -85,6 +110,12 @@ func New(cc *cryptocore.CryptoCore, plainBS uint64) *ContentEnc {
 	return c
 }
 
+// ValidBlockSize returns true if "plainBS" is a power of two between MinBS
+// and MaxBS.
+func ValidBlockSize(plainBS uint64) bool {
+	return plainBS >= MinBS && plainBS <= MaxBS && plainBS&(plainBS-1) == 0
+}
+
 // PlainBS returns the plaintext block size
 func (be *ContentEnc) PlainBS() uint64 {
 	return be.plainBS
@@ -135,7 +166,9 @@ func concatAD(blockNo uint64, fileID []byte) (aData []byte) {
 // DecryptBlock - Verify and decrypt GCM block
 //
 // Corner case: A full-sized block of all-zero ciphertext bytes is translated
-// to an all-zero plaintext block, i.e. file hole passthrough.
+// to an all-zero plaintext block, i.e. file hole passthrough. Not with write
+// authentication, where anybody could write such a block. Files on these
+// filesystems have no holes.
 func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []byte) ([]byte, error) {
 
 	// Empty block?
@@ -144,11 +177,23 @@ func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []b
 	}
 
 	// All-zero block?
-	if bytes.Equal(ciphertext, be.allZeroBlock) {
+	if be.writeAuth == nil && bytes.Equal(ciphertext, be.allZeroBlock) {
 		tlog.Debug.Printf("DecryptBlock: file hole encountered")
 		return make([]byte, be.plainBS), nil
 	}
 
+	aData := concatAD(blockNo, fileID)
+	ciphertextOrig := ciphertext
+	if be.writeAuth != nil {
+		var err error
+		ciphertext, err = be.verifyBlock(ciphertext, aData)
+		if err != nil {
+			metrics.AuthFailures.Inc()
+			tlog.Debug.Printf("DecryptBlock: %s, len=%d", err.Error(), len(ciphertextOrig))
+			return nil, err
+		}
+	}
+
 	if len(ciphertext) < be.cryptoCore.IVLen {
 		tlog.Warn.Printf("DecryptBlock: Block is too short: %d bytes", len(ciphertext))
 		return nil, errors.New("Block is too short")
@@ -162,20 +207,20 @@ func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []b
 		// http://www.spinics.net/lists/kernel/msg2370127.html
 		return nil, errors.New("all-zero nonce")
 	}
-	ciphertextOrig := ciphertext
 	ciphertext = ciphertext[be.cryptoCore.IVLen:]
 
 	// Decrypt
 	plaintext := be.pBlockPool.Get()
 	plaintext = plaintext[:0]
-	aData := concatAD(blockNo, fileID)
 	plaintext, err := be.cryptoCore.AEADCipher.Open(plaintext, nonce, ciphertext, aData)
 
 	if err != nil {
+		metrics.AuthFailures.Inc()
 		tlog.Debug.Printf("DecryptBlock: %s, len=%d", err.Error(), len(ciphertextOrig))
 		tlog.Debug.Println(hex.Dump(ciphertextOrig))
 		return nil, err
 	}
+	metrics.BlocksDecrypted.Inc()
 
 	return plaintext, nil
 }
@@ -217,7 +262,10 @@ func (be *ContentEnc) encryptBlocksParallel(plaintextBlocks [][]byte, ciphertext
 // EncryptBlocks is like EncryptBlock but takes multiple plaintext blocks.
 // Returns a byte slice from CReqPool - so don't forget to return it
 // to the pool.
-func (be *ContentEnc) EncryptBlocks(plaintextBlocks [][]byte, firstBlockNo uint64, fileID []byte) []byte {
+func (be *ContentEnc) EncryptBlocks(plaintextBlocks [][]byte, firstBlockNo uint64, fileID []byte) ([]byte, error) {
+	if !be.CanWrite() {
+		return nil, ErrNoSigningKey
+	}
 	ciphertextBlocks := make([][]byte, len(plaintextBlocks))
 	// For large writes, we parallelize encryption.
 	if len(plaintextBlocks) >= 32 && runtime.NumCPU() >= 2 {
@@ -233,39 +281,48 @@ func (be *ContentEnc) EncryptBlocks(plaintextBlocks [][]byte, firstBlockNo uint6
 		// Return the memory to cBlockPool
 		be.cBlockPool.Put(v)
 	}
-	return out.Bytes()
+	return out.Bytes(), nil
 }
 
-// doEncryptBlocks is called by EncryptBlocks to do the actual encryption work
+// doEncryptBlocks is called by EncryptBlocks to do the actual encryption work.
+// The caller has checked CanWrite().
 func (be *ContentEnc) doEncryptBlocks(in [][]byte, out [][]byte, firstBlockNo uint64, fileID []byte) {
 	for i, v := range in {
-		out[i] = be.EncryptBlock(v, firstBlockNo+uint64(i), fileID)
+		out[i] = be.doEncryptBlock(v, firstBlockNo+uint64(i), fileID, be.cryptoCore.IVGenerator.Get())
 	}
 }
 
 // EncryptBlock - Encrypt plaintext using a random nonce.
 // blockNo and fileID are used as associated data.
 // The output is nonce + ciphertext + tag.
-func (be *ContentEnc) EncryptBlock(plaintext []byte, blockNo uint64, fileID []byte) []byte {
+// Returns ErrNoSigningKey if CanWrite() is false.
+func (be *ContentEnc) EncryptBlock(plaintext []byte, blockNo uint64, fileID []byte) ([]byte, error) {
+	if !be.CanWrite() {
+		return nil, ErrNoSigningKey
+	}
 	// Get a fresh random nonce
 	nonce := be.cryptoCore.IVGenerator.Get()
-	return be.doEncryptBlock(plaintext, blockNo, fileID, nonce)
+	return be.doEncryptBlock(plaintext, blockNo, fileID, nonce), nil
 }
 
 // EncryptBlockNonce - Encrypt plaintext using a nonce chosen by the caller.
 // blockNo and fileID are used as associated data.
 // The output is nonce + ciphertext + tag.
-// This function can only be used in SIV mode.
+// This function can only be used in AES-SIV and AES-GCM-SIV mode.
 func (be *ContentEnc) EncryptBlockNonce(plaintext []byte, blockNo uint64, fileID []byte, nonce []byte) []byte {
-	if be.cryptoCore.AEADBackend != cryptocore.BackendAESSIV {
+	if !be.cryptoCore.AEADBackend.MisuseResistant() {
 		log.Panic("deterministic nonces are only secure in SIV mode")
 	}
+	if be.writeAuth != nil {
+		// Reverse mode, the only user, does not support write authentication
+		log.Panic("BUG: deterministic nonces cannot be used with write authentication")
+	}
 	return be.doEncryptBlock(plaintext, blockNo, fileID, nonce)
 }
 
 // doEncryptBlock is the backend for EncryptBlock and EncryptBlockNonce.
 // blockNo and fileID are used as associated data.
-// The output is nonce + ciphertext + tag.
+// The output is nonce + ciphertext + tag. The caller has checked CanWrite().
 func (be *ContentEnc) doEncryptBlock(plaintext []byte, blockNo uint64, fileID []byte, nonce []byte) []byte {
 	// Empty block?
 	if len(plaintext) == 0 {
@@ -283,6 +340,10 @@ func (be *ContentEnc) doEncryptBlock(plaintext []byte, blockNo uint64, fileID []
 	cBlock = cBlock[0:len(nonce)]
 	// Encrypt plaintext and append to nonce
 	ciphertext := be.cryptoCore.AEADCipher.Seal(cBlock, nonce, plaintext, aData)
+	if be.writeAuth != nil {
+		ciphertext = be.signBlock(ciphertext, aData)
+	}
+	metrics.BlocksEncrypted.Inc()
 	overhead := int(be.BlockOverhead())
 	if len(plaintext)+overhead != len(ciphertext) {
 		log.Panicf("unexpected ciphertext length: plaintext=%d, overhead=%d, ciphertext=%d",
@@ -321,4 +382,14 @@ func (be *ContentEnc) MergeBlocks(oldData []byte, newData []byte, offset int) []
 func (be *ContentEnc) Wipe() {
 	be.cryptoCore.Wipe()
 	be.cryptoCore = nil
+	for _, e := range be.keyEpochs {
+		e.Wipe()
+	}
+	be.keyEpochs = nil
+	if be.writeAuth != nil {
+		for i := range be.writeAuth.PrivateKey {
+			be.writeAuth.PrivateKey[i] = 0
+		}
+		be.writeAuth = nil
+	}
 }
@@ -94,3 +94,34 @@ func TestBlockNo(t *testing.T) {
 		t.Errorf("actual: %d", b)
 	}
 }
+
+// Block sizes above MAX_KERNEL_WRITE need request buffers that hold two
+// whole blocks
+func TestLargeBlockSize(t *testing.T) {
+	for _, bs := range []uint64{MinBS, 64 * 1024, MaxBS} {
+		key := make([]byte, cryptocore.KeyLen)
+		f := New(cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true), bs)
+		if f.CipherBS() != bs+32 {
+			t.Errorf("bs=%d: wrong cipherBS %d", bs, f.CipherBS())
+		}
+		// Unaligned request of maximum size
+		blocks := f.ExplodePlainRange(bs-1, 128*1024)
+		_, cLen := blocks[0].JointCiphertextRange(blocks)
+		if buf := f.CReqPool.Get(); uint64(len(buf)) < cLen {
+			t.Errorf("bs=%d: CReqPool slices have %d bytes, need %d", bs, len(buf), cLen)
+		}
+		plain := make([]byte, bs)
+		plain[bs-1] = 1
+		fileID := RandomHeader().ID
+		c, _ := f.EncryptBlock(plain, 3, fileID)
+		out, err := f.DecryptBlock(c, 3, fileID)
+		if err != nil || len(out) != int(bs) || out[bs-1] != 1 {
+			t.Errorf("bs=%d: round trip failed: %v", bs, err)
+		}
+	}
+	for _, bs := range []uint64{0, 2048, 5000, 2 * MaxBS} {
+		if ValidBlockSize(bs) {
+			t.Errorf("block size %d should be invalid", bs)
+		}
+	}
+}
@@ -3,6 +3,16 @@ package contentenc
 // Per-file header
 //
 // Format: [ "Version" uint16 big endian ] [ "Id" 16 random bytes ]
+//
+// On filesystems with the KeyEpochs feature flag, new files get a version 3
+// header, where the first four bytes of the Id hold the key epoch:
+//
+// Format: [ "Version" uint16 big endian ] [ "Epoch" uint32 big endian ] [ 12 random bytes ]
+//
+// As the complete Id is used as associated data for every block, the epoch is
+// authenticated.
+//
+// Compressed files have a version 4 header, see compress.go.
 
 import (
 	"bytes"
@@ -17,9 +27,14 @@ import (
 const (
 	// CurrentVersion is the current On-Disk-Format version
 	CurrentVersion = 2
+	// EpochVersion is the file header version that carries a key epoch
+	EpochVersion = 3
+	// CompressedVersion is the file header version of compressed files
+	CompressedVersion = 4
 
 	headerVersionLen = 2  // uint16
 	headerIDLen      = 16 // 128 bit random file id
+	headerEpochLen   = 4  // uint32, only in EpochVersion headers
 	// HeaderLen is the total header length
 	HeaderLen = headerVersionLen + headerIDLen
 )
@@ -28,11 +43,13 @@ const (
 type FileHeader struct {
 	Version uint16
 	ID      []byte
+	// Epoch is the key epoch. Always 0 for CurrentVersion headers.
+	Epoch uint32
 }
 
 // Pack - serialize fileHeader object
 func (h *FileHeader) Pack() []byte {
-	if len(h.ID) != headerIDLen || h.Version != CurrentVersion {
+	if len(h.ID) != headerIDLen || !validVersion(h.Version) {
 		log.Panic("FileHeader object not properly initialized")
 	}
 	buf := make([]byte, HeaderLen)
@@ -42,6 +59,10 @@ func (h *FileHeader) Pack() []byte {
 
 }
 
+func validVersion(v uint16) bool {
+	return v == CurrentVersion || v == EpochVersion || v == CompressedVersion
+}
+
 // allZeroFileID is preallocated to quickly check if the data read from disk is all zero
 var allZeroFileID = make([]byte, headerIDLen)
 var allZeroHeader = make([]byte, HeaderLen)
@@ -56,11 +77,14 @@ func ParseHeader(buf []byte) (*FileHeader, error) {
 	}
 	var h FileHeader
 	h.Version = binary.BigEndian.Uint16(buf[0:headerVersionLen])
-	if h.Version != CurrentVersion {
+	if !validVersion(h.Version) {
 		return nil, fmt.Errorf("ParseHeader: invalid version, want=%d have=%d. Header hexdump: %s",
 			CurrentVersion, h.Version, hex.EncodeToString(buf))
 	}
 	h.ID = buf[headerVersionLen:]
+	if h.Version == EpochVersion {
+		h.Epoch = binary.BigEndian.Uint32(h.ID[:headerEpochLen])
+	}
 	if bytes.Equal(h.ID, allZeroFileID) {
 		return nil, fmt.Errorf("ParseHeader: file id is all-zero. Header hexdump: %s",
 			hex.EncodeToString(buf))
@@ -75,3 +99,18 @@ func RandomHeader() *FileHeader {
 	h.ID = cryptocore.RandBytes(headerIDLen)
 	return &h
 }
+
+// RandomHeaderEpoch - create new fileHeader object for key epoch "epoch".
+// Epoch 0 gets a CurrentVersion header like from RandomHeader().
+func RandomHeaderEpoch(epoch uint32) *FileHeader {
+	if epoch == 0 {
+		return RandomHeader()
+	}
+	var h FileHeader
+	h.Version = EpochVersion
+	h.Epoch = epoch
+	h.ID = make([]byte, headerIDLen)
+	binary.BigEndian.PutUint32(h.ID, epoch)
+	copy(h.ID[headerEpochLen:], cryptocore.RandBytes(headerIDLen-headerEpochLen))
+	return &h
+}
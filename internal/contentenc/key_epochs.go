@@ -0,0 +1,46 @@
+package contentenc
+
+import (
+	"fmt"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+)
+
+// AddKeyEpoch registers the CryptoCore "cc" for key epoch "epoch". The
+// CryptoCore passed to New() is always used for epoch 0. The highest epoch
+// becomes the write epoch that is used for new files.
+// Must be called before the ContentEnc is used.
+func (be *ContentEnc) AddKeyEpoch(epoch uint32, cc *cryptocore.CryptoCore) {
+	if be.keyEpochs == nil {
+		be.keyEpochs = make(map[uint32]*ContentEnc)
+	}
+	// Shares the pools with "be"
+	e := *be
+	e.cryptoCore = cc
+	e.keyEpochs = nil
+	be.keyEpochs[epoch] = &e
+	if epoch > be.writeEpoch {
+		be.writeEpoch = epoch
+	}
+}
+
+// WriteEpoch returns the key epoch used for new files.
+func (be *ContentEnc) WriteEpoch() uint32 {
+	return be.writeEpoch
+}
+
+// ForEpoch returns the ContentEnc instance for key epoch "epoch".
+func (be *ContentEnc) ForEpoch(epoch uint32) (*ContentEnc, error) {
+	if e := be.keyEpochs[epoch]; e != nil {
+		return e, nil
+	}
+	if epoch == 0 {
+		return be, nil
+	}
+	return nil, fmt.Errorf("unknown key epoch %d", epoch)
+}
+
+// NewHeader returns a new random file header for the write epoch.
+func (be *ContentEnc) NewHeader() *FileHeader {
+	return RandomHeaderEpoch(be.writeEpoch)
+}
@@ -0,0 +1,60 @@
+package contentenc
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+)
+
+// Version 3 headers carry the key epoch and survive a Pack/Parse round trip
+func TestHeaderEpoch(t *testing.T) {
+	h := RandomHeaderEpoch(7)
+	if h.Version != EpochVersion {
+		t.Fatalf("wrong version %d", h.Version)
+	}
+	h2, err := ParseHeader(h.Pack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h2.Epoch != 7 || !bytes.Equal(h2.ID, h.ID) {
+		t.Errorf("round trip failed: %#v", h2)
+	}
+	if h := RandomHeaderEpoch(0); h.Version != CurrentVersion {
+		t.Errorf("epoch 0 should use version %d, got %d", CurrentVersion, h.Version)
+	}
+}
+
+// Blocks written with one epoch cannot be decrypted with another
+func TestForEpoch(t *testing.T) {
+	cc := cryptocore.New(make([]byte, cryptocore.KeyLen), cryptocore.BackendGoGCM, DefaultIVBits, true)
+	be := New(cc, DefaultBS)
+	key1 := bytes.Repeat([]byte{1}, cryptocore.KeyLen)
+	be.AddKeyEpoch(1, cryptocore.New(key1, cryptocore.BackendGoGCM, DefaultIVBits, true))
+	if be.WriteEpoch() != 1 {
+		t.Fatalf("wrong write epoch %d", be.WriteEpoch())
+	}
+	e0, err := be.ForEpoch(0)
+	if err != nil || e0 != be {
+		t.Fatalf("epoch 0: %v", err)
+	}
+	e1, err := be.ForEpoch(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = be.ForEpoch(2); err == nil {
+		t.Error("unknown epoch should return an error")
+	}
+	h := be.NewHeader()
+	if h.Epoch != 1 {
+		t.Fatalf("NewHeader: wrong epoch %d", h.Epoch)
+	}
+	plain := []byte("hello key epochs")
+	c, _ := e1.EncryptBlock(plain, 0, h.ID)
+	if out, err := e1.DecryptBlock(c, 0, h.ID); err != nil || !bytes.Equal(out, plain) {
+		t.Errorf("decrypt with epoch 1: %v", err)
+	}
+	if _, err := e0.DecryptBlock(c, 0, h.ID); err == nil {
+		t.Error("decrypt with epoch 0 should fail")
+	}
+}
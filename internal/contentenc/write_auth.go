@@ -0,0 +1,73 @@
+package contentenc
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"log"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+)
+
+// ErrNoSigningKey is returned when encrypting on a filesystem that was
+// unlocked using the reader key.
+var ErrNoSigningKey = syscall.EROFS
+
+// SignatureLen is the length of the Ed25519 signature that is appended to
+// each block when write authentication is enabled.
+const SignatureLen = ed25519.SignatureSize
+
+// WriteAuth holds the keys that sign and verify file content blocks.
+type WriteAuth struct {
+	// PublicKey verifies the block signatures
+	PublicKey ed25519.PublicKey
+	// PrivateKey signs new blocks. It is nil when the filesystem was
+	// unlocked using the reader key, and the ContentEnc can then only
+	// decrypt.
+	PrivateKey ed25519.PrivateKey
+}
+
+// NewWriteAuth is like New, but every block carries an Ed25519 signature
+// over the associated data and the encrypted block. Blocks without a valid
+// signature are rejected, even if they decrypt fine.
+func NewWriteAuth(cc *cryptocore.CryptoCore, plainBS uint64, wa *WriteAuth) *ContentEnc {
+	if len(wa.PublicKey) != ed25519.PublicKeySize {
+		log.Panicf("wrong public key length: %d", len(wa.PublicKey))
+	}
+	c := newContentEnc(cc, plainBS, SignatureLen)
+	c.writeAuth = wa
+	return c
+}
+
+// CanWrite returns false if the ContentEnc can only decrypt because the
+// signing key is not known.
+func (be *ContentEnc) CanWrite() bool {
+	return be.writeAuth == nil || be.writeAuth.PrivateKey != nil
+}
+
+// Signed returns true if blocks carry a signature. There are no file holes
+// then, as an all-zero block has no valid signature.
+func (be *ContentEnc) Signed() bool {
+	return be.writeAuth != nil
+}
+
+// signBlock appends the signature over "aData" and "block" to "block".
+// The caller has checked CanWrite().
+func (be *ContentEnc) signBlock(block []byte, aData []byte) []byte {
+	sig := ed25519.Sign(be.writeAuth.PrivateKey, append(aData, block...))
+	return append(block, sig...)
+}
+
+// verifyBlock checks the signature of "block" and returns the block without
+// the signature.
+func (be *ContentEnc) verifyBlock(block []byte, aData []byte) ([]byte, error) {
+	if len(block) < SignatureLen {
+		return nil, errors.New("Block is too short")
+	}
+	sig := block[len(block)-SignatureLen:]
+	block = block[:len(block)-SignatureLen]
+	if !ed25519.Verify(be.writeAuth.PublicKey, append(aData, block...), sig) {
+		return nil, errors.New("block signature is invalid")
+	}
+	return block, nil
+}
@@ -0,0 +1,67 @@
+package contentenc
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+)
+
+// A reader can decrypt signed blocks, but blocks it authors itself, or
+// moves to a different position, are rejected
+func TestWriteAuth(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := make([]byte, cryptocore.KeyLen)
+	writer := NewWriteAuth(cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true), DefaultBS,
+		&WriteAuth{PublicKey: pub, PrivateKey: priv})
+	reader := NewWriteAuth(cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true), DefaultBS,
+		&WriteAuth{PublicKey: pub})
+	if writer.CipherBS() != DefaultBS+16+cryptocore.AuthTagLen+SignatureLen {
+		t.Fatalf("wrong cipherBS %d", writer.CipherBS())
+	}
+	if !writer.CanWrite() || reader.CanWrite() {
+		t.Fatal("CanWrite is wrong")
+	}
+	id := RandomHeader().ID
+	plain := bytes.Repeat([]byte("x"), DefaultBS)
+	c, err := writer.EncryptBlock(plain, 5, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint64(len(c)) != writer.CipherBS() {
+		t.Fatalf("wrong block length %d", len(c))
+	}
+	if out, err := reader.DecryptBlock(c, 5, id); err != nil || !bytes.Equal(out, plain) {
+		t.Fatalf("reader decrypt: %v", err)
+	}
+	if _, err := reader.DecryptBlock(c, 6, id); err == nil {
+		t.Error("moved block should be rejected")
+	}
+	// The reader has the content key, so it can produce a block that passes
+	// the AEAD check. Reusing the signature of the original block must fail.
+	plain[0] = 'y'
+	forged, _ := New(cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true), DefaultBS).EncryptBlock(plain, 5, id)
+	forged = append(forged, c[len(c)-SignatureLen:]...)
+	if _, err := reader.DecryptBlock(forged, 5, id); err == nil {
+		t.Error("forged block should be rejected")
+	}
+	// Unsigned blocks are rejected even if they decrypt fine
+	c[len(c)-1] ^= 1
+	if _, err := reader.DecryptBlock(c, 5, id); err == nil {
+		t.Error("bad signature should be rejected")
+	}
+	// Anybody can write an all-zero block, so it is not a file hole
+	if _, err := reader.DecryptBlock(make([]byte, reader.CipherBS()), 0, id); err == nil {
+		t.Error("all-zero block should be rejected")
+	}
+	if _, err := reader.EncryptBlock(plain, 0, id); err != ErrNoSigningKey {
+		t.Errorf("encrypting without the signing key: want %v, got %v", ErrNoSigningKey, err)
+	}
+	if _, err := reader.EncryptBlocks([][]byte{plain}, 0, id); err != ErrNoSigningKey {
+		t.Errorf("EncryptBlocks without the signing key: want %v, got %v", ErrNoSigningKey, err)
+	}
+}
@@ -13,6 +13,7 @@ import (
 
 	"github.com/rfjakob/eme"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/gcmsiv"
 	"github.com/rfjakob/gocryptfs/v2/internal/siv_aead"
 	"github.com/rfjakob/gocryptfs/v2/internal/stupidgcm"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
@@ -40,6 +41,13 @@ func (a AEADTypeEnum) String() string {
 	return a.Algo + "-" + a.Lib
 }
 
+// MisuseResistant tells if the algorithm stays secure when a nonce is reused.
+// Only these algorithms can be used with the deterministic nonces of reverse
+// mode.
+func (a AEADTypeEnum) MisuseResistant() bool {
+	return a.Algo == BackendAESSIV.Algo || a.Algo == BackendAESGCMSIV.Algo
+}
+
 // BackendOpenSSL specifies the OpenSSL AES-256-GCM backend.
 // "AES-GCM-256-OpenSSL" in gocryptfs -speed.
 var BackendOpenSSL = AEADTypeEnum{"AES-GCM-256", "OpenSSL", 16}
@@ -52,6 +60,11 @@ var BackendGoGCM = AEADTypeEnum{"AES-GCM-256", "Go", 16}
 // "AES-SIV-512-Go" in gocryptfs -speed.
 var BackendAESSIV = AEADTypeEnum{"AES-SIV-512", "Go", siv_aead.NonceSize}
 
+// BackendAESGCMSIV specifies the nonce-misuse resistant AES-256-GCM-SIV
+// backend (RFC 8452).
+// "AES-GCM-SIV-256-Go" in gocryptfs -speed.
+var BackendAESGCMSIV = AEADTypeEnum{"AES-GCM-SIV-256", "Go", gcmsiv.NonceSize}
+
 // BackendXChaCha20Poly1305 specifies XChaCha20-Poly1305-Go.
 // "XChaCha20-Poly1305-Go" in gocryptfs -speed.
 var BackendXChaCha20Poly1305 = AEADTypeEnum{"XChaCha20-Poly1305", "Go", chacha20poly1305.NonceSizeX}
@@ -63,7 +76,8 @@ var BackendXChaCha20Poly1305OpenSSL = AEADTypeEnum{"XChaCha20-Poly1305", "OpenSS
 type CryptoCore struct {
 	// EME is used for filename encryption.
 	EMECipher *eme.EMECipher
-	// GCM or AES-SIV. This is used for content encryption.
+	// GCM, AES-SIV, AES-GCM-SIV or XChaCha20-Poly1305.
+	// This is used for content encryption.
 	AEADCipher cipher.AEAD
 	// Which backend is behind AEADCipher?
 	AEADBackend AEADTypeEnum
@@ -164,6 +178,19 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool) *CryptoC
 		for i := range key64 {
 			key64[i] = 0
 		}
+	} else if aeadType == BackendAESGCMSIV {
+		// AES-GCM-SIV is new enough that we don't support legacy modes
+		if IVBitLen != gcmsiv.NonceSize*8 {
+			log.Panicf("AES-GCM-SIV must use 128-bit IVs, you wanted %d", IVBitLen)
+		}
+		if !useHKDF {
+			log.Panic("AES-GCM-SIV must use HKDF, but it is disabled")
+		}
+		derivedKey := hkdfDerive(key, hkdfInfoGCMSIVContent, gcmsiv.KeyLen)
+		aeadCipher = gcmsiv.New(derivedKey)
+		for i := range derivedKey {
+			derivedKey[i] = 0
+		}
 	} else if aeadType == BackendXChaCha20Poly1305 || aeadType == BackendXChaCha20Poly1305OpenSSL {
 		// We don't support legacy modes with XChaCha20-Poly1305
 		if IVBitLen != chacha20poly1305.NonceSizeX*8 {
@@ -212,7 +239,7 @@ type wiper interface {
 // still raises to bar for extracting the key.
 func (c *CryptoCore) Wipe() {
 	be := c.AEADBackend
-	if be == BackendOpenSSL || be == BackendAESSIV {
+	if be == BackendOpenSSL || be == BackendAESSIV || be == BackendAESGCMSIV {
 		tlog.Debug.Printf("CryptoCore.Wipe: Wiping AEADBackend %q key", be)
 		// We don't use "x, ok :=" because we *want* to crash loudly if the
 		// type assertion fails.
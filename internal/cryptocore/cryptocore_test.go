@@ -18,6 +18,12 @@ func TestCryptoCoreNew(t *testing.T) {
 		if c.IVLen != 16 {
 			t.Fail()
 		}
+		if useHKDF {
+			c = New(key, BackendAESGCMSIV, 128, useHKDF)
+			if c.IVLen != 16 {
+				t.Fail()
+			}
+		}
 		if stupidgcm.BuiltWithoutOpenssl {
 			continue
 		}
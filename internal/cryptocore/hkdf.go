@@ -13,7 +13,10 @@ const (
 	hkdfInfoEMENames               = "EME filename encryption"
 	hkdfInfoGCMContent             = "AES-GCM file content encryption"
 	hkdfInfoSIVContent             = "AES-SIV file content encryption"
+	hkdfInfoGCMSIVContent          = "AES-GCM-SIV file content encryption"
 	hkdfInfoXChaChaPoly1305Content = "XChaCha20-Poly1305 file content encryption"
+	hkdfInfoReaderKey              = "write authentication reader key"
+	hkdfInfoSigningKey             = "write authentication Ed25519 signing key"
 )
 
 // hkdfDerive derives "outLen" bytes from "masterkey" and "info" using
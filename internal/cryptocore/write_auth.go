@@ -0,0 +1,22 @@
+package cryptocore
+
+import (
+	"crypto/ed25519"
+)
+
+// DeriveWriteAuthKeys derives the reader key and the Ed25519 signing key of a
+// filesystem with write authentication from "masterkey".
+//
+// The reader key takes the place of the master key when calling New(), so
+// that the file content and file name keys can be handed out without the
+// signing key. Both are derived using HKDF, so neither can be used to
+// calculate the master key or the other key.
+func DeriveWriteAuthKeys(masterkey []byte) (readerKey []byte, signingKey ed25519.PrivateKey) {
+	readerKey = hkdfDerive(masterkey, hkdfInfoReaderKey, KeyLen)
+	seed := hkdfDerive(masterkey, hkdfInfoSigningKey, ed25519.SeedSize)
+	signingKey = ed25519.NewKeyFromSeed(seed)
+	for i := range seed {
+		seed[i] = 0
+	}
+	return readerKey, signingKey
+}
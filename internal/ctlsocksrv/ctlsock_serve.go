@@ -9,6 +9,7 @@ import (
 	"io"
 	"net"
 	"os"
+	"sync"
 	"syscall"
 
 	"github.com/rfjakob/gocryptfs/v2/ctlsock"
@@ -21,22 +22,58 @@ type Interface interface {
 	DecryptPath(string) (string, error)
 }
 
-type ctlSockHandler struct {
+// BatchInterface can be implemented in addition to Interface to translate
+// the paths of a batch request more efficiently than one by one
+type BatchInterface interface {
+	EncryptPaths([]string) ([]string, []error)
+	DecryptPaths([]string) ([]string, []error)
+}
+
+// Mount provides the versioned API commands that concern the mount as a
+// whole. It is implemented by the main package.
+type Mount interface {
+	Status() ctlsock.MountStatus
+	OpenFiles() []ctlsock.OpenFile
+	FlushDirCache() error
+	SetDebug(enable bool)
+	Unmount() error
+	FeatureFlags() []string
+	Metrics() string
+}
+
+// Server handles the requests on a control socket
+type Server struct {
 	fs     Interface
+	mount  Mount
 	socket *net.UnixListener
+	// busy is read-locked while a request is handled, see Drain()
+	busy sync.RWMutex
 }
 
-// Serve serves incoming connections on "sock". This call blocks so you
-// probably want to run it in a new goroutine.
-func Serve(sock net.Listener, fs Interface) {
-	handler := ctlSockHandler{
+// New returns a Server for the listening socket "sock". Path translation
+// requests are handled by "fs", the other commands by "mount".
+func New(sock net.Listener, fs Interface, mount Mount) *Server {
+	return &Server{
 		fs:     fs,
+		mount:  mount,
 		socket: sock.(*net.UnixListener),
 	}
-	handler.acceptLoop()
 }
 
-func (ch *ctlSockHandler) acceptLoop() {
+// Serve serves incoming connections. This call blocks so you probably want
+// to run it in a new goroutine.
+func (ch *Server) Serve() {
+	ch.acceptLoop()
+}
+
+// Drain waits until the requests that are being handled have been answered,
+// and blocks new requests. Call it after unmount, so the response to
+// CmdUnmount is sent before the process exits.
+func (ch *Server) Drain() {
+	ch.busy.Lock()
+}
+
+func (ch *Server) acceptLoop() {
 	for {
 		conn, err := ch.socket.Accept()
 		if err != nil {
@@ -50,85 +87,224 @@ func (ch *ctlSockHandler) acceptLoop() {
 	}
 }
 
-// ReadBufSize is the size of the request read buffer.
-// The longest possible path is 4096 bytes on Linux and 1024 on Mac OS X so
-// 5000 bytes should be enough to hold the whole JSON request. This
-// assumes that the path does not contain too many characters that had to be
-// be escaped in JSON (for example, a null byte blows up to "\u0000").
-// We abort the connection if the request is bigger than this.
-const ReadBufSize = 5000
+// MaxRequestSize is the approximate maximum size of a JSON request.
+// A single path is at most 4096 bytes on Linux and 1024 on Mac OS X, but
+// batch requests (CmdEncryptPaths, CmdDecryptPaths) carry many paths.
+// Clients should split longer lists into several requests.
+// We abort the connection if a request is bigger than this.
+const MaxRequestSize = 16 * 1024 * 1024
 
-// handleConnection reads and parses JSON requests from "conn"
-func (ch *ctlSockHandler) handleConnection(conn *net.UnixConn) {
-	buf := make([]byte, ReadBufSize)
+var errRequestTooBig = fmt.Errorf("request too big (max = %d bytes)", MaxRequestSize)
+
+// requestReader limits the number of bytes that can be read from the
+// connection for a single request
+type requestReader struct {
+	conn io.Reader
+	left int
+}
+
+func (r *requestReader) Read(p []byte) (int, error) {
+	if r.left <= 0 {
+		return 0, errRequestTooBig
+	}
+	if len(p) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.conn.Read(p)
+	r.left -= n
+	return n, err
+}
+
+// handleConnection reads and parses JSON requests from "conn". Requests can
+// be sent back-to-back without waiting for the responses, which are sent in
+// the same order.
+func (ch *Server) handleConnection(conn *net.UnixConn) {
+	defer conn.Close()
+	r := &requestReader{conn: conn}
+	dec := json.NewDecoder(r)
 	for {
-		n, err := conn.Read(buf)
+		r.left = MaxRequestSize
+		var in ctlsock.RequestStruct
+		err := dec.Decode(&in)
 		if err == io.EOF {
-			conn.Close()
-			return
-		} else if err != nil {
-			tlog.Warn.Printf("ctlsock: Read error: %#v", err)
-			conn.Close()
 			return
-		}
-		if n == ReadBufSize {
-			tlog.Warn.Printf("ctlsock: request too big (max = %d bytes)", ReadBufSize-1)
-			conn.Close()
+		} else if err == errRequestTooBig {
+			tlog.Warn.Printf("ctlsock: %v", err)
 			return
-		}
-		data := buf[:n]
-		var in ctlsock.RequestStruct
-		err = json.Unmarshal(data, &in)
-		if err != nil {
+		} else if _, ok := err.(*json.UnmarshalTypeError); ok {
+			// The decoder has skipped the bad request, we can go on with
+			// the next one
 			tlog.Warn.Printf("ctlsock: JSON Unmarshal error: %#v", err)
-			err = errors.New("JSON Unmarshal error: " + err.Error())
-			sendResponse(conn, err, "", "")
+			sendResponse(conn, errors.New("JSON Unmarshal error: "+err.Error()), "", "")
 			continue
+		} else if _, ok := err.(*json.SyntaxError); ok {
+			// We cannot find the start of the next request in a broken
+			// stream
+			tlog.Warn.Printf("ctlsock: JSON Unmarshal error: %#v", err)
+			sendResponse(conn, errors.New("JSON Unmarshal error: "+err.Error()), "", "")
+			return
+		} else if err != nil {
+			tlog.Warn.Printf("ctlsock: Read error: %#v", err)
+			return
 		}
 		ch.handleRequest(&in, conn)
 	}
 }
 
 // handleRequest handles an already-unmarshaled JSON request
-func (ch *ctlSockHandler) handleRequest(in *ctlsock.RequestStruct, conn *net.UnixConn) {
-	var err error
-	var inPath, outPath, clean, warnText string
+func (ch *Server) handleRequest(in *ctlsock.RequestStruct, conn *net.UnixConn) {
+	ch.busy.RLock()
+	defer ch.busy.RUnlock()
+	if in.Version > 0 {
+		ch.handleCommand(in, conn)
+		return
+	}
 	// You cannot perform both decryption and encryption in one request
 	if in.DecryptPath != "" && in.EncryptPath != "" {
-		err = errors.New("Ambiguous")
+		err := errors.New("Ambiguous")
 		sendResponse(conn, err, "", "")
 		return
 	}
 	// Neither encryption nor encryption has been requested, makes no sense
 	if in.DecryptPath == "" && in.EncryptPath == "" {
-		err = errors.New("Empty input")
+		err := errors.New("Empty input")
 		sendResponse(conn, err, "", "")
 		return
 	}
-	// Canonicalize input path
+	var outPath, warnText string
+	var err error
 	if in.EncryptPath != "" {
-		inPath = in.EncryptPath
+		outPath, warnText, err = ch.translatePath(in.EncryptPath, true)
 	} else {
-		inPath = in.DecryptPath
+		outPath, warnText, err = ch.translatePath(in.DecryptPath, false)
 	}
-	clean = SanitizePath(inPath)
+	sendResponse(conn, err, outPath, warnText)
+}
+
+// translatePath encrypts or decrypts "inPath"
+func (ch *Server) translatePath(inPath string, encrypt bool) (outPath string, warnText string, err error) {
+	// Canonicalize input path
+	clean := SanitizePath(inPath)
 	// Warn if a non-canonical path was passed
 	if inPath != clean {
 		warnText = fmt.Sprintf("Non-canonical input path '%s' has been interpreted as '%s'.", inPath, clean)
 	}
 	// Error out if the canonical path is now empty
 	if clean == "" {
-		err = errors.New("Empty input after canonicalization")
-		sendResponse(conn, err, "", warnText)
-		return
+		return "", warnText, errors.New("Empty input after canonicalization")
 	}
 	// Actual encrypt or decrypt operation
-	if in.EncryptPath != "" {
+	if encrypt {
 		outPath, err = ch.fs.EncryptPath(clean)
 	} else {
 		outPath, err = ch.fs.DecryptPath(clean)
 	}
-	sendResponse(conn, err, outPath, warnText)
+	return outPath, warnText, err
+}
+
+// translatePaths encrypts or decrypts all of "inPaths". Errors for
+// individual paths are reported in their PathResult.
+func (ch *Server) translatePaths(inPaths []string, encrypt bool) ([]ctlsock.PathResult, error) {
+	if len(inPaths) == 0 {
+		return nil, errors.New("Empty input")
+	}
+	results := make([]ctlsock.PathResult, len(inPaths))
+	// Canonicalize input paths. The ones that are left are translated
+	// together.
+	var clean []string
+	var idx []int
+	for i, inPath := range inPaths {
+		c := SanitizePath(inPath)
+		if inPath != c {
+			results[i].WarnText = fmt.Sprintf("Non-canonical input path '%s' has been interpreted as '%s'.", inPath, c)
+		}
+		if c == "" {
+			setPathError(&results[i], errors.New("Empty input after canonicalization"))
+			continue
+		}
+		clean = append(clean, c)
+		idx = append(idx, i)
+	}
+	outPaths := make([]string, len(clean))
+	errs := make([]error, len(clean))
+	if b, ok := ch.fs.(BatchInterface); ok {
+		if encrypt {
+			outPaths, errs = b.EncryptPaths(clean)
+		} else {
+			outPaths, errs = b.DecryptPaths(clean)
+		}
+	} else {
+		for i, c := range clean {
+			if encrypt {
+				outPaths[i], errs[i] = ch.fs.EncryptPath(c)
+			} else {
+				outPaths[i], errs[i] = ch.fs.DecryptPath(c)
+			}
+		}
+	}
+	for j, i := range idx {
+		if errs[j] != nil {
+			setPathError(&results[i], errs[j])
+			continue
+		}
+		results[i].Result = outPaths[j]
+	}
+	return results, nil
+}
+
+// setPathError fills in the error fields of "res"
+func setPathError(res *ctlsock.PathResult, err error) {
+	res.ErrText = err.Error()
+	res.ErrNo = errNo(err)
+}
+
+// handleCommand handles a versioned request
+func (ch *Server) handleCommand(in *ctlsock.RequestStruct, conn *net.UnixConn) {
+	msg := ctlsock.ResponseStruct{Version: ctlsock.CurrentVersion}
+	if in.Version > ctlsock.CurrentVersion {
+		err := fmt.Errorf("unsupported API version %d, the server has version %d", in.Version, ctlsock.CurrentVersion)
+		send(conn, err, msg)
+		return
+	}
+	if in.EncryptPath != "" || in.DecryptPath != "" {
+		send(conn, errors.New("EncryptPath and DecryptPath are not used in versioned requests, use Command"), msg)
+		return
+	}
+	var err error
+	switch in.Command {
+	case ctlsock.CmdEncryptPath:
+		msg.Result, msg.WarnText, err = ch.translatePath(in.Path, true)
+	case ctlsock.CmdDecryptPath:
+		msg.Result, msg.WarnText, err = ch.translatePath(in.Path, false)
+	case ctlsock.CmdEncryptPaths:
+		msg.Results, err = ch.translatePaths(in.Paths, true)
+	case ctlsock.CmdDecryptPaths:
+		msg.Results, err = ch.translatePaths(in.Paths, false)
+	case ctlsock.CmdStatus:
+		st := ch.mount.Status()
+		msg.Status = &st
+	case ctlsock.CmdOpenFiles:
+		msg.OpenFiles = ch.mount.OpenFiles()
+	case ctlsock.CmdFlushDirCache:
+		err = ch.mount.FlushDirCache()
+	case ctlsock.CmdSetDebug:
+		ch.mount.SetDebug(in.Debug)
+	case ctlsock.CmdUnmount:
+		err = ch.mount.Unmount()
+	case ctlsock.CmdFeatureFlags:
+		msg.FeatureFlags = ch.mount.FeatureFlags()
+	case ctlsock.CmdMetrics:
+		msg.Metrics = ch.mount.Metrics()
+	case "":
+		err = errors.New("Empty command")
+	default:
+		err = fmt.Errorf("Unknown command %q", in.Command)
+	}
+	if err != nil {
+		// Do not return partial results
+		msg = ctlsock.ResponseStruct{Version: msg.Version, WarnText: msg.WarnText}
+	}
+	send(conn, err, msg)
 }
 
 // sendResponse sends a JSON response message
@@ -137,17 +313,27 @@ func sendResponse(conn *net.UnixConn, err error, result string, warnText string)
 		Result:   result,
 		WarnText: warnText,
 	}
+	send(conn, err, msg)
+}
+
+// errNo extracts the error number from "err", or returns -1 if there is
+// none
+func errNo(err error) int32 {
+	if pe, ok := err.(*os.PathError); ok {
+		if se, ok := pe.Err.(syscall.Errno); ok {
+			return int32(se)
+		}
+	} else if se, ok := err.(syscall.Errno); ok {
+		return int32(se)
+	}
+	return -1
+}
+
+// send fills in the error fields of "msg" and sends it
+func send(conn *net.UnixConn, err error, msg ctlsock.ResponseStruct) {
 	if err != nil {
 		msg.ErrText = err.Error()
-		msg.ErrNo = -1
-		// Try to extract the actual error number
-		if pe, ok := err.(*os.PathError); ok {
-			if se, ok := pe.Err.(syscall.Errno); ok {
-				msg.ErrNo = int32(se)
-			}
-		} else if err == syscall.ENOENT {
-			msg.ErrNo = int32(syscall.ENOENT)
-		}
+		msg.ErrNo = errNo(err)
 	}
 	jsonMsg, err := json.Marshal(msg)
 	if err != nil {
@@ -72,6 +72,15 @@ const (
 	DevNull = 30
 	// FIDO2Error - an error was encountered while interacting with a FIDO2 token
 	FIDO2Error = 31
+	// KMS - an error was encountered while talking to the external key
+	// management service
+	KMS = 32
+	// Rekey - one or more files could not be rewritten by "-rekey"
+	Rekey = 33
+	// Metrics - could not listen on the "-metrics" address
+	Metrics = 34
+	// Export - one or more entries could not be written by "-export"
+	Export = 35
 )
 
 // Err wraps an error with an associated numeric exit code
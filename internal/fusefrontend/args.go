@@ -1,6 +1,8 @@
 package fusefrontend
 
 import (
+	"time"
+
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
@@ -35,6 +37,18 @@ type Args struct {
 	// ExcludeFrom is a list of files from which to read exclusion patterns
 	// (with wildcard syntax)
 	ExcludeFrom []string
+	// ExcludeLargerThan hides regular files larger than this many bytes.
+	// 0 means no limit.
+	ExcludeLargerThan int64
+	// ExcludeSpecial hides sockets, FIFOs and device nodes
+	ExcludeSpecial bool
+	// ExcludeOlderThan and ExcludeNewerThan hide files by their modification
+	// time. The zero value disables the check.
+	ExcludeOlderThan time.Time
+	ExcludeNewerThan time.Time
+	// ExcludeIgnoreFiles makes every directory's ".gocryptfs-ignore" file add
+	// exclusion patterns for that directory
+	ExcludeIgnoreFiles bool
 	// Suid is true if the filesystem has been mounted with the "-suid" flag.
 	// If it is false, we can ignore the GETXATTR "security.capability" calls,
 	// which are a performance problem for writes. See
@@ -49,6 +63,17 @@ type Args struct {
 	// like rsync's `--one-file-system` does.
 	// Only applicable to reverse mode.
 	OneFileSystem bool
+	// ConsistentReads makes reads fail when the backing file has changed
+	// since it was opened. Only applicable to reverse mode.
+	ConsistentReads bool
+	// Writable allows writing ciphertext into the reverse view, which is
+	// decrypted into the backing plaintext directory. Used for restoring a
+	// backup. Only applicable to reverse mode.
+	Writable bool
 	// DeterministicNames disables gocryptfs.diriv files
 	DeterministicNames bool
+	// Compression is the compression algorithm (see contentenc.CompressionLZ4)
+	// or empty. Reverse mode presents compressed files, forward mode can
+	// read them.
+	Compression string
 }
@@ -1,22 +1,18 @@
 package fusefrontend
 
 import (
-	"path"
-	"path/filepath"
-	"strings"
 	"syscall"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
-	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
-	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
-var _ ctlsocksrv.Interface = &RootNode{} // Verify that interface is implemented.
+var _ ctlsocksrv.Interface = &RootNode{}      // Verify that interface is implemented.
+var _ ctlsocksrv.BatchInterface = &RootNode{} // Verify that interface is implemented.
 
 // EncryptPath implements ctlsock.Backend
 //
-// Symlink-safe through openBackingDir().
+// Symlink-safe through openBackingDir() and EncryptPathAt().
 func (rn *RootNode) EncryptPath(plainPath string) (cipherPath string, err error) {
 	if rn.args.PlaintextNames || plainPath == "" {
 		return plainPath, nil
@@ -28,32 +24,9 @@ func (rn *RootNode) EncryptPath(plainPath string) (cipherPath string, err error)
 	}
 	defer syscall.Close(dirfd)
 
-	// Encrypt path level by level
-	parts := strings.Split(plainPath, "/")
-	wd := dirfd
-	for i, part := range parts {
-		dirIV, err := rn.nameTransform.ReadDirIVAt(wd)
-		if err != nil {
-			return "", err
-		}
-		cPart, err := rn.nameTransform.EncryptAndHashName(part, dirIV)
-		if err != nil {
-			return "", err
-		}
-		cipherPath = filepath.Join(cipherPath, cPart)
-		// Last path component? We are done.
-		if i == len(parts)-1 {
-			break
-		}
-		// Descend into next directory
-		wd, err = syscallcompat.Openat(wd, cPart, syscall.O_NOFOLLOW|syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
-		if err != nil {
-			return "", err
-		}
-		// Yes this is somewhat wasteful in terms of used file descriptors:
-		// we keep them all open until the function returns. But it is simple
-		// and reliable.
-		defer syscall.Close(wd)
+	cipherPath, err = rn.nameTransform.EncryptPathAt(dirfd, plainPath)
+	if err != nil {
+		return "", err
 	}
 	tlog.Debug.Printf("EncryptPath %q -> %q", plainPath, cipherPath)
 	return cipherPath, nil
@@ -61,7 +34,7 @@ func (rn *RootNode) EncryptPath(plainPath string) (cipherPath string, err error)
 
 // DecryptPath implements ctlsock.Backend
 //
-// DecryptPath is symlink-safe because openBackingDir() and decryptPathAt()
+// DecryptPath is symlink-safe because openBackingDir() and DecryptPathAt()
 // are symlink-safe.
 func (rn *RootNode) DecryptPath(cipherPath string) (plainPath string, err error) {
 	if rn.args.PlaintextNames || cipherPath == "" {
@@ -74,39 +47,53 @@ func (rn *RootNode) DecryptPath(cipherPath string) (plainPath string, err error)
 	}
 	defer syscall.Close(dirfd)
 
-	// Decrypt path level by level
-	parts := strings.Split(cipherPath, "/")
-	wd := dirfd
-	for i, part := range parts {
-		dirIV, err := rn.nameTransform.ReadDirIVAt(wd)
-		if err != nil {
-			return "", err
-		}
-		longPart := part
-		if nametransform.IsLongContent(part) {
-			longPart, err = nametransform.ReadLongNameAt(wd, part)
-			if err != nil {
-				return "", err
-			}
-		}
-		name, err := rn.nameTransform.DecryptName(longPart, dirIV)
-		if err != nil {
-			return "", err
+	return rn.nameTransform.DecryptPathAt(dirfd, cipherPath)
+}
+
+// EncryptPaths implements ctlsocksrv.BatchInterface. Paths that share a
+// directory only read its IV once.
+func (rn *RootNode) EncryptPaths(plainPaths []string) (cipherPaths []string, errs []error) {
+	return rn.translatePaths(plainPaths, true)
+}
+
+// DecryptPaths implements ctlsocksrv.BatchInterface, see EncryptPaths.
+func (rn *RootNode) DecryptPaths(cipherPaths []string) (plainPaths []string, errs []error) {
+	return rn.translatePaths(cipherPaths, false)
+}
+
+// translatePaths encrypts or decrypts all of "in" using a single
+// nametransform.PathTranslator.
+//
+// Symlink-safe through openBackingDir() and PathTranslator.
+func (rn *RootNode) translatePaths(in []string, encrypt bool) (out []string, errs []error) {
+	out = make([]string, len(in))
+	errs = make([]error, len(in))
+	if rn.args.PlaintextNames {
+		copy(out, in)
+		return out, errs
+	}
+
+	dirfd, _, errno := rn.prepareAtSyscallMyself()
+	if errno != 0 {
+		for i := range errs {
+			errs[i] = errno
 		}
-		plainPath = path.Join(plainPath, name)
-		// Last path component? We are done.
-		if i == len(parts)-1 {
-			break
+		return out, errs
+	}
+	defer syscall.Close(dirfd)
+
+	t := rn.nameTransform.NewPathTranslator(dirfd)
+	defer t.Close()
+	for i, p := range in {
+		if p == "" {
+			continue
 		}
-		// Descend into next directory
-		wd, err = syscallcompat.Openat(wd, part, syscall.O_NOFOLLOW|syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
-		if err != nil {
-			return "", err
+		if encrypt {
+			out[i], errs[i] = t.Encrypt(p)
+		} else {
+			out[i], errs[i] = t.Decrypt(p)
 		}
-		// Yes this is somewhat wasteful in terms of used file descriptors:
-		// we keep them all open until the function returns. But it is simple
-		// and reliable.
-		defer syscall.Close(wd)
 	}
-	return plainPath, nil
+	tlog.Debug.Printf("translatePaths: translated %d paths", len(in))
+	return out, errs
 }
@@ -7,6 +7,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/metrics"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
@@ -135,9 +136,11 @@ func (d *dirCache) Lookup(node *Node) (fd int, iv []byte) {
 		break
 	}
 	if fd == 0 {
+		metrics.DirCacheMisses.Inc()
 		d.dbg("dirCache.Lookup %p miss\n", node)
 		return -1, nil
 	}
+	metrics.DirCacheHits.Inc()
 	if enableStats {
 		d.hits++
 	}
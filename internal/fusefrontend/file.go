@@ -19,6 +19,7 @@ import (
 
 	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/v2/internal/inomap"
+	"github.com/rfjakob/gocryptfs/v2/internal/metrics"
 	"github.com/rfjakob/gocryptfs/v2/internal/openfiletable"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
@@ -52,6 +53,12 @@ type File struct {
 	rootNode *RootNode
 }
 
+// reportMitigatedCorruption reports a corrupt block in this file. The item is
+// the inode number of the backing file.
+func (f *File) reportMitigatedCorruption() {
+	f.rootNode.reportMitigatedCorruption(f.rootNode.inoMap.Translate(f.qIno), fmt.Sprint(f.qIno.Ino))
+}
+
 // NewFile returns a new go-fuse File instance based on an already-open file
 // descriptor. NewFile internally calls Fstat() on the fd. The resulting Stat_t
 // is returned because node.Create() needs it.
@@ -84,9 +91,9 @@ func (f *File) intFd() int {
 	return int(f.fd.Fd())
 }
 
-// readFileID loads the file header from disk and extracts the file ID.
+// readHeader loads the file header from disk.
 // Returns io.EOF if the file is empty.
-func (f *File) readFileID() ([]byte, error) {
+func (f *File) readHeader() (*contentenc.FileHeader, error) {
 	// We read +1 byte to determine if the file has actual content
 	// and not only the header. A header-only file will be considered empty.
 	// This makes File ID poisoning more difficult.
@@ -95,25 +102,21 @@ func (f *File) readFileID() ([]byte, error) {
 	n, err := f.fd.ReadAt(buf, 0)
 	if err != nil {
 		if err == io.EOF && n != 0 {
-			tlog.Warn.Printf("readFileID %d: incomplete file, got %d instead of %d bytes",
+			tlog.Warn.Printf("readHeader %d: incomplete file, got %d instead of %d bytes",
 				f.qIno.Ino, n, readLen)
-			f.rootNode.reportMitigatedCorruption(fmt.Sprint(f.qIno.Ino))
+			f.reportMitigatedCorruption()
 		}
 		return nil, err
 	}
 	buf = buf[:contentenc.HeaderLen]
-	h, err := contentenc.ParseHeader(buf)
-	if err != nil {
-		return nil, err
-	}
-	return h.ID, nil
+	return contentenc.ParseHeader(buf)
 }
 
-// createHeader creates a new random header and writes it to disk.
-// Returns the new file ID.
+// createHeader creates a new random header for the current key epoch and
+// writes it to disk.
 // The caller must hold fileIDLock.Lock().
-func (f *File) createHeader() (fileID []byte, err error) {
-	h := contentenc.RandomHeader()
+func (f *File) createHeader() (h *contentenc.FileHeader, err error) {
+	h = f.contentEnc.NewHeader()
 	buf := h.Pack()
 	// Prevent partially written (=corrupt) header by preallocating the space beforehand
 	if !f.rootNode.args.NoPrealloc && f.rootNode.quirks&syscallcompat.QuirkBrokenFalloc == 0 {
@@ -130,7 +133,51 @@ func (f *File) createHeader() (fileID []byte, err error) {
 	if err != nil {
 		return nil, err
 	}
-	return h.ID, err
+	return h, err
+}
+
+// loadHeader reads the file header into the open file table entry, unless
+// it is already cached there. For compressed files, the block index is
+// loaded as well. Returns io.EOF if the file is empty.
+// The caller must hold IDLock or an exclusive lock on ContentLock.
+func (f *File) loadHeader() error {
+	if f.fileTableEntry.ID != nil {
+		return nil
+	}
+	h, err := f.readHeader()
+	if err != nil {
+		return err
+	}
+	var index *contentenc.BlockIndex
+	if h.Version == contentenc.CompressedVersion {
+		if f.rootNode.args.Compression == "" {
+			return fmt.Errorf("compressed file, but compression is not enabled")
+		}
+		fi, err := f.fd.Stat()
+		if err != nil {
+			return err
+		}
+		index, err = f.contentEnc.ReadBlockIndex(f.fd, uint64(fi.Size()))
+		if err != nil {
+			return err
+		}
+	}
+	f.fileTableEntry.ID = h.ID
+	f.fileTableEntry.Epoch = h.Epoch
+	f.fileTableEntry.Index = index
+	return nil
+}
+
+// epochContentEnc returns the ContentEnc for the key epoch stored in the open
+// file table entry.
+func (f *File) epochContentEnc(epoch uint32) (*contentenc.ContentEnc, syscall.Errno) {
+	ce, err := f.contentEnc.ForEpoch(epoch)
+	if err != nil {
+		tlog.Warn.Printf("ino%d: %v", f.qIno.Ino, err)
+		f.reportMitigatedCorruption()
+		return nil, syscall.EIO
+	}
+	return ce, 0
 }
 
 // doRead - read "length" plaintext bytes from plaintext offset "off" and append
@@ -144,36 +191,34 @@ func (f *File) createHeader() (fileID []byte, err error) {
 // by Write() and Truncate() via doWrite() for Read-Modify-Write.
 func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, syscall.Errno) {
 	// Get the file ID, either from the open file table, or from disk.
-	var fileID []byte
 	f.fileTableEntry.IDLock.Lock()
-	if f.fileTableEntry.ID != nil {
-		// Use the cached value in the file table
-		fileID = f.fileTableEntry.ID
-	} else {
-		// Not cached, we have to read it from disk.
-		var err error
-		fileID, err = f.readFileID()
-		if err != nil {
-			f.fileTableEntry.IDLock.Unlock()
-			if err == io.EOF {
-				// Empty file
-				return nil, 0
-			}
-			buf := make([]byte, 100)
-			n, _ := f.fd.ReadAt(buf, 0)
-			buf = buf[:n]
-			hexdump := hex.EncodeToString(buf)
-			tlog.Warn.Printf("doRead %d: corrupt header: %v\nFile hexdump (%d bytes): %s",
-				f.qIno.Ino, err, n, hexdump)
-			return nil, syscall.EIO
-		}
-		// Save into the file table
-		f.fileTableEntry.ID = fileID
-	}
+	err := f.loadHeader()
+	fileID := f.fileTableEntry.ID
+	epoch := f.fileTableEntry.Epoch
+	index := f.fileTableEntry.Index
 	f.fileTableEntry.IDLock.Unlock()
+	if err == io.EOF {
+		// Empty file
+		return nil, 0
+	} else if err != nil {
+		buf := make([]byte, 100)
+		n, _ := f.fd.ReadAt(buf, 0)
+		buf = buf[:n]
+		hexdump := hex.EncodeToString(buf)
+		tlog.Warn.Printf("doRead %d: corrupt header: %v\nFile hexdump (%d bytes): %s",
+			f.qIno.Ino, err, n, hexdump)
+		return nil, syscall.EIO
+	}
 	if fileID == nil {
 		log.Panicf("fileID=%v", fileID)
 	}
+	ce, errno := f.epochContentEnc(epoch)
+	if errno != 0 {
+		return nil, errno
+	}
+	if index != nil {
+		return f.doReadCompressed(dst, off, length, ce, fileID, index)
+	}
 	// Read the backing ciphertext in one go
 	blocks := f.contentEnc.ExplodePlainRange(off, length)
 	alignedOffset, alignedLength := blocks[0].JointCiphertextRange(blocks)
@@ -204,7 +249,7 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, syscall.Er
 	tlog.Debug.Printf("ReadAt offset=%d bytes (%d blocks), want=%d, got=%d", alignedOffset, firstBlockNo, alignedLength, n)
 
 	// Decrypt it
-	plaintext, err := f.contentEnc.DecryptBlocks(ciphertext, firstBlockNo, fileID)
+	plaintext, err := ce.DecryptBlocks(ciphertext, firstBlockNo, fileID)
 	f.rootNode.contentEnc.CReqPool.Put(ciphertext)
 	if err != nil {
 		corruptBlockNo := firstBlockNo + f.contentEnc.PlainOffToBlockNo(uint64(len(plaintext)))
@@ -248,6 +293,7 @@ func (f *File) Read(ctx context.Context, buf []byte, off int64) (resultData fuse
 		return nil, errno
 	}
 	tlog.Debug.Printf("ino%d: Read: errno=%d, returning %d bytes", f.qIno.Ino, errno, len(out))
+	metrics.BytesRead.Add(uint64(len(out)))
 	return fuse.ReadResultData(out), errno
 }
 
@@ -267,21 +313,28 @@ func (f *File) doWrite(data []byte, off int64) (uint32, syscall.Errno) {
 	//
 	// If the file ID is not cached, read it from disk
 	if f.fileTableEntry.ID == nil {
-		var err error
-		fileID, err := f.readFileID()
+		h, err := f.readHeader()
 		// Write a new file header if the file is empty
 		if err == io.EOF {
-			fileID, err = f.createHeader()
+			h, err = f.createHeader()
 			fileWasEmpty = true
 		} else if err != nil {
-			// Other errors mean readFileID() found a corrupt header
+			// Other errors mean readHeader() found a corrupt header
 			tlog.Warn.Printf("doWrite %d: corrupt header: %v", f.qIno.Ino, err)
 			return 0, syscall.EIO
 		}
 		if err != nil {
 			return 0, fs.ToErrno(err)
 		}
-		f.fileTableEntry.ID = fileID
+		if h.Version == contentenc.CompressedVersion {
+			log.Panicf("BUG: ino%d: doWrite on compressed file", f.qIno.Ino)
+		}
+		f.fileTableEntry.ID = h.ID
+		f.fileTableEntry.Epoch = h.Epoch
+	}
+	ce, errno := f.epochContentEnc(f.fileTableEntry.Epoch)
+	if errno != 0 {
+		return 0, errno
 	}
 	// Handle payload data
 	dataBuf := bytes.NewBuffer(data)
@@ -307,10 +360,12 @@ func (f *File) doWrite(data []byte, off int64) (uint32, syscall.Errno) {
 		toEncrypt[i] = blockData
 	}
 	// Encrypt all blocks
-	ciphertext := f.contentEnc.EncryptBlocks(toEncrypt, blocks[0].BlockNo, f.fileTableEntry.ID)
+	ciphertext, err := ce.EncryptBlocks(toEncrypt, blocks[0].BlockNo, f.fileTableEntry.ID)
+	if err != nil {
+		return 0, fs.ToErrno(err)
+	}
 	// Preallocate so we cannot run out of space in the middle of the write.
 	// This prevents partially written (=corrupt) blocks.
-	var err error
 	cOff := blocks[0].BlockCipherOff()
 	// f.fd.WriteAt & syscallcompat.EnospcPrealloc take int64 offsets!
 	if cOff > math.MaxInt64 {
@@ -374,6 +429,9 @@ func (f *File) Write(ctx context.Context, data []byte, off int64) (uint32, sysca
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
 	tlog.Debug.Printf("ino%d: FUSE Write: offset=%d length=%d", f.qIno.Ino, off, len(data))
+	if errno := f.ensureUncompressed(); errno != 0 {
+		return 0, errno
+	}
 	// If the write creates a file hole, we have to zero-pad the last block.
 	// But if the write directly follows an earlier write, it cannot create a
 	// hole, and we can save one Stat() call.
@@ -387,6 +445,7 @@ func (f *File) Write(ctx context.Context, data []byte, off int64) (uint32, sysca
 	if errno == 0 {
 		f.lastOpCount = openfiletable.WriteOpCount()
 		f.lastWrittenOffset = off + int64(len(data)) - 1
+		metrics.BytesWritten.Add(uint64(n))
 	}
 	return n, errno
 }
@@ -437,7 +496,11 @@ func (f *File) Getattr(ctx context.Context, a *fuse.AttrOut) syscall.Errno {
 	}
 	f.rootNode.inoMap.TranslateStat(&st)
 	a.FromStat(&st)
-	a.Size = f.contentEnc.CipherSizeToPlainSize(a.Size)
+	if plainSize, ok := f.compressedPlainSize(); ok {
+		a.Size = plainSize
+	} else {
+		a.Size = f.contentEnc.CipherSizeToPlainSize(a.Size)
+	}
 	if f.rootNode.args.ForceOwner != nil {
 		a.Owner = *f.rootNode.args.ForceOwner
 	}
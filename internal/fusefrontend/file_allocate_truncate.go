@@ -53,6 +53,9 @@ func (f *File) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32)
 	}
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
+	if errno := f.ensureUncompressed(); errno != 0 {
+		return errno
+	}
 
 	blocks := f.contentEnc.ExplodePlainRange(off, sz)
 	firstBlock := blocks[0]
@@ -104,8 +107,12 @@ func (f *File) truncate(newSize uint64) (errno syscall.Errno) {
 		}
 		// Truncate to zero kills the file header
 		f.fileTableEntry.ID = nil
+		f.fileTableEntry.Index = nil
 		return 0
 	}
+	if errno = f.ensureUncompressed(); errno != 0 {
+		return errno
+	}
 	// We need the old file size to determine if we are growing or shrinking
 	// the file
 	oldSize, err := f.statPlainSize()
@@ -167,11 +174,15 @@ func (f *File) statPlainSize() (uint64, error) {
 
 // truncateGrowFile extends a file using seeking or ftruncate performing RMW on
 // the first and last block as necessary. New blocks in the middle become
-// file holes unless they have been fallocate()'d beforehand.
+// file holes unless they have been fallocate()'d beforehand, or the blocks
+// are signed.
 func (f *File) truncateGrowFile(oldPlainSz uint64, newPlainSz uint64) syscall.Errno {
 	if newPlainSz <= oldPlainSz {
 		log.Panicf("BUG: newSize=%d <= oldSize=%d", newPlainSz, oldPlainSz)
 	}
+	if f.contentEnc.Signed() {
+		return f.zeroFill(oldPlainSz, newPlainSz)
+	}
 	newEOFOffset := newPlainSz - 1
 	if oldPlainSz > 0 {
 		n1 := f.contentEnc.PlainOffToBlockNo(oldPlainSz - 1)
@@ -197,11 +208,12 @@ func (f *File) truncateGrowFile(oldPlainSz uint64, newPlainSz uint64) syscall.Er
 	if newPlainSz%f.contentEnc.PlainBS() == 0 {
 		// The file was empty, so it did not have a header. Create one.
 		if oldPlainSz == 0 {
-			id, err := f.createHeader()
+			h, err := f.createHeader()
 			if err != nil {
 				return fs.ToErrno(err)
 			}
-			f.fileTableEntry.ID = id
+			f.fileTableEntry.ID = h.ID
+			f.fileTableEntry.Epoch = h.Epoch
 		}
 		cSz := int64(f.contentEnc.PlainSizeToCipherSize(newPlainSz))
 		err := syscall.Ftruncate(f.intFd(), cSz)
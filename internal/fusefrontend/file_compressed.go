@@ -0,0 +1,300 @@
+package fusefrontend
+
+// Reading compressed files, and converting them to the normal file format
+// before they are modified
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// doReadCompressed is doRead for compressed files.
+func (f *File) doReadCompressed(dst []byte, off uint64, length uint64, ce *contentenc.ContentEnc,
+	fileID []byte, index *contentenc.BlockIndex) ([]byte, syscall.Errno) {
+	if off >= index.PlainSize || length == 0 {
+		return dst, 0
+	}
+	end := contentenc.MinUint64(off+length, index.PlainSize)
+	firstBlockNo := ce.PlainOffToBlockNo(off)
+	lastBlockNo := ce.PlainOffToBlockNo(end - 1)
+	cOff := index.BlockCipherOff(firstBlockNo)
+	ciphertext := make([]byte, index.BlockCipherOff(lastBlockNo+1)-cOff)
+	_, err := f.fd.ReadAt(ciphertext, int64(cOff))
+	if err != nil {
+		// The index says the file is larger. The file must have been
+		// truncated behind our back.
+		tlog.Warn.Printf("doReadCompressed %d: ReadAt off=%d len=%d: %v", f.qIno.Ino, cOff, len(ciphertext), err)
+		return nil, syscall.EIO
+	}
+	plaintext := make([]byte, 0, (lastBlockNo-firstBlockNo+1)*ce.PlainBS())
+	for blockNo := firstBlockNo; blockNo <= lastBlockNo; blockNo++ {
+		start := index.BlockCipherOff(blockNo) - cOff
+		block := ciphertext[start : start+uint64(index.CipherLen[blockNo])]
+		p, err := ce.DecryptCompressedBlock(block, blockNo, fileID, ce.BlockPlainLen(index.PlainSize, blockNo))
+		if err != nil {
+			tlog.Warn.Printf("doReadCompressed %d: corrupt block #%d: %v", f.qIno.Ino, blockNo, err)
+			f.reportMitigatedCorruption()
+			return nil, syscall.EIO
+		}
+		plaintext = append(plaintext, p...)
+	}
+	skip := off - ce.BlockNoToPlainOff(firstBlockNo)
+	return append(dst, plaintext[skip:skip+end-off]...), 0
+}
+
+const (
+	// uncompressPrefix is the name prefix of the converted copies that
+	// ensureUncompressed writes to the root of CIPHERDIR
+	uncompressPrefix = nametransform.UncompressPrefix
+	// uncompressTmpSuffix marks a converted copy that is still being written
+	uncompressTmpSuffix = ".tmp"
+)
+
+// uncompressName returns the name of the converted copy of the file with
+// inode number "ino" and file ID "id".
+func uncompressName(ino uint64, id []byte) string {
+	return fmt.Sprintf("%s%d-%s", uncompressPrefix, ino, hex.EncodeToString(id))
+}
+
+// isUncompressName returns true if "name" in the root of CIPHERDIR is
+// reserved for the converted copies written by ensureUncompressed.
+func isUncompressName(name string) bool {
+	return strings.HasPrefix(name, uncompressPrefix)
+}
+
+// parseUncompressName parses a name returned by uncompressName, with or
+// without uncompressTmpSuffix. "ok" is false for any other name.
+func parseUncompressName(name string) (ino uint64, oldID string, tmp bool, ok bool) {
+	if !isUncompressName(name) {
+		return 0, "", false, false
+	}
+	if strings.HasSuffix(name, uncompressTmpSuffix) {
+		tmp = true
+		name = strings.TrimSuffix(name, uncompressTmpSuffix)
+	}
+	parts := strings.Split(strings.TrimPrefix(name, uncompressPrefix), "-")
+	if len(parts) != 2 {
+		return 0, "", false, false
+	}
+	ino, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", false, false
+	}
+	// 128 bit file ID
+	if id, err := hex.DecodeString(parts[1]); err != nil || len(id) != 16 {
+		return 0, "", false, false
+	}
+	return ino, parts[1], tmp, true
+}
+
+// ensureUncompressed converts a compressed file to the normal file format.
+// Compressed files cannot be modified in place, so this is called before
+// every write, truncate and fallocate.
+//
+// The converted file is written to a copy in the root of CIPHERDIR and
+// synced to disk before it is copied over the original file, which keeps
+// its inode, hard links and xattrs. If gocryptfs is killed during the copy,
+// the next mount finishes it (see recoverUncompressed).
+//
+// The caller must hold an exclusive lock on ContentLock.
+func (f *File) ensureUncompressed() syscall.Errno {
+	if f.rootNode.args.Compression == "" {
+		// There cannot be any compressed files
+		return 0
+	}
+	err := f.loadHeader()
+	if err == io.EOF {
+		return 0
+	} else if err != nil {
+		tlog.Warn.Printf("ensureUncompressed %d: corrupt header: %v", f.qIno.Ino, err)
+		return syscall.EIO
+	}
+	index := f.fileTableEntry.Index
+	if index == nil {
+		return 0
+	}
+	tlog.Debug.Printf("ino%d: converting compressed file (%d bytes)", f.qIno.Ino, index.PlainSize)
+	name := filepath.Join(f.rootNode.args.Cipherdir, uncompressName(f.qIno.Ino, f.fileTableEntry.ID))
+	tmp, err := os.OpenFile(name+uncompressTmpSuffix, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		tlog.Warn.Printf("ensureUncompressed %d: %v", f.qIno.Ino, err)
+		return fs.ToErrno(err)
+	}
+	defer tmp.Close()
+	// Only an incomplete copy is still there when we return
+	defer os.Remove(name + uncompressTmpSuffix)
+	// Write the file in the normal format to tmp
+	h := f.contentEnc.NewHeader()
+	if _, err = tmp.WriteAt(h.Pack(), 0); err != nil {
+		return fs.ToErrno(err)
+	}
+	blocksPerChunk := uint64(fuse.MAX_KERNEL_WRITE) / f.contentEnc.PlainBS()
+	if blocksPerChunk == 0 {
+		blocksPerChunk = 1
+	}
+	chunk := blocksPerChunk * f.contentEnc.PlainBS()
+	for off := uint64(0); off < index.PlainSize; off += chunk {
+		plaintext, errno := f.doRead(nil, off, chunk)
+		if errno != 0 {
+			return errno
+		}
+		var blocks [][]byte
+		for len(plaintext) > 0 {
+			n := contentenc.MinUint64(uint64(len(plaintext)), f.contentEnc.PlainBS())
+			blocks = append(blocks, plaintext[:n])
+			plaintext = plaintext[n:]
+		}
+		blockNo := f.contentEnc.PlainOffToBlockNo(off)
+		ciphertext, err := f.contentEnc.EncryptBlocks(blocks, blockNo, h.ID)
+		if err != nil {
+			return fs.ToErrno(err)
+		}
+		_, err = tmp.WriteAt(ciphertext, int64(f.contentEnc.BlockNoToCipherOff(blockNo)))
+		f.contentEnc.CReqPool.Put(ciphertext)
+		if err != nil {
+			tlog.Warn.Printf("ensureUncompressed %d: %v", f.qIno.Ino, err)
+			return fs.ToErrno(err)
+		}
+	}
+	if err = tmp.Sync(); err != nil {
+		tlog.Warn.Printf("ensureUncompressed %d: %v", f.qIno.Ino, err)
+		return fs.ToErrno(err)
+	}
+	if err = os.Rename(name+uncompressTmpSuffix, name); err != nil {
+		tlog.Warn.Printf("ensureUncompressed %d: %v", f.qIno.Ino, err)
+		return fs.ToErrno(err)
+	}
+	if err = syscallcompat.SyncDir(f.rootNode.args.Cipherdir); err != nil {
+		tlog.Warn.Printf("ensureUncompressed %d: %v", f.qIno.Ino, err)
+		os.Remove(name)
+		return fs.ToErrno(err)
+	}
+	// Replace the content of the original file
+	f.fileTableEntry.ID = nil
+	f.fileTableEntry.Index = nil
+	if err = syscallcompat.CopyOver(tmp, f.fd); err != nil {
+		tlog.Warn.Printf("ensureUncompressed %d: copy failed, the converted file is kept as %q "+
+			"and restored on the next mount: %v", f.qIno.Ino, name, err)
+		return fs.ToErrno(err)
+	}
+	os.Remove(name)
+	f.fileTableEntry.ID = h.ID
+	f.fileTableEntry.Epoch = h.Epoch
+	return 0
+}
+
+// recoverUncompressed finishes the conversions of compressed files that
+// ensureUncompressed could not complete because gocryptfs was killed or the
+// copy failed. Called on mount. A converted copy is only copied over a file
+// that has the recorded inode number and either the old or the new file ID,
+// so it cannot clobber an unrelated file that reused the inode number.
+func recoverUncompressed(cipherdir string) {
+	entries, err := os.ReadDir(cipherdir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		name := e.Name()
+		ino, oldID, tmp, ok := parseUncompressName(name)
+		if !ok {
+			continue
+		}
+		path := filepath.Join(cipherdir, name)
+		if tmp {
+			// The original file was not touched yet
+			os.Remove(path)
+			continue
+		}
+		if err := finishUncompressed(cipherdir, path, ino, oldID); err != nil {
+			tlog.Warn.Printf("recoverUncompressed: %q: %v", name, err)
+			continue
+		}
+		tlog.Info.Printf("recoverUncompressed: finished interrupted conversion of inode %d", ino)
+		os.Remove(path)
+	}
+}
+
+// finishUncompressed copies the converted copy at "path" over the file in
+// "cipherdir" it belongs to.
+func finishUncompressed(cipherdir string, path string, ino uint64, oldID string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	h, err := readHeaderFrom(src)
+	if err != nil {
+		return err
+	}
+	newID := hex.EncodeToString(h.ID)
+	var dstPath string
+	err = filepath.Walk(cipherdir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() || filepath.Dir(p) == cipherdir && isUncompressName(fi.Name()) {
+			return nil
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); !ok || uint64(st.Ino) != ino {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return nil
+		}
+		defer f.Close()
+		if h, err := readHeaderFrom(f); err == nil {
+			if id := hex.EncodeToString(h.ID); id == oldID || id == newID {
+				dstPath = p
+				return io.EOF
+			}
+		}
+		return nil
+	})
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if dstPath == "" {
+		return fmt.Errorf("file with inode %d not found, keeping the converted copy", ino)
+	}
+	dst, err := os.OpenFile(dstPath, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	return syscallcompat.CopyOver(src, dst)
+}
+
+// readHeaderFrom reads and parses the file header of the encrypted file "f"
+func readHeaderFrom(f *os.File) (*contentenc.FileHeader, error) {
+	buf := make([]byte, contentenc.HeaderLen)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return nil, err
+	}
+	return contentenc.ParseHeader(buf)
+}
+
+// compressedPlainSize returns the plaintext size of the file if it is a
+// compressed file, and ok=false otherwise.
+func (f *File) compressedPlainSize() (plainSize uint64, ok bool) {
+	if f.rootNode.args.Compression == "" {
+		return 0, false
+	}
+	f.fileTableEntry.IDLock.Lock()
+	defer f.fileTableEntry.IDLock.Unlock()
+	if f.loadHeader() != nil || f.fileTableEntry.Index == nil {
+		return 0, false
+	}
+	return f.fileTableEntry.Index.PlainSize, true
+}
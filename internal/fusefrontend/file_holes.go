@@ -8,7 +8,9 @@ import (
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
@@ -32,6 +34,11 @@ func (f *File) writePadHole(targetOff int64) syscall.Errno {
 	if targetBlock <= nextBlock {
 		return 0
 	}
+	// Signed blocks cannot be file holes. Fill everything up to the target
+	// block.
+	if f.contentEnc.Signed() {
+		return f.zeroFill(plainSize, f.contentEnc.BlockNoToPlainOff(targetBlock))
+	}
 	// The write goes past the next block. nextBlock has
 	// to be zero-padded to the block boundary and (at least) nextBlock+1
 	// will contain a file hole in the ciphertext.
@@ -42,6 +49,26 @@ func (f *File) writePadHole(targetOff int64) syscall.Errno {
 	return 0
 }
 
+// zeroFill grows the file of size "from" to size "to" by writing encrypted
+// zeros instead of creating a file hole. On "-write-auth" filesystems, an
+// all-zero block has no valid signature and cannot be a file hole.
+func (f *File) zeroFill(from uint64, to uint64) syscall.Errno {
+	// Write requests of at most MAX_KERNEL_WRITE, aligned to the block size
+	chunk := uint64(fuse.MAX_KERNEL_WRITE) / f.contentEnc.PlainBS() * f.contentEnc.PlainBS()
+	if chunk == 0 {
+		chunk = f.contentEnc.PlainBS()
+	}
+	zeros := make([]byte, chunk)
+	for off := from; off < to; {
+		n := contentenc.MinUint64(to-off, (off/chunk+1)*chunk-off)
+		if _, errno := f.doWrite(zeros[:n], int64(off)); errno != 0 {
+			return errno
+		}
+		off += n
+	}
+	return 0
+}
+
 // Zero-pad the file of size plainSize to the next block boundary. This is a no-op
 // if the file is already block-aligned.
 func (f *File) zeroPad(plainSize uint64) syscall.Errno {
@@ -80,6 +107,16 @@ func (f *File) Lseek(ctx context.Context, off uint64, whence uint32) (uint64, sy
 		tlog.Warn.Printf("buggy on non-linux platforms, disabling SEEK_DATA & SEEK_HOLE")
 		return MinusOne, syscall.ENOSYS
 	}
+	// Compressed files have no holes
+	if plainSize, ok := f.compressedPlainSize(); ok {
+		if off >= plainSize {
+			return MinusOne, syscall.ENXIO
+		}
+		if whence == SEEK_DATA {
+			return off, 0
+		}
+		return plainSize, 0
+	}
 
 	// We will need the file size
 	var st syscall.Stat_t
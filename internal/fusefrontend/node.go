@@ -366,12 +366,15 @@ func (n *Node) Symlink(ctx context.Context, target, name string, out *fuse.Entry
 	}
 
 	cTarget := target
+	var err error
 	if !rn.args.PlaintextNames {
 		// Symlinks are encrypted like file contents (GCM) and base64-encoded
-		cTarget = rn.encryptSymlinkTarget(target)
+		cTarget, err = rn.encryptSymlinkTarget(target)
+		if err != nil {
+			return nil, fs.ToErrno(err)
+		}
 	}
 	// Create ".name" file to store long file name (except in PlaintextNames mode)
-	var err error
 	ctx2 := toFuseCtx(ctx)
 	if !rn.args.PlaintextNames && nametransform.IsLongContent(cName) {
 		err = rn.nameTransform.WriteLongNameAt(dirfd, cName, name)
@@ -202,6 +202,10 @@ func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 			// silently ignore "gocryptfs.conf" in the top level dir
 			continue
 		}
+		if n.IsRoot() && nametransform.IsReservedRootName(cName) {
+			// internal file, like the converted copy of a compressed file
+			continue
+		}
 		if rn.args.PlaintextNames {
 			plain = append(plain, cipherEntries[i])
 			continue
@@ -220,7 +224,7 @@ func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 			if err != nil {
 				tlog.Warn.Printf("OpenDir %q: invalid entry %q: Could not read .name: %v",
 					cDirName, cName, err)
-				rn.reportMitigatedCorruption(cName)
+				rn.reportMitigatedCorruption(n.StableAttr().Ino, cName)
 				continue
 			}
 			cName = cNameLong
@@ -232,7 +236,7 @@ func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 		if err != nil {
 			tlog.Warn.Printf("OpenDir %q: invalid entry %q: %v",
 				cDirName, cName, err)
-			rn.reportMitigatedCorruption(cName)
+			rn.reportMitigatedCorruption(n.StableAttr().Ino, cName)
 			continue
 		}
 		// Override the ciphertext name with the plaintext name but reuse the rest
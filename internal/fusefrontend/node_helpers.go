@@ -2,6 +2,7 @@ package fusefrontend
 
 import (
 	"context"
+	"os"
 	"sync/atomic"
 	"syscall"
 
@@ -9,6 +10,7 @@ import (
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
@@ -60,6 +62,12 @@ func (n *Node) readlink(dirfd int, cName string) (out []byte, errno syscall.Errn
 func (n *Node) translateSize(dirfd int, cName string, out *fuse.Attr) {
 	if out.IsRegular() {
 		rn := n.rootNode()
+		if rn.args.Compression != "" && out.Size > contentenc.HeaderLen {
+			if plainSize, ok := compressedPlainSize(dirfd, cName); ok {
+				out.Size = plainSize
+				return
+			}
+		}
 		out.Size = rn.contentEnc.CipherSizeToPlainSize(out.Size)
 	} else if out.IsSymlink() {
 		// read and decrypt target
@@ -68,6 +76,18 @@ func (n *Node) translateSize(dirfd int, cName string, out *fuse.Attr) {
 	}
 }
 
+// compressedPlainSize opens the file and returns its plaintext size if it is a
+// compressed file.
+func compressedPlainSize(dirfd int, cName string) (plainSize uint64, ok bool) {
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return 0, false
+	}
+	f := os.NewFile(uintptr(fd), cName)
+	defer f.Close()
+	return contentenc.CompressedPlainSize(f)
+}
+
 // Path returns the relative plaintext path of this node
 func (n *Node) Path() string {
 	return n.Inode.Path(n.Root())
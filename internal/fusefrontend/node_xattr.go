@@ -7,6 +7,7 @@ import (
 	"strings"
 	"syscall"
 
+	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
@@ -100,7 +101,10 @@ func (n *Node) Setxattr(ctx context.Context, attr string, data []byte, flags uin
 	if err != nil {
 		return syscall.EINVAL
 	}
-	cData := rn.encryptXattrValue(data)
+	cData, err := rn.encryptXattrValue(data)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
 	return n.setXAttr(nil, cAttr, cData, flags)
 }
 
@@ -144,13 +148,13 @@ func (n *Node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errn
 		name, err := rn.decryptXattrName(curName)
 		if err != nil {
 			tlog.Warn.Printf("ListXAttr: invalid xattr name %q: %v", curName, err)
-			rn.reportMitigatedCorruption(curName)
+			rn.reportMitigatedCorruption(n.StableAttr().Ino, curName)
 			continue
 		}
 		// We *used to* encrypt ACLs, which caused a lot of problems.
 		if isAcl(name) {
 			tlog.Warn.Printf("ListXAttr: ignoring deprecated encrypted ACL %q = %q", curName, name)
-			rn.reportMitigatedCorruption(curName)
+			rn.reportMitigatedCorruption(n.StableAttr().Ino, curName)
 			continue
 		}
 		buf.WriteString(name + "\000")
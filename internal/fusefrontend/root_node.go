@@ -39,7 +39,7 @@ type RootNode struct {
 	// reportMitigatedCorruption().
 	// "gocryptfs -fsck" reads from the channel to also catch these transparently-
 	// mitigated corruptions.
-	MitigatedCorruptions chan string
+	MitigatedCorruptions chan MitigatedCorruption
 	// IsIdle flag is set to zero each time fs.isFiltered() is called
 	// (uint32 so that it can be reset with CompareAndSwapUint32).
 	// When -idle was used when mounting, idleMonitor() sets it to 1
@@ -73,6 +73,12 @@ func NewRootNode(args Args, c *contentenc.ContentEnc, n *nametransform.NameTrans
 	if len(args.Exclude) > 0 {
 		tlog.Warn.Printf("Forward mode does not support -exclude")
 	}
+	if args.ConsistentReads {
+		tlog.Warn.Printf("Forward mode does not support -consistent-reads")
+	}
+	if args.Writable {
+		tlog.Warn.Printf("Forward mode does not support -writable")
+	}
 
 	ivLen := nametransform.DirIVLen
 	if args.PlaintextNames {
@@ -87,6 +93,9 @@ func NewRootNode(args Args, c *contentenc.ContentEnc, n *nametransform.NameTrans
 		dirCache:      dirCache{ivLen: ivLen},
 		quirks:        syscallcompat.DetectQuirks(args.Cipherdir),
 	}
+	if args.Compression != "" {
+		recoverUncompressed(args.Cipherdir)
+	}
 	return rn
 }
 
@@ -96,6 +105,12 @@ func (rn *RootNode) AfterUnmount() {
 	rn.dirCache.stats()
 }
 
+// FlushDirCache drops the cached directory fds and IVs. Called via the
+// control socket.
+func (rn *RootNode) FlushDirCache() {
+	rn.dirCache.Clear()
+}
+
 // mangleOpenFlags is used by Create() and Open() to convert the open flags the user
 // wants to the flags we internally use to open the backing file.
 // The returned flags always contain O_NOFOLLOW.
@@ -120,16 +135,27 @@ func (rn *RootNode) mangleOpenFlags(flags uint32) (newFlags int) {
 	return newFlags
 }
 
+// MitigatedCorruption is sent to the MitigatedCorruptions channel
+type MitigatedCorruption struct {
+	// Ino is the inode number (as seen through the mount) of the file or
+	// directory where the corruption was found. This allows "gocryptfs -fsck"
+	// to attribute the corruption when it checks several files at once.
+	Ino uint64
+	// Item is the name of the corrupt item
+	Item string
+}
+
 // reportMitigatedCorruption is used to report a corruption that was transparently
-// mitigated and did not return an error to the user. Pass the name of the corrupt
-// item (filename for OpenDir(), xattr name for ListXAttr() etc).
+// mitigated and did not return an error to the user. Pass the inode number
+// and the name of the corrupt item (filename for OpenDir(), xattr name for
+// ListXAttr() etc).
 // See the MitigatedCorruptions channel for more info.
-func (rn *RootNode) reportMitigatedCorruption(item string) {
+func (rn *RootNode) reportMitigatedCorruption(ino uint64, item string) {
 	if rn.MitigatedCorruptions == nil {
 		return
 	}
 	select {
-	case rn.MitigatedCorruptions <- item:
+	case rn.MitigatedCorruptions <- MitigatedCorruption{Ino: ino, Item: item}:
 	case <-time.After(1 * time.Second):
 		tlog.Warn.Printf("BUG: reportCorruptItem: timeout")
 		//debug.PrintStack()
@@ -150,6 +176,11 @@ func (rn *RootNode) isFiltered(child string) bool {
 			configfile.ConfDefaultName)
 		return true
 	}
+	// Names of internal files in the root directory are forbidden
+	if nametransform.IsReservedRootName(child) {
+		tlog.Info.Printf("The name /%s is reserved when -plaintextnames is used\n", child)
+		return true
+	}
 	// Note: gocryptfs.diriv is NOT forbidden because diriv and plaintextnames
 	// are exclusive
 	return false
@@ -225,22 +256,25 @@ func (rn *RootNode) openWriteOnlyFile(dirfd int, cName string, newFlags int) (rw
 // The empty string encrypts to the empty string.
 //
 // Symlink-safe because it does not do any I/O.
-func (rn *RootNode) encryptSymlinkTarget(data string) (cData64 string) {
+func (rn *RootNode) encryptSymlinkTarget(data string) (cData64 string, err error) {
 	if data == "" {
-		return ""
+		return "", nil
+	}
+	cData, err := rn.contentEnc.EncryptBlock([]byte(data), 0, nil)
+	if err != nil {
+		return "", err
 	}
-	cData := rn.contentEnc.EncryptBlock([]byte(data), 0, nil)
 	cData64 = rn.nameTransform.B64EncodeToString(cData)
-	return cData64
+	return cData64, nil
 }
 
 // encryptXattrValue encrypts the xattr value "data".
 // The data is encrypted like a file content block, but without binding it to
 // a file location (block number and file id are set to zero).
 // Special case: an empty value is encrypted to an empty value.
-func (rn *RootNode) encryptXattrValue(data []byte) (cData []byte) {
+func (rn *RootNode) encryptXattrValue(data []byte) (cData []byte, err error) {
 	if len(data) == 0 {
-		return []byte{}
+		return []byte{}, nil
 	}
 	return rn.contentEnc.EncryptBlock(data, 0, nil)
 }
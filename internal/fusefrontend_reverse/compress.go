@@ -0,0 +1,198 @@
+package fusefrontend_reverse
+
+// Presenting files in the compressed format (see contentenc/compress.go)
+
+import (
+	"container/list"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/inomap"
+	"github.com/rfjakob/gocryptfs/v2/internal/pathiv"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// indexCacheMax is the number of block indexes we keep. When the cache is
+// full, the least recently used entry is dropped.
+const indexCacheMax = 1000
+
+// The ciphertext size of a compressed file is only known after the whole
+// file has been compressed. indexCache stores the block index so Lookup,
+// Getattr and Open do not have to do that every time. An entry is only used
+// if size and timestamps of the backing file have not changed.
+type indexCache struct {
+	sync.Mutex
+	entries map[indexCacheKey]*list.Element
+	// lru holds the *indexCacheEntry values, most recently used first
+	lru list.List
+}
+
+// indexCacheKey identifies a version of a backing file
+type indexCacheKey struct {
+	qi               inomap.QIno
+	size             uint64
+	mtime, mtimensec uint64
+}
+
+type indexCacheEntry struct {
+	key indexCacheKey
+	// ctime of the backing file when the index was created
+	ctime, ctimensec uint64
+	index            *contentenc.BlockIndex
+}
+
+// get returns the cached index for "key" if the ctime matches.
+func (c *indexCache) get(key indexCacheKey, a *fuse.Attr) *contentenc.BlockIndex {
+	c.Lock()
+	defer c.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*indexCacheEntry)
+	if e.ctime != a.Ctime || e.ctimensec != uint64(a.Ctimensec) {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return e.index
+}
+
+// put stores "index" and drops the least recently used entry if the cache
+// is full.
+func (c *indexCache) put(key indexCacheKey, a *fuse.Attr, index *contentenc.BlockIndex) {
+	c.Lock()
+	defer c.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[indexCacheKey]*list.Element)
+	}
+	e := &indexCacheEntry{key: key, ctime: a.Ctime, ctimensec: uint64(a.Ctimensec), index: index}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	if c.lru.Len() > indexCacheMax {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*indexCacheEntry).key)
+	}
+}
+
+// blockIndex returns the block index of the backing file "fd".
+func (rn *RootNode) blockIndex(fd int, st *syscall.Stat_t) (*contentenc.BlockIndex, error) {
+	var a fuse.Attr
+	a.FromStat(st)
+	key := indexCacheKey{
+		qi:        inomap.QInoFromStat(st),
+		size:      a.Size,
+		mtime:     a.Mtime,
+		mtimensec: uint64(a.Mtimensec),
+	}
+	if index := rn.indexCache.get(key, &a); index != nil {
+		return index, nil
+	}
+	index, err := rn.computeBlockIndex(fd)
+	if err != nil {
+		return nil, err
+	}
+	rn.indexCache.put(key, &a, index)
+	return index, nil
+}
+
+// openBlockIndex opens the backing file "pName" in "dirfd" and returns its
+// block index.
+func (rn *RootNode) openBlockIndex(dirfd int, pName string) (*contentenc.BlockIndex, error) {
+	fd, err := syscallcompat.Openat(dirfd, pName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fd, &st); err != nil {
+		return nil, err
+	}
+	return rn.blockIndex(fd, &st)
+}
+
+// computeBlockIndex compresses all blocks of the backing file "fd" to find
+// out their ciphertext length.
+func (rn *RootNode) computeBlockIndex(fd int) (*contentenc.BlockIndex, error) {
+	bs := rn.contentEnc.PlainBS()
+	buf := make([]byte, bs)
+	var plainSize uint64
+	var cipherLen []uint32
+	for {
+		n, err := syscall.Pread(fd, buf, int64(plainSize))
+		if err != nil {
+			tlog.Warn.Printf("computeBlockIndex: pread at %d: %v", plainSize, err)
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+		cipherLen = append(cipherLen, rn.contentEnc.CompressedBlockLen(buf[:n]))
+		plainSize += uint64(n)
+		if uint64(n) < bs {
+			break
+		}
+	}
+	return rn.contentEnc.NewBlockIndex(plainSize, cipherLen), nil
+}
+
+// readCompressed returns the synthesized header and index, and the
+// compressed blocks, in the ciphertext range off...off+length.
+func (f *File) readCompressed(off uint64, length uint64) ([]byte, syscall.Errno) {
+	size := f.index.CipherSize()
+	if off >= size {
+		return nil, 0
+	}
+	end := contentenc.MinUint64(off+length, size)
+	var out []byte
+	// Header and index
+	if metaLen := uint64(len(f.meta)); off < metaLen {
+		out = append(out, f.meta[off:contentenc.MinUint64(end, metaLen)]...)
+		off = metaLen
+		if off >= end {
+			return out, 0
+		}
+	}
+	// Blocks
+	bs := f.contentEnc.PlainBS()
+	firstBlockNo := f.index.CipherOffToBlockNo(off)
+	lastBlockNo := f.index.CipherOffToBlockNo(end - 1)
+	plaintext := make([]byte, (lastBlockNo-firstBlockNo+1)*bs)
+	n, err := syscall.Pread(int(f.fd.Fd()), plaintext, int64(firstBlockNo*bs))
+	if err != nil {
+		tlog.Warn.Printf("readCompressed: pread: %v", err)
+		return nil, syscall.EIO
+	}
+	plaintext = plaintext[:n]
+	for blockNo := firstBlockNo; blockNo <= lastBlockNo; blockNo++ {
+		start := (blockNo - firstBlockNo) * bs
+		if start >= uint64(len(plaintext)) {
+			tlog.Warn.Printf("readCompressed: file shrank while it was open")
+			return nil, syscall.EIO
+		}
+		p := plaintext[start:contentenc.MinUint64(start+bs, uint64(len(plaintext)))]
+		iv := pathiv.BlockIV(f.block0IV, blockNo)
+		block := f.contentEnc.EncryptCompressedBlock(p, blockNo, f.header.ID, iv)
+		if len(block) != int(f.index.CipherLen[blockNo]) {
+			// We cannot change the index of an open file
+			tlog.Warn.Printf("readCompressed: block %d changed while the file was open", blockNo)
+			return nil, syscall.EIO
+		}
+		blockOff := f.index.BlockCipherOff(blockNo)
+		var lo uint64
+		if off > blockOff {
+			lo = off - blockOff
+		}
+		hi := contentenc.MinUint64(end, blockOff+uint64(len(block))) - blockOff
+		out = append(out, block[lo:hi]...)
+	}
+	return out, 0
+}
@@ -0,0 +1,49 @@
+package fusefrontend_reverse
+
+import (
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/inomap"
+)
+
+// The least recently used index is dropped when the cache is full, and an
+// entry is only used while the ctime matches
+func TestIndexCache(t *testing.T) {
+	var c indexCache
+	key := func(ino uint64) indexCacheKey {
+		return indexCacheKey{qi: inomap.QIno{Ino: ino}, size: 100, mtime: 1}
+	}
+	a := fuse.Attr{Ctime: 5}
+	index := &contentenc.BlockIndex{}
+	for ino := uint64(0); ino < indexCacheMax; ino++ {
+		c.put(key(ino), &a, index)
+	}
+	// Use inode 0, so inode 1 is the least recently used one
+	if c.get(key(0), &a) != index {
+		t.Fatal("inode 0 not cached")
+	}
+	c.put(key(indexCacheMax), &a, index)
+	if c.get(key(1), &a) != nil {
+		t.Error("inode 1 should have been dropped")
+	}
+	for _, ino := range []uint64{0, 2, indexCacheMax} {
+		if c.get(key(ino), &a) != index {
+			t.Errorf("inode %d not cached", ino)
+		}
+	}
+	if len(c.entries) != indexCacheMax || c.lru.Len() != indexCacheMax {
+		t.Errorf("wrong size: %d %d", len(c.entries), c.lru.Len())
+	}
+	// Changed file
+	if c.get(key(0), &fuse.Attr{Ctime: 6}) != nil {
+		t.Error("entry with a different ctime was used")
+	}
+	k := key(0)
+	k.size++
+	if c.get(k, &a) != nil {
+		t.Error("entry with a different size was used")
+	}
+}
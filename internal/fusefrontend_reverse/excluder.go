@@ -4,23 +4,295 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 
 	"github.com/sabhiram/go-gitignore"
 )
 
+// ignoreFileName is the per-directory file with exclusion patterns that
+// "-exclude-ignore-files" reads
+const ignoreFileName = ".gocryptfs-ignore"
+
+// excluder decides which plaintext paths are hidden from the encrypted view.
+type excluder struct {
+	// cipherdir is the plaintext directory, needed to stat files and to read
+	// ignore files
+	cipherdir string
+	// patterns from -exclude, -exclude-wildcard and -exclude-from, or nil
+	patterns ignore.IgnoreParser
+	// largerThan is -exclude-larger-than, 0 means no limit
+	largerThan int64
+	// special is -exclude-special
+	special bool
+	// olderThan and newerThan are -exclude-older-than and -exclude-newer-than
+	olderThan time.Time
+	newerThan time.Time
+	// ignoreFiles is nil unless -exclude-ignore-files was passed
+	ignoreFiles *ignoreFileCache
+}
+
 // prepareExcluder creates an object to check if paths are excluded
-// based on the patterns specified in the command line.
-func prepareExcluder(args fusefrontend.Args) *ignore.GitIgnore {
-	patterns := getExclusionPatterns(args)
-	if len(patterns) == 0 {
-		log.Panic(patterns)
+// based on the options specified in the command line. Returns nil if
+// there are no exclusions.
+func prepareExcluder(args fusefrontend.Args) *excluder {
+	e := &excluder{
+		cipherdir:  args.Cipherdir,
+		largerThan: args.ExcludeLargerThan,
+		special:    args.ExcludeSpecial,
+		olderThan:  args.ExcludeOlderThan,
+		newerThan:  args.ExcludeNewerThan,
+	}
+	if len(args.Exclude) > 0 || len(args.ExcludeWildcard) > 0 || len(args.ExcludeFrom) > 0 {
+		patterns := getExclusionPatterns(args)
+		if len(patterns) == 0 {
+			log.Panic(patterns)
+		}
+		e.patterns = ignore.CompileIgnoreLines(patterns...)
+	}
+	if args.ExcludeIgnoreFiles {
+		e.ignoreFiles = newIgnoreFileCache()
+	}
+	if e.patterns == nil && e.ignoreFiles == nil && !e.checksAttr() {
+		return nil
+	}
+	return e
+}
+
+// checksAttr returns true if there are rules that need the file attributes
+func (e *excluder) checksAttr() bool {
+	return e.largerThan > 0 || e.special || !e.olderThan.IsZero() || !e.newerThan.IsZero()
+}
+
+// matchesPath checks the patterns and the ignore files against the
+// relative plaintext path "pPath"
+func (e *excluder) matchesPath(pPath string) bool {
+	if e.patterns != nil && e.patterns.MatchesPath(pPath) {
+		return true
+	}
+	if e.ignoreFiles != nil {
+		return matchIgnoreFiles(e.ignoreFiles.load(e.cipherdir, filepath.Dir(pPath)), pPath)
+	}
+	return false
+}
+
+// matchesAttr checks the size, type and age rules against "st".
+// Directories are only excluded by their path: their mtime says nothing
+// about the files inside.
+func (e *excluder) matchesAttr(st *syscall.Stat_t) bool {
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		return false
+	case syscall.S_IFREG:
+		if e.largerThan > 0 && st.Size > e.largerThan {
+			return true
+		}
+	case syscall.S_IFSOCK, syscall.S_IFIFO, syscall.S_IFCHR, syscall.S_IFBLK:
+		if e.special {
+			return true
+		}
+	}
+	if e.olderThan.IsZero() && e.newerThan.IsZero() {
+		return false
+	}
+	var a fuse.Attr
+	a.FromStat(st)
+	mtime := a.ModTime()
+	return (!e.olderThan.IsZero() && mtime.Before(e.olderThan)) ||
+		(!e.newerThan.IsZero() && mtime.After(e.newerThan))
+}
+
+// lstat returns the attributes of the relative plaintext path "pPath", or
+// nil if it cannot be stat'ed.
+func (e *excluder) lstat(pPath string) *syscall.Stat_t {
+	dirfd, err := syscallcompat.OpenDirNofollow(e.cipherdir, filepath.Dir(pPath))
+	if err != nil {
+		return nil
+	}
+	defer syscall.Close(dirfd)
+	st, err := syscallcompat.Fstatat2(dirfd, filepath.Base(pPath), unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return nil
+	}
+	return st
+}
+
+// racyWindow is how old a modification must be before its stat is trusted
+// to detect later changes. Timestamps are coarse on some filesystems, and a
+// change in the same tick would go unnoticed.
+const racyWindow = 2 * time.Second
+
+// statStamp identifies a version of a file or a directory
+type statStamp struct {
+	ino   uint64
+	size  int64
+	mtime time.Time
+}
+
+// newStatStamp returns the statStamp of "st", and false if it changed too
+// recently to be cached.
+func newStatStamp(st *syscall.Stat_t) (statStamp, bool) {
+	var a fuse.Attr
+	a.FromStat(st)
+	s := statStamp{ino: st.Ino, size: st.Size, mtime: a.ModTime()}
+	return s, time.Since(s.mtime) >= racyWindow
+}
+
+// ignoreFile is a parsed ".gocryptfs-ignore" file
+type ignoreFile struct {
+	// dir is the relative plaintext path of the directory the file is in
+	dir string
+	// patterns read from the file
+	patterns ignore.IgnoreParser
+	// stamp of the file when it was parsed
+	stamp statStamp
+}
+
+// ignoreFileCache stores parsed ".gocryptfs-ignore" files by directory, so
+// they are only parsed again when they change. Directories without one are
+// stored as well, so they are only checked again when they change.
+type ignoreFileCache struct {
+	sync.Mutex
+	entries map[string]*ignoreFile
+	// missing maps directories without an ignore file to their stamp
+	missing map[string]statStamp
+}
+
+func newIgnoreFileCache() *ignoreFileCache {
+	return &ignoreFileCache{
+		entries: make(map[string]*ignoreFile),
+		missing: make(map[string]statStamp),
+	}
+}
+
+// load returns the ignore files that apply to entries of the relative
+// plaintext directory "pDir": those in all directories above it and the one
+// in "pDir" itself.
+func (c *ignoreFileCache) load(cipherdir string, pDir string) (out []*ignoreFile) {
+	dirfd, err := syscallcompat.OpenDirNofollow(cipherdir, "")
+	if err != nil {
+		return nil
+	}
+	var parts []string
+	if pDir != "." && pDir != "" {
+		parts = strings.Split(pDir, "/")
+	}
+	// Walk down from the root, so every directory is opened only once
+	dir := ""
+	for i := 0; ; i++ {
+		if f := c.get(dirfd, dir); f != nil {
+			out = append(out, f)
+		}
+		if i == len(parts) {
+			break
+		}
+		next, err := syscallcompat.Openat(dirfd, parts[i], syscall.O_NOFOLLOW|syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+		syscall.Close(dirfd)
+		if err != nil {
+			return out
+		}
+		dirfd = next
+		dir = filepath.Join(dir, parts[i])
+	}
+	syscall.Close(dirfd)
+	return out
+}
+
+// get returns the parsed ignore file in the relative plaintext directory
+// "pDir", which is open as "dirfd", or nil if there is none.
+func (c *ignoreFileCache) get(dirfd int, pDir string) *ignoreFile {
+	var dirSt syscall.Stat_t
+	if err := syscall.Fstat(dirfd, &dirSt); err != nil {
+		return nil
+	}
+	dirStamp, dirStable := newStatStamp(&dirSt)
+	c.Lock()
+	missing, ok := c.missing[pDir]
+	c.Unlock()
+	// An ignore file cannot appear without changing the directory
+	if ok && missing == dirStamp {
+		return nil
+	}
+	st, err := syscallcompat.Fstatat2(dirfd, ignoreFileName, unix.AT_SYMLINK_NOFOLLOW)
+	if err == syscall.ENOENT {
+		c.Lock()
+		delete(c.entries, pDir)
+		if dirStable {
+			c.missing[pDir] = dirStamp
+		}
+		c.Unlock()
+		return nil
+	} else if err != nil {
+		tlog.Warn.Printf("Cannot read exclusion patterns from %q: %v", filepath.Join(pDir, ignoreFileName), err)
+		return nil
+	}
+	stamp, stable := newStatStamp(st)
+	c.Lock()
+	delete(c.missing, pDir)
+	cached := c.entries[pDir]
+	c.Unlock()
+	if cached != nil && cached.stamp == stamp {
+		return cached
+	}
+	buf, err := readIgnoreFile(dirfd)
+	if err != nil {
+		tlog.Warn.Printf("Cannot read exclusion patterns from %q: %v", filepath.Join(pDir, ignoreFileName), err)
+		return nil
+	}
+	entry := &ignoreFile{
+		dir:      pDir,
+		patterns: ignore.CompileIgnoreLines(strings.Split(string(buf), "\n")...),
+		stamp:    stamp,
+	}
+	if stable {
+		c.Lock()
+		c.entries[pDir] = entry
+		c.Unlock()
+	}
+	return entry
+}
+
+// readIgnoreFile returns the content of the ignore file in "dirfd"
+func readIgnoreFile(dirfd int) ([]byte, error) {
+	fd, err := syscallcompat.Openat(dirfd, ignoreFileName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), ignoreFileName)
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// matchIgnoreFiles checks if one of "files" excludes the relative
+// plaintext path "pPath". The patterns of each file are matched against the
+// path relative to the directory the file is in. Files in other directories
+// than those above "pPath" do not apply.
+func matchIgnoreFiles(files []*ignoreFile, pPath string) bool {
+	for _, f := range files {
+		rel := pPath
+		if f.dir != "" {
+			if !strings.HasPrefix(pPath, f.dir+"/") {
+				continue
+			}
+			rel = pPath[len(f.dir)+1:]
+		}
+		if f.patterns.MatchesPath(rel) {
+			return true
+		}
 	}
-	return ignore.CompileIgnoreLines(patterns...)
+	return false
 }
 
 // getExclusionPatters prepares a list of patterns to be excluded.
@@ -3,10 +3,15 @@ package fusefrontend_reverse
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+
+	"github.com/sabhiram/go-gitignore"
 )
 
 func TestShouldPrefixExcludeValuesWithSlash(t *testing.T) {
@@ -64,3 +69,149 @@ func TestShouldReturnFalseIfThereAreNoExclusions(t *testing.T) {
 		t.Error("Should not exclude any path if no exclusions were specified")
 	}
 }
+
+func TestExcludeByAttr(t *testing.T) {
+	dir := t.TempDir()
+	e := excluder{
+		cipherdir:  dir,
+		largerThan: 100,
+		special:    true,
+		olderThan:  time.Unix(1000, 0),
+		newerThan:  time.Unix(2000, 0),
+	}
+	create := func(name string, size int, mtime int64) {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, make([]byte, size), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, time.Unix(mtime, 0), time.Unix(mtime, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	create("small", 100, 1500)
+	create("big", 101, 1500)
+	create("old", 0, 999)
+	create("new", 0, 2001)
+	if err := syscall.Mkfifo(filepath.Join(dir, "fifo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "olddir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(filepath.Join(dir, "olddir"), time.Unix(999, 0), time.Unix(999, 0))
+	testCases := map[string]bool{
+		"small": false,
+		"big":   true,
+		"old":   true,
+		"new":   true,
+		"fifo":  true,
+		// Directories are only excluded by path
+		"olddir": false,
+	}
+	for name, excluded := range testCases {
+		st := e.lstat(name)
+		if st == nil {
+			t.Fatalf("%q: lstat failed", name)
+		}
+		if have := e.matchesAttr(st); have != excluded {
+			t.Errorf("%q: want %v, have %v", name, excluded, have)
+		}
+	}
+}
+
+func TestIgnoreFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "a/b"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	write := func(path string, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, path), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(ignoreFileName, "*.tmp\n")
+	write("a/"+ignoreFileName, "/cache\nb/*.log\n")
+
+	var rn RootNode
+	rn.excluder = prepareExcluder(fusefrontend.Args{Cipherdir: dir, ExcludeIgnoreFiles: true})
+	testCases := map[string]bool{
+		"x.tmp":        true,
+		"a/b/x.tmp":    true,
+		"cache":        false,
+		"a/cache":      true,
+		"a/b/cache":    false,
+		"a/b/x.log":    true,
+		"b/x.log":      false,
+		"a/x.log":      false,
+		ignoreFileName: false,
+	}
+	for path, excluded := range testCases {
+		if have := rn.isExcludedPlain(path); have != excluded {
+			t.Errorf("%q: want %v, have %v", path, excluded, have)
+		}
+	}
+	// Changes are picked up
+	write("a/"+ignoreFileName, "*.log\n")
+	if !rn.isExcludedPlain("a/x.log") || rn.isExcludedPlain("a/cache") {
+		t.Error("changed ignore file was not reloaded")
+	}
+}
+
+// A directory without an ignore file is only checked again when it changes
+func TestIgnoreFilesMissing(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "a/b"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	for _, d := range []string{"a/b", "a", ""} {
+		if err := os.Chtimes(filepath.Join(dir, d), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := newIgnoreFileCache()
+	if files := c.load(dir, "a/b"); len(files) != 0 {
+		t.Fatalf("want no ignore files, have %d", len(files))
+	}
+	if len(c.missing) != 3 {
+		t.Errorf("want 3 directories without ignore file, have %v", c.missing)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "a", ignoreFileName), []byte("*.log\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	files := c.load(dir, "a/b")
+	if len(files) != 1 || files[0].dir != "a" {
+		t.Fatalf("new ignore file was not found: %v", files)
+	}
+	if _, ok := c.missing["a"]; ok {
+		t.Error("directory with ignore file is still listed as missing one")
+	}
+	if !matchIgnoreFiles(files, "a/b/x.log") {
+		t.Error("a/b/x.log should be excluded")
+	}
+}
+
+// The patterns of a nested ignore file are relative to its own directory
+func TestMatchIgnoreFiles(t *testing.T) {
+	files := []*ignoreFile{
+		{dir: "", patterns: ignore.CompileIgnoreLines("/top")},
+		{dir: "a/b", patterns: ignore.CompileIgnoreLines("/c", "d/*.o")},
+	}
+	testCases := map[string]bool{
+		"top":       true,
+		"a/top":     false,
+		"a/b/c":     true,
+		"a/b/c/x":   true,
+		"c":         false,
+		"a/c":       false,
+		"a/b/x/c":   false,
+		"a/b/d/x.o": true,
+		"d/x.o":     false,
+		"a/bc":      false,
+	}
+	for path, excluded := range testCases {
+		if have := matchIgnoreFiles(files, path); have != excluded {
+			t.Errorf("%q: want %v, have %v", path, excluded, have)
+		}
+	}
+}
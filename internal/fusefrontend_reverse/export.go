@@ -0,0 +1,614 @@
+package fusefrontend_reverse
+
+// Writing the encrypted view to a directory without going through FUSE
+// (gocryptfs -export)
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/pathiv"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+const (
+	// exportTmpPrefix is the name prefix of the temporary files Export
+	// writes. Encrypted names are base64 and never start with a dot.
+	exportTmpPrefix = ".gocryptfs-export-"
+	// exportChunkBlocks is the number of blocks encrypted per read
+	exportChunkBlocks = 128
+)
+
+// ExportStats counts what Export has done
+type ExportStats struct {
+	// Files that were written
+	Written int
+	// Files that were skipped because they have not changed since the last
+	// export
+	Unchanged int
+	// Stale entries that were deleted from the destination
+	Removed int
+	// Entries that could not be exported
+	Errors int
+}
+
+// exporter holds the state of an Export run
+type exporter struct {
+	rn    *RootNode
+	stats ExportStats
+	// noXattrs is set when the destination does not support xattrs
+	noXattrs bool
+}
+
+// Export writes the ciphertext tree that a reverse mount presents to the
+// directory "dst", without going through FUSE. Entries in "dst" that do not
+// exist in the encrypted view are deleted. Regular files whose size and mtime
+// match the last export are skipped.
+//
+// An error is only returned if the export could not be started. Problems
+// with individual entries are logged and counted in ExportStats.Errors.
+func (rn *RootNode) Export(dst string) (ExportStats, error) {
+	e := exporter{rn: rn}
+	if err := rn.checkExportDest(dst); err != nil {
+		return e.stats, err
+	}
+	fd, err := syscall.Open(rn.args.Cipherdir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return e.stats, err
+	}
+	defer syscall.Close(fd)
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fd, &st); err != nil {
+		return e.stats, err
+	}
+	e.dir(fd, "", "", dst, &st)
+	return e.stats, nil
+}
+
+// checkExportDest makes sure we do not delete files that are not from an
+// earlier export: "dst" must be empty or contain gocryptfs.conf or
+// gocryptfs.diriv.
+func (rn *RootNode) checkExportDest(dst string) error {
+	src, err := filepath.EvalSymlinks(rn.args.Cipherdir)
+	if err != nil {
+		return err
+	}
+	dstReal, err := filepath.EvalSymlinks(dst)
+	if err != nil {
+		return err
+	}
+	if dstReal == src || strings.HasPrefix(dstReal, src+"/") {
+		return fmt.Errorf("destination %q is inside of %q", dst, rn.args.Cipherdir)
+	}
+	entries, err := ioutil.ReadDir(dst)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	for _, name := range []string{configfile.ConfDefaultName, nametransform.DirIVFilename} {
+		if _, err = os.Lstat(filepath.Join(dst, name)); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("destination %q is not empty and does not look like an earlier export", dst)
+}
+
+// errorf logs an error and counts it
+func (e *exporter) errorf(format string, a ...interface{}) {
+	tlog.Warn.Printf("export: "+format, a...)
+	e.stats.Errors++
+}
+
+// dir exports the plaintext directory "fd" at "pPath" (ciphertext path
+// "cPath") to "dst", which must already exist.
+func (e *exporter) dir(fd int, pPath string, cPath string, dst string, st *syscall.Stat_t) {
+	rn := e.rn
+	var a fuse.Attr
+	a.FromStat(st)
+	// Entries that belong into "dst". Everything else is deleted.
+	keep := make(map[string]bool)
+	if !rn.args.PlaintextNames && !rn.args.DeterministicNames {
+		content := pathiv.Derive(cPath, pathiv.PurposeDirIV)
+		e.virtualFile(filepath.Join(dst, nametransform.DirIVFilename), content, &a)
+		keep[nametransform.DirIVFilename] = true
+	}
+	var entries []fuse.DirEntry
+	// With -one-file-system, mountpoints are presented as empty
+	if !rn.args.OneFileSystem || uint64(st.Dev) == rn.rootDev {
+		var err error
+		entries, err = syscallcompat.Getdents(fd)
+		if err != nil {
+			e.errorf("%q: %v", pPath, err)
+			return
+		}
+		entries = rn.excludeDirEntries(&dirfdPlus{pPath: pPath}, entries)
+		// Hard links get the IVs of the first path, so the order matters
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	}
+	var dirIV []byte
+	if !rn.args.PlaintextNames {
+		dirIV = rn.deriveDirIV(cPath)
+	}
+	for _, entry := range entries {
+		pName := entry.Name
+		cName, ok := e.encryptName(pPath, pName, dirIV)
+		if !ok {
+			continue
+		}
+		est, err := syscallcompat.Fstatat2(fd, pName, unix.AT_SYMLINK_NOFOLLOW)
+		if err != nil {
+			e.errorf("%q: %v", filepath.Join(pPath, pName), err)
+			continue
+		}
+		if !rn.args.PlaintextNames && (len(cName) > unix.NAME_MAX || len(cName) > rn.nameTransform.GetLongNameMax()) {
+			var ea fuse.Attr
+			ea.FromStat(est)
+			hName := rn.nameTransform.HashLongName(cName)
+			nameFile := hName + nametransform.LongNameSuffix
+			e.virtualFile(filepath.Join(dst, nameFile), []byte(cName), &ea)
+			keep[nameFile] = true
+			cName = hName
+		}
+		keep[cName] = true
+		if pPath == "" && pName == configfile.ConfReverseName && !rn.args.ConfigCustom {
+			e.confFile(fd, pName, filepath.Join(dst, cName), est)
+			continue
+		}
+		e.entry(fd, filepath.Join(pPath, pName), filepath.Join(cPath, cName), filepath.Join(dst, cName), est)
+	}
+	e.removeStale(dst, keep)
+	// Creating and deleting entries has changed the mtime
+	if pPath != "" {
+		e.setAttr(dst, &a, false)
+	}
+}
+
+// encryptName returns the full encrypted name of "pName", like Readdir.
+// Returns ok=false if the entry must be skipped.
+func (e *exporter) encryptName(pDir string, pName string, dirIV []byte) (cName string, ok bool) {
+	rn := e.rn
+	if pDir == "" && !rn.args.ConfigCustom {
+		// ".gocryptfs.reverse.conf" in the root directory is mapped to "gocryptfs.conf"
+		if pName == configfile.ConfReverseName {
+			return configfile.ConfDefaultName, true
+		}
+		if rn.args.PlaintextNames && pName == configfile.ConfDefaultName {
+			e.errorf("The file %q is mapped to %q and shadows another file. Please rename %q in directory %q.",
+				configfile.ConfReverseName, configfile.ConfDefaultName, configfile.ConfDefaultName, rn.args.Cipherdir)
+			return "", false
+		}
+	}
+	if rn.args.PlaintextNames {
+		return pName, true
+	}
+	cName, err := rn.nameTransform.EncryptName(pName, dirIV)
+	if err != nil {
+		e.errorf("%q: cannot encrypt name: %v", filepath.Join(pDir, pName), err)
+		return "", false
+	}
+	return cName, true
+}
+
+// entry exports the directory, file or symlink "pPath" in the directory
+// "dirfd" to "dst".
+func (e *exporter) entry(dirfd int, pPath string, cPath string, dst string, st *syscall.Stat_t) {
+	pName := filepath.Base(pPath)
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		fd, err := syscallcompat.Openat(dirfd, pName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+		if err != nil {
+			e.errorf("%q: %v", pPath, err)
+			return
+		}
+		defer syscall.Close(fd)
+		if err = e.prepareDest(dst, syscall.S_IFDIR); err != nil {
+			e.errorf("%q: %v", dst, err)
+			return
+		}
+		if fi, err := os.Lstat(dst); err != nil {
+			if err = os.Mkdir(dst, 0700); err != nil {
+				e.errorf("%q: %v", dst, err)
+				return
+			}
+		} else if fi.Mode().Perm()&0700 != 0700 {
+			// We may need to create and delete entries in there
+			os.Chmod(dst, 0700)
+		}
+		e.dir(fd, pPath, cPath, dst, st)
+	case syscall.S_IFREG:
+		e.file(dirfd, pPath, cPath, dst)
+	case syscall.S_IFLNK:
+		e.symlink(dirfd, pPath, cPath, dst, st)
+	default:
+		tlog.Info.Printf("export: %q: skipping special file", pPath)
+		return
+	}
+	// Linux does not allow user xattrs on symlinks
+	if st.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+		e.xattrs(dirfd, pPath, cPath, dst)
+	}
+}
+
+// xattrs sets the xattrs of "dst" to the encrypted xattrs that Listxattr and
+// Getxattr present for "pPath" in "dirfd". Other xattrs of "dst" that look
+// like encrypted xattrs or ACLs are removed.
+func (e *exporter) xattrs(dirfd int, pPath string, cPath string, dst string) {
+	if e.noXattrs {
+		return
+	}
+	rn := e.rn
+	pName := filepath.Base(pPath)
+	names, errno := listXAttrAt(dirfd, pName)
+	if errno == syscall.EOPNOTSUPP || errno == syscall.ENOTSUP {
+		names = nil
+	} else if errno != 0 {
+		e.errorf("%q: listing xattrs: %v", pPath, errno)
+		return
+	}
+	want := make(map[string][]byte)
+	for _, name := range names {
+		cAttr, ok := rn.encryptXattrName(name)
+		if !ok {
+			continue
+		}
+		data, errno := getXAttrAt(dirfd, pName, name)
+		if errno == syscall.Errno(fuse.ENOATTR) {
+			// Removed in the meantime
+			continue
+		} else if errno != 0 {
+			e.errorf("%q: reading xattr %q: %v", pPath, name, errno)
+			continue
+		}
+		if !isAcl(name) {
+			data = rn.encryptXattrValue(cPath, cAttr, data)
+		}
+		want[cAttr] = data
+	}
+	have, err := syscallcompat.Llistxattr(dst)
+	if err == syscall.ENOENT {
+		// Export of the entry failed
+		return
+	} else if err != nil {
+		if err == syscall.EOPNOTSUPP || err == syscall.ENOTSUP {
+			e.xattrsUnsupported(len(want))
+			return
+		}
+		e.errorf("%q: listing xattrs: %v", dst, err)
+		return
+	}
+	var remove []string
+	for _, cAttr := range have {
+		if _, ok := want[cAttr]; !ok && (strings.HasPrefix(cAttr, xattrStorePrefix) || isAcl(cAttr)) {
+			remove = append(remove, cAttr)
+		}
+	}
+	for cAttr, data := range want {
+		if old, err := syscallcompat.Lgetxattr(dst, cAttr); err == nil && bytes.Equal(old, data) {
+			delete(want, cAttr)
+		}
+	}
+	if len(remove) == 0 && len(want) == 0 {
+		return
+	}
+	// Changing user xattrs needs write permission
+	var st syscall.Stat_t
+	if err = syscall.Lstat(dst, &st); err == nil && st.Mode&0200 == 0 {
+		syscall.Chmod(dst, uint32(st.Mode)&07777|0200)
+		defer syscall.Chmod(dst, uint32(st.Mode)&07777)
+	}
+	for _, cAttr := range remove {
+		if err = unix.Lremovexattr(dst, cAttr); err != nil {
+			e.errorf("%q: removing xattr %q: %v", dst, cAttr, err)
+		}
+	}
+	for cAttr, data := range want {
+		if err = unix.Lsetxattr(dst, cAttr, data, 0); err != nil {
+			if err == syscall.EOPNOTSUPP || err == syscall.ENOTSUP {
+				e.xattrsUnsupported(len(want))
+				return
+			}
+			e.errorf("%q: setting xattr %q: %v", dst, cAttr, err)
+		}
+	}
+}
+
+// xattrsUnsupported is called when the destination does not support xattrs.
+// It is an error if there are xattrs to export.
+func (e *exporter) xattrsUnsupported(n int) {
+	if n == 0 {
+		return
+	}
+	e.errorf("the destination does not support extended attributes, they are not exported")
+	e.noXattrs = true
+}
+
+// file exports the regular file "pPath" in the directory "dirfd" to "dst".
+// The file is skipped if "dst" already has the expected size and mtime.
+func (e *exporter) file(dirfd int, pPath string, cPath string, dst string) {
+	rn := e.rn
+	fd, err := syscallcompat.Openat(dirfd, filepath.Base(pPath), syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		e.errorf("%q: %v", pPath, err)
+		return
+	}
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fd, &st); err != nil {
+		syscall.Close(fd)
+		e.errorf("%q: %v", pPath, err)
+		return
+	}
+	var a fuse.Attr
+	a.FromStat(&st)
+	// Also for unchanged files, so hard links get the same IVs as last time
+	ivs := rn.fileIVs(&st, cPath)
+	if e.unchanged(dst, &a) {
+		syscall.Close(fd)
+		e.stats.Unchanged++
+		return
+	}
+	rf, err := rn.newFile(fd, &st, ivs, pPath)
+	if err != nil {
+		syscall.Close(fd)
+		e.errorf("%q: %v", pPath, err)
+		return
+	}
+	defer rf.fd.Close()
+	// A file that changes while we read it would be exported in an
+	// inconsistent state, and then skipped by the next run
+	rf.pinned = &a
+	err = e.writeFile(dst, &a, func(w *os.File) error {
+		var buf []byte
+		var off uint64
+		for {
+			end := rf.chunkEnd(off, exportChunkBlocks)
+			if end <= off {
+				return nil
+			}
+			// The first chunk of a compressed file also contains the index
+			if uint64(cap(buf)) < end-off {
+				buf = make([]byte, end-off)
+			}
+			out, errno := rf.readAt(buf[:end-off], off)
+			if errno != 0 {
+				return errno
+			}
+			if _, err := w.Write(out); err != nil {
+				return err
+			}
+			if uint64(len(out)) < end-off {
+				return nil
+			}
+			off = end
+		}
+	})
+	if err != nil {
+		e.errorf("%q: %v", pPath, err)
+		return
+	}
+	e.stats.Written++
+}
+
+// chunkEnd returns the end of the ciphertext range that starts at "off" and
+// contains "blocks" blocks. "off" must be zero or the start of a block.
+func (f *File) chunkEnd(off uint64, blocks uint64) uint64 {
+	if f.index != nil {
+		var blockNo uint64
+		if off > 0 {
+			blockNo = f.index.CipherOffToBlockNo(off)
+		}
+		if blockNo+blocks >= uint64(len(f.index.CipherLen)) {
+			return f.index.CipherSize()
+		}
+		return f.index.BlockCipherOff(blockNo + blocks)
+	}
+	if off == 0 {
+		off = contentenc.HeaderLen
+	}
+	return off + blocks*f.contentEnc.CipherBS()
+}
+
+// unchanged returns true if "dst" is a regular file that has the size the
+// backing file with attributes "a" has in encrypted form, and the same mtime.
+func (e *exporter) unchanged(dst string, a *fuse.Attr) bool {
+	fi, err := os.Lstat(dst)
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	if !fi.ModTime().Equal(time.Unix(int64(a.Mtime), int64(a.Mtimensec))) {
+		return false
+	}
+	if a.Size == 0 || e.rn.args.Compression == "" {
+		return uint64(fi.Size()) == e.rn.contentEnc.PlainSizeToCipherSize(a.Size)
+	}
+	// The ciphertext size of a compressed file is only known after
+	// compressing it. Compare the plaintext size stored in the index instead.
+	f, err := os.Open(dst)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	plainSize, ok := contentenc.CompressedPlainSize(f)
+	return ok && plainSize == a.Size
+}
+
+// symlink exports the symlink "pPath" in the directory "dirfd" to "dst".
+func (e *exporter) symlink(dirfd int, pPath string, cPath string, dst string, st *syscall.Stat_t) {
+	plainTarget, err := syscallcompat.Readlinkat(dirfd, filepath.Base(pPath))
+	if err != nil {
+		e.errorf("%q: %v", pPath, err)
+		return
+	}
+	// Readlink derives the nonce from the path of the symlink node joined
+	// with its name
+	cTarget, errno := e.rn.encryptSymlinkTarget(plainTarget, filepath.Join(cPath, filepath.Base(cPath)))
+	if errno != 0 {
+		e.errorf("%q: %v", pPath, errno)
+		return
+	}
+	if old, err := os.Readlink(dst); err != nil || old != string(cTarget) {
+		if err = e.prepareDest(dst, syscall.S_IFLNK); err != nil {
+			e.errorf("%q: %v", dst, err)
+			return
+		}
+		os.Remove(dst)
+		if err = os.Symlink(string(cTarget), dst); err != nil {
+			e.errorf("%q: %v", dst, err)
+			return
+		}
+	}
+	var a fuse.Attr
+	a.FromStat(st)
+	e.setAttr(dst, &a, true)
+}
+
+// confFile copies the config file "pName" in "dirfd" to "dst"
+func (e *exporter) confFile(dirfd int, pName string, dst string, st *syscall.Stat_t) {
+	fd, err := syscallcompat.Openat(dirfd, pName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		e.errorf("%q: %v", pName, err)
+		return
+	}
+	f := os.NewFile(uintptr(fd), pName)
+	defer f.Close()
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		e.errorf("%q: %v", pName, err)
+		return
+	}
+	var a fuse.Attr
+	a.FromStat(st)
+	e.smallFile(dst, content, &a)
+}
+
+// virtualFile writes a gocryptfs.diriv or *.name file. Timestamps and owner
+// are copied from "parent", like newVirtualMemNode does.
+func (e *exporter) virtualFile(dst string, content []byte, parent *fuse.Attr) {
+	a := *parent
+	a.Mode = virtualFileMode
+	e.smallFile(dst, content, &a)
+}
+
+// smallFile writes "content" to "dst" if it does not already contain it,
+// and sets the attributes in "a".
+func (e *exporter) smallFile(dst string, content []byte, a *fuse.Attr) {
+	if old, err := ioutil.ReadFile(dst); err == nil && bytes.Equal(old, content) {
+		e.setAttr(dst, a, false)
+		return
+	}
+	err := e.writeFile(dst, a, func(w *os.File) error {
+		_, err := w.Write(content)
+		return err
+	})
+	if err != nil {
+		e.errorf("%q: %v", dst, err)
+	}
+}
+
+// writeFile atomically replaces "dst" with a new file that gets its
+// content from "fill" and its attributes from "a".
+func (e *exporter) writeFile(dst string, a *fuse.Attr, fill func(w *os.File) error) error {
+	if err := e.prepareDest(dst, syscall.S_IFREG); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), exportTmpPrefix)
+	if err != nil {
+		return err
+	}
+	err = fill(tmp)
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		e.setAttr(tmp.Name(), a, false)
+		err = os.Rename(tmp.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// prepareDest deletes "dst" if it exists and is not of type "mode" (one of
+// the S_IFMT constants)
+func (e *exporter) prepareDest(dst string, mode uint32) error {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(dst, &st); err != nil || uint32(st.Mode)&syscall.S_IFMT == mode {
+		return nil
+	}
+	e.stats.Removed++
+	return os.RemoveAll(dst)
+}
+
+// removeStale deletes all entries of the directory "dst" that are not in
+// "keep"
+func (e *exporter) removeStale(dst string, keep map[string]bool) {
+	f, err := os.Open(dst)
+	if err != nil {
+		e.errorf("%q: %v", dst, err)
+		return
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		e.errorf("%q: %v", dst, err)
+		return
+	}
+	for _, name := range names {
+		if keep[name] {
+			continue
+		}
+		if strings.HasPrefix(name, exportTmpPrefix) {
+			tlog.Debug.Printf("export: removing temporary file %q", name)
+		} else {
+			tlog.Debug.Printf("export: removing stale entry %q", name)
+			e.stats.Removed++
+		}
+		if err = os.RemoveAll(filepath.Join(dst, name)); err != nil {
+			e.errorf("%q: %v", filepath.Join(dst, name), err)
+		}
+	}
+}
+
+// setAttr sets permissions, timestamps and, when running as root, the owner
+// of "path" to the values in "a", like the reverse mount presents them.
+func (e *exporter) setAttr(path string, a *fuse.Attr, isSymlink bool) {
+	if os.Getuid() == 0 {
+		owner := a.Owner
+		if e.rn.args.ForceOwner != nil {
+			owner = *e.rn.args.ForceOwner
+		}
+		if err := os.Lchown(path, int(owner.Uid), int(owner.Gid)); err != nil {
+			e.errorf("%q: %v", path, err)
+		}
+	}
+	if !isSymlink {
+		// Chmod after Lchown, which may clear the suid and sgid bits
+		if err := syscall.Chmod(path, a.Mode&07777); err != nil {
+			e.errorf("%q: %v", path, err)
+		}
+	}
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(int64(a.Atime)*1e9 + int64(a.Atimensec)),
+		unix.NsecToTimespec(int64(a.Mtime)*1e9 + int64(a.Mtimensec)),
+	}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		e.errorf("%q: %v", path, err)
+	}
+}
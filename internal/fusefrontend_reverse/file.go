@@ -10,6 +10,8 @@ import (
 	"github.com/hanwen/go-fuse/v2/fuse"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/metrics"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
 type File struct {
@@ -21,12 +23,41 @@ type File struct {
 	block0IV []byte
 	// Content encryption helper
 	contentEnc *contentenc.ContentEnc
+	// Block index of compressed files, nil otherwise
+	index *contentenc.BlockIndex
+	// Packed header and block index of compressed files
+	meta []byte
+	// pinned are the attributes of the backing file at open time, only set
+	// with -consistent-reads
+	pinned *fuse.Attr
+	// pPath is the relative plaintext path, for log messages
+	pPath string
 }
 
 // Read - FUSE call
 func (f *File) Read(ctx context.Context, buf []byte, ioff int64) (resultData fuse.ReadResult, errno syscall.Errno) {
+	out, errno := f.readAt(buf, uint64(ioff))
+	if errno != 0 {
+		return nil, errno
+	}
+	metrics.BytesRead.Add(uint64(len(out)))
+	return fuse.ReadResultData(out), 0
+}
+
+// readAt returns up to len(buf) bytes of ciphertext starting at offset
+// "off". The returned slice may or may not use "buf" as storage.
+func (f *File) readAt(buf []byte, off uint64) ([]byte, syscall.Errno) {
 	length := uint64(len(buf))
-	off := uint64(ioff)
+	if f.index != nil {
+		out, errno := f.readCompressed(off, length)
+		if errno == 0 {
+			errno = f.checkPinned()
+		}
+		if errno != 0 {
+			return nil, errno
+		}
+		return out, 0
+	}
 	out := bytes.NewBuffer(buf[:0])
 	var header []byte
 
@@ -52,6 +83,11 @@ func (f *File) Read(ctx context.Context, buf []byte, ioff int64) (resultData fus
 		if err != nil {
 			return nil, fs.ToErrno(err)
 		}
+		// The data we have read must be from the version of the file we
+		// have opened. Checking after the read catches concurrent writes.
+		if errno := f.checkPinned(); errno != 0 {
+			return nil, errno
+		}
 		if len(fileData) == 0 {
 			// If we could not read any actual data, we also don't want to
 			// return the file header. An empty file stays empty in encrypted
@@ -60,8 +96,28 @@ func (f *File) Read(ctx context.Context, buf []byte, ioff int64) (resultData fus
 		}
 		out.Write(fileData)
 	}
+	return out.Bytes(), 0
+}
 
-	return fuse.ReadResultData(out.Bytes()), 0
+// checkPinned returns EIO if the backing file has changed since it was
+// opened. No-op without -consistent-reads.
+func (f *File) checkPinned() syscall.Errno {
+	if f.pinned == nil {
+		return 0
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.fd.Fd()), &st); err != nil {
+		return fs.ToErrno(err)
+	}
+	var a fuse.Attr
+	a.FromStat(&st)
+	p := f.pinned
+	if a.Size != p.Size || a.Mtime != p.Mtime || a.Mtimensec != p.Mtimensec ||
+		a.Ctime != p.Ctime || a.Ctimensec != p.Ctimensec {
+		tlog.Warn.Printf("%q changed while it was being read, returning EIO. Use a snapshot of the plaintext directory for consistent backups.", f.pPath)
+		return syscall.EIO
+	}
+	return 0
 }
 
 // Release - FUSE call, close file
@@ -71,6 +127,17 @@ func (f *File) Release(context.Context) syscall.Errno {
 
 // Lseek - FUSE call.
 func (f *File) Lseek(ctx context.Context, off uint64, whence uint32) (uint64, syscall.Errno) {
+	if f.index != nil {
+		// Compressed files have no holes
+		const SEEK_DATA = 3
+		if off >= f.index.CipherSize() {
+			return 0, syscall.ENXIO
+		}
+		if whence == SEEK_DATA {
+			return off, 0
+		}
+		return f.index.CipherSize(), 0
+	}
 	plainOff := f.contentEnc.CipherSizeToPlainSize(off)
 	newPlainOff, err := syscall.Seek(int(f.fd.Fd()), int64(plainOff), int(whence))
 	if err != nil {
@@ -16,7 +16,8 @@ var _ = (fs.FileSetlker)((*File)(nil))
 var _ = (fs.FileSetlkwer)((*File)(nil))
 */
 
-/* Will not implement these - reverse mode is read-only!
+/* Will not implement these - reverse mode is read-only! Writes in a
+   -writable mount go to restoreFile instead.
 var _ = (fs.FileSetattrer)((*File)(nil))
 var _ = (fs.FileWriter)((*File)(nil))
 var _ = (fs.FileFsyncer)((*File)(nil))
@@ -2,8 +2,11 @@ package fusefrontend_reverse
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"os"
 	"sync"
+	"syscall"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/v2/internal/pathiv"
@@ -12,6 +15,59 @@ import (
 
 var inodeTable sync.Map
 
+// fileIVs returns the file ID and block 0 IV of the backing file "st" at the
+// relative ciphertext path "cPath".
+func (rn *RootNode) fileIVs(st *syscall.Stat_t, cPath string) pathiv.FileIVs {
+	// See if we have that inode number already in the table
+	// (even if Nlink has dropped to 1)
+	v, found := inodeTable.Load(st.Ino)
+	if found {
+		tlog.Debug.Printf("ino%d: newFile: found in the inode table", st.Ino)
+		return v.(pathiv.FileIVs)
+	}
+	derivedIVs := pathiv.DeriveFile(cPath)
+	// Nlink > 1 means there is more than one path to this file.
+	// Store the derived values so we always return the same data,
+	// regardless of the path that is used to access the file.
+	// This means that the first path wins.
+	if st.Nlink > 1 {
+		v, found = inodeTable.LoadOrStore(st.Ino, derivedIVs)
+		if found {
+			// Another thread has stored a different value before we could.
+			derivedIVs = v.(pathiv.FileIVs)
+		} else {
+			tlog.Debug.Printf("ino%d: newFile: Nlink=%d, stored in the inode table", st.Ino, st.Nlink)
+		}
+	}
+	return derivedIVs
+}
+
+// newFile returns a File that presents the backing file "fd" in encrypted
+// form. "st" must be the result of fstat() on "fd". The File takes ownership
+// of "fd" only if no error is returned.
+func (rn *RootNode) newFile(fd int, st *syscall.Stat_t, derivedIVs pathiv.FileIVs, pPath string) (*File, error) {
+	rf := &File{
+		header: contentenc.FileHeader{
+			Version: contentenc.CurrentVersion,
+			ID:      derivedIVs.ID,
+		},
+		block0IV:   derivedIVs.Block0IV,
+		contentEnc: rn.contentEnc,
+		pPath:      pPath,
+	}
+	if rn.args.Compression != "" {
+		var err error
+		rf.index, err = rn.blockIndex(fd, st)
+		if err != nil {
+			return nil, err
+		}
+		rf.header.Version = contentenc.CompressedVersion
+		rf.meta = append(rf.header.Pack(), rf.index.Pack()...)
+	}
+	rf.fd = os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd))
+	return rf, nil
+}
+
 // encryptBlocks - encrypt "plaintext" into a number of ciphertext blocks.
 // "plaintext" must already be block-aligned.
 func (rf *File) encryptBlocks(plaintext []byte, firstBlockNo uint64, fileID []byte, block0IV []byte) []byte {
@@ -0,0 +1,316 @@
+package fusefrontend_reverse
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+)
+
+// Check that we have implemented the fs.File* interfaces
+var _ = (fs.FileReader)((*restoreFile)(nil))
+var _ = (fs.FileWriter)((*restoreFile)(nil))
+var _ = (fs.FileFlusher)((*restoreFile)(nil))
+var _ = (fs.FileFsyncer)((*restoreFile)(nil))
+var _ = (fs.FileReleaser)((*restoreFile)(nil))
+
+// restoreFile is an open file in a "-writable" mount. Reads and writes go to
+// the staged ciphertext as-is.
+//
+// A handle of a real file only stages the file when something is written to
+// it or it is truncated. Until then, reads are served from the encrypted view
+// and the plaintext file stays as it is.
+type restoreFile struct {
+	// mu protects fd, hidden and view
+	mu sync.Mutex
+	// fd is the staged ciphertext, nil until the file is staged
+	fd *os.File
+	// hidden is the hidden name of the staged file
+	hidden string
+	// view reads the encrypted view of the real file before it is staged,
+	// nil otherwise
+	view *File
+	// node is used to find the current ciphertext path
+	node *Node
+}
+
+// newRestoreFile returns a handle of the staged file "fd" with the hidden name
+// "hidden". The caller must hold opMu.
+func newRestoreFile(fd int, hidden string, node *Node) *restoreFile {
+	node.rootNode().restore.opened(hidden)
+	return &restoreFile{
+		fd:     os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd)),
+		hidden: hidden,
+		node:   node,
+	}
+}
+
+// stagedFd returns the fd of the staged file, or -1 if the file has not been
+// staged yet
+func (f *restoreFile) stagedFd() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fd == nil {
+		return -1
+	}
+	return int(f.fd.Fd())
+}
+
+// ensureStaged stages the file if this handle has not been written to yet.
+// See stageHandles.
+func (f *restoreFile) ensureStaged(keep bool) syscall.Errno {
+	if f.stagedFd() >= 0 {
+		return 0
+	}
+	rn := f.node.rootNode()
+	rn.restore.opMu.Lock()
+	defer rn.restore.opMu.Unlock()
+	// Another handle may have staged the file in the meantime
+	if f.stagedFd() >= 0 {
+		return 0
+	}
+	_, errno := rn.stageHandles(f.node, keep)
+	return errno
+}
+
+// stageHandles stages the real file "n" for all of its handles that have not
+// been written to yet. With "keep", the staged file starts with the current
+// ciphertext, otherwise it is empty. Returns false if there were no such
+// handles. The caller must hold opMu.
+func (rn *RootNode) stageHandles(n *Node, keep bool) (bool, syscall.Errno) {
+	handles := rn.restore.takeUnstaged(n)
+	if len(handles) == 0 {
+		return false, 0
+	}
+	errno := rn.stageHandlesOf(n, handles, keep)
+	if errno != 0 {
+		for _, f := range handles {
+			rn.restore.addUnstaged(n, f)
+		}
+		return false, errno
+	}
+	return true, 0
+}
+
+// stageHandlesOf is the part of stageHandles that can fail
+func (rn *RootNode) stageHandlesOf(n *Node, handles []*restoreFile, keep bool) syscall.Errno {
+	view := handles[0].view
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(view.fd.Fd()), &st); err != nil {
+		return fs.ToErrno(err)
+	}
+	cPath := n.Path()
+	dirfd, err := rn.openPlainDir(parentDir(cPath))
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	defer syscall.Close(dirfd)
+	fd, _, hidden, errno := rn.stage(dirfd, cPath, uint32(st.Mode)&07777)
+	if errno != 0 {
+		return errno
+	}
+	staged := os.NewFile(uintptr(fd), hidden)
+	defer staged.Close()
+	if keep {
+		errno = copyView(view, staged)
+	}
+	if errno != 0 {
+		syscallcompat.Unlinkat(dirfd, hidden, 0)
+		rn.restore.remove(cPath)
+		return errno
+	}
+	// The staged file may not be writable by its mode, so the handles get
+	// duplicates of "fd" instead of opening it again
+	fds := make([]int, len(handles))
+	for i := range handles {
+		fds[i], err = syscall.Dup(fd)
+		if err != nil {
+			for _, fd2 := range fds[:i] {
+				syscall.Close(fd2)
+			}
+			syscallcompat.Unlinkat(dirfd, hidden, 0)
+			rn.restore.remove(cPath)
+			return fs.ToErrno(err)
+		}
+	}
+	for i, f := range handles {
+		f.mu.Lock()
+		f.fd = os.NewFile(uintptr(fds[i]), hidden)
+		f.hidden = hidden
+		f.view.Release(context.Background())
+		f.view = nil
+		f.mu.Unlock()
+		rn.restore.opened(hidden)
+	}
+	return 0
+}
+
+// copyView copies the ciphertext that "view" reads to "dst"
+func copyView(view *File, dst *os.File) syscall.Errno {
+	buf := make([]byte, 128*1024)
+	for off := uint64(0); ; {
+		data, errno := view.readAt(buf, off)
+		if errno != 0 {
+			return errno
+		}
+		if len(data) == 0 {
+			return 0
+		}
+		if _, err := dst.WriteAt(data, int64(off)); err != nil {
+			return fs.ToErrno(err)
+		}
+		off += uint64(len(data))
+	}
+}
+
+// truncate stages the file and truncates it to "size"
+func (f *restoreFile) truncate(size uint64) syscall.Errno {
+	if errno := f.ensureStaged(size > 0); errno != 0 {
+		return errno
+	}
+	return fs.ToErrno(syscall.Ftruncate(f.stagedFd(), int64(size)))
+}
+
+// Read - FUSE call
+func (f *restoreFile) Read(ctx context.Context, buf []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fd == nil {
+		return f.view.Read(ctx, buf, off)
+	}
+	n, err := f.fd.ReadAt(buf, off)
+	if err != nil && err != io.EOF {
+		return nil, fs.ToErrno(err)
+	}
+	return fuse.ReadResultData(buf[:n]), 0
+}
+
+// Write - FUSE call
+func (f *restoreFile) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	if errno := f.ensureStaged(true); errno != 0 {
+		return 0, errno
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.fd.WriteAt(data, off)
+	return uint32(n), fs.ToErrno(err)
+}
+
+// Flush - FUSE call. Called on every close(), also of dup'ed fds, so the file
+// is only settled in Release. Content written to a virtual file is checked
+// here to report a mismatch to the application.
+func (f *restoreFile) Flush(ctx context.Context) syscall.Errno {
+	fd := f.stagedFd()
+	if fd < 0 {
+		return 0
+	}
+	rn := f.node.rootNode()
+	rn.restore.opMu.Lock()
+	defer rn.restore.opMu.Unlock()
+	cPath, ok := rn.restore.pathOf(f.hidden)
+	if !ok {
+		return 0
+	}
+	cDir, cName := parentDir(cPath), filepath.Base(cPath)
+	dirfd, kind, _, errno := rn.restoreTarget(cDir, cName)
+	if errno != 0 {
+		return errno
+	}
+	syscall.Close(dirfd)
+	if kind == restoreReal || kind == restoreStaged {
+		return 0
+	}
+	content, err := ioutil.ReadAll(io.NewSectionReader(f.fd, 0, virtualFileMax+1))
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	if len(content) > virtualFileMax {
+		return syscall.EFBIG
+	}
+	return rn.checkVirtual(cDir, cName, kind, content)
+}
+
+// Fsync - FUSE call
+func (f *restoreFile) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fd == nil {
+		return 0
+	}
+	return fs.ToErrno(f.fd.Sync())
+}
+
+// Release - FUSE call, close file. Settles the staged file when its last
+// handle is closed. Errors can only be logged here, and the staged file
+// is kept if it cannot be decrypted.
+func (f *restoreFile) Release(ctx context.Context) syscall.Errno {
+	rn := f.node.rootNode()
+	rn.restore.opMu.Lock()
+	defer rn.restore.opMu.Unlock()
+	f.mu.Lock()
+	fd, view := f.fd, f.view
+	f.mu.Unlock()
+	if fd == nil {
+		rn.restore.removeUnstaged(f.node, f)
+		return view.Release(ctx)
+	}
+	err := fd.Close()
+	if rn.restore.closed(f.hidden) {
+		if cPath, ok := rn.restore.pathOf(f.hidden); ok {
+			rn.settle(cPath)
+		}
+	}
+	return fs.ToErrno(err)
+}
+
+// Check that we have implemented the fs.File* interfaces
+var _ = (fs.FileWriter)((*virtualWriteFile)(nil))
+var _ = (fs.FileFlusher)((*virtualWriteFile)(nil))
+
+// virtualWriteFile is a virtual file that has been opened for writing in a
+// "-writable" mount. Virtual files cannot change, so what is written is only
+// compared with the content they have anyway.
+type virtualWriteFile struct {
+	mu sync.Mutex
+	// content of the virtual file
+	content []byte
+	// what has been written
+	buf []byte
+	// relative ciphertext path, for log messages
+	cPath string
+}
+
+// Write - FUSE call
+func (f *virtualWriteFile) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	end := int(off) + len(data)
+	if end > virtualFileMax {
+		return 0, syscall.EFBIG
+	}
+	if end > len(f.buf) {
+		f.buf = append(f.buf, make([]byte, end-len(f.buf))...)
+	}
+	copy(f.buf[off:], data)
+	return uint32(len(data)), 0
+}
+
+// Flush - FUSE call. Rejects content that differs from the virtual file.
+func (f *virtualWriteFile) Flush(ctx context.Context) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.buf == nil || bytes.Equal(f.buf, f.content) {
+		return 0
+	}
+	return virtualMismatch(f.cPath)
+}
@@ -2,8 +2,6 @@ package fusefrontend_reverse
 
 import (
 	"context"
-	"fmt"
-	"os"
 	"path/filepath"
 	"syscall"
 
@@ -12,8 +10,6 @@ import (
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 
-	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
-	"github.com/rfjakob/gocryptfs/v2/internal/pathiv"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
@@ -32,11 +28,19 @@ type Node struct {
 func (n *Node) Lookup(ctx context.Context, cName string, out *fuse.EntryOut) (ch *fs.Inode, errno syscall.Errno) {
 	var d *dirfdPlus
 	t := n.lookupFileType(cName)
+	rn := n.rootNode()
+	if _, ok := rn.restore.lookup(filepath.Join(n.Path(), cName)); ok {
+		// Staged entry in a -writable mount, see restore.go
+		t = typeReal
+	} else if rn.restore != nil && (t == typeDiriv || t == typeName) {
+		// Hidden in a -writable mount. Copy tools expect a new directory
+		// to be empty, and fail with EEXIST otherwise.
+		return nil, syscall.ENOENT
+	}
 	if t == typeDiriv {
 		// gocryptfs.diriv
 		return n.lookupDiriv(ctx, out)
 	}
-	rn := n.rootNode()
 	if rn.args.OneFileSystem && n.isOtherFilesystem {
 		// With --one-file-system, we present mountpoints as empty. That is,
 		// it contains only a gocryptfs.diriv file (allowed above).
@@ -66,7 +70,9 @@ func (n *Node) Lookup(ctx context.Context, cName string, out *fuse.EntryOut) (ch
 	ch = n.newChild(ctx, st, out)
 	// Translate ciphertext size in `out.Attr.Size` to plaintext size
 	if t == typeReal {
-		n.translateSize(d.dirfd, cName, d.pName, &out.Attr)
+		if errno = n.translateSize(d.dirfd, cName, d.pName, &out.Attr); errno != 0 {
+			return nil, errno
+		}
 	}
 	return ch, 0
 }
@@ -93,7 +99,9 @@ func (n *Node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut)
 
 	// Translate ciphertext size in `out.Attr.Size` to plaintext size
 	cName := filepath.Base(n.Path())
-	n.translateSize(d.dirfd, cName, d.pName, &out.Attr)
+	if errno = n.translateSize(d.dirfd, cName, d.pName, &out.Attr); errno != 0 {
+		return errno
+	}
 
 	if rn.args.ForceOwner != nil {
 		out.Owner = *rn.args.ForceOwner
@@ -118,6 +126,26 @@ func (n *Node) Readlink(ctx context.Context) (out []byte, errno syscall.Errno) {
 //
 // Symlink-safe through Openat().
 func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	rn := n.rootNode()
+	if rn.restore != nil {
+		// Staged files are read as-is, and writing to real files stages them
+		// once something is written
+		_, staged := rn.restore.lookup(n.Path())
+		if staged || flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+			fh, errno = n.openRestore(flags)
+			return
+		}
+	}
+	rf, errno := n.openCiphertext()
+	if errno != 0 {
+		return
+	}
+	return rf, 0, 0
+}
+
+// openCiphertext opens the backing file and returns a handle that reads its
+// encrypted view
+func (n *Node) openCiphertext() (rf *File, errno syscall.Errno) {
 	d, errno := n.prepareAtSyscall("")
 	if errno != 0 {
 		return
@@ -147,41 +175,17 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 		errno = syscall.EACCES
 		return
 	}
-	// See if we have that inode number already in the table
-	// (even if Nlink has dropped to 1)
-	var derivedIVs pathiv.FileIVs
-	v, found := inodeTable.Load(st.Ino)
-	if found {
-		tlog.Debug.Printf("ino%d: newFile: found in the inode table", st.Ino)
-		derivedIVs = v.(pathiv.FileIVs)
-	} else {
-		p := n.Path()
-		derivedIVs = pathiv.DeriveFile(p)
-		// Nlink > 1 means there is more than one path to this file.
-		// Store the derived values so we always return the same data,
-		// regardless of the path that is used to access the file.
-		// This means that the first path wins.
-		if st.Nlink > 1 {
-			v, found = inodeTable.LoadOrStore(st.Ino, derivedIVs)
-			if found {
-				// Another thread has stored a different value before we could.
-				derivedIVs = v.(pathiv.FileIVs)
-			} else {
-				tlog.Debug.Printf("ino%d: newFile: Nlink=%d, stored in the inode table", st.Ino, st.Nlink)
-			}
-		}
-	}
-	header := contentenc.FileHeader{
-		Version: contentenc.CurrentVersion,
-		ID:      derivedIVs.ID,
+	rn := n.rootNode()
+	rf, err = rn.newFile(fd, &st, rn.fileIVs(&st, n.Path()), d.pPath)
+	if err != nil {
+		syscall.Close(fd)
+		errno = fs.ToErrno(err)
+		return
 	}
-	fh = &File{
-		fd:         os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd)),
-		header:     header,
-		block0IV:   derivedIVs.Block0IV,
-		contentEnc: n.rootNode().contentEnc,
+	if rn.args.ConsistentReads {
+		rf.pinned = &a
 	}
-	return
+	return rf, 0
 }
 
 // StatFs - FUSE call. Returns information about the filesystem.
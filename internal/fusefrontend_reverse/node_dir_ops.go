@@ -25,7 +25,8 @@ func (n *Node) Readdir(ctx context.Context) (stream fs.DirStream, errno syscall.
 	rn := n.rootNode()
 	// Should we present a virtual gocryptfs.diriv?
 	var virtualFiles []fuse.DirEntry
-	if !rn.args.PlaintextNames && !rn.args.DeterministicNames {
+	// Virtual files are hidden in a -writable mount, see Lookup.
+	if !rn.args.PlaintextNames && !rn.args.DeterministicNames && rn.restore == nil {
 		virtualFiles = append(virtualFiles, fuse.DirEntry{Mode: virtualFileMode, Name: nametransform.DirIVFilename})
 	}
 
@@ -55,8 +56,14 @@ func (n *Node) Readdir(ctx context.Context) (stream fs.DirStream, errno syscall.
 	// Filter out excluded entries
 	entries = rn.excludeDirEntries(d, entries)
 
+	// Show staged entries of a -writable mount under their ciphertext names
+	var staged []fuse.DirEntry
+	if rn.restore != nil {
+		entries, staged = rn.restore.dirEntries(d.pPath, d.cPath, entries)
+	}
+
 	if rn.args.PlaintextNames {
-		return n.readdirPlaintextnames(entries)
+		return n.readdirPlaintextnames(mergeStaged(entries, staged))
 	}
 
 	dirIV := rn.deriveDirIV(d.cPath)
@@ -75,11 +82,13 @@ func (n *Node) Readdir(ctx context.Context) (stream fs.DirStream, errno syscall.
 			}
 			if len(cName) > unix.NAME_MAX || len(cName) > rn.nameTransform.GetLongNameMax() {
 				cName = rn.nameTransform.HashLongName(cName)
-				dotNameFile := fuse.DirEntry{
-					Mode: virtualFileMode,
-					Name: cName + nametransform.LongNameSuffix,
+				if rn.restore == nil {
+					dotNameFile := fuse.DirEntry{
+						Mode: virtualFileMode,
+						Name: cName + nametransform.LongNameSuffix,
+					}
+					virtualFiles = append(virtualFiles, dotNameFile)
 				}
-				virtualFiles = append(virtualFiles, dotNameFile)
 			}
 		}
 		entries[i].Name = cName
@@ -87,6 +96,7 @@ func (n *Node) Readdir(ctx context.Context) (stream fs.DirStream, errno syscall.
 
 	// Add virtual files
 	entries = append(entries, virtualFiles...)
+	entries = mergeStaged(entries, staged)
 	return fs.NewListDirStream(entries), 0
 }
 
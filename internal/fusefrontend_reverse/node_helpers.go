@@ -27,15 +27,32 @@ const (
 	shortNameMax = 175
 )
 
-// translateSize translates the ciphertext size in `out` into plaintext size.
-func (n *Node) translateSize(dirfd int, cName string, pName string, out *fuse.Attr) {
+// translateSize translates the plaintext size in `out` into ciphertext size.
+// With compression, this needs the block index of the file, and an error is
+// returned if it cannot be computed.
+func (n *Node) translateSize(dirfd int, cName string, pName string, out *fuse.Attr) syscall.Errno {
 	if out.IsRegular() {
 		rn := n.rootNode()
+		if rn.restore != nil {
+			if _, staged := rn.restore.pathOf(pName); staged {
+				// Staged files contain ciphertext already
+				return 0
+			}
+		}
+		if rn.args.Compression != "" {
+			index, err := rn.openBlockIndex(dirfd, pName)
+			if err != nil {
+				return fs.ToErrno(err)
+			}
+			out.Size = index.CipherSize()
+			return 0
+		}
 		out.Size = rn.contentEnc.PlainSizeToCipherSize(out.Size)
 	} else if out.IsSymlink() {
 		cLink, _ := n.readlink(dirfd, cName, pName)
 		out.Size = uint64(len(cLink))
 	}
+	return 0
 }
 
 // Path returns the relative plaintext path of this node
@@ -136,7 +153,7 @@ func (n *Node) lookupLongnameName(ctx context.Context, nameFile string, out *fus
 	if errno != 0 {
 		return
 	}
-	if rn.isExcludedPlain(filepath.Join(d.cPath, pName)) {
+	if rn.isExcludedPlain(filepath.Join(d.pPath, pName)) {
 		errno = syscall.EPERM
 		return
 	}
@@ -212,6 +229,23 @@ func (n *Node) lookupConf(ctx context.Context, out *fuse.EntryOut) (ch *fs.Inode
 	return
 }
 
+// decryptSymlinkTarget is the inverse of encryptSymlinkTarget. Used with
+// -writable.
+func (rn *RootNode) decryptSymlinkTarget(cTarget string) (plainTarget string, errno syscall.Errno) {
+	if rn.args.PlaintextNames {
+		return cTarget, 0
+	}
+	cBinTarget, err := rn.nameTransform.B64DecodeString(cTarget)
+	if err != nil {
+		return "", syscall.EINVAL
+	}
+	pBinTarget, err := rn.contentEnc.DecryptBlock(cBinTarget, 0, nil)
+	if err != nil {
+		return "", syscall.EINVAL
+	}
+	return string(pBinTarget), 0
+}
+
 // readlink reads and encrypts a symlink. Used by Readlink, Getattr, Lookup.
 func (n *Node) readlink(dirfd int, cName string, pName string) (out []byte, errno syscall.Errno) {
 	plainTarget, err := syscallcompat.Readlinkat(dirfd, pName)
@@ -219,13 +253,17 @@ func (n *Node) readlink(dirfd int, cName string, pName string) (out []byte, errn
 		errno = fs.ToErrno(err)
 		return
 	}
-	rn := n.rootNode()
+	// Nonce is derived from the relative *ciphertext* path
+	return n.rootNode().encryptSymlinkTarget(plainTarget, filepath.Join(n.Path(), cName))
+}
+
+// encryptSymlinkTarget encrypts the symlink target "plainTarget" using a
+// nonce derived from "cPath".
+func (rn *RootNode) encryptSymlinkTarget(plainTarget string, cPath string) (out []byte, errno syscall.Errno) {
 	if rn.args.PlaintextNames {
 		return []byte(plainTarget), 0
 	}
-	// Nonce is derived from the relative *ciphertext* path
-	p := filepath.Join(n.Path(), cName)
-	nonce := pathiv.Derive(p, pathiv.PurposeSymlinkIV)
+	nonce := pathiv.Derive(cPath, pathiv.PurposeSymlinkIV)
 	// Symlinks are encrypted like file contents and base64-encoded
 	cBinTarget := rn.contentEnc.EncryptBlockNonce([]byte(plainTarget), 0, nil, nonce)
 	cTarget := rn.nameTransform.B64EncodeToString(cBinTarget)
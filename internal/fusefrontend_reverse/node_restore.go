@@ -0,0 +1,443 @@
+package fusefrontend_reverse
+
+// Write operations, only available with "-writable". See restore.go.
+
+import (
+	"context"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+)
+
+// Create - FUSE call. New files are always staged and decrypted when their
+// last handle is released, or when they are renamed.
+func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	rn := n.rootNode()
+	if rn.restore == nil {
+		return nil, nil, 0, syscall.EROFS
+	}
+	rn.restore.opMu.Lock()
+	defer rn.restore.opMu.Unlock()
+
+	cDir := n.Path()
+	dirfd, _, _, errno := rn.restoreTarget(cDir, name)
+	if errno != 0 {
+		return
+	}
+	defer syscall.Close(dirfd)
+	fd, st, hidden, errno := rn.stage(dirfd, filepath.Join(cDir, name), mode&07777)
+	if errno != 0 {
+		return
+	}
+	inode = n.newChild(ctx, st, out)
+	fh = newRestoreFile(fd, hidden, inode.Operations().(*Node))
+	return inode, fh, 0, 0
+}
+
+// openRestore opens a staged file, or another file for writing. The content
+// of a real file can only be replaced as a whole, so writing to it stages a
+// copy of its ciphertext that is decrypted over the real file when it is
+// closed. A virtual file whose dentry the kernel still has cached after an
+// earlier write has no data to keep and is staged right away.
+func (n *Node) openRestore(flags uint32) (fh fs.FileHandle, errno syscall.Errno) {
+	rn := n.rootNode()
+	rn.restore.opMu.Lock()
+	defer rn.restore.opMu.Unlock()
+
+	cPath := n.Path()
+	if hidden, ok := rn.restore.lookup(cPath); ok {
+		d, errno := n.prepareAtSyscall("")
+		if errno != 0 {
+			return nil, errno
+		}
+		defer syscall.Close(d.dirfd)
+		fd, err := syscallcompat.Openat(d.dirfd, d.pName, int(flags)&(syscall.O_ACCMODE|syscall.O_APPEND)|syscall.O_NOFOLLOW, 0)
+		if err != nil {
+			return nil, fs.ToErrno(err)
+		}
+		return newRestoreFile(fd, hidden, n), 0
+	}
+	dirfd, kind, _, errno := rn.restoreTarget(parentDir(cPath), filepath.Base(cPath))
+	if errno != 0 {
+		return nil, errno
+	}
+	defer syscall.Close(dirfd)
+	if kind == restoreReal {
+		view, errno := n.openCiphertext()
+		if errno != 0 {
+			return nil, errno
+		}
+		rf := &restoreFile{view: view, node: n}
+		rn.restore.addUnstaged(n, rf)
+		return rf, 0
+	}
+	fd, _, hidden, errno := rn.stage(dirfd, cPath, 0600)
+	if errno != 0 {
+		return nil, errno
+	}
+	return newRestoreFile(fd, hidden, n), 0
+}
+
+// Mkdir - FUSE call. Directories that cannot be decrypted yet are staged.
+func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	rn := n.rootNode()
+	if rn.restore == nil {
+		return nil, syscall.EROFS
+	}
+	rn.restore.opMu.Lock()
+	defer rn.restore.opMu.Unlock()
+
+	cDir := n.Path()
+	dirfd, kind, pName, errno := rn.restoreTarget(cDir, name)
+	if errno != 0 {
+		return nil, errno
+	}
+	defer syscall.Close(dirfd)
+	switch kind {
+	case restoreReal:
+	case restoreStaged:
+		pName = newHiddenName()
+	default:
+		return nil, syscall.EEXIST
+	}
+	if kind == restoreStaged {
+		if errno := rn.restore.add(filepath.Join(cDir, name), pName); errno != 0 {
+			return nil, errno
+		}
+	}
+	if err := unix.Mkdirat(dirfd, pName, mode); err != nil {
+		if kind == restoreStaged {
+			rn.restore.remove(filepath.Join(cDir, name))
+		}
+		return nil, fs.ToErrno(err)
+	}
+	st, err := syscallcompat.Fstatat2(dirfd, pName, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	return n.newChild(ctx, st, out), 0
+}
+
+// Symlink - FUSE call. The encrypted target is decrypted.
+func (n *Node) Symlink(ctx context.Context, target string, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	rn := n.rootNode()
+	if rn.restore == nil {
+		return nil, syscall.EROFS
+	}
+	rn.restore.opMu.Lock()
+	defer rn.restore.opMu.Unlock()
+
+	plainTarget, errno := rn.decryptSymlinkTarget(target)
+	if errno != 0 {
+		return nil, errno
+	}
+	cDir := n.Path()
+	dirfd, kind, pName, errno := rn.restoreTarget(cDir, name)
+	if errno != 0 {
+		return nil, errno
+	}
+	defer syscall.Close(dirfd)
+	switch kind {
+	case restoreReal:
+	case restoreStaged:
+		pName = newHiddenName()
+	default:
+		return nil, syscall.EEXIST
+	}
+	if kind == restoreStaged {
+		if errno := rn.restore.add(filepath.Join(cDir, name), pName); errno != 0 {
+			return nil, errno
+		}
+	}
+	if err := unix.Symlinkat(plainTarget, dirfd, pName); err != nil {
+		if kind == restoreStaged {
+			rn.restore.remove(filepath.Join(cDir, name))
+		}
+		return nil, fs.ToErrno(err)
+	}
+	st, err := syscallcompat.Fstatat2(dirfd, pName, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	ch := n.newChild(ctx, st, out)
+	if errno := n.translateSize(dirfd, name, pName, &out.Attr); errno != 0 {
+		return nil, errno
+	}
+	return ch, 0
+}
+
+// Unlink - FUSE call. Deleting gocryptfs.conf is refused.
+func (n *Node) Unlink(ctx context.Context, name string) syscall.Errno {
+	return n.remove(name, 0)
+}
+
+// Rmdir - FUSE call.
+func (n *Node) Rmdir(ctx context.Context, name string) syscall.Errno {
+	return n.remove(name, unix.AT_REMOVEDIR)
+}
+
+// remove implements Unlink and Rmdir
+func (n *Node) remove(name string, flags int) syscall.Errno {
+	rn := n.rootNode()
+	if rn.restore == nil {
+		return syscall.EROFS
+	}
+	rn.restore.opMu.Lock()
+	defer rn.restore.opMu.Unlock()
+
+	cPath := filepath.Join(n.Path(), name)
+	if hidden, ok := rn.restore.lookup(cPath); ok {
+		dirfd, err := rn.openPlainDir(n.Path())
+		if err != nil {
+			return fs.ToErrno(err)
+		}
+		defer syscall.Close(dirfd)
+		if err = syscallcompat.Unlinkat(dirfd, hidden, flags); err != nil {
+			return fs.ToErrno(err)
+		}
+		rn.restore.remove(cPath)
+		return 0
+	}
+	if n.lookupFileType(name) == typeConfig {
+		return syscall.EPERM
+	}
+	d, errno := n.prepareAtSyscall(name)
+	if errno != 0 {
+		return errno
+	}
+	defer syscall.Close(d.dirfd)
+	return fs.ToErrno(syscallcompat.Unlinkat(d.dirfd, d.pName, flags))
+}
+
+// Rename - FUSE call.
+// This function is called on the PARENT DIRECTORY of `name`.
+//
+// A staged entry is moved and settled if the new name can be decrypted.
+// Renaming a staged file to a virtual file checks the content.
+func (n *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	rn := n.rootNode()
+	if rn.restore == nil {
+		return syscall.EROFS
+	}
+	if flags&^syscallcompat.RENAME_NOREPLACE != 0 {
+		return syscall.EINVAL
+	}
+	rn.restore.opMu.Lock()
+	defer rn.restore.opMu.Unlock()
+
+	oldPath := filepath.Join(n.Path(), name)
+	newDir := newParent.EmbeddedInode().Path(n.Root())
+	newPath := filepath.Join(newDir, newName)
+	hidden, staged := rn.restore.lookup(oldPath)
+	if !staged && n.lookupFileType(name) != typeReal {
+		return syscall.EPERM
+	}
+	dirfd2, kind, pName2, errno := rn.restoreTarget(newDir, newName)
+	if errno != 0 {
+		return errno
+	}
+	defer syscall.Close(dirfd2)
+	// A staged entry at the destination is replaced
+	if hidden2, ok := rn.restore.lookup(newPath); ok && newPath != oldPath {
+		if flags&syscallcompat.RENAME_NOREPLACE != 0 {
+			return syscall.EEXIST
+		}
+		if err := removeAt(dirfd2, hidden2); err != nil {
+			return fs.ToErrno(err)
+		}
+		rn.restore.remove(newPath)
+	}
+	if staged {
+		if flags&syscallcompat.RENAME_NOREPLACE != 0 && kind == restoreReal {
+			// Settling would replace the plaintext file
+			if _, err := syscallcompat.Fstatat2(dirfd2, pName2, unix.AT_SYMLINK_NOFOLLOW); err == nil {
+				return syscall.EEXIST
+			}
+		}
+		dirfd, err := rn.openPlainDir(n.Path())
+		if err != nil {
+			return fs.ToErrno(err)
+		}
+		defer syscall.Close(dirfd)
+		if err = syscallcompat.Renameat2(dirfd, hidden, dirfd2, hidden, 0); err != nil {
+			return fs.ToErrno(err)
+		}
+		rn.restore.move(oldPath, newPath)
+		return rn.settle(newPath)
+	}
+	d, errno := n.prepareAtSyscall(name)
+	if errno != 0 {
+		return errno
+	}
+	defer syscall.Close(d.dirfd)
+	switch kind {
+	case restoreReal:
+		err := syscallcompat.Renameat2(d.dirfd, d.pName, dirfd2, pName2, uint(flags))
+		if err != nil {
+			return fs.ToErrno(err)
+		}
+	case restoreStaged:
+		hidden = newHiddenName()
+		if errno := rn.restore.add(newPath, hidden); errno != 0 {
+			return errno
+		}
+		if err := syscallcompat.Renameat2(d.dirfd, d.pName, dirfd2, hidden, 0); err != nil {
+			rn.restore.remove(newPath)
+			return fs.ToErrno(err)
+		}
+	default:
+		return syscall.EPERM
+	}
+	// Staged entries inside a renamed directory move with it
+	rn.restore.move(oldPath, newPath)
+	return 0
+}
+
+// Setxattr - FUSE call. Extended attributes cannot be restored. ENOTSUP makes
+// copy tools skip them.
+func (n *Node) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	if n.rootNode().restore == nil {
+		return syscall.EROFS
+	}
+	return syscall.ENOTSUP
+}
+
+// Removexattr - FUSE call. See Setxattr.
+func (n *Node) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	if n.rootNode().restore == nil {
+		return syscall.EROFS
+	}
+	return syscall.ENOTSUP
+}
+
+// Setattr - FUSE call. The size can only be changed for staged files, and
+// through handles of files opened for writing, which stages them.
+func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	rn := n.rootNode()
+	if rn.restore == nil {
+		return syscall.EROFS
+	}
+	rf, _ := f.(*restoreFile)
+
+	// truncate(2). This comes first, so that the other changes go to the file
+	// it stages.
+	if sz, ok := in.GetSize(); ok {
+		if errno := n.truncate(rf, sz); errno != 0 {
+			return errno
+		}
+	}
+
+	rn.restore.opMu.Lock()
+	defer rn.restore.opMu.Unlock()
+	d, errno := n.prepareAtSyscall("")
+	if errno != 0 {
+		return errno
+	}
+	defer syscall.Close(d.dirfd)
+	// Use the fd if the kernel gave us one of a staged file
+	fd := -1
+	if rf != nil {
+		fd = rf.stagedFd()
+	}
+
+	// chmod(2)
+	if mode, ok := in.GetMode(); ok {
+		var err error
+		if fd >= 0 {
+			err = syscall.Fchmod(fd, mode)
+		} else {
+			err = syscallcompat.FchmodatNofollow(d.dirfd, d.pName, mode)
+		}
+		if err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+
+	// chown(2)
+	uid32, uOk := in.GetUID()
+	gid32, gOk := in.GetGID()
+	if uOk || gOk {
+		uid := -1
+		gid := -1
+		if uOk {
+			uid = int(uid32)
+		}
+		if gOk {
+			gid = int(gid32)
+		}
+		var err error
+		if fd >= 0 {
+			err = syscall.Fchown(fd, uid, gid)
+		} else {
+			err = syscallcompat.Fchownat(d.dirfd, d.pName, uid, gid, unix.AT_SYMLINK_NOFOLLOW)
+		}
+		if err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+
+	// utimens(2)
+	mtime, mok := in.GetMTime()
+	atime, aok := in.GetATime()
+	if mok || aok {
+		ap := &atime
+		mp := &mtime
+		if !aok {
+			ap = nil
+		}
+		if !mok {
+			mp = nil
+		}
+		var err error
+		if fd >= 0 {
+			err = syscallcompat.FutimesNano(fd, ap, mp)
+		} else {
+			err = syscallcompat.UtimesNanoAtNofollow(d.dirfd, d.pName, ap, mp)
+		}
+		if err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+	return n.Getattr(ctx, f, out)
+}
+
+// truncate implements the size change of Setattr. "rf" is the file handle
+// the kernel passed, or nil. For open(2) with O_TRUNC, the kernel passes no
+// file handle, so handles of the file that have not been written to yet are
+// staged here as well.
+func (n *Node) truncate(rf *restoreFile, size uint64) syscall.Errno {
+	if rf != nil {
+		return rf.truncate(size)
+	}
+	rn := n.rootNode()
+	rn.restore.opMu.Lock()
+	defer rn.restore.opMu.Unlock()
+	stagedNow, errno := rn.stageHandles(n, size > 0)
+	if errno != 0 {
+		return errno
+	}
+	if stagedNow && size == 0 {
+		// Already empty
+		return 0
+	}
+	if _, staged := rn.restore.lookup(n.Path()); !staged {
+		return syscall.EPERM
+	}
+	d, errno := n.prepareAtSyscall("")
+	if errno != 0 {
+		return errno
+	}
+	defer syscall.Close(d.dirfd)
+	fd, err := syscallcompat.Openat(d.dirfd, d.pName, syscall.O_WRONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	defer syscall.Close(fd)
+	return fs.ToErrno(syscall.Ftruncate(fd, int64(size)))
+}
@@ -0,0 +1,115 @@
+package fusefrontend_reverse
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/pathiv"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// -1 as uint32
+const minus1 = ^uint32(0)
+
+// Encrypted xattrs are presented under this prefix plus the base64-encoded
+// encrypted original name, like forward mode stores them.
+// Keep in sync with fusefrontend.xattrStorePrefix!
+const xattrStorePrefix = "user.gocryptfs."
+
+// isAcl returns true if the attribute name is for storing ACLs
+//
+// ACLs are passed through without encryption, like in forward mode
+func isAcl(attr string) bool {
+	return attr == "system.posix_acl_access" || attr == "system.posix_acl_default"
+}
+
+// Getxattr - FUSE call. Reads the plaintext xattr that "cAttr" is the
+// encrypted name of, and returns the encrypted value.
+func (n *Node) Getxattr(ctx context.Context, cAttr string, dest []byte) (uint32, syscall.Errno) {
+	rn := n.rootNode()
+	var data []byte
+	if isAcl(cAttr) {
+		var errno syscall.Errno
+		data, errno = n.getXAttr(cAttr)
+		if errno != 0 {
+			return minus1, errno
+		}
+	} else {
+		if !strings.HasPrefix(cAttr, xattrStorePrefix) {
+			return minus1, syscall.Errno(fuse.ENOATTR)
+		}
+		attr, err := rn.nameTransform.DecryptXattrName(cAttr[len(xattrStorePrefix):])
+		if err != nil || isAcl(attr) {
+			return minus1, syscall.Errno(fuse.ENOATTR)
+		}
+		pData, errno := n.getXAttr(attr)
+		if errno != 0 {
+			return minus1, errno
+		}
+		data = rn.encryptXattrValue(n.Path(), cAttr, pData)
+	}
+	// Caller passes size zero to find out how large their buffer should be
+	if len(dest) == 0 {
+		return uint32(len(data)), 0
+	}
+	if len(dest) < len(data) {
+		return minus1, syscall.ERANGE
+	}
+	return uint32(copy(dest, data)), 0
+}
+
+// Listxattr - FUSE call. Lists the encrypted names of the xattrs of the
+// plaintext file.
+func (n *Node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	names, errno := n.listXAttr()
+	if errno != 0 {
+		return minus1, errno
+	}
+	rn := n.rootNode()
+	var buf bytes.Buffer
+	for _, name := range names {
+		if cAttr, ok := rn.encryptXattrName(name); ok {
+			buf.WriteString(cAttr + "\000")
+		}
+	}
+	// Caller passes size zero to find out how large their buffer should be
+	if len(dest) == 0 {
+		return uint32(buf.Len()), 0
+	}
+	if buf.Len() > len(dest) {
+		return minus1, syscall.ERANGE
+	}
+	return uint32(copy(dest, buf.Bytes())), 0
+}
+
+// encryptXattrName returns the name the plaintext xattr "attr" is presented
+// under. ACLs keep their name. Returns ok=false if the name cannot be
+// encrypted.
+func (rn *RootNode) encryptXattrName(attr string) (cAttr string, ok bool) {
+	if isAcl(attr) {
+		return attr, true
+	}
+	cName, err := rn.nameTransform.EncryptXattrName(attr)
+	if err != nil {
+		tlog.Warn.Printf("encryptXattrName: cannot encrypt %q: %v", attr, err)
+		return "", false
+	}
+	return xattrStorePrefix + cName, true
+}
+
+// encryptXattrValue encrypts the xattr value "data" of the file at "cPath"
+// like forward mode does, but with a nonce derived from the path and the
+// encrypted xattr name "cAttr", so the output is deterministic.
+// Special case: an empty value is encrypted to an empty value.
+func (rn *RootNode) encryptXattrValue(cPath string, cAttr string, data []byte) []byte {
+	if len(data) == 0 {
+		return []byte{}
+	}
+	// Neither can contain a null byte
+	nonce := pathiv.Derive(cPath+"\000"+cAttr, pathiv.PurposeXattrIV)
+	return rn.contentEnc.EncryptBlockNonce(data, 0, nil, nonce)
+}
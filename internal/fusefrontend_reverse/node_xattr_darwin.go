@@ -0,0 +1,67 @@
+package fusefrontend_reverse
+
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+)
+
+// openBackingAt opens "pName" in "dirfd" for reading its xattrs
+func openBackingAt(dirfd int, pName string) (fd int, errno syscall.Errno) {
+	// O_NONBLOCK to not block on FIFOs.
+	fd, err := syscallcompat.Openat(dirfd, pName, syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return -1, fs.ToErrno(err)
+	}
+	return fd, 0
+}
+
+// getXAttr reads the plaintext xattr "attr" of the backing file.
+func (n *Node) getXAttr(attr string) (out []byte, errno syscall.Errno) {
+	d, errno := n.prepareAtSyscall("")
+	if errno != 0 {
+		return
+	}
+	defer syscall.Close(d.dirfd)
+	return getXAttrAt(d.dirfd, d.pName, attr)
+}
+
+// listXAttr lists the plaintext xattr names of the backing file.
+func (n *Node) listXAttr() (out []string, errno syscall.Errno) {
+	d, errno := n.prepareAtSyscall("")
+	if errno != 0 {
+		return
+	}
+	defer syscall.Close(d.dirfd)
+	return listXAttrAt(d.dirfd, d.pName)
+}
+
+// getXAttrAt reads the plaintext xattr "attr" of "pName" in "dirfd".
+func getXAttrAt(dirfd int, pName string, attr string) ([]byte, syscall.Errno) {
+	fd, errno := openBackingAt(dirfd, pName)
+	if errno != 0 {
+		return nil, errno
+	}
+	defer syscall.Close(fd)
+	data, err := syscallcompat.Fgetxattr(fd, attr)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	return data, 0
+}
+
+// listXAttrAt lists the plaintext xattr names of "pName" in "dirfd".
+func listXAttrAt(dirfd int, pName string) ([]string, syscall.Errno) {
+	fd, errno := openBackingAt(dirfd, pName)
+	if errno != 0 {
+		return nil, errno
+	}
+	defer syscall.Close(fd)
+	names, err := syscallcompat.Flistxattr(fd)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	return names, 0
+}
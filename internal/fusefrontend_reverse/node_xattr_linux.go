@@ -0,0 +1,52 @@
+package fusefrontend_reverse
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+)
+
+// getXAttr reads the plaintext xattr "attr" of the backing file.
+//
+// Symlink-safe through openBackingDir() and the /proc/self/fd path.
+func (n *Node) getXAttr(attr string) (out []byte, errno syscall.Errno) {
+	d, errno := n.prepareAtSyscall("")
+	if errno != 0 {
+		return
+	}
+	defer syscall.Close(d.dirfd)
+	return getXAttrAt(d.dirfd, d.pName, attr)
+}
+
+// listXAttr lists the plaintext xattr names of the backing file.
+func (n *Node) listXAttr() (out []string, errno syscall.Errno) {
+	d, errno := n.prepareAtSyscall("")
+	if errno != 0 {
+		return
+	}
+	defer syscall.Close(d.dirfd)
+	return listXAttrAt(d.dirfd, d.pName)
+}
+
+// getXAttrAt reads the plaintext xattr "attr" of "pName" in "dirfd".
+func getXAttrAt(dirfd int, pName string, attr string) ([]byte, syscall.Errno) {
+	procPath := fmt.Sprintf("/proc/self/fd/%d/%s", dirfd, pName)
+	data, err := syscallcompat.Lgetxattr(procPath, attr)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	return data, 0
+}
+
+// listXAttrAt lists the plaintext xattr names of "pName" in "dirfd".
+func listXAttrAt(dirfd int, pName string) ([]string, syscall.Errno) {
+	procPath := fmt.Sprintf("/proc/self/fd/%d/%s", dirfd, pName)
+	names, err := syscallcompat.Llistxattr(procPath)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	return names, 0
+}
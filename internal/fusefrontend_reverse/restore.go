@@ -0,0 +1,817 @@
+package fusefrontend_reverse
+
+// Restoring a backup through a "-writable" reverse mount
+//
+// Ciphertext that is written into the reverse view is decrypted into the
+// backing plaintext directory. Copy tools do not always write under the
+// final name: rsync writes to a temporary file like ".foo.XXXXXX" and renames
+// it when done, and the content of a file with a long name
+// ("gocryptfs.longname.XYZ") may arrive before its ".name" file.
+//
+// Entries that cannot be decrypted yet are "staged": they are stored under a
+// hidden name in the plaintext directory, regular files keep their
+// ciphertext, and they show up under their ciphertext name in the reverse
+// view. Once a staged entry has a name that can be decrypted, it is
+// "settled": regular files are decrypted into a file with the plaintext
+// name, directories and symlinks are renamed. New regular files are always
+// staged and settled when their last handle is released, or when they are
+// renamed while closed. Writing to an existing file stages a copy of its
+// ciphertext, the plaintext file is only replaced when that copy is settled.
+//
+// Writing the virtual files (gocryptfs.diriv, gocryptfs.longname.XYZ.name,
+// gocryptfs.conf) only checks that the content matches.
+//
+// The staged entries are recorded in a journal in the plaintext root
+// directory before they are created, so they are not lost on unmount or
+// crash. The next "-writable" mount shows them again under their ciphertext
+// names. A read-only mount hides them, so they do not end up in a backup.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+const (
+	// restorePrefix starts the hidden plaintext names of staged entries.
+	// Only the names in the journal are hidden, other files with this prefix
+	// are normal files.
+	restorePrefix = nametransform.RestorePrefix
+	// restoreJournal is the name of the journal in the plaintext root
+	// directory
+	restoreJournal = restorePrefix + "journal"
+	// restoreTmpSuffix is appended to a hidden name for the plaintext file
+	// that a staged file is decrypted into, and to the journal while it is
+	// written
+	restoreTmpSuffix = ".tmp"
+	// Virtual files are small. This limits what we read when checking a
+	// staged one.
+	virtualFileMax = 1024 * 1024
+)
+
+// restoreState tracks the staged entries of a "-writable" mount. The
+// methods can be called on a nil *restoreState (read-only mount) and then
+// report that nothing is staged.
+type restoreState struct {
+	// opMu serializes all write operations
+	opMu sync.Mutex
+	// mu protects the maps
+	mu sync.Mutex
+	// journal is the absolute path of the journal file
+	journal string
+	// staged maps the relative ciphertext path of a staged entry to its
+	// hidden name. The hidden entry lives in the plaintext directory that
+	// the parent ciphertext path decrypts to. Saved to the journal on every
+	// change.
+	staged map[string]string
+	// byHidden is the reverse of staged
+	byHidden map[string]string
+	// handles counts the open file handles of staged files by hidden name.
+	// A staged file is only settled when its last handle is closed.
+	handles map[string]int
+	// unstaged lists the handles of real files that have been opened for
+	// writing but not written to yet. They are staged together, so that they
+	// all see the same content.
+	unstaged map[*Node][]*restoreFile
+	// longNames maps the relative ciphertext path of a
+	// "gocryptfs.longname.XYZ" entry to the full ciphertext name from its
+	// ".name" file
+	longNames map[string]string
+}
+
+func newRestoreState(journal string) *restoreState {
+	return &restoreState{
+		journal:   journal,
+		staged:    make(map[string]string),
+		byHidden:  make(map[string]string),
+		handles:   make(map[string]int),
+		unstaged:  make(map[*Node][]*restoreFile),
+		longNames: make(map[string]string),
+	}
+}
+
+// lookup returns the hidden name of the staged entry at "cPath"
+func (r *restoreState) lookup(cPath string) (hidden string, ok bool) {
+	if r == nil {
+		return "", false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hidden, ok = r.staged[cPath]
+	return
+}
+
+// add records the staged entry at "cPath". Must be called before the hidden
+// entry is created, so the journal knows about it if we crash.
+func (r *restoreState) add(cPath string, hidden string) syscall.Errno {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.staged[cPath] = hidden
+	r.byHidden[hidden] = cPath
+	if err := r.save(); err != nil {
+		tlog.Warn.Printf("restore: writing the journal: %v", err)
+		delete(r.staged, cPath)
+		delete(r.byHidden, hidden)
+		return fs.ToErrno(err)
+	}
+	return 0
+}
+
+func (r *restoreState) remove(cPath string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.byHidden, r.staged[cPath])
+	delete(r.staged, cPath)
+	if err := r.save(); err != nil {
+		tlog.Warn.Printf("restore: writing the journal: %v", err)
+	}
+}
+
+// save writes the staged entries to the journal, or deletes it if there are
+// none. The caller holds r.mu.
+//
+// The journal is replaced atomically, but not fsync'ed: that would cost two
+// fsyncs for every restored file.
+func (r *restoreState) save() error {
+	if len(r.staged) == 0 {
+		err := os.Remove(r.journal)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	data, err := json.Marshal(r.staged)
+	if err != nil {
+		return err
+	}
+	tmp := r.journal + restoreTmpSuffix
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.journal)
+}
+
+// loadRestoreJournal reads the staged entries from the journal file. A
+// missing journal means that nothing is staged.
+func loadRestoreJournal(journal string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(journal)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var staged map[string]string
+	if err = json.Unmarshal(data, &staged); err != nil {
+		return nil, fmt.Errorf("%s: %v", journal, err)
+	}
+	return staged, nil
+}
+
+// pathOf returns the relative ciphertext path of the staged entry with the
+// hidden name "hidden"
+func (r *restoreState) pathOf(hidden string) (cPath string, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cPath, ok = r.byHidden[hidden]
+	return
+}
+
+// isHidden returns true if the plaintext name "pName" in the directory
+// "pDir" is a staged entry, the file a staged entry is being decrypted into,
+// or the journal.
+func (r *restoreState) isHidden(pDir string, pName string) bool {
+	if !strings.HasPrefix(pName, restorePrefix) {
+		return false
+	}
+	pName = strings.TrimSuffix(pName, restoreTmpSuffix)
+	if pDir == "" && pName == restoreJournal {
+		return true
+	}
+	_, ok := r.pathOf(pName)
+	return ok
+}
+
+// opened records a new file handle of the staged file "hidden"
+func (r *restoreState) opened(hidden string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handles[hidden]++
+}
+
+// closed records that a file handle of the staged file "hidden" has been
+// released. Returns true if it was the last one.
+func (r *restoreState) closed(hidden string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handles[hidden]--
+	if r.handles[hidden] > 0 {
+		return false
+	}
+	delete(r.handles, hidden)
+	return true
+}
+
+// isOpen returns true if the staged file "hidden" has open file handles
+func (r *restoreState) isOpen(hidden string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.handles[hidden] > 0
+}
+
+// addUnstaged records the handle "f" of the real file "n"
+func (r *restoreState) addUnstaged(n *Node, f *restoreFile) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.unstaged[n] = append(r.unstaged[n], f)
+}
+
+// removeUnstaged forgets the handle "f" of the real file "n"
+func (r *restoreState) removeUnstaged(n *Node, f *restoreFile) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := r.unstaged[n]
+	for i := range list {
+		if list[i] == f {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(r.unstaged, n)
+	} else {
+		r.unstaged[n] = list
+	}
+}
+
+// takeUnstaged returns and forgets all unstaged handles of "n"
+func (r *restoreState) takeUnstaged(n *Node) []*restoreFile {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := r.unstaged[n]
+	delete(r.unstaged, n)
+	return list
+}
+
+// move updates the entries at and below "oldPath" after a rename
+func (r *restoreState) move(oldPath string, newPath string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changed := false
+	for _, m := range []map[string]string{r.staged, r.longNames} {
+		for k, v := range m {
+			if k == oldPath || strings.HasPrefix(k, oldPath+"/") {
+				delete(m, k)
+				m[newPath+k[len(oldPath):]] = v
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return
+	}
+	for k, v := range r.staged {
+		r.byHidden[v] = k
+	}
+	if err := r.save(); err != nil {
+		tlog.Warn.Printf("restore: writing the journal: %v", err)
+	}
+}
+
+// children returns the staged entries in the ciphertext directory "cDir",
+// mapping the ciphertext name to the hidden name
+func (r *restoreState) children(cDir string) map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make(map[string]string)
+	for k, v := range r.staged {
+		if parentDir(k) == cDir {
+			out[filepath.Base(k)] = v
+		}
+	}
+	return out
+}
+
+func (r *restoreState) longName(cPath string) (cFullName string, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cFullName, ok = r.longNames[cPath]
+	return
+}
+
+func (r *restoreState) setLongName(cPath string, cFullName string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.longNames[cPath] = cFullName
+}
+
+// dirEntries removes the hidden entries from the listing "entries" of the
+// plaintext directory "pDir" and returns the staged entries of "cDir" under
+// their ciphertext names.
+func (r *restoreState) dirEntries(pDir string, cDir string, entries []fuse.DirEntry) (filtered []fuse.DirEntry, staged []fuse.DirEntry) {
+	modes := make(map[string]uint32)
+	filtered = make([]fuse.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		if r.isHidden(pDir, entry.Name) {
+			modes[entry.Name] = entry.Mode
+			continue
+		}
+		filtered = append(filtered, entry)
+	}
+	for cName, hidden := range r.children(cDir) {
+		if mode, ok := modes[hidden]; ok {
+			staged = append(staged, fuse.DirEntry{Name: cName, Mode: mode})
+		}
+	}
+	return filtered, staged
+}
+
+// mergeStaged appends the staged entries to the ciphertext directory listing
+// "entries". A staged entry hides a real one with the same name, which
+// happens when a file is being overwritten.
+func mergeStaged(entries []fuse.DirEntry, staged []fuse.DirEntry) []fuse.DirEntry {
+	if len(staged) == 0 {
+		return entries
+	}
+	names := make(map[string]bool)
+	for _, s := range staged {
+		names[s.Name] = true
+	}
+	out := make([]fuse.DirEntry, 0, len(entries)+len(staged))
+	for _, entry := range entries {
+		if !names[entry.Name] {
+			out = append(out, entry)
+		}
+	}
+	return append(out, staged...)
+}
+
+// parentDir is filepath.Dir for relative ciphertext paths, with "" for the
+// root directory.
+func parentDir(cPath string) string {
+	d := filepath.Dir(cPath)
+	if d == "." {
+		return ""
+	}
+	return d
+}
+
+// newHiddenName returns a random name with restorePrefix
+func newHiddenName() string {
+	return fmt.Sprintf("%s%016x", restorePrefix, cryptocore.RandUint64())
+}
+
+type restoreKind int
+
+// What writing to a ciphertext name means, as returned by restoreTarget
+const (
+	// The name decrypts to a plaintext name
+	restoreReal restoreKind = iota
+	// The name cannot be decrypted (yet). These are temporary files, and
+	// long names whose ".name" file has not been written.
+	restoreStaged
+	// gocryptfs.diriv
+	restoreDiriv
+	// gocryptfs.longname.XYZ.name
+	restoreNameFile
+	// gocryptfs.conf in the root directory
+	restoreConf
+)
+
+// openPlainDir opens the plaintext directory that the ciphertext directory
+// "cDir" decrypts to.
+func (rn *RootNode) openPlainDir(cDir string) (fd int, err error) {
+	dirfd, pPath, err := rn.openBackingDir(cDir)
+	if err != nil {
+		return -1, err
+	}
+	defer syscall.Close(dirfd)
+	return syscallcompat.Openat(dirfd, filepath.Base(pPath), syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+}
+
+// restoreTarget opens the plaintext directory for the ciphertext directory
+// "cDir" and finds out what writing to "cName" in it means. For restoreReal,
+// "pName" is the plaintext name. The caller must close "dirfd".
+func (rn *RootNode) restoreTarget(cDir string, cName string) (dirfd int, kind restoreKind, pName string, errno syscall.Errno) {
+	dirfd, err := rn.openPlainDir(cDir)
+	if err != nil {
+		return -1, 0, "", fs.ToErrno(err)
+	}
+	kind, pName, errno = rn.classify(dirfd, cDir, cName)
+	if errno == 0 && kind == restoreReal {
+		pDir, err := rn.decryptPath(cDir)
+		if err != nil {
+			errno = fs.ToErrno(err)
+		} else if rn.isExcludedPlain(filepath.Join(pDir, pName)) || rn.restore.isHidden(pDir, pName) {
+			errno = syscall.EPERM
+		}
+	}
+	if errno != 0 {
+		syscall.Close(dirfd)
+		return -1, 0, "", errno
+	}
+	return dirfd, kind, pName, 0
+}
+
+// classify is the part of restoreTarget that looks at the name
+func (rn *RootNode) classify(dirfd int, cDir string, cName string) (kind restoreKind, pName string, errno syscall.Errno) {
+	if cDir == "" && !rn.args.ConfigCustom && cName == configfile.ConfDefaultName {
+		return restoreConf, "", 0
+	}
+	if rn.args.PlaintextNames {
+		// The plaintext directory is the ciphertext directory, unless it is
+		// staged, and then it has no hidden entries
+		if rn.restore.isHidden(cDir, cName) {
+			return 0, "", syscall.EPERM
+		}
+		return restoreReal, cName, 0
+	}
+	if !rn.args.DeterministicNames && cName == nametransform.DirIVFilename {
+		return restoreDiriv, "", 0
+	}
+	dirIV := rn.deriveDirIV(cDir)
+	switch nametransform.NameType(cName) {
+	case nametransform.LongNameFilename:
+		return restoreNameFile, "", 0
+	case nametransform.LongNameContent:
+		cFullName, ok := rn.restore.longName(filepath.Join(cDir, cName))
+		if !ok {
+			// The plaintext file may exist already
+			pName, _, errno = rn.findLongnameParent(dirfd, dirIV, cName)
+			if errno != 0 {
+				return restoreStaged, "", 0
+			}
+			return restoreReal, pName, 0
+		}
+		cName = cFullName
+	}
+	pName, err := rn.nameTransform.DecryptName(cName, dirIV)
+	if err != nil {
+		return restoreStaged, "", 0
+	}
+	return restoreReal, pName, 0
+}
+
+// stage creates a new empty file with a hidden name in "dirfd" and records it
+// as the staged entry at "cPath". The caller must close "fd".
+func (rn *RootNode) stage(dirfd int, cPath string, mode uint32) (fd int, st *syscall.Stat_t, hidden string, errno syscall.Errno) {
+	hidden = newHiddenName()
+	if errno = rn.restore.add(cPath, hidden); errno != 0 {
+		return -1, nil, "", errno
+	}
+	fd, err := syscallcompat.Openat(dirfd, hidden, syscall.O_RDWR|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW, mode)
+	if err != nil {
+		rn.restore.remove(cPath)
+		return -1, nil, "", fs.ToErrno(err)
+	}
+	st = &syscall.Stat_t{}
+	if err = syscall.Fstat(fd, st); err != nil {
+		syscall.Close(fd)
+		syscallcompat.Unlinkat(dirfd, hidden, 0)
+		rn.restore.remove(cPath)
+		return -1, nil, "", fs.ToErrno(err)
+	}
+	return fd, st, hidden, 0
+}
+
+// removeAt removes the file or empty directory "name"
+func removeAt(dirfd int, name string) error {
+	err := syscallcompat.Unlinkat(dirfd, name, 0)
+	if err == syscall.EISDIR || err == syscall.EPERM {
+		err = syscallcompat.Unlinkat(dirfd, name, unix.AT_REMOVEDIR)
+	}
+	return err
+}
+
+// settle finishes the staged entry at "cPath" if its name can be decrypted
+// now. Does nothing if there is no staged entry at "cPath", or if it is a
+// file that is still open. A regular file that cannot be decrypted stays
+// staged, so the data is not lost and the copy can be retried.
+func (rn *RootNode) settle(cPath string) syscall.Errno {
+	hidden, ok := rn.restore.lookup(cPath)
+	if !ok || rn.restore.isOpen(hidden) {
+		return 0
+	}
+	cDir, cName := parentDir(cPath), filepath.Base(cPath)
+	dirfd, kind, pName, errno := rn.restoreTarget(cDir, cName)
+	if errno != 0 {
+		return errno
+	}
+	defer syscall.Close(dirfd)
+	switch kind {
+	case restoreStaged:
+		return 0
+	case restoreReal:
+		// The staged entry was visible under its ciphertext name all along, so
+		// replacing it does not change the directory. Keep its timestamps,
+		// which a copy tool may have set already.
+		var dirSt syscall.Stat_t
+		if err := syscall.Fstat(dirfd, &dirSt); err != nil {
+			return fs.ToErrno(err)
+		}
+		st, err := syscallcompat.Fstatat2(dirfd, hidden, unix.AT_SYMLINK_NOFOLLOW)
+		if err == nil {
+			if st.Mode&syscall.S_IFMT == syscall.S_IFREG {
+				err = rn.decryptFileAt(dirfd, hidden, pName)
+				if err == nil {
+					err = syscallcompat.Unlinkat(dirfd, hidden, 0)
+				}
+			} else {
+				err = syscallcompat.Renameat2(dirfd, hidden, dirfd, pName, 0)
+			}
+		}
+		if err != nil {
+			tlog.Warn.Printf("restore: %q: %v. Keeping the staged copy %q.", cPath, err, hidden)
+			return fs.ToErrno(err)
+		}
+		rn.restore.remove(cPath)
+		var a fuse.Attr
+		a.FromStat(&dirSt)
+		atime, mtime := a.AccessTime(), a.ModTime()
+		if err = syscallcompat.FutimesNano(dirfd, &atime, &mtime); err != nil {
+			tlog.Warn.Printf("restore: %q: restoring directory timestamps: %v", cDir, err)
+		}
+		return 0
+	default:
+		content, err := readFileAt(dirfd, hidden)
+		syscallcompat.Unlinkat(dirfd, hidden, 0)
+		rn.restore.remove(cPath)
+		if err != nil {
+			tlog.Warn.Printf("restore: %q: %v", cPath, err)
+			return fs.ToErrno(err)
+		}
+		return rn.checkVirtual(cDir, cName, kind, content)
+	}
+}
+
+// checkVirtual handles the content written to a virtual file. The content
+// must be what the virtual file contains anyway. A ".name" file tells us the
+// full name of a long name, which may settle a staged entry.
+func (rn *RootNode) checkVirtual(cDir string, cName string, kind restoreKind, content []byte) syscall.Errno {
+	cPath := filepath.Join(cDir, cName)
+	var want []byte
+	switch kind {
+	case restoreDiriv:
+		want = rn.deriveDirIV(cDir)
+	case restoreConf:
+		var err error
+		want, err = ioutil.ReadFile(filepath.Join(rn.args.Cipherdir, configfile.ConfReverseName))
+		if err != nil {
+			return fs.ToErrno(err)
+		}
+	case restoreNameFile:
+		cFullName := string(content)
+		hashName := nametransform.RemoveLongNameSuffix(cName)
+		if rn.nameTransform.HashLongName(cFullName) != hashName {
+			tlog.Warn.Printf("restore: %q: content does not match the hash", cPath)
+			return syscall.EINVAL
+		}
+		if _, err := rn.nameTransform.DecryptName(cFullName, rn.deriveDirIV(cDir)); err != nil {
+			tlog.Warn.Printf("restore: %q: cannot decrypt name: %v", cPath, err)
+			return syscall.EINVAL
+		}
+		contentPath := filepath.Join(cDir, hashName)
+		rn.restore.setLongName(contentPath, cFullName)
+		return rn.settle(contentPath)
+	}
+	if !bytes.Equal(content, want) {
+		return virtualMismatch(cPath)
+	}
+	return 0
+}
+
+// virtualMismatch logs and returns the error for content that does not match
+// a virtual file
+func virtualMismatch(cPath string) syscall.Errno {
+	tlog.Warn.Printf("restore: %q: content differs from the virtual file. Was the backup made with a different config file?", cPath)
+	return syscall.EINVAL
+}
+
+// readFileAt reads a staged virtual file
+func readFileAt(dirfd int, name string) ([]byte, error) {
+	fd, err := syscallcompat.Openat(dirfd, name, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close()
+	content, err := ioutil.ReadAll(io.LimitReader(f, virtualFileMax+1))
+	if err == nil && len(content) > virtualFileMax {
+		err = syscall.EFBIG
+	}
+	return content, err
+}
+
+// decryptFileAt decrypts the staged ciphertext file "src" into a new file
+// that replaces "pName". Both are relative to "dirfd". Permissions,
+// timestamps and, when running as root, the owner are copied from "src".
+func (rn *RootNode) decryptFileAt(dirfd int, src string, pName string) error {
+	fd, err := syscallcompat.Openat(dirfd, src, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	in := os.NewFile(uintptr(fd), src)
+	defer in.Close()
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fd, &st); err != nil {
+		return err
+	}
+	// Left behind on a crash, and deleted on the next mount
+	tmp := src + restoreTmpSuffix
+	syscallcompat.Unlinkat(dirfd, tmp, 0)
+	fd, err = syscallcompat.Openat(dirfd, tmp, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	out := os.NewFile(uintptr(fd), tmp)
+	err = rn.decryptContent(in, uint64(st.Size), out)
+	if err == nil && os.Getuid() == 0 {
+		err = syscall.Fchown(fd, int(st.Uid), int(st.Gid))
+	}
+	if err == nil {
+		err = syscall.Fchmod(fd, uint32(st.Mode)&07777)
+	}
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		var a fuse.Attr
+		a.FromStat(&st)
+		atime, mtime := a.AccessTime(), a.ModTime()
+		err = syscallcompat.UtimesNanoAtNofollow(dirfd, tmp, &atime, &mtime)
+	}
+	if err == nil {
+		err = syscallcompat.Renameat2(dirfd, tmp, dirfd, pName, 0)
+	}
+	if err != nil {
+		syscallcompat.Unlinkat(dirfd, tmp, 0)
+	}
+	return err
+}
+
+// decryptContent writes the plaintext of the ciphertext file "in", which is
+// "size" bytes long, to "w".
+func (rn *RootNode) decryptContent(in *os.File, size uint64, w io.Writer) error {
+	// An empty file stays empty in encrypted form
+	if size == 0 {
+		return nil
+	}
+	buf := make([]byte, contentenc.HeaderLen)
+	if _, err := in.ReadAt(buf, 0); err != nil {
+		return err
+	}
+	h, err := contentenc.ParseHeader(buf)
+	if err != nil {
+		return err
+	}
+	ce, err := rn.contentEnc.ForEpoch(h.Epoch)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriterSize(w, 128*1024)
+	if h.Version == contentenc.CompressedVersion {
+		index, err := ce.ReadBlockIndex(in, size)
+		if err != nil {
+			return err
+		}
+		for i, l := range index.CipherLen {
+			blockNo := uint64(i)
+			block := make([]byte, l)
+			if _, err := in.ReadAt(block, int64(index.BlockCipherOff(blockNo))); err != nil {
+				return err
+			}
+			plain, err := ce.DecryptCompressedBlock(block, blockNo, h.ID, ce.BlockPlainLen(index.PlainSize, blockNo))
+			if err != nil {
+				return fmt.Errorf("block %d: %w", blockNo, err)
+			}
+			bw.Write(plain)
+		}
+		return bw.Flush()
+	}
+	block := make([]byte, ce.CipherBS())
+	for blockNo := uint64(0); ; blockNo++ {
+		n, err := in.ReadAt(block, int64(contentenc.HeaderLen+blockNo*ce.CipherBS()))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		plain, err := ce.DecryptBlock(block[:n], blockNo, h.ID)
+		if err != nil {
+			return fmt.Errorf("block %d: %w", blockNo, err)
+		}
+		bw.Write(plain)
+	}
+	return bw.Flush()
+}
+
+// recoverRestore loads the journal of an earlier "-writable" mount. The staged
+// entries that still exist are shown again under their ciphertext names, so
+// the restore can be finished or the entries deleted. Interrupted decryptions
+// are cleaned up.
+func (rn *RootNode) recoverRestore() {
+	r := rn.restore
+	staged, err := loadRestoreJournal(r.journal)
+	if err != nil {
+		tlog.Warn.Printf("restore: cannot read the journal: %v", err)
+		return
+	}
+	os.Remove(r.journal + restoreTmpSuffix)
+	if len(staged) == 0 {
+		return
+	}
+	cPaths := make([]string, 0, len(staged))
+	for cPath, hidden := range staged {
+		cPaths = append(cPaths, cPath)
+		r.staged[cPath] = hidden
+		r.byHidden[hidden] = cPath
+	}
+	// Parents first. If a parent is gone, its children are gone too.
+	sort.Strings(cPaths)
+	for _, cPath := range cPaths {
+		pPath, err := rn.decryptPath(cPath)
+		if err == nil {
+			_, err = os.Lstat(filepath.Join(rn.args.Cipherdir, pPath))
+		}
+		if err != nil {
+			delete(r.byHidden, r.staged[cPath])
+			delete(r.staged, cPath)
+			continue
+		}
+		os.Remove(filepath.Join(rn.args.Cipherdir, pPath+restoreTmpSuffix))
+	}
+	r.mu.Lock()
+	err = r.save()
+	r.mu.Unlock()
+	if err != nil {
+		tlog.Warn.Printf("restore: writing the journal: %v", err)
+	}
+	if len(r.staged) > 0 {
+		tlog.Info.Printf("restore: %d entries of an unfinished restore are shown under their ciphertext names", len(r.staged))
+	}
+}
+
+// loadRestoreLeftovers finds the staged entries of a "-writable" mount that
+// were not finished, so a read-only mount can hide them. They contain
+// ciphertext, which would otherwise be encrypted again.
+func (rn *RootNode) loadRestoreLeftovers() {
+	journal := filepath.Join(rn.args.Cipherdir, restoreJournal)
+	staged, err := loadRestoreJournal(journal)
+	if err != nil {
+		tlog.Warn.Printf("restore: cannot read the journal: %v", err)
+	}
+	if len(staged) == 0 {
+		return
+	}
+	rn.restoreLeftovers = newRestoreState(journal)
+	for cPath, hidden := range staged {
+		rn.restoreLeftovers.staged[cPath] = hidden
+		rn.restoreLeftovers.byHidden[hidden] = cPath
+	}
+	tlog.Warn.Printf("restore: %d entries of an unfinished restore are hidden. Mount with -writable to finish or delete them.", len(staged))
+}
+
+// isRestoreLeftover returns true if the plaintext path "pPath" is hidden
+// because of an unfinished restore
+func (rn *RootNode) isRestoreLeftover(pPath string) bool {
+	if pPath == restoreJournal || pPath == restoreJournal+restoreTmpSuffix {
+		return true
+	}
+	if rn.restoreLeftovers == nil || pPath == "" {
+		return false
+	}
+	return rn.restoreLeftovers.isHidden(parentDir(pPath), filepath.Base(pPath))
+}
+
+// hideRestoreLeftovers removes the entries of the plaintext directory "pDir"
+// that isRestoreLeftover hides from "entries"
+func (rn *RootNode) hideRestoreLeftovers(pDir string, entries []fuse.DirEntry) []fuse.DirEntry {
+	filtered := entries[:0]
+	for _, entry := range entries {
+		if !rn.isRestoreLeftover(filepath.Join(pDir, entry.Name)) {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered
+}
@@ -16,13 +16,12 @@ import (
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
 	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
 	"github.com/rfjakob/gocryptfs/v2/internal/inomap"
 	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
-
-	"github.com/sabhiram/go-gitignore"
 )
 
 // RootNode is the root directory in a `gocryptfs -reverse` mount
@@ -34,8 +33,9 @@ type RootNode struct {
 	nameTransform *nametransform.NameTransform
 	// Content encryption helper
 	contentEnc *contentenc.ContentEnc
-	// Tests whether a path is excluded (hidden) from the user. Used by -exclude.
-	excluder ignore.IgnoreParser
+	// Tests whether a path is excluded (hidden) from the user. Used by -exclude
+	// and friends, nil if there are no exclusions.
+	excluder *excluder
 	// inoMap translates inode numbers from different devices to unique inode
 	// numbers.
 	inoMap *inomap.InoMap
@@ -45,6 +45,13 @@ type RootNode struct {
 	// If a file name length is shorter than shortNameMax, there is no need to
 	// hash it.
 	shortNameMax int
+	// Block indexes of compressed files
+	indexCache indexCache
+	// Staged entries of a -writable mount, nil otherwise
+	restore *restoreState
+	// Staged entries of an unfinished restore that a read-only mount hides,
+	// nil if there are none
+	restoreLeftovers *restoreState
 }
 
 // NewRootNode returns an encrypted FUSE overlay filesystem.
@@ -75,8 +82,12 @@ func NewRootNode(args fusefrontend.Args, c *contentenc.ContentEnc, n *nametransf
 		rootDev:       rootDev,
 		shortNameMax:  shortNameMax,
 	}
-	if len(args.Exclude) > 0 || len(args.ExcludeWildcard) > 0 || len(args.ExcludeFrom) > 0 {
-		rn.excluder = prepareExcluder(args)
+	rn.excluder = prepareExcluder(args)
+	if args.Writable {
+		rn.restore = newRestoreState(filepath.Join(args.Cipherdir, restoreJournal))
+		rn.recoverRestore()
+	} else {
+		rn.loadRestoreLeftovers()
 	}
 	return rn
 }
@@ -126,25 +137,73 @@ func (rn *RootNode) isExcludedPlain(pPath string) bool {
 	if pPath == "" {
 		return false
 	}
-	return rn.excluder != nil && rn.excluder.MatchesPath(pPath)
+	if rn.restore == nil && rn.isRestoreLeftover(pPath) {
+		return true
+	}
+	if rn.excluder == nil {
+		return false
+	}
+	if rn.excluder.matchesPath(pPath) {
+		return true
+	}
+	if !rn.excluder.checksAttr() || rn.isReverseConf(pPath) {
+		return false
+	}
+	st := rn.excluder.lstat(pPath)
+	return st != nil && rn.excluder.matchesAttr(st)
+}
+
+// isReverseConf returns true if "pPath" is the config file that is shown as
+// "gocryptfs.conf". Without it, the encrypted view cannot be decrypted, so it
+// is never excluded because of its size, type or age.
+func (rn *RootNode) isReverseConf(pPath string) bool {
+	return pPath == configfile.ConfReverseName && !rn.args.ConfigCustom
 }
 
 // excludeDirEntries filters out directory entries that are "-exclude"d.
 // pDir is the relative plaintext path to the directory these entries are
 // from. The entries should be plaintext files.
 func (rn *RootNode) excludeDirEntries(d *dirfdPlus, entries []fuse.DirEntry) (filtered []fuse.DirEntry) {
-	if rn.excluder == nil {
+	if rn.restore == nil {
+		entries = rn.hideRestoreLeftovers(d.pPath, entries)
+	}
+	e := rn.excluder
+	if e == nil {
 		return entries
 	}
+	// Ignore files and the directory are the same for all entries
+	var ignoreFiles []*ignoreFile
+	if e.ignoreFiles != nil {
+		ignoreFiles = e.ignoreFiles.load(e.cipherdir, d.pPath)
+	}
+	dirfd := -1
+	if e.checksAttr() {
+		var err error
+		dirfd, err = syscallcompat.OpenDirNofollow(e.cipherdir, d.pPath)
+		if err != nil {
+			tlog.Warn.Printf("excludeDirEntries: %q: %v", d.pPath, err)
+		} else {
+			defer syscall.Close(dirfd)
+		}
+	}
 	filtered = make([]fuse.DirEntry, 0, len(entries))
 	for _, entry := range entries {
 		// filepath.Join handles the case of pDir="" correctly:
 		// Join("", "foo") -> "foo". This does not: pDir + "/" + name"
 		p := filepath.Join(d.pPath, entry.Name)
-		if rn.isExcludedPlain(p) {
+		if e.patterns != nil && e.patterns.MatchesPath(p) {
 			// Skip file
 			continue
 		}
+		if matchIgnoreFiles(ignoreFiles, p) {
+			continue
+		}
+		if dirfd >= 0 && !rn.isReverseConf(p) {
+			st, err := syscallcompat.Fstatat2(dirfd, entry.Name, unix.AT_SYMLINK_NOFOLLOW)
+			if err == nil && e.matchesAttr(st) {
+				continue
+			}
+		}
 		filtered = append(filtered, entry)
 	}
 	return filtered
@@ -64,12 +64,21 @@ func (rfs *RootNode) rDecryptName(cName string, dirIV []byte, pDir string) (pNam
 // decryptPath decrypts a relative ciphertext path to a relative plaintext
 // path.
 func (rn *RootNode) decryptPath(cPath string) (string, error) {
-	if rn.args.PlaintextNames || cPath == "" {
+	if (rn.args.PlaintextNames && rn.restore == nil) || cPath == "" {
 		return cPath, nil
 	}
 	parts := strings.Split(cPath, "/")
 	var transformedParts []string
 	for i := range parts {
+		// Staged entries in a -writable mount have a hidden name
+		if hidden, ok := rn.restore.lookup(filepath.Join(parts[:i+1]...)); ok {
+			transformedParts = append(transformedParts, hidden)
+			continue
+		}
+		if rn.args.PlaintextNames {
+			transformedParts = append(transformedParts, parts[i])
+			continue
+		}
 		// Start at the top and recurse
 		currentCipherDir := filepath.Join(parts[:i]...)
 		currentPlainDir := filepath.Join(transformedParts[:i]...)
@@ -2,6 +2,7 @@ package fusefrontend_reverse
 
 import (
 	"context"
+	"io/ioutil"
 	"sync"
 	"syscall"
 
@@ -11,6 +12,8 @@ import (
 
 var _ = (fs.NodeOpener)((*VirtualConfNode)(nil))
 var _ = (fs.NodeGetattrer)((*VirtualConfNode)(nil))
+var _ = (fs.NodeSetattrer)((*VirtualConfNode)(nil))
+var _ = (fs.NodeSetxattrer)((*VirtualConfNode)(nil))
 
 type VirtualConfNode struct {
 	fs.Inode
@@ -19,6 +22,16 @@ type VirtualConfNode struct {
 }
 
 func (n *VirtualConfNode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		// Only possible with -writable, see virtualWriteFile
+		content, err := ioutil.ReadFile(n.path)
+		if err != nil {
+			errno = fs.ToErrno(err)
+			return
+		}
+		fh = &virtualWriteFile{content: content, cPath: n.Path(n.Root())}
+		return
+	}
 	fd, err := syscall.Open(n.path, syscall.O_RDONLY, 0)
 	if err != nil {
 		errno = fs.ToErrno(err)
@@ -38,6 +51,17 @@ func (n *VirtualConfNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fu
 	return 0
 }
 
+// Setattr - FUSE call. The config file cannot change in a -writable mount,
+// the call is accepted so that copy tools do not fail.
+func (n *VirtualConfNode) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	return n.Getattr(ctx, fh, out)
+}
+
+// Setxattr - FUSE call. Like for Node, see Node.Setxattr.
+func (n *VirtualConfNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	return syscall.ENOTSUP
+}
+
 // Check that we have implemented the fs.File* interfaces
 var _ = (fs.FileReader)((*VirtualConfFile)(nil))
 var _ = (fs.FileReleaser)((*VirtualConfFile)(nil))
@@ -0,0 +1,65 @@
+package gcmsiv
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"log"
+)
+
+// encrypter is AES-256 with a per-message key, used for computing the tag
+// and for counter mode.
+type encrypter interface {
+	// encrypt encrypts a single block
+	encrypt(dst, src *[16]byte)
+	// ctr XORs "in" with the keystream that starts at "counter" and writes
+	// the result to "out"
+	ctr(counter [16]byte, out, in []byte)
+	// wipe overwrites the key, if possible
+	wipe()
+}
+
+// ctrBatch is the number of keystream blocks that goEncrypter.ctr generates
+// at a time
+const ctrBatch = 8
+
+// goEncrypter uses the AES implementation from the Go stdlib.
+type goEncrypter struct {
+	block cipher.Block
+}
+
+func newGoEncrypter(key []byte) *goEncrypter {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		log.Panic(err)
+	}
+	return &goEncrypter{block: block}
+}
+
+func (e *goEncrypter) encrypt(dst, src *[16]byte) {
+	e.block.Encrypt(dst[:], src[:])
+}
+
+func (e *goEncrypter) ctr(counter [16]byte, out, in []byte) {
+	c := binary.LittleEndian.Uint32(counter[:4])
+	var ks [ctrBatch * 16]byte
+	for len(in) > 0 {
+		// Generate as many keystream blocks as needed, up to ctrBatch
+		n := 0
+		for ; n < len(in) && n < len(ks); n += 16 {
+			binary.LittleEndian.PutUint32(counter[:4], c)
+			e.block.Encrypt(ks[n:n+16], counter[:])
+			c++
+		}
+		n = subtle.XORBytes(out, in, ks[:n])
+		in = in[n:]
+		out = out[n:]
+	}
+}
+
+// wipe drops the reference to the key. The key schedule is held by the
+// Go stdlib and cannot be overwritten.
+func (e *goEncrypter) wipe() {
+	e.block = nil
+}
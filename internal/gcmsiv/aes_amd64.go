@@ -0,0 +1,65 @@
+package gcmsiv
+
+import (
+	"crypto/subtle"
+
+	"golang.org/x/sys/cpu"
+)
+
+// hasAESNI enables the assembly implementation of AES-256 and counter mode
+// that uses the AES-NI instructions.
+var hasAESNI = cpu.X86.HasAES && cpu.X86.HasSSE2
+
+// aesniEncrypter keeps the expanded key in memory we own, so that it can be
+// wiped, and encrypts 8 counter blocks in parallel.
+type aesniEncrypter struct {
+	// xk holds the 15 round keys of AES-256
+	xk [15 * 16]byte
+}
+
+//go:noescape
+func expandKeyAsm(key *byte, xk *[15 * 16]byte)
+
+//go:noescape
+func encryptBlockAsm(xk *[15 * 16]byte, dst, src *[16]byte)
+
+// ctrAsm processes len(src)/16 full blocks and increments "counter"
+// accordingly.
+//
+//go:noescape
+func ctrAsm(xk *[15 * 16]byte, counter *[16]byte, dst, src []byte)
+
+func newEncrypter(key []byte) encrypter {
+	if !hasAESNI {
+		return newGoEncrypter(key)
+	}
+	if len(key) != KeyLen {
+		panic("BUG: wrong key length")
+	}
+	e := &aesniEncrypter{}
+	expandKeyAsm(&key[0], &e.xk)
+	return e
+}
+
+func (e *aesniEncrypter) encrypt(dst, src *[16]byte) {
+	encryptBlockAsm(&e.xk, dst, src)
+}
+
+func (e *aesniEncrypter) ctr(counter [16]byte, out, in []byte) {
+	n := len(in) &^ 15
+	if n > 0 {
+		ctrAsm(&e.xk, &counter, out[:n], in[:n])
+	}
+	if n < len(in) {
+		// Partial last block
+		var ks [16]byte
+		encryptBlockAsm(&e.xk, &ks, &counter)
+		subtle.XORBytes(out[n:], in[n:], ks[:])
+	}
+}
+
+func (e *aesniEncrypter) wipe() {
+	for i := range e.xk {
+		e.xk[i] = 0
+	}
+}
@@ -0,0 +1,210 @@
+#include "textflag.h"
+
+// Key expansion for AES-256, as in the Intel AES-NI white paper.
+// X0 and X2 hold the previous two round keys, X1 the output of
+// AESKEYGENASSIST, X4 must be zero on entry. BX points to the next round key.
+#define EXPAND_KEY_256A \
+	PSHUFD $0xff, X1, X1 \
+	SHUFPS $0x10, X0, X4 \
+	PXOR   X4, X0        \
+	SHUFPS $0x8c, X0, X4 \
+	PXOR   X4, X0        \
+	PXOR   X1, X0        \
+	MOVUPS X0, (BX)      \
+	ADDQ   $16, BX
+
+#define EXPAND_KEY_256B \
+	PSHUFD $0xaa, X1, X1 \
+	SHUFPS $0x10, X2, X4 \
+	PXOR   X4, X2        \
+	SHUFPS $0x8c, X2, X4 \
+	PXOR   X4, X2        \
+	PXOR   X1, X2        \
+	MOVUPS X2, (BX)      \
+	ADDQ   $16, BX
+
+// func expandKeyAsm(key *byte, xk *[15 * 16]byte)
+TEXT ·expandKeyAsm(SB), NOSPLIT, $0-16
+	MOVQ   key+0(FP), AX
+	MOVQ   xk+8(FP), BX
+	MOVUPS (AX), X0
+	MOVUPS X0, (BX)
+	ADDQ   $16, BX
+	MOVUPS 16(AX), X2
+	MOVUPS X2, (BX)
+	ADDQ   $16, BX
+	PXOR   X4, X4
+	AESKEYGENASSIST $0x01, X2, X1
+	EXPAND_KEY_256A
+	AESKEYGENASSIST $0x01, X0, X1
+	EXPAND_KEY_256B
+	AESKEYGENASSIST $0x02, X2, X1
+	EXPAND_KEY_256A
+	AESKEYGENASSIST $0x02, X0, X1
+	EXPAND_KEY_256B
+	AESKEYGENASSIST $0x04, X2, X1
+	EXPAND_KEY_256A
+	AESKEYGENASSIST $0x04, X0, X1
+	EXPAND_KEY_256B
+	AESKEYGENASSIST $0x08, X2, X1
+	EXPAND_KEY_256A
+	AESKEYGENASSIST $0x08, X0, X1
+	EXPAND_KEY_256B
+	AESKEYGENASSIST $0x10, X2, X1
+	EXPAND_KEY_256A
+	AESKEYGENASSIST $0x10, X0, X1
+	EXPAND_KEY_256B
+	AESKEYGENASSIST $0x20, X2, X1
+	EXPAND_KEY_256A
+	AESKEYGENASSIST $0x20, X0, X1
+	EXPAND_KEY_256B
+	AESKEYGENASSIST $0x40, X2, X1
+	EXPAND_KEY_256A
+	// Don't leave key material in registers
+	PXOR X0, X0
+	PXOR X1, X1
+	PXOR X2, X2
+	PXOR X4, X4
+	RET
+
+// One AES round with the round key at offset "off" from AX, applied to X0
+// through X7 (8 blocks in parallel)
+#define ROUND8(off) \
+	MOVOU  off(AX), X10 \
+	AESENC X10, X0      \
+	AESENC X10, X1      \
+	AESENC X10, X2      \
+	AESENC X10, X3      \
+	AESENC X10, X4      \
+	AESENC X10, X5      \
+	AESENC X10, X6      \
+	AESENC X10, X7
+
+#define ROUND1(off) \
+	MOVOU  off(AX), X10 \
+	AESENC X10, X0
+
+// Encrypts X0 using the round keys at AX
+#define ENCRYPT1 \
+	MOVOU      (AX), X10 \
+	PXOR       X10, X0   \
+	ROUND1(16)           \
+	ROUND1(32)           \
+	ROUND1(48)           \
+	ROUND1(64)           \
+	ROUND1(80)           \
+	ROUND1(96)           \
+	ROUND1(112)          \
+	ROUND1(128)          \
+	ROUND1(144)          \
+	ROUND1(160)          \
+	ROUND1(176)          \
+	ROUND1(192)          \
+	ROUND1(208)          \
+	MOVOU      224(AX), X10 \
+	AESENCLAST X10, X0
+
+// func encryptBlockAsm(xk *[15 * 16]byte, dst, src *[16]byte)
+TEXT ·encryptBlockAsm(SB), NOSPLIT, $0-24
+	MOVQ  xk+0(FP), AX
+	MOVQ  dst+8(FP), DI
+	MOVQ  src+16(FP), SI
+	MOVOU (SI), X0
+	ENCRYPT1
+	MOVOU X0, (DI)
+	RET
+
+// XOR 16 bytes at offset "off" from SI with register "x" and store the
+// result at the same offset from DI
+#define XOR_STORE(off, x) \
+	MOVOU off(SI), X10 \
+	PXOR  X10, x       \
+	MOVOU x, off(DI)
+
+// Copies the counter X8 to register "x" and increments the counter, which
+// is the first 32 bits in little-endian byte order
+#define NEXT_COUNTER(x) \
+	MOVOU X8, x \
+	PADDD X9, X8
+
+// func ctrAsm(xk *[15 * 16]byte, counter *[16]byte, dst, src []byte)
+TEXT ·ctrAsm(SB), NOSPLIT, $0-64
+	MOVQ  xk+0(FP), AX
+	MOVQ  counter+8(FP), BX
+	MOVQ  dst_base+16(FP), DI
+	MOVQ  src_base+40(FP), SI
+	MOVQ  src_len+48(FP), CX
+	SHRQ  $4, CX
+	MOVOU (BX), X8
+	MOVL  $1, DX
+	MOVQ  DX, X9
+
+loop8:
+	CMPQ CX, $8
+	JB   loop1
+	NEXT_COUNTER(X0)
+	NEXT_COUNTER(X1)
+	NEXT_COUNTER(X2)
+	NEXT_COUNTER(X3)
+	NEXT_COUNTER(X4)
+	NEXT_COUNTER(X5)
+	NEXT_COUNTER(X6)
+	NEXT_COUNTER(X7)
+	MOVOU (AX), X10
+	PXOR  X10, X0
+	PXOR  X10, X1
+	PXOR  X10, X2
+	PXOR  X10, X3
+	PXOR  X10, X4
+	PXOR  X10, X5
+	PXOR  X10, X6
+	PXOR  X10, X7
+	ROUND8(16)
+	ROUND8(32)
+	ROUND8(48)
+	ROUND8(64)
+	ROUND8(80)
+	ROUND8(96)
+	ROUND8(112)
+	ROUND8(128)
+	ROUND8(144)
+	ROUND8(160)
+	ROUND8(176)
+	ROUND8(192)
+	ROUND8(208)
+	MOVOU      224(AX), X10
+	AESENCLAST X10, X0
+	AESENCLAST X10, X1
+	AESENCLAST X10, X2
+	AESENCLAST X10, X3
+	AESENCLAST X10, X4
+	AESENCLAST X10, X5
+	AESENCLAST X10, X6
+	AESENCLAST X10, X7
+	XOR_STORE(0, X0)
+	XOR_STORE(16, X1)
+	XOR_STORE(32, X2)
+	XOR_STORE(48, X3)
+	XOR_STORE(64, X4)
+	XOR_STORE(80, X5)
+	XOR_STORE(96, X6)
+	XOR_STORE(112, X7)
+	ADDQ $128, SI
+	ADDQ $128, DI
+	SUBQ $8, CX
+	JMP  loop8
+
+loop1:
+	TESTQ CX, CX
+	JZ    done
+	NEXT_COUNTER(X0)
+	ENCRYPT1
+	XOR_STORE(0, X0)
+	ADDQ $16, SI
+	ADDQ $16, DI
+	DECQ CX
+	JMP  loop1
+
+done:
+	MOVOU X8, (BX)
+	RET
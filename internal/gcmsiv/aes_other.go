@@ -0,0 +1,9 @@
+//go:build !amd64
+
+package gcmsiv
+
+var hasAESNI = false
+
+func newEncrypter(key []byte) encrypter {
+	return newGoEncrypter(key)
+}
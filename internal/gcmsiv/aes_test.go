@@ -0,0 +1,38 @@
+package gcmsiv
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// TestEncrypterGeneric compares the encrypter returned by newEncrypter,
+// which may be accelerated, with the Go stdlib based implementation
+func TestEncrypterGeneric(t *testing.T) {
+	key := make([]byte, KeyLen)
+	in := make([]byte, 16*20+5)
+	rand.Read(key)
+	rand.Read(in)
+	fast := newEncrypter(key)
+	generic := newGoEncrypter(key)
+
+	var src, dst1, dst2 [16]byte
+	copy(src[:], in)
+	fast.encrypt(&dst1, &src)
+	generic.encrypt(&dst2, &src)
+	if dst1 != dst2 {
+		t.Fatalf("encrypt mismatch: %x vs %x", dst1, dst2)
+	}
+	// Start close to the wraparound of the 32-bit counter
+	counter := src
+	copy(counter[:4], []byte{0xfc, 0xff, 0xff, 0xff})
+	for _, n := range []int{0, 1, 16, 17, 16 * 8, 16*9 + 1, len(in)} {
+		out1 := make([]byte, n)
+		out2 := make([]byte, n)
+		fast.ctr(counter, out1, in[:n])
+		generic.ctr(counter, out2, in[:n])
+		if !bytes.Equal(out1, out2) {
+			t.Errorf("n=%d: ctr mismatch", n)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// Package gcmsiv implements AES-256-GCM-SIV (RFC 8452), a nonce-misuse
+// resistant AEAD, and wraps it in a crypto.AEAD interface that takes the
+// 16-byte nonces gocryptfs uses.
+//
+// On amd64, AES-NI and PCLMULQDQ are used when the CPU supports them.
+package gcmsiv
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"log"
+)
+
+const (
+	// KeyLen is the required key length. RFC 8452 also defines
+	// AES-128-GCM-SIV, but we only support AES-256.
+	KeyLen = 32
+	// NonceSize is the nonce length used by gocryptfs. The first 12 bytes
+	// are the RFC 8452 nonce, the remaining 4 bytes are authenticated as
+	// part of the associated data.
+	NonceSize = 16
+	// Overhead is the number of bytes added for integrity checking
+	Overhead = 16
+	// rfcNonceSize is the nonce length defined by RFC 8452
+	rfcNonceSize = 12
+	// maxPlaintextLen is the limit of 2^36 bytes from RFC 8452
+	maxPlaintextLen = 1 << 36
+)
+
+var errOpen = errors.New("cipher: message authentication failed")
+
+// gcmSiv is AES-256-GCM-SIV with 12-byte nonces as specified in RFC 8452.
+type gcmSiv struct {
+	// keyGen is the key-generating key, used to derive the per-nonce keys
+	keyGen cipher.Block
+}
+
+// gcmSiv16 takes 16-byte nonces and feeds the last 4 bytes into the
+// associated data.
+type gcmSiv16 struct {
+	gcmSiv
+}
+
+var _ cipher.AEAD = &gcmSiv16{}
+
+// New returns a new cipher.AEAD implementation that takes 16-byte nonces.
+func New(key []byte) cipher.AEAD {
+	if len(key) != KeyLen {
+		log.Panicf("Key must be %d byte long (you passed %d)", KeyLen, len(key))
+	}
+	return &gcmSiv16{*newRFC(key)}
+}
+
+// newRFC returns the RFC 8452 variant with 12-byte nonces.
+func newRFC(key []byte) *gcmSiv {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		log.Panic(err)
+	}
+	return &gcmSiv{keyGen: block}
+}
+
+func (g *gcmSiv16) NonceSize() int {
+	return NonceSize
+}
+
+func (g *gcmSiv16) Overhead() int {
+	return Overhead
+}
+
+// ad16 prepends the last 4 bytes of the 16-byte nonce to the associated data.
+func ad16(nonce, authData []byte) []byte {
+	ad := make([]byte, 0, NonceSize-rfcNonceSize+len(authData))
+	ad = append(ad, nonce[rfcNonceSize:]...)
+	return append(ad, authData...)
+}
+
+// Seal encrypts "plaintext" using "nonce" and "authData" and appends the
+// result to "dst"
+func (g *gcmSiv16) Seal(dst, nonce, plaintext, authData []byte) []byte {
+	if len(nonce) != NonceSize {
+		log.Panicf("nonce must be %d bytes long", NonceSize)
+	}
+	return g.seal(dst, nonce[:rfcNonceSize], plaintext, ad16(nonce, authData))
+}
+
+// Open decrypts "ciphertext" using "nonce" and "authData" and appends the
+// result to "dst"
+func (g *gcmSiv16) Open(dst, nonce, ciphertext, authData []byte) ([]byte, error) {
+	if len(nonce) != NonceSize {
+		log.Panicf("nonce must be %d bytes long", NonceSize)
+	}
+	return g.open(dst, nonce[:rfcNonceSize], ciphertext, ad16(nonce, authData))
+}
+
+// Wipe drops the reference to the key. The AES key schedule is held by the
+// Go stdlib and cannot be overwritten.
+func (g *gcmSiv16) Wipe() {
+	g.keyGen = nil
+}
+
+// deriveKeys derives the per-nonce message authentication key and message
+// encryption key (RFC 8452, section 4).
+func (g *gcmSiv) deriveKeys(nonce []byte) (authKey []byte, enc encrypter) {
+	if g.keyGen == nil {
+		log.Panic("Key has been wiped?")
+	}
+	var in, out [16]byte
+	copy(in[4:], nonce)
+	// 16 bytes authentication key + 32 bytes encryption key, 8 bytes per block
+	keys := make([]byte, 0, 48)
+	for i := uint32(0); i < 6; i++ {
+		binary.LittleEndian.PutUint32(in[:4], i)
+		g.keyGen.Encrypt(out[:], in[:])
+		keys = append(keys, out[:8]...)
+	}
+	enc = newEncrypter(keys[16:])
+	authKey = keys[:16]
+	for i := range keys[16:] {
+		keys[16+i] = 0
+	}
+	return authKey, enc
+}
+
+// tag calculates the authentication tag over "authData" and "plaintext".
+func tag(authKey []byte, enc encrypter, nonce, plaintext, authData []byte) (t [16]byte) {
+	p := newPolyval(authKey)
+	p.update(authData)
+	p.update(plaintext)
+	var lengths [16]byte
+	binary.LittleEndian.PutUint64(lengths[0:8], uint64(len(authData))*8)
+	binary.LittleEndian.PutUint64(lengths[8:16], uint64(len(plaintext))*8)
+	p.update(lengths[:])
+	var s [16]byte
+	p.sum(&s)
+	for i := range nonce {
+		s[i] ^= nonce[i]
+	}
+	s[15] &= 0x7f
+	enc.encrypt(&t, &s)
+	return t
+}
+
+// counterBlock returns the initial counter block for counter mode, which is
+// the tag with the most significant bit set. The counter is the first 32
+// bits in little-endian byte order.
+func counterBlock(t [16]byte) [16]byte {
+	t[15] |= 0x80
+	return t
+}
+
+// sliceForAppend extends "in" by "n" bytes and returns the whole slice and
+// the extension (same as in crypto/cipher).
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
+
+func (g *gcmSiv) seal(dst, nonce, plaintext, authData []byte) []byte {
+	if uint64(len(plaintext)) > maxPlaintextLen {
+		log.Panic("plaintext too long")
+	}
+	authKey, enc := g.deriveKeys(nonce)
+	defer enc.wipe()
+	t := tag(authKey, enc, nonce, plaintext, authData)
+	ret, out := sliceForAppend(dst, len(plaintext)+Overhead)
+	enc.ctr(counterBlock(t), out, plaintext)
+	copy(out[len(plaintext):], t[:])
+	return ret
+}
+
+func (g *gcmSiv) open(dst, nonce, ciphertext, authData []byte) ([]byte, error) {
+	if len(ciphertext) < Overhead || uint64(len(ciphertext)) > maxPlaintextLen+Overhead {
+		return nil, errOpen
+	}
+	var expected [16]byte
+	copy(expected[:], ciphertext[len(ciphertext)-Overhead:])
+	ciphertext = ciphertext[:len(ciphertext)-Overhead]
+	authKey, enc := g.deriveKeys(nonce)
+	defer enc.wipe()
+	ret, out := sliceForAppend(dst, len(ciphertext))
+	enc.ctr(counterBlock(expected), out, ciphertext)
+	t := tag(authKey, enc, nonce, out, authData)
+	if subtle.ConstantTimeCompare(t[:], expected[:]) != 1 {
+		for i := range out {
+			out[i] = 0
+		}
+		return nil, errOpen
+	}
+	return ret, nil
+}
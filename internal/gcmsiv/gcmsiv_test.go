@@ -0,0 +1,107 @@
+package gcmsiv
+
+import (
+	"bytes"
+	"testing"
+)
+
+// withImplementations runs "f" with the accelerated implementation, if there
+// is one, and with the generic Go code.
+func withImplementations(t *testing.T, f func(t *testing.T)) {
+	t.Run("default", f)
+	if !hasAESNI && !hasPCLMULQDQ {
+		return
+	}
+	aesni, pclmul := hasAESNI, hasPCLMULQDQ
+	defer func() { hasAESNI, hasPCLMULQDQ = aesni, pclmul }()
+	hasAESNI, hasPCLMULQDQ = false, false
+	t.Run("generic", f)
+}
+
+// Test vectors from RFC 8452, Appendix C.2 (AEAD_AES_256_GCM_SIV)
+func TestRFCVectors(t *testing.T) {
+	key := unhex("0100000000000000000000000000000000000000000000000000000000000000")
+	nonce := unhex("030000000000000000000000")
+	vectors := []struct {
+		plaintext, authData, result string
+	}{
+		{"", "", "07f5f4169bbf55a8400cd47ea6fd400f"},
+		{"0100000000000000", "", "c2ef328e5c71c83b843122130f7364b761e0b97427e3df28"},
+		{"010000000000000000000000", "", "9aab2aeb3faa0a34aea8e2b18ca50da9ae6559e48fd10f6e5c9ca17e"},
+		{"01000000000000000000000000000000", "", "85a01b63025ba19b7fd3ddfc033b3e76c9eac6fa700942702e90862383c6c366"},
+		{"0100000000000000000000000000000002000000000000000000000000000000", "",
+			"4a6a9db4c8c6549201b9edb53006cba821ec9cf850948a7c86c68ac7539d027fe819e63abcd020b006a976397632eb5d"},
+		{"010000000000000000000000000000000200000000000000000000000000000003000000000000000000000000000000", "",
+			"c00d121893a9fa603f48ccc1ca3c57ce7499245ea0046db16c53c7c66fe717e39cf6c748837b61f6ee3adcee17534ed5790bc96880a99ba804bd12c0e6a22cc4"},
+		{"01000000000000000000000000000000020000000000000000000000000000000300000000000000000000000000000004000000000000000000000000000000", "",
+			"c2d5160a1f8683834910acdafc41fbb1632d4a353e8b905ec9a5499ac34f96c7e1049eb080883891a4db8caaa1f99dd004d80487540735234e3744512c6f90ce112864c269fc0d9d88c61fa47e39aa08"},
+		{"0200000000000000", "01", "1de22967237a813291213f267e3b452f02d01ae33e4ec854"},
+		{"020000000000000000000000", "01", "163d6f9cc1b346cd453a2e4cc1a4a19ae800941ccdc57cc8413c277f"},
+		{"02000000000000000000000000000000", "01", "c91545823cc24f17dbb0e9e807d5ec17b292d28ff61189e8e49f3875ef91aff7"},
+		{"0200000000000000000000000000000003000000000000000000000000000000", "01",
+			"07dad364bfc2b9da89116d7bef6daaaf6f255510aa654f920ac81b94e8bad365aea1bad12702e1965604374aab96dbbc"},
+		{"020000000000000000000000000000000300000000000000000000000000000004000000000000000000000000000000", "01",
+			"c67a1f0f567a5198aa1fcc8e3f21314336f7f51ca8b1af61feac35a86416fa47fbca3b5f749cdf564527f2314f42fe2503332742b228c647173616cfd44c54eb"},
+		{"02000000000000000000000000000000030000000000000000000000000000000400000000000000000000000000000005000000000000000000000000000000", "01",
+			"67fd45e126bfb9a79930c43aad2d36967d3f0e4d217c1e551f59727870beefc98cb933a8fce9de887b1e40799988db1fc3f91880ed405b2dd298318858467c895bde0285037c5de81e5b570a049b62a0"},
+		{"02000000", "010000000000000000000000", "22b3f4cd1835e517741dfddccfa07fa4661b74cf"},
+		{"0300000000000000000000000000000004000000", "010000000000000000000000000000000200",
+			"43dd0163cdb48f9fe3212bf61b201976067f342bb879ad976d8242acc188ab59cabfe307"},
+		{"030000000000000000000000000000000400", "0100000000000000000000000000000002000000",
+			"462401724b5ce6588d5a54aae5375513a075cfcdf5042112aa29685c912fc2056543"},
+	}
+	withImplementations(t, func(t *testing.T) {
+		g := newRFC(key)
+		for i, v := range vectors {
+			out := g.seal(nil, nonce, unhex(v.plaintext), unhex(v.authData))
+			if !bytes.Equal(out, unhex(v.result)) {
+				t.Errorf("vector %d: have %x, want %s", i, out, v.result)
+			}
+			pt, err := g.open(nil, nonce, out, unhex(v.authData))
+			if err != nil {
+				t.Errorf("vector %d: open failed: %v", i, err)
+			}
+			if !bytes.Equal(pt, unhex(v.plaintext)) {
+				t.Errorf("vector %d: plaintext mismatch: %x", i, pt)
+			}
+		}
+	})
+}
+
+// Test that Seal and Open round-trip with 16-byte nonces, and that the last
+// 4 bytes of the nonce are authenticated. The RFC vectors above cannot be
+// used here because the 16-byte nonce is not part of RFC 8452.
+func TestRoundTrip(t *testing.T) {
+	withImplementations(t, func(t *testing.T) {
+		key := make([]byte, KeyLen)
+		key[0] = 1
+		a := New(key)
+		nonce := bytes.Repeat([]byte{7}, NonceSize)
+		ad := []byte("associated data")
+		for _, n := range []int{0, 1, 15, 16, 17, 4096} {
+			in := bytes.Repeat([]byte{0xaa}, n)
+			prefix := []byte("prefix")
+			ct := a.Seal(prefix, nonce, in, ad)
+			if len(ct) != len(prefix)+n+Overhead || !bytes.HasPrefix(ct, prefix) {
+				t.Fatalf("n=%d: wrong ciphertext length %d", n, len(ct))
+			}
+			ct = ct[len(prefix):]
+			pt, err := a.Open(nil, nonce, ct, ad)
+			if err != nil || !bytes.Equal(pt, in) {
+				t.Fatalf("n=%d: round trip failed: %v", n, err)
+			}
+			nonce2 := append([]byte{}, nonce...)
+			nonce2[NonceSize-1]++
+			if _, err := a.Open(nil, nonce2, ct, ad); err == nil {
+				t.Errorf("n=%d: modified nonce tail was accepted", n)
+			}
+			if _, err := a.Open(nil, nonce, ct, []byte("other")); err == nil {
+				t.Errorf("n=%d: modified authData was accepted", n)
+			}
+			ct[0] ^= 1
+			if _, err := a.Open(nil, nonce, ct, ad); err == nil {
+				t.Errorf("n=%d: modified ciphertext was accepted", n)
+			}
+		}
+	})
+}
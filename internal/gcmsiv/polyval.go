@@ -0,0 +1,116 @@
+package gcmsiv
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// polyval computes POLYVAL as defined in RFC 8452, section 3: the 128-bit
+// universal hash over GF(2^128) with the field polynomial
+// x^128 + x^127 + x^126 + x^121 + 1, using little-endian byte order.
+type polyval struct {
+	// h is the hash key
+	h fieldElement
+	// s is the running state
+	s fieldElement
+	// hPowers holds H, H^2, H^3 and H^4 for the assembly implementation,
+	// which processes four blocks at a time
+	hPowers [4]fieldElement
+}
+
+// fieldElement is a GF(2^128) element. Bit i of lo (or hi) is the
+// coefficient of x^i (or x^(64+i)).
+type fieldElement struct {
+	lo, hi uint64
+}
+
+func loadElement(b []byte) fieldElement {
+	return fieldElement{
+		lo: binary.LittleEndian.Uint64(b[0:8]),
+		hi: binary.LittleEndian.Uint64(b[8:16]),
+	}
+}
+
+func newPolyval(key []byte) *polyval {
+	p := &polyval{h: loadElement(key)}
+	if hasPCLMULQDQ {
+		polyvalInit(p)
+	}
+	return p
+}
+
+// update absorbs "in". If len(in) is not a multiple of 16, the last block is
+// zero-padded.
+func (p *polyval) update(in []byte) {
+	if hasPCLMULQDQ && len(in) >= 16 {
+		n := len(in) &^ 15
+		polyvalBlocks(p, in[:n])
+		in = in[n:]
+	}
+	for len(in) >= 16 {
+		x := loadElement(in)
+		p.s = dot(fieldElement{p.s.lo ^ x.lo, p.s.hi ^ x.hi}, p.h)
+		in = in[16:]
+	}
+	if len(in) > 0 {
+		var block [16]byte
+		copy(block[:], in)
+		p.update(block[:])
+	}
+}
+
+// sum writes the current state to "out".
+func (p *polyval) sum(out *[16]byte) {
+	binary.LittleEndian.PutUint64(out[0:8], p.s.lo)
+	binary.LittleEndian.PutUint64(out[8:16], p.s.hi)
+}
+
+// bmul64 returns the lower 64 bits of the carry-less product of x and y.
+// It uses integer multiplication with the inputs split into bit groups that
+// leave room for the carries ("holes"), so that it runs in constant time
+// (technique from BearSSL, https://www.bearssl.org/constanttime.html#ghash-for-gcm ).
+func bmul64(x, y uint64) uint64 {
+	const (
+		m0 = 0x1111111111111111
+		m1 = 0x2222222222222222
+		m2 = 0x4444444444444444
+		m3 = 0x8888888888888888
+	)
+	x0, x1, x2, x3 := x&m0, x&m1, x&m2, x&m3
+	y0, y1, y2, y3 := y&m0, y&m1, y&m2, y&m3
+	z0 := (x0 * y0) ^ (x1 * y3) ^ (x2 * y2) ^ (x3 * y1)
+	z1 := (x0 * y1) ^ (x1 * y0) ^ (x2 * y3) ^ (x3 * y2)
+	z2 := (x0 * y2) ^ (x1 * y1) ^ (x2 * y0) ^ (x3 * y3)
+	z3 := (x0 * y3) ^ (x1 * y2) ^ (x2 * y1) ^ (x3 * y0)
+	return (z0 & m0) | (z1 & m1) | (z2 & m2) | (z3 & m3)
+}
+
+// clmul64 returns the 128-bit carry-less product of x and y. The upper half
+// is the bit-reversed lower half of the product of the bit-reversed inputs,
+// shifted by one.
+func clmul64(x, y uint64) (hi, lo uint64) {
+	lo = bmul64(x, y)
+	hi = bits.Reverse64(bmul64(bits.Reverse64(x), bits.Reverse64(y))) >> 1
+	return hi, lo
+}
+
+// dot returns a * b * x^-128 in the POLYVAL field ("dot" in RFC 8452).
+func dot(a, b fieldElement) fieldElement {
+	// 256-bit carry-less product using Karatsuba
+	h1, l1 := clmul64(a.lo, b.lo)
+	h2, l2 := clmul64(a.hi, b.hi)
+	h3, l3 := clmul64(a.lo^a.hi, b.lo^b.hi)
+	h3 ^= h1 ^ h2
+	l3 ^= l1 ^ l2
+	v0 := l1
+	v1 := h1 ^ l3
+	v2 := l2 ^ h3
+	v3 := h2
+	// Montgomery reduction: multiply by x^-128 modulo the field polynomial,
+	// one 64-bit word at a time
+	v2 ^= v0 ^ (v0 >> 1) ^ (v0 >> 2) ^ (v0 >> 7)
+	v1 ^= (v0 << 63) ^ (v0 << 62) ^ (v0 << 57)
+	v3 ^= v1 ^ (v1 >> 1) ^ (v1 >> 2) ^ (v1 >> 7)
+	v2 ^= (v1 << 63) ^ (v1 << 62) ^ (v1 << 57)
+	return fieldElement{lo: v2, hi: v3}
+}
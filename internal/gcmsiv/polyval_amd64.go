@@ -0,0 +1,27 @@
+package gcmsiv
+
+import "golang.org/x/sys/cpu"
+
+// hasPCLMULQDQ enables the assembly implementation of POLYVAL that uses the
+// carry-less multiplication instruction.
+var hasPCLMULQDQ = cpu.X86.HasPCLMULQDQ && cpu.X86.HasSSE2
+
+// polyvalInitAsm computes h[1:4] = H^2, H^3, H^4 from h[0] = H.
+//
+//go:noescape
+func polyvalInitAsm(h *[4]fieldElement)
+
+// polyvalBlocksAsm absorbs len(in)/16 full blocks into "s" using the hash
+// key powers "h".
+//
+//go:noescape
+func polyvalBlocksAsm(s *fieldElement, h *[4]fieldElement, in []byte)
+
+func polyvalInit(p *polyval) {
+	p.hPowers[0] = p.h
+	polyvalInitAsm(&p.hPowers)
+}
+
+func polyvalBlocks(p *polyval, in []byte) {
+	polyvalBlocksAsm(&p.s, &p.hPowers, in)
+}
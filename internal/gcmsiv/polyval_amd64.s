@@ -0,0 +1,124 @@
+#include "textflag.h"
+
+// Register usage:
+// X0 state, X6 reduction constant (high qword 0xc200000000000000),
+// X2, X3, X11 low, high and middle part of the 256-bit product,
+// X4, X5 scratch, X7-X10 input blocks, X12-X15 hash key powers H^1 to H^4
+
+// Adds the carry-less product of "x" and "h" to X2, X3 and X11
+#define MUL_ACC(x, h) \
+	MOVOU     x, X4        \
+	PCLMULQDQ $0x00, h, X4 \
+	PXOR      X4, X2       \
+	MOVOU     x, X4        \
+	PCLMULQDQ $0x11, h, X4 \
+	PXOR      X4, X3       \
+	MOVOU     x, X4        \
+	PCLMULQDQ $0x10, h, X4 \
+	PXOR      X4, X11      \
+	MOVOU     x, X4        \
+	PCLMULQDQ $0x01, h, X4 \
+	PXOR      X4, X11
+
+#define ZERO_ACC \
+	PXOR X2, X2 \
+	PXOR X3, X3 \
+	PXOR X11, X11
+
+// Montgomery reduction of X2, X3, X11 to X0, one qword at a time
+#define REDUCE \
+	MOVOU     X11, X5        \
+	PSLLDQ    $8, X5         \
+	PSRLDQ    $8, X11        \
+	PXOR      X5, X2         \
+	PXOR      X11, X3        \
+	MOVOU     X2, X4         \
+	PCLMULQDQ $0x10, X6, X4  \
+	PSHUFD    $0x4e, X2, X2  \
+	PXOR      X4, X2         \
+	MOVOU     X2, X4         \
+	PCLMULQDQ $0x10, X6, X4  \
+	PSHUFD    $0x4e, X2, X2  \
+	PXOR      X4, X2         \
+	PXOR      X3, X2         \
+	MOVOU     X2, X0
+
+#define LOAD_POLY \
+	MOVQ   $0xc200000000000000, AX \
+	MOVQ   AX, X6                  \
+	PSLLDQ $8, X6
+
+// func polyvalInitAsm(h *[4]fieldElement)
+//
+// Computes H^2, H^3 and H^4 from H, which is h[0].
+TEXT ·polyvalInitAsm(SB), NOSPLIT, $0-8
+	MOVQ  h+0(FP), DI
+	LOAD_POLY
+	MOVOU (DI), X12
+	MOVOU X12, X0
+	ZERO_ACC
+	MUL_ACC(X0, X12)
+	REDUCE
+	MOVOU X0, 16(DI)
+	ZERO_ACC
+	MUL_ACC(X0, X12)
+	REDUCE
+	MOVOU X0, 32(DI)
+	ZERO_ACC
+	MUL_ACC(X0, X12)
+	REDUCE
+	MOVOU X0, 48(DI)
+	RET
+
+// func polyvalBlocksAsm(s *fieldElement, h *[4]fieldElement, in []byte)
+TEXT ·polyvalBlocksAsm(SB), NOSPLIT, $0-40
+	MOVQ s+0(FP), DI
+	MOVQ h+8(FP), DX
+	MOVQ in_base+16(FP), SI
+	MOVQ in_len+24(FP), CX
+	SHRQ $4, CX
+	JZ   done
+
+	LOAD_POLY
+	MOVOU (DI), X0
+	MOVOU (DX), X12
+	MOVOU 16(DX), X13
+	MOVOU 32(DX), X14
+	MOVOU 48(DX), X15
+
+	// Four blocks at a time: s = (s+x1)*H^4 + x2*H^3 + x3*H^2 + x4*H
+loop4:
+	CMPQ  CX, $4
+	JB    loop1
+	MOVOU (SI), X7
+	PXOR  X0, X7
+	MOVOU 16(SI), X8
+	MOVOU 32(SI), X9
+	MOVOU 48(SI), X10
+	ZERO_ACC
+	MUL_ACC(X7, X15)
+	MUL_ACC(X8, X14)
+	MUL_ACC(X9, X13)
+	MUL_ACC(X10, X12)
+	REDUCE
+	ADDQ  $64, SI
+	SUBQ  $4, CX
+	JMP   loop4
+
+loop1:
+	TESTQ CX, CX
+	JZ    store
+	MOVOU (SI), X7
+	PXOR  X0, X7
+	ZERO_ACC
+	MUL_ACC(X7, X12)
+	REDUCE
+	ADDQ  $16, SI
+	DECQ  CX
+	JMP   loop1
+
+store:
+	MOVOU X0, (DI)
+
+done:
+	RET
@@ -0,0 +1,13 @@
+//go:build !amd64
+
+package gcmsiv
+
+var hasPCLMULQDQ = false
+
+func polyvalInit(p *polyval) {
+	panic("BUG: no assembly implementation on this platform")
+}
+
+func polyvalBlocks(p *polyval, in []byte) {
+	panic("BUG: no assembly implementation on this platform")
+}
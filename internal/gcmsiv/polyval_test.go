@@ -0,0 +1,91 @@
+package gcmsiv
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/rand"
+	"testing"
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Test vector from RFC 8452, Appendix A
+func TestPolyvalRFC(t *testing.T) {
+	p := newPolyval(unhex("25629347589242761d31f826ba4b757b"))
+	p.update(unhex("4f4f95668c83dfb6401762bb2d01a262d1a24ddd2721d006bbe45f20d3c9f362"))
+	var out [16]byte
+	p.sum(&out)
+	if want := unhex("f7a3b47b846119fae5b7866cf5e5b77e"); !bytes.Equal(out[:], want) {
+		t.Errorf("have %x, want %x", out, want)
+	}
+}
+
+// mulmod is a slow bit-by-bit reference implementation of a * b modulo the
+// POLYVAL field polynomial.
+func mulmod(a, b fieldElement) (r fieldElement) {
+	for i := 0; i < 128; i++ {
+		var bit uint64
+		if i < 64 {
+			bit = (b.lo >> i) & 1
+		} else {
+			bit = (b.hi >> (i - 64)) & 1
+		}
+		if bit == 1 {
+			r.lo ^= a.lo
+			r.hi ^= a.hi
+		}
+		// a = a * x mod P
+		carry := a.hi >> 63
+		a.hi = a.hi<<1 | a.lo>>63
+		a.lo <<= 1
+		if carry == 1 {
+			// x^128 = x^127 + x^126 + x^121 + 1
+			a.lo ^= 1
+			a.hi ^= 1<<63 | 1<<62 | 1<<57
+		}
+	}
+	return r
+}
+
+// dot(a, b) * x^128 must equal a * b
+func TestDotReference(t *testing.T) {
+	x128 := fieldElement{lo: 1, hi: 1<<63 | 1<<62 | 1<<57}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		a := fieldElement{rng.Uint64(), rng.Uint64()}
+		b := fieldElement{rng.Uint64(), rng.Uint64()}
+		if have, want := mulmod(dot(a, b), x128), mulmod(a, b); have != want {
+			t.Fatalf("a=%x b=%x: have %x, want %x", a, b, have, want)
+		}
+	}
+}
+
+// TestPolyvalGeneric compares the accelerated implementation (if any) with
+// the generic Go code
+func TestPolyvalGeneric(t *testing.T) {
+	if !hasPCLMULQDQ {
+		t.Skip("no accelerated implementation on this CPU")
+	}
+	key := make([]byte, 16)
+	in := make([]byte, 16*33)
+	rand.Read(key)
+	rand.Read(in)
+	for _, n := range []int{16, 32, 48, 16 * 33} {
+		fast := newPolyval(key)
+		fast.update(in[:n])
+		generic := newPolyval(key)
+		for off := 0; off < n; off += 16 {
+			x := loadElement(in[off:])
+			generic.s = dot(fieldElement{generic.s.lo ^ x.lo, generic.s.hi ^ x.hi}, generic.h)
+		}
+		if fast.s != generic.s {
+			t.Errorf("n=%d: have %x, want %x", n, fast.s, generic.s)
+		}
+	}
+}
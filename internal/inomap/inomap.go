@@ -19,6 +19,7 @@ import (
 	"sync"
 	"syscall"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/metrics"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
@@ -81,6 +82,7 @@ func (m *InoMap) spill(in QIno) (out uint64) {
 	}
 	out = m.spillNext
 	m.spillNext++
+	metrics.InoMapSpills.Inc()
 	m.spillMap[in] = out
 	return out | spillBit
 }
@@ -0,0 +1,191 @@
+// Package lz4 implements the LZ4 block format
+// ( https://github.com/lz4/lz4/blob/dev/doc/lz4_Block_format.md ).
+//
+// Only raw blocks are supported, not the LZ4 frame format. The compressor is
+// a simple greedy one, which is fast and good enough for per-block
+// compression of file contents.
+package lz4
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	minMatch = 4
+	// The last match must start at least mfLimit bytes before the end of the
+	// block
+	mfLimit = 12
+	// The last lastLiterals bytes are always literals
+	lastLiterals = 5
+	maxOffset    = 65535
+	hashLog      = 12
+)
+
+// ErrCorrupt is returned by Decompress when the input is not a valid LZ4
+// block or does not fit into the destination buffer.
+var ErrCorrupt = errors.New("lz4: corrupt input")
+
+// CompressBound returns the maximum compressed size of "n" input bytes.
+func CompressBound(n int) int {
+	return n + n/255 + 16
+}
+
+func hash(v uint32) uint32 {
+	return (v * 2654435761) >> (32 - hashLog)
+}
+
+// Compress appends the compressed form of "src" to "dst" and returns the
+// result.
+func Compress(dst, src []byte) []byte {
+	var table [1 << hashLog]int32
+	anchor := 0
+	if len(src) > mfLimit {
+		limit := len(src) - mfLimit
+		matchEnd := len(src) - lastLiterals
+		for i := 0; i < limit; {
+			seq := binary.LittleEndian.Uint32(src[i:])
+			h := hash(seq)
+			// Positions are stored +1 so that 0 means "empty"
+			ref := int(table[h]) - 1
+			table[h] = int32(i + 1)
+			if ref < 0 || i-ref > maxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+				// Skip faster through incompressible data
+				i += 1 + (i-anchor)>>6
+				continue
+			}
+			mLen := minMatch
+			for i+mLen < matchEnd && src[ref+mLen] == src[i+mLen] {
+				mLen++
+			}
+			dst = appendSequence(dst, src[anchor:i], i-ref, mLen)
+			i += mLen
+			anchor = i
+		}
+	}
+	// The last sequence only has literals
+	return appendSequence(dst, src[anchor:], 0, 0)
+}
+
+// appendSequence appends one sequence of literals and a match. The match is
+// omitted if mLen is zero.
+func appendSequence(dst, literals []byte, offset int, mLen int) []byte {
+	lLen := len(literals)
+	var token byte
+	if lLen >= 15 {
+		token = 15 << 4
+	} else {
+		token = byte(lLen) << 4
+	}
+	if mLen > 0 {
+		if mLen-minMatch >= 15 {
+			token |= 15
+		} else {
+			token |= byte(mLen - minMatch)
+		}
+	}
+	dst = append(dst, token)
+	if lLen >= 15 {
+		dst = appendLength(dst, lLen-15)
+	}
+	dst = append(dst, literals...)
+	if mLen == 0 {
+		return dst
+	}
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if mLen-minMatch >= 15 {
+		dst = appendLength(dst, mLen-minMatch-15)
+	}
+	return dst
+}
+
+func appendLength(dst []byte, n int) []byte {
+	for n >= 255 {
+		dst = append(dst, 255)
+		n -= 255
+	}
+	return append(dst, byte(n))
+}
+
+// readLength reads an extended length field starting at src[i].
+func readLength(src []byte, i int) (n int, next int, err error) {
+	for {
+		if i >= len(src) {
+			return 0, 0, ErrCorrupt
+		}
+		b := src[i]
+		i++
+		n += int(b)
+		if b != 255 {
+			return n, i, nil
+		}
+	}
+}
+
+// Decompress decompresses "src" into "dst" and returns the number of bytes
+// written. It fails with ErrCorrupt if "dst" is too small.
+func Decompress(dst, src []byte) (int, error) {
+	si, di := 0, 0
+	for si < len(src) {
+		token := src[si]
+		si++
+		// Literals
+		lLen := int(token >> 4)
+		if lLen == 15 {
+			n, next, err := readLength(src, si)
+			if err != nil {
+				return 0, err
+			}
+			lLen += n
+			si = next
+		}
+		if lLen > len(src)-si || lLen > len(dst)-di {
+			return 0, ErrCorrupt
+		}
+		copy(dst[di:], src[si:si+lLen])
+		si += lLen
+		di += lLen
+		if si == len(src) {
+			// The last sequence has no match
+			return di, nil
+		}
+		// Match
+		if len(src)-si < 2 {
+			return 0, ErrCorrupt
+		}
+		offset := int(binary.LittleEndian.Uint16(src[si:]))
+		si += 2
+		if offset == 0 || offset > di {
+			return 0, ErrCorrupt
+		}
+		mLen := int(token & 15)
+		if mLen == 15 {
+			n, next, err := readLength(src, si)
+			if err != nil {
+				return 0, err
+			}
+			mLen += n
+			si = next
+		}
+		mLen += minMatch
+		if mLen > len(dst)-di {
+			return 0, ErrCorrupt
+		}
+		ref := di - offset
+		if offset >= mLen {
+			copy(dst[di:di+mLen], dst[ref:ref+mLen])
+		} else {
+			// Overlapping match, copy byte by byte
+			for j := 0; j < mLen; j++ {
+				dst[di+j] = dst[ref+j]
+			}
+		}
+		di += mLen
+	}
+	// An empty input is valid and decompresses to nothing, anything else
+	// must end with a literals-only sequence
+	if len(src) > 0 {
+		return 0, ErrCorrupt
+	}
+	return di, nil
+}
@@ -0,0 +1,88 @@
+package lz4
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/rand"
+	"testing"
+)
+
+func testData() []byte {
+	var b bytes.Buffer
+	for i := 0; i < 20; i++ {
+		b.WriteString("gocryptfs encrypts file contents. ")
+	}
+	for i := 0; i < 256; i++ {
+		b.WriteByte(byte(i))
+	}
+	b.Write(bytes.Repeat([]byte("a"), 300))
+	b.WriteString("end")
+	return b.Bytes()
+}
+
+// testBlock is testData() compressed by the lz4 reference implementation
+// (lz4 v1.9, "lz4 -9 -B4", extracted from the frame)
+const testBlock = "c1676f6372797074667320656e0a00ff02732066696c6520636f6e74656e74732e202200ffff75fff2000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f404142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f606162636465666768696a6b6c6d6e6f707172737475767778797a7b7c7d7e7f808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9fa0a1a2a3a4a5a6a7a8a9aaabacadaeafb0b1b2b3b4b5b6b7b8b9babbbcbdbebfc0c1c2c3c4c5c6c7c8c9cacbcccdcecfd0d1d2d3d4d5d6d7d8d9dadbdcdddedfe0e1e2e3e4e5e6e7e8e9eaebecedeeeff0f1f2f3f4f5f6f7f8f9fafbfcfdfeff610100ff17506161656e64"
+
+func TestDecompressReference(t *testing.T) {
+	want := testData()
+	block, _ := hex.DecodeString(testBlock)
+	out := make([]byte, len(want))
+	n, err := Decompress(out, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out[:n], want) {
+		t.Errorf("wrong output")
+	}
+	// Output buffer too small
+	if _, err := Decompress(out[:len(want)-1], block); err != ErrCorrupt {
+		t.Errorf("want ErrCorrupt, got %v", err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	random := make([]byte, 70000)
+	rand.Read(random)
+	inputs := [][]byte{
+		nil,
+		[]byte("x"),
+		[]byte("0123456789abc"),
+		bytes.Repeat([]byte{0}, 4096),
+		bytes.Repeat([]byte("abcd"), 1024*64),
+		random,
+		append(append([]byte{}, random[:40000]...), random[:40000]...),
+		testData(),
+	}
+	for i, in := range inputs {
+		c := Compress(nil, in)
+		if len(c) > CompressBound(len(in)) {
+			t.Errorf("input %d: compressed size %d exceeds bound %d", i, len(c), CompressBound(len(in)))
+		}
+		out := make([]byte, len(in))
+		n, err := Decompress(out, c)
+		if err != nil {
+			t.Fatalf("input %d: %v", i, err)
+		}
+		if !bytes.Equal(out[:n], in) || n != len(in) {
+			t.Errorf("input %d: round trip mismatch", i)
+		}
+	}
+	if c := Compress(nil, bytes.Repeat([]byte{0}, 4096)); len(c) > 50 {
+		t.Errorf("zeros compressed badly: %d bytes", len(c))
+	}
+}
+
+// Corrupt input must not cause a panic
+func TestDecompressCorrupt(t *testing.T) {
+	c := Compress(nil, testData())
+	out := make([]byte, len(testData()))
+	for i := range c {
+		for _, x := range []byte{0x01, 0x10, 0xff} {
+			tmp := append([]byte{}, c...)
+			tmp[i] ^= x
+			Decompress(out, tmp)
+		}
+		Decompress(out, c[:i])
+	}
+}
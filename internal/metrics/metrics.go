@@ -0,0 +1,234 @@
+// Package metrics collects statistics about a mount and writes them in the
+// Prometheus text exposition format. They can be queried through the control
+// socket ("Metrics" command) or through the HTTP listener enabled by
+// "-metrics".
+//
+// There is one mount per process, so the counters are global.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counter is a monotonically increasing counter. Safe for concurrent use.
+type Counter struct {
+	v uint64
+}
+
+// Add adds "n" to the counter
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+// Inc increments the counter by one
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+// Value returns the current value
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+var (
+	// BytesRead counts the plaintext bytes read through the mount
+	// (ciphertext bytes in reverse mode)
+	BytesRead Counter
+	// BytesWritten counts the plaintext bytes written through the mount
+	BytesWritten Counter
+	// BlocksEncrypted counts the encrypted content blocks
+	BlocksEncrypted Counter
+	// BlocksDecrypted counts the successfully decrypted content blocks
+	BlocksDecrypted Counter
+	// AuthFailures counts the content blocks that failed authentication
+	AuthFailures Counter
+	// DirCacheHits counts the directory cache lookups that found an entry
+	DirCacheHits Counter
+	// DirCacheMisses counts the directory cache lookups that did not
+	DirCacheMisses Counter
+	// InoMapSpills counts the inode numbers that had to be stored in the
+	// inode map spill map
+	InoMapSpills Counter
+)
+
+// FuseLatencies records the duration of each FUSE operation. It implements
+// the go-fuse LatencyMap interface.
+var FuseLatencies = &LatencyMap{ops: make(map[string]*histogram)}
+
+// latencyBuckets are the upper bounds of the histogram buckets in seconds
+var latencyBuckets = []float64{
+	0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05,
+	0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+// histogram counts durations in latencyBuckets
+type histogram struct {
+	// sumNs is the sum of all observations in nanoseconds.
+	// Must be the first field so it is 64-bit aligned on 32-bit platforms,
+	// see https://pkg.go.dev/sync/atomic#pkg-note-BUG
+	sumNs uint64
+	// counts[i] is the number of observations in bucket i (not cumulative).
+	// The last element is the +Inf bucket.
+	counts []uint64
+}
+
+func (h *histogram) observe(dt time.Duration) {
+	s := dt.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets, s)
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.sumNs, uint64(dt))
+}
+
+// LatencyMap keeps a latency histogram for each FUSE operation
+type LatencyMap struct {
+	mu  sync.RWMutex
+	ops map[string]*histogram
+}
+
+// Add records that operation "name" took "dt"
+func (l *LatencyMap) Add(name string, dt time.Duration) {
+	l.mu.RLock()
+	h := l.ops[name]
+	l.mu.RUnlock()
+	if h == nil {
+		l.mu.Lock()
+		h = l.ops[name]
+		if h == nil {
+			h = &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+			l.ops[name] = h
+		}
+		l.mu.Unlock()
+	}
+	h.observe(dt)
+}
+
+// funcMetric is a metric whose value is read from a function
+type funcMetric struct {
+	name string
+	help string
+	typ  string
+	f    func() float64
+}
+
+var (
+	funcsLock sync.Mutex
+	funcs     []funcMetric
+	// info is the label set of the gocryptfs_mount_info metric
+	info []string
+)
+
+// RegisterCounterFunc registers a counter named "name" whose value is
+// returned by "f"
+func RegisterCounterFunc(name string, help string, f func() float64) {
+	register(funcMetric{name, help, "counter", f})
+}
+
+// RegisterGaugeFunc registers a gauge named "name" whose value is returned
+// by "f"
+func RegisterGaugeFunc(name string, help string, f func() float64) {
+	register(funcMetric{name, help, "gauge", f})
+}
+
+func register(m funcMetric) {
+	funcsLock.Lock()
+	defer funcsLock.Unlock()
+	funcs = append(funcs, m)
+}
+
+// SetInfo sets the labels of the gocryptfs_mount_info metric, which always
+// has the value 1. "labels" are name, value pairs.
+func SetInfo(labels ...string) {
+	funcsLock.Lock()
+	defer funcsLock.Unlock()
+	info = labels
+}
+
+// counters lists the global counters in output order
+var counters = []struct {
+	name string
+	help string
+	c    *Counter
+}{
+	{"gocryptfs_read_bytes_total", "Bytes read through the mount.", &BytesRead},
+	{"gocryptfs_written_bytes_total", "Bytes written through the mount.", &BytesWritten},
+	{"gocryptfs_blocks_encrypted_total", "Content blocks encrypted.", &BlocksEncrypted},
+	{"gocryptfs_blocks_decrypted_total", "Content blocks decrypted.", &BlocksDecrypted},
+	{"gocryptfs_auth_failures_total", "Content blocks that failed authentication.", &AuthFailures},
+	{"gocryptfs_dircache_hits_total", "Directory cache hits.", &DirCacheHits},
+	{"gocryptfs_dircache_misses_total", "Directory cache misses.", &DirCacheMisses},
+	{"gocryptfs_inomap_spill_entries_total", "Inode numbers stored in the inode map spill map.", &InoMapSpills},
+}
+
+// Write writes all metrics to "w" in the Prometheus text exposition format
+func Write(w io.Writer) error {
+	var b strings.Builder
+	funcsLock.Lock()
+	if len(info) > 0 {
+		header(&b, "gocryptfs_mount_info", "Information about the mount.", "gauge")
+		fmt.Fprintf(&b, "gocryptfs_mount_info{%s} 1\n", labels(info...))
+	}
+	for _, m := range funcs {
+		header(&b, m.name, m.help, m.typ)
+		fmt.Fprintf(&b, "%s %v\n", m.name, m.f())
+	}
+	funcsLock.Unlock()
+	for _, c := range counters {
+		header(&b, c.name, c.help, "counter")
+		fmt.Fprintf(&b, "%s %d\n", c.name, c.c.Value())
+	}
+	FuseLatencies.write(&b)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (l *LatencyMap) write(b *strings.Builder) {
+	const name = "gocryptfs_fuse_op_duration_seconds"
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if len(l.ops) == 0 {
+		return
+	}
+	ops := make([]string, 0, len(l.ops))
+	for op := range l.ops {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	header(b, name, "Duration of FUSE operations.", "histogram")
+	for _, op := range ops {
+		h := l.ops[op]
+		var cum uint64
+		for i := range h.counts {
+			cum += atomic.LoadUint64(&h.counts[i])
+			le := "+Inf"
+			if i < len(latencyBuckets) {
+				le = fmt.Sprint(latencyBuckets[i])
+			}
+			fmt.Fprintf(b, "%s_bucket{%s} %d\n", name, labels("op", op, "le", le), cum)
+		}
+		sum := time.Duration(atomic.LoadUint64(&h.sumNs)).Seconds()
+		fmt.Fprintf(b, "%s_sum{%s} %v\n", name, labels("op", op), sum)
+		fmt.Fprintf(b, "%s_count{%s} %d\n", name, labels("op", op), cum)
+	}
+}
+
+func header(b *strings.Builder, name string, help string, typ string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// labelEscaper escapes label values as required by the text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats name, value pairs as a label set
+func labels(kv ...string) string {
+	var parts []string
+	for i := 0; i+1 < len(kv); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, kv[i], labelEscaper.Replace(kv[i+1])))
+	}
+	return strings.Join(parts, ",")
+}
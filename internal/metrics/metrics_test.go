@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWrite(t *testing.T) {
+	BytesRead.Add(100)
+	RegisterGaugeFunc("gocryptfs_test_gauge", "Test gauge.", func() float64 { return 42 })
+	SetInfo("version", "v1", "cipherdir", `/tmp/a"b`)
+	FuseLatencies.Add("READ", 300*time.Microsecond)
+	FuseLatencies.Add("READ", 20*time.Second)
+
+	var b strings.Builder
+	if err := Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		"# TYPE gocryptfs_read_bytes_total counter\ngocryptfs_read_bytes_total 100\n",
+		"gocryptfs_test_gauge 42\n",
+		`gocryptfs_mount_info{version="v1",cipherdir="/tmp/a\"b"} 1` + "\n",
+		`gocryptfs_fuse_op_duration_seconds_bucket{op="READ",le="0.00025"} 0` + "\n",
+		`gocryptfs_fuse_op_duration_seconds_bucket{op="READ",le="0.0005"} 1` + "\n",
+		`gocryptfs_fuse_op_duration_seconds_bucket{op="READ",le="10"} 1` + "\n",
+		`gocryptfs_fuse_op_duration_seconds_bucket{op="READ",le="+Inf"} 2` + "\n",
+		`gocryptfs_fuse_op_duration_seconds_sum{op="READ"} 20.0003` + "\n",
+		`gocryptfs_fuse_op_duration_seconds_count{op="READ"} 2` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in output:\n%s", want, out)
+		}
+	}
+}
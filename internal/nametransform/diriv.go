@@ -65,7 +65,16 @@ func fdReadDirIV(fd *os.File) (iv []byte, err error) {
 // This function is exported because it is used from fusefrontend, main,
 // and also the automated tests.
 func WriteDirIVAt(dirfd int) error {
-	iv := cryptocore.RandBytes(DirIVLen)
+	return WriteDirIVValueAt(dirfd, cryptocore.RandBytes(DirIVLen))
+}
+
+// WriteDirIVValueAt is like WriteDirIVAt, but writes the given "iv" instead
+// of a random one. Used by fsck to restore a gocryptfs.diriv file from a
+// backup.
+func WriteDirIVValueAt(dirfd int, iv []byte) error {
+	if len(iv) != DirIVLen {
+		return fmt.Errorf("WriteDirIV: wrong iv length %d", len(iv))
+	}
 	// 0400 permissions: gocryptfs.diriv should never be modified after creation.
 	// Don't use "ioutil.WriteFile", it causes trouble on NFS:
 	// https://github.com/rfjakob/gocryptfs/commit/7d38f80a78644c8ec4900cc990bfb894387112ed
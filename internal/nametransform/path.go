@@ -0,0 +1,176 @@
+package nametransform
+
+import (
+	"path"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+)
+
+// maxCachedDirs limits the number of directories (and open fds) a
+// PathTranslator caches
+const maxCachedDirs = 1000
+
+// EncryptPathAt encrypts the relative path "plainPath" level by level,
+// starting at the directory "dirfd" (usually the root of the encrypted
+// directory).
+//
+// Symlink-safe: all intermediate directories are opened with O_NOFOLLOW.
+func (n *NameTransform) EncryptPathAt(dirfd int, plainPath string) (cipherPath string, err error) {
+	t := n.NewPathTranslator(dirfd)
+	defer t.Close()
+	return t.Encrypt(plainPath)
+}
+
+// DecryptPathAt decrypts the relative path "cipherPath" level by level,
+// starting at the directory "dirfd". Long names are resolved through their
+// .name files.
+//
+// Symlink-safe: all intermediate directories are opened with O_NOFOLLOW.
+func (n *NameTransform) DecryptPathAt(dirfd int, cipherPath string) (plainPath string, err error) {
+	t := n.NewPathTranslator(dirfd)
+	defer t.Close()
+	return t.Decrypt(cipherPath)
+}
+
+// translatedDir is a directory the PathTranslator has already visited
+type translatedDir struct {
+	// fd is the directory, opened with O_PATH
+	fd int
+	iv []byte
+	// out is the translated path of the directory
+	out string
+}
+
+// PathTranslator encrypts and decrypts many paths below the same root
+// directory. The directories that have been visited are cached, so paths
+// that share a directory only read its gocryptfs.diriv once.
+// Not safe for concurrent use.
+type PathTranslator struct {
+	n      *NameTransform
+	rootFd int
+	// enc caches directories by plaintext path, dec by ciphertext path
+	enc map[string]*translatedDir
+	dec map[string]*translatedDir
+}
+
+// NewPathTranslator returns a PathTranslator for the directory "rootFd".
+// The caller keeps ownership of "rootFd", which must stay open until Close()
+// is called.
+func (n *NameTransform) NewPathTranslator(rootFd int) *PathTranslator {
+	return &PathTranslator{
+		n:      n,
+		rootFd: rootFd,
+		enc:    make(map[string]*translatedDir),
+		dec:    make(map[string]*translatedDir),
+	}
+}
+
+// Encrypt encrypts the relative path "plainPath"
+func (t *PathTranslator) Encrypt(plainPath string) (cipherPath string, err error) {
+	return t.translate(plainPath, true)
+}
+
+// Decrypt decrypts the relative path "cipherPath"
+func (t *PathTranslator) Decrypt(cipherPath string) (plainPath string, err error) {
+	return t.translate(cipherPath, false)
+}
+
+// Close closes the cached directory fds
+func (t *PathTranslator) Close() {
+	for _, cache := range []map[string]*translatedDir{t.enc, t.dec} {
+		for k, d := range cache {
+			if d.fd != t.rootFd {
+				syscall.Close(d.fd)
+			}
+			delete(cache, k)
+		}
+	}
+}
+
+func (t *PathTranslator) translate(in string, encrypt bool) (string, error) {
+	if len(t.enc)+len(t.dec) > maxCachedDirs {
+		t.Close()
+	}
+	dir, name := splitPath(in)
+	d, err := t.dir(dir, encrypt)
+	if err != nil {
+		return "", err
+	}
+	out, err := t.name(d, name, encrypt)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(d.out, out), nil
+}
+
+// splitPath splits "p" into the parent directory ("" for the root) and the
+// last component
+func splitPath(p string) (dir string, name string) {
+	dir, name = path.Split(p)
+	if dir != "" {
+		dir = dir[:len(dir)-1]
+	}
+	return dir, name
+}
+
+// dir returns the directory "in", which is a plaintext path if "encrypt" is
+// set, and a ciphertext path otherwise
+func (t *PathTranslator) dir(in string, encrypt bool) (*translatedDir, error) {
+	cache := t.dec
+	if encrypt {
+		cache = t.enc
+	}
+	if d := cache[in]; d != nil {
+		return d, nil
+	}
+	fd := t.rootFd
+	out := ""
+	if in != "" {
+		parentPath, name := splitPath(in)
+		parent, err := t.dir(parentPath, encrypt)
+		if err != nil {
+			return nil, err
+		}
+		outName, err := t.name(parent, name, encrypt)
+		if err != nil {
+			return nil, err
+		}
+		cName := name
+		if encrypt {
+			cName = outName
+		}
+		// Descend into next directory
+		fd, err = syscallcompat.Openat(parent.fd, cName, syscall.O_NOFOLLOW|syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+		if err != nil {
+			return nil, err
+		}
+		out = path.Join(parent.out, outName)
+	}
+	iv, err := t.n.ReadDirIVAt(fd)
+	if err != nil {
+		if fd != t.rootFd {
+			syscall.Close(fd)
+		}
+		return nil, err
+	}
+	d := &translatedDir{fd: fd, iv: iv, out: out}
+	cache[in] = d
+	return d, nil
+}
+
+// name translates the name "name" in the directory "d"
+func (t *PathTranslator) name(d *translatedDir, name string, encrypt bool) (string, error) {
+	if encrypt {
+		return t.n.EncryptAndHashName(name, d.iv)
+	}
+	longName := name
+	if IsLongContent(name) {
+		var err error
+		longName, err = ReadLongNameAt(d.fd, name)
+		if err != nil {
+			return "", err
+		}
+	}
+	return t.n.DecryptName(longName, d.iv)
+}
@@ -0,0 +1,38 @@
+package nametransform
+
+import "strings"
+
+// Internal files in the root directory of CIPHERDIR. Encrypted names never
+// contain a dot, so they cannot clash with user files. With -plaintextnames,
+// the FUSE frontend rejects these names.
+const (
+	// UncompressPrefix is the name prefix of the converted copies of
+	// compressed files that are about to be modified
+	UncompressPrefix = "gocryptfs.uncompress."
+	// RekeyPrefix is the name prefix of the temporary files of "-rekey"
+	RekeyPrefix = "gocryptfs.rekey."
+)
+
+// Internal files that can be in any directory. They are not valid encrypted
+// names.
+const (
+	// DirIVTmpName is the temporary file "-fsck -repair" writes a new
+	// gocryptfs.diriv to
+	DirIVTmpName = DirIVFilename + ".fsck.tmp"
+	// RestorePrefix is the name prefix of the entries a "-reverse -writable"
+	// mount stages in the plaintext directory
+	RestorePrefix = ".gocryptfs-restore-"
+)
+
+// IsReservedRootName returns true if "name" in the root directory of
+// CIPHERDIR is reserved for an internal file.
+func IsReservedRootName(name string) bool {
+	return strings.HasPrefix(name, UncompressPrefix) || strings.HasPrefix(name, RekeyPrefix)
+}
+
+// IsInternalName returns true if "name" is an internal file that is not a
+// valid encrypted name. Only meaningful without -plaintextnames, where
+// these names are normal user files.
+func IsInternalName(name string) bool {
+	return name == DirIVTmpName || strings.HasPrefix(name, RestorePrefix)
+}
@@ -0,0 +1,749 @@
+// Package offlinefsck checks a gocryptfs filesystem by reading the encrypted
+// directory directly, without mounting it via FUSE.
+package offlinefsck
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/v2/internal/inomap"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// Class is the kind of problem that was found
+type Class string
+
+const (
+	// ClassIO is an error while accessing a file or directory
+	ClassIO Class = "io"
+	// ClassDirIV is a missing or invalid gocryptfs.diriv file
+	ClassDirIV Class = "diriv"
+	// ClassName is a file name that cannot be decrypted
+	ClassName Class = "name"
+	// ClassLongName is a missing, invalid or orphaned
+	// gocryptfs.longname.*.name file
+	ClassLongName Class = "longname"
+	// ClassHeader is an invalid file header or block index
+	ClassHeader Class = "header"
+	// ClassBlock is a file content block that cannot be decrypted
+	ClassBlock Class = "block"
+	// ClassSymlink is a symlink target that cannot be decrypted
+	ClassSymlink Class = "symlink"
+	// ClassXattr is an extended attribute that cannot be decrypted
+	ClassXattr Class = "xattr"
+)
+
+// Problem describes a single problem found by the Checker
+type Problem struct {
+	// Path is the relative plaintext path. Parts of the path that cannot be
+	// decrypted are left encrypted.
+	Path string
+	// CipherPath is the relative path in the encrypted directory
+	CipherPath string
+	Class      Class
+	// Block is the number of the bad block for ClassBlock
+	Block uint64
+	// Err describes the problem
+	Err error
+	// Repaired describes what -repair did about the problem. Empty if the
+	// problem was not repaired.
+	Repaired string
+}
+
+func (p *Problem) String() string {
+	var s string
+	if p.Class == ClassBlock {
+		s = fmt.Sprintf("%q (%s): bad block %d: %v", p.Path, p.CipherPath, p.Block, p.Err)
+	} else {
+		s = fmt.Sprintf("%q (%s): %s: %v", p.Path, p.CipherPath, p.Class, p.Err)
+	}
+	if p.Repaired != "" {
+		s += " [repaired: " + p.Repaired + "]"
+	}
+	return s
+}
+
+// Checker checks the encrypted directory tree
+type Checker struct {
+	args          fusefrontend.Args
+	contentEnc    *contentenc.ContentEnc
+	nameTransform *nametransform.NameTransform
+	// Repair enables fixing the problems that are found. The filesystem must
+	// not be mounted while repairing.
+	Repair bool
+	// RepairFrom is an optional backup copy of the encrypted directory.
+	// Missing gocryptfs.diriv files are restored from there.
+	RepairFrom string
+	// PrevState lists the files that were found clean by an earlier run.
+	// Regular files that are unchanged since then are not checked again.
+	PrevState *State
+	// NewState, if not nil, receives the files that were found clean, or
+	// were skipped because they are unchanged
+	NewState *State
+	// Checked, if not nil, is called for each directory, file and symlink.
+	// Directories are passed before their contents.
+	Checked func(e Entry)
+	// Unchanged counts the files skipped because of PrevState
+	Unchanged int
+	// Jobs is the number of files that are checked in parallel. Values
+	// below 2 check serially.
+	Jobs int
+	// Report is called for each problem found. Report and Checked are
+	// never called concurrently.
+	Report func(p Problem)
+	// Problems lists everything that was found
+	Problems []Problem
+	// Skipped lists the relative ciphertext paths that could not be checked
+	// due to missing permissions
+	Skipped []string
+	// Protects Problems, Skipped, dirty and NewState
+	lock sync.Mutex
+	// Ciphertext paths with problems or skipped due to missing permissions
+	dirty map[string]struct{}
+	// Serializes the Report and Checked callbacks
+	callbackLock sync.Mutex
+	// Serializes moves to lost+found
+	repairLock sync.Mutex
+	// Files to check, read by the threads started by startWorkers().
+	// nil if we check serially.
+	jobs    chan fileJob
+	workers sync.WaitGroup
+	// Inode numbers of hard-linked files (Nlink > 1) that we have already
+	// checked, and the relative ciphertext path they were checked under
+	seenInodes map[inomap.QIno]string
+	// Further links to the files in seenInodes
+	extraLinks []hardLink
+	// aborted is set by Abort() and checked in long-running loops
+	aborted int32
+	// Root directory fd during Run()
+	rootFd int
+	// lost+found directory fd and entry, set on first use by lostFound()
+	lfFd    int
+	lfEntry entry
+}
+
+// New returns a Checker for the encrypted directory args.Cipherdir
+func New(args fusefrontend.Args, c *contentenc.ContentEnc, n *nametransform.NameTransform) *Checker {
+	return &Checker{
+		args:          args,
+		contentEnc:    c,
+		nameTransform: n,
+		seenInodes:    make(map[inomap.QIno]string),
+		dirty:         make(map[string]struct{}),
+		rootFd:        -1,
+		lfFd:          -1,
+	}
+}
+
+// Abort stops a running check
+func (ck *Checker) Abort() {
+	atomic.StoreInt32(&ck.aborted, 1)
+}
+
+// Aborted returns true if Abort() has been called
+func (ck *Checker) Aborted() bool {
+	return atomic.LoadInt32(&ck.aborted) != 0
+}
+
+// entry identifies a file or directory during the check
+type entry struct {
+	// Relative plaintext and ciphertext path
+	pPath string
+	cPath string
+}
+
+func (ck *Checker) problem(e entry, class Class, err error) {
+	ck.addProblem(Problem{Path: e.pPath, CipherPath: e.cPath, Class: class, Err: err})
+}
+
+// Repaired returns the number of problems that have been repaired
+func (ck *Checker) Repaired() (n int) {
+	ck.lock.Lock()
+	defer ck.lock.Unlock()
+	for _, p := range ck.Problems {
+		if p.Repaired != "" {
+			n++
+		}
+	}
+	return n
+}
+
+func (ck *Checker) addProblem(p Problem) {
+	ck.lock.Lock()
+	ck.Problems = append(ck.Problems, p)
+	ck.dirty[p.CipherPath] = struct{}{}
+	ck.lock.Unlock()
+	if ck.Report != nil {
+		ck.callbackLock.Lock()
+		ck.Report(p)
+		ck.callbackLock.Unlock()
+	}
+}
+
+// ioProblem records an access error. Permission errors are recorded as
+// skipped when we do not run as root.
+func (ck *Checker) ioProblem(e entry, err error) {
+	if (err == syscall.EACCES || err == syscall.EPERM) && syscall.Geteuid() != 0 {
+		tlog.Info.Printf("fsck: skipping %q: %v", e.cPath, err)
+		ck.lock.Lock()
+		ck.Skipped = append(ck.Skipped, e.cPath)
+		ck.dirty[e.cPath] = struct{}{}
+		ck.lock.Unlock()
+		return
+	}
+	ck.problem(e, ClassIO, err)
+}
+
+// Run checks the whole filesystem
+func (ck *Checker) Run() {
+	root := entry{}
+	fd, err := syscall.Open(ck.args.Cipherdir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		ck.ioProblem(root, err)
+		return
+	}
+	defer syscall.Close(fd)
+	ck.rootFd = fd
+	defer func() {
+		if ck.lfFd >= 0 {
+			syscall.Close(ck.lfFd)
+			ck.lfFd = -1
+		}
+	}()
+	ck.xattrs(root)
+	ck.checked(root, TypeDir, false)
+	ck.startWorkers()
+	ck.dir(fd, root)
+	ck.stopWorkers()
+	ck.rememberLinks()
+}
+
+// hardLink is a further link to a hard-linked file that has been checked
+// under the relative ciphertext path "first"
+type hardLink struct {
+	e     entry
+	first string
+	fs    FileState
+}
+
+// rememberLinks records the further links of hard-linked files in NewState
+// if the file was found clean under its first path. The next run finds them
+// unchanged even if the first path is gone.
+func (ck *Checker) rememberLinks() {
+	if ck.NewState == nil || ck.Aborted() {
+		return
+	}
+	for _, l := range ck.extraLinks {
+		if _, ok := ck.NewState.Files[l.first]; ok {
+			ck.rememberFile(l.e, l.fs)
+		}
+	}
+}
+
+// fileJob is a regular file to check
+type fileJob struct {
+	// The directory containing the file. Owned by the job when it is passed
+	// to a worker thread.
+	dirfd int
+	cName string
+	e     entry
+	fs    FileState
+}
+
+// startWorkers starts the threads that check the files passed to
+// checkFile(), if ck.Jobs > 1
+func (ck *Checker) startWorkers() {
+	if ck.Jobs <= 1 {
+		return
+	}
+	ck.jobs = make(chan fileJob, ck.Jobs)
+	for i := 0; i < ck.Jobs; i++ {
+		ck.workers.Add(1)
+		go func() {
+			defer ck.workers.Done()
+			for j := range ck.jobs {
+				ck.fileJob(j)
+				syscall.Close(j.dirfd)
+			}
+		}()
+	}
+}
+
+// stopWorkers waits until all files passed to checkFile() have been checked
+func (ck *Checker) stopWorkers() {
+	if ck.jobs == nil {
+		return
+	}
+	close(ck.jobs)
+	ck.workers.Wait()
+	ck.jobs = nil
+}
+
+// checkFile checks the regular file "cName" in "dirfd", in a worker thread
+// if there are any
+func (ck *Checker) checkFile(dirfd int, cName string, e entry, fs FileState) {
+	j := fileJob{dirfd: dirfd, cName: cName, e: e, fs: fs}
+	if ck.jobs == nil {
+		ck.fileJob(j)
+		return
+	}
+	// The caller closes dirfd when it is done with the directory, so the
+	// worker gets its own copy.
+	fd, err := syscall.Dup(dirfd)
+	if err != nil {
+		ck.ioProblem(e, err)
+		return
+	}
+	j.dirfd = fd
+	ck.jobs <- j
+}
+
+func (ck *Checker) fileJob(j fileJob) {
+	ck.xattrs(j.e)
+	ck.file(j.dirfd, j.cName, j.e)
+	if !ck.isDirty(j.e) && !ck.Aborted() {
+		ck.rememberFile(j.e, j.fs)
+	}
+	ck.checked(j.e, TypeFile, false)
+}
+
+// checked calls the Checked callback
+func (ck *Checker) checked(e entry, typ string, unchanged bool) {
+	if ck.Checked != nil {
+		ck.callbackLock.Lock()
+		ck.Checked(Entry{Path: e.pPath, CipherPath: e.cPath, Type: typ, Unchanged: unchanged})
+		ck.callbackLock.Unlock()
+	}
+}
+
+// isDirty returns true if a problem has been found at "e", or if "e" has been
+// skipped
+func (ck *Checker) isDirty(e entry) bool {
+	ck.lock.Lock()
+	defer ck.lock.Unlock()
+	_, ok := ck.dirty[e.cPath]
+	return ok
+}
+
+// unchanged returns true if the regular file "e" with the stat data "fs" is
+// listed in PrevState with the same size, mtime and inode number.
+func (ck *Checker) unchanged(e entry, fs FileState) bool {
+	if ck.PrevState == nil {
+		return false
+	}
+	prev, ok := ck.PrevState.Files[e.cPath]
+	return ok && prev == fs
+}
+
+// rememberFile records the clean file "e" in NewState
+func (ck *Checker) rememberFile(e entry, fs FileState) {
+	if ck.NewState == nil {
+		return
+	}
+	ck.lock.Lock()
+	ck.NewState.Files[e.cPath] = fs
+	ck.lock.Unlock()
+}
+
+// abs returns the absolute ciphertext path of "e"
+func (ck *Checker) abs(e entry) string {
+	return filepath.Join(ck.args.Cipherdir, e.cPath)
+}
+
+// dir checks the directory opened as "dirfd" and everything below it.
+func (ck *Checker) dir(dirfd int, e entry) {
+	tlog.Debug.Printf("fsck: dir %q", e.cPath)
+	cipherEntries, _, err := syscallcompat.GetdentsSpecial(dirfd)
+	if err != nil {
+		ck.ioProblem(e, err)
+		return
+	}
+	// Sort alphabetically to make fsck runs deterministic
+	sort.Slice(cipherEntries, func(i, j int) bool { return cipherEntries[i].Name < cipherEntries[j].Name })
+	var iv []byte
+	ivOk := true
+	if !ck.args.PlaintextNames {
+		iv, err = ck.nameTransform.ReadDirIVAt(dirfd)
+		if err != nil {
+			p := Problem{Path: e.pPath, CipherPath: e.cPath, Class: ClassDirIV, Err: err}
+			if ck.Repair {
+				iv, p.Repaired = ck.repairDirIV(dirfd, e, cipherEntries)
+			}
+			ivOk = p.Repaired != ""
+			ck.addProblem(p)
+		}
+	}
+	// Long name content files, to find orphaned .name files
+	longNames := make(map[string]struct{})
+	for _, ce := range cipherEntries {
+		if nametransform.IsLongContent(ce.Name) {
+			longNames[ce.Name] = struct{}{}
+		}
+	}
+	for _, ce := range cipherEntries {
+		if ck.Aborted() {
+			return
+		}
+		// Entries that cannot be repaired in place are moved to lost+found.
+		// "entryFd" and "cName" always point to the current location.
+		entryFd, cName := dirfd, ce.Name
+		child := entry{
+			pPath: filepath.Join(e.pPath, cName),
+			cPath: filepath.Join(e.cPath, cName),
+		}
+		if ck.isInternal(child) {
+			continue
+		}
+		if !ck.args.PlaintextNames {
+			isLong := nametransform.LongNameNone
+			if ck.args.LongNames {
+				isLong = nametransform.NameType(cName)
+			}
+			if isLong == nametransform.LongNameFilename {
+				if _, ok := longNames[nametransform.RemoveLongNameSuffix(cName)]; !ok {
+					p := Problem{Path: child.pPath, CipherPath: child.cPath, Class: ClassLongName, Err: fmt.Errorf("orphaned .name file")}
+					if ck.Repair {
+						if err := syscallcompat.Unlinkat(dirfd, cName, 0); err != nil {
+							repairFailed(child, err)
+						} else {
+							p.Repaired = "removed"
+						}
+					}
+					ck.addProblem(p)
+				}
+				continue
+			}
+			if ivOk {
+				name, p := ck.decryptName(dirfd, cName, iv, child, isLong)
+				if p == nil {
+					child.pPath = filepath.Join(e.pPath, name)
+				} else {
+					if ck.Repair {
+						if dirfd2, cName2, child2, err := ck.moveToLostFound(dirfd, cName, child); err != nil {
+							repairFailed(child, err)
+						} else {
+							p.Repaired = "moved to " + child2.pPath
+							entryFd, cName, child = dirfd2, cName2, child2
+						}
+					}
+					ck.addProblem(*p)
+				}
+			}
+		}
+		st, err := syscallcompat.Fstatat2(entryFd, cName, unix.AT_SYMLINK_NOFOLLOW)
+		if err != nil {
+			ck.ioProblem(child, err)
+			continue
+		}
+		switch st.Mode & syscall.S_IFMT {
+		case syscall.S_IFDIR:
+			ck.xattrs(child)
+			fd, err := syscallcompat.Openat(entryFd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+			if err != nil {
+				ck.ioProblem(child, err)
+				continue
+			}
+			ck.checked(child, TypeDir, false)
+			ck.dir(fd, child)
+			syscall.Close(fd)
+		case syscall.S_IFREG:
+			if st.Nlink > 1 {
+				// Due to hard links, we may have already checked this file.
+				qi := inomap.QInoFromStat(st)
+				if first, ok := ck.seenInodes[qi]; ok {
+					ck.extraLinks = append(ck.extraLinks, hardLink{e: child, first: first, fs: fileState(st)})
+					continue
+				}
+				ck.seenInodes[qi] = child.cPath
+			}
+			fs := fileState(st)
+			if ck.unchanged(child, fs) {
+				ck.xattrs(child)
+				ck.Unchanged++
+				ck.rememberFile(child, fs)
+				ck.checked(child, TypeFile, true)
+				continue
+			}
+			ck.checkFile(entryFd, cName, child, fs)
+		case syscall.S_IFLNK:
+			ck.symlink(entryFd, cName, child)
+			ck.checked(child, TypeSymlink, false)
+		}
+	}
+}
+
+// decryptName decrypts the ciphertext name "cName". If that fails, the
+// problem is returned.
+func (ck *Checker) decryptName(dirfd int, cName string, iv []byte, e entry, isLong int) (string, *Problem) {
+	if isLong == nametransform.LongNameContent {
+		cNameLong, err := nametransform.ReadLongNameAt(dirfd, cName)
+		if err != nil {
+			return "", &Problem{Path: e.pPath, CipherPath: e.cPath, Class: ClassLongName, Err: err}
+		}
+		if ck.nameTransform.HashLongName(cNameLong) != cName {
+			return "", &Problem{Path: e.pPath, CipherPath: e.cPath, Class: ClassLongName,
+				Err: fmt.Errorf(".name file does not match the hash")}
+		}
+		cName = cNameLong
+	}
+	name, err := ck.nameTransform.DecryptName(cName, iv)
+	if err != nil {
+		return "", &Problem{Path: e.pPath, CipherPath: e.cPath, Class: ClassName, Err: err}
+	}
+	return name, nil
+}
+
+// headerProblem records a problem with the file header or block index of
+// "cName" and quarantines the file when repairing.
+func (ck *Checker) headerProblem(dirfd int, cName string, e entry, err error) {
+	p := Problem{Path: e.pPath, CipherPath: e.cPath, Class: ClassHeader, Err: err}
+	if ck.Repair {
+		p.Repaired = ck.quarantine(dirfd, cName, e)
+	}
+	ck.addProblem(p)
+}
+
+// file checks the content of the regular file "cName" in "dirfd"
+func (ck *Checker) file(dirfd int, cName string, e entry) {
+	tlog.Debug.Printf("fsck: file %q", e.cPath)
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		ck.ioProblem(e, err)
+		return
+	}
+	f := os.NewFile(uintptr(fd), cName)
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		ck.ioProblem(e, err)
+		return
+	}
+	size := uint64(fi.Size())
+	if size == 0 {
+		return
+	}
+	buf := make([]byte, contentenc.HeaderLen)
+	if _, err = f.ReadAt(buf, 0); err != nil {
+		if err == io.EOF {
+			err = fmt.Errorf("incomplete header, file has %d bytes", size)
+		}
+		ck.headerProblem(dirfd, cName, e, err)
+		return
+	}
+	h, err := contentenc.ParseHeader(buf)
+	if err != nil {
+		ck.headerProblem(dirfd, cName, e, err)
+		return
+	}
+	ce, err := ck.contentEnc.ForEpoch(h.Epoch)
+	if err != nil {
+		ck.headerProblem(dirfd, cName, e, err)
+		return
+	}
+	if h.Version == contentenc.CompressedVersion {
+		ck.compressedFile(dirfd, cName, f, size, ce, h, e)
+		return
+	}
+	w := blockWriter{dirfd: dirfd, cName: cName, e: e, ce: ce, h: h}
+	defer w.close()
+	cipherBS := ce.CipherBS()
+	// Read in chunks of whole blocks
+	chunk := make([]byte, cipherBS*32)
+	for off := uint64(contentenc.HeaderLen); off < size; {
+		if ck.Aborted() {
+			return
+		}
+		n, err := f.ReadAt(chunk, int64(off))
+		if err != nil && err != io.EOF {
+			ck.ioProblem(e, err)
+			return
+		}
+		if n == 0 {
+			return
+		}
+		blockNo := (off - contentenc.HeaderLen) / cipherBS
+		data := chunk[:n]
+		if isZero(data) && !ce.Signed() {
+			// File hole. Skip to the block that contains the next data.
+			off = ck.skipHole(f, off+uint64(n), cipherBS)
+			continue
+		}
+		for len(data) > 0 {
+			block := data[:contentenc.MinUint64(uint64(len(data)), cipherBS)]
+			if _, err := ce.DecryptBlock(block, blockNo, h.ID); err != nil {
+				p := Problem{Path: e.pPath, CipherPath: e.cPath, Class: ClassBlock, Block: blockNo, Err: err}
+				if ck.Repair {
+					p.Repaired = w.zeroFill(blockNo, len(block), contentenc.HeaderLen+blockNo*cipherBS)
+				}
+				ck.addProblem(p)
+			}
+			data = data[len(block):]
+			blockNo++
+		}
+		off += uint64(n)
+	}
+}
+
+// isZero returns true if "buf" only contains zero bytes
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// skipHole returns the offset of the block that contains the next data at or
+// after "off", or "off" if that cannot be determined.
+func (ck *Checker) skipHole(f *os.File, off uint64, cipherBS uint64) uint64 {
+	const SEEK_DATA = 3
+	next, err := syscall.Seek(int(f.Fd()), int64(off), SEEK_DATA)
+	if err == syscall.ENXIO {
+		// No more data, the rest of the file is a hole
+		fi, err := f.Stat()
+		if err == nil {
+			return uint64(fi.Size())
+		}
+		return off
+	} else if err != nil || uint64(next) <= off {
+		return off
+	}
+	blockNo := (uint64(next) - contentenc.HeaderLen) / cipherBS
+	return contentenc.HeaderLen + blockNo*cipherBS
+}
+
+// compressedFile checks the block index and the blocks of a compressed file
+// Compressed files cannot be repaired in place because the blocks have
+// variable length, so they are quarantined as a whole.
+func (ck *Checker) compressedFile(dirfd int, cName string, f *os.File, size uint64, ce *contentenc.ContentEnc, h *contentenc.FileHeader, e entry) {
+	if ck.args.Compression == "" {
+		// Not damaged, just unreadable without -compress. Do not quarantine.
+		ck.problem(e, ClassHeader, fmt.Errorf("compressed file, but compression is not enabled"))
+		return
+	}
+	index, err := ce.ReadBlockIndex(f, size)
+	if err != nil {
+		ck.headerProblem(dirfd, cName, e, err)
+		return
+	}
+	for blockNo, l := range index.CipherLen {
+		if ck.Aborted() {
+			return
+		}
+		b := uint64(blockNo)
+		block := make([]byte, l)
+		if _, err := f.ReadAt(block, int64(index.BlockCipherOff(b))); err != nil {
+			ck.ioProblem(e, err)
+			return
+		}
+		if _, err := ce.DecryptCompressedBlock(block, b, h.ID, ce.BlockPlainLen(index.PlainSize, b)); err != nil {
+			p := Problem{Path: e.pPath, CipherPath: e.cPath, Class: ClassBlock, Block: b, Err: err}
+			if ck.Repair {
+				p.Repaired = ck.quarantine(dirfd, cName, e)
+			}
+			ck.addProblem(p)
+			if p.Repaired != "" {
+				return
+			}
+		}
+	}
+}
+
+// symlink checks that the target of the symlink "cName" can be decrypted
+func (ck *Checker) symlink(dirfd int, cName string, e entry) {
+	cTarget, err := syscallcompat.Readlinkat(dirfd, cName)
+	if err != nil {
+		ck.ioProblem(e, err)
+		return
+	}
+	if ck.args.PlaintextNames || cTarget == "" {
+		return
+	}
+	cData, err := ck.nameTransform.B64DecodeString(cTarget)
+	if err == nil {
+		_, err = ck.contentEnc.DecryptBlock(cData, 0, nil)
+	}
+	if err != nil {
+		p := Problem{Path: e.pPath, CipherPath: e.cPath, Class: ClassSymlink, Err: err}
+		if ck.Repair {
+			p.Repaired = ck.quarantine(dirfd, cName, e)
+		}
+		ck.addProblem(p)
+	}
+}
+
+// xattrs checks that names and values of all gocryptfs xattrs on "e" can be
+// decrypted
+func (ck *Checker) xattrs(e entry) {
+	path := ck.abs(e)
+	attrs, err := syscallcompat.Llistxattr(path)
+	if err != nil {
+		if err == syscall.EOPNOTSUPP {
+			return
+		}
+		ck.ioProblem(e, err)
+		return
+	}
+	for _, cAttr := range attrs {
+		if len(cAttr) <= len(xattrStorePrefix) || cAttr[:len(xattrStorePrefix)] != xattrStorePrefix {
+			continue
+		}
+		attr, err := ck.nameTransform.DecryptXattrName(cAttr[len(xattrStorePrefix):])
+		if err != nil {
+			ck.xattrProblem(e, cAttr, fmt.Errorf("name %q: %v", cAttr, err))
+			continue
+		}
+		cData, err := syscallcompat.Lgetxattr(path, cAttr)
+		if err != nil {
+			ck.ioProblem(e, err)
+			continue
+		}
+		if err = ck.decryptXattrValue(cData); err != nil {
+			ck.xattrProblem(e, cAttr, fmt.Errorf("value of %q: %v", attr, err))
+		}
+	}
+}
+
+// xattrProblem records a problem with the xattr "cAttr" and removes the
+// xattr when repairing.
+func (ck *Checker) xattrProblem(e entry, cAttr string, err error) {
+	p := Problem{Path: e.pPath, CipherPath: e.cPath, Class: ClassXattr, Err: err}
+	if ck.Repair {
+		p.Repaired = ck.removeXattr(e, cAttr)
+	}
+	ck.addProblem(p)
+}
+
+// xattrStorePrefix is the prefix of the xattrs stored by fusefrontend
+const xattrStorePrefix = "user.gocryptfs."
+
+// decryptXattrValue tries to decrypt an xattr value like fusefrontend
+// does, including the base64 encoding of old filesystems.
+func (ck *Checker) decryptXattrValue(cData []byte) error {
+	if len(cData) == 0 {
+		return nil
+	}
+	_, err1 := ck.contentEnc.DecryptBlock(cData, 0, nil)
+	if err1 == nil {
+		return nil
+	}
+	cData, err2 := ck.nameTransform.B64DecodeString(string(cData))
+	if err2 != nil {
+		return err1
+	}
+	_, err := ck.contentEnc.DecryptBlock(cData, 0, nil)
+	return err
+}
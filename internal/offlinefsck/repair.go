@@ -0,0 +1,341 @@
+package offlinefsck
+
+// Repair actions for -fsck -repair. Each function returns a short description
+// of what was done, which ends up in Problem.Repaired, or "" if the problem
+// could not be repaired.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// LostFound is the plaintext name of the directory in the root of the
+// filesystem that receives entries that could not be repaired in place.
+const LostFound = "lost+found"
+
+// repairFailed logs why a repair action failed and returns "" for
+// Problem.Repaired.
+func repairFailed(e entry, err error) string {
+	tlog.Warn.Printf("fsck: repairing %q failed: %v", e.cPath, err)
+	return ""
+}
+
+// repairDirIV repairs the missing or invalid gocryptfs.diriv file in "dirfd".
+// A file that is too long is cut to its first 16 bytes. A file that is
+// missing or unusable is replaced by a new IV if the directory is empty, or
+// by the IV from the backup copy in RepairFrom. Otherwise the directory is
+// left alone, as a new IV would make the existing names undecryptable.
+// Files that cannot be read are never touched.
+func (ck *Checker) repairDirIV(dirfd int, e entry, cipherEntries []fuse.DirEntry) (iv []byte, action string) {
+	old, err := readDirIVRaw(dirfd)
+	if err != nil && err != syscall.ENOENT {
+		return nil, repairFailed(e, err)
+	}
+	if len(old) > nametransform.DirIVLen && !bytes.Equal(old[:nametransform.DirIVLen], make([]byte, nametransform.DirIVLen)) {
+		iv = old[:nametransform.DirIVLen]
+		if err = replaceDirIV(dirfd, iv); err != nil {
+			return nil, repairFailed(e, err)
+		}
+		return iv, "truncated gocryptfs.diriv"
+	}
+	empty := true
+	for _, ce := range cipherEntries {
+		if ce.Name == nametransform.DirIVFilename || nametransform.IsInternalName(ce.Name) {
+			continue
+		}
+		if e.cPath == "" && (ce.Name == configfile.ConfDefaultName || nametransform.IsReservedRootName(ce.Name)) {
+			continue
+		}
+		empty = false
+		break
+	}
+	action = "created new gocryptfs.diriv"
+	if empty {
+		iv = cryptocore.RandBytes(nametransform.DirIVLen)
+	} else {
+		if ck.RepairFrom == "" {
+			tlog.Info.Printf("fsck: %q: not creating a new gocryptfs.diriv, the names of the entries could not be decrypted anymore. Use -repair-from to restore it from a backup.", e.cPath)
+			return nil, ""
+		}
+		if iv, err = ck.backupDirIV(e); err != nil {
+			tlog.Info.Printf("fsck: no usable backup of %q: %v", e.cPath, err)
+			return nil, ""
+		}
+		action = "restored gocryptfs.diriv from backup"
+	}
+	if err = replaceDirIV(dirfd, iv); err != nil {
+		return nil, repairFailed(e, err)
+	}
+	return iv, action
+}
+
+// readDirIVRaw returns the content of the gocryptfs.diriv file in "dirfd"
+// without checking it, or the error that prevented reading it.
+func readDirIVRaw(dirfd int) ([]byte, error) {
+	fd, err := syscallcompat.Openat(dirfd, nametransform.DirIVFilename, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), nametransform.DirIVFilename)
+	defer f.Close()
+	// The file may be arbitrarily large
+	return ioutil.ReadAll(io.LimitReader(f, 4096))
+}
+
+// replaceDirIV atomically replaces the gocryptfs.diriv file in "dirfd" by
+// one containing "iv", so that the old file is kept if anything goes wrong.
+func replaceDirIV(dirfd int, iv []byte) error {
+	tmp := nametransform.DirIVTmpName
+	syscallcompat.Unlinkat(dirfd, tmp, 0)
+	fd, err := syscallcompat.Openat(dirfd, tmp, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW, 0400)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), tmp)
+	_, err = f.Write(iv)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = syscallcompat.Renameat(dirfd, tmp, dirfd, nametransform.DirIVFilename)
+	}
+	if err != nil {
+		syscallcompat.Unlinkat(dirfd, tmp, 0)
+	}
+	return err
+}
+
+// backupDirIV reads the gocryptfs.diriv file of "e" from the backup copy
+// of the encrypted directory in RepairFrom.
+func (ck *Checker) backupDirIV(e entry) ([]byte, error) {
+	fd, err := syscall.Open(filepath.Join(ck.RepairFrom, e.cPath), syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	return ck.nameTransform.ReadDirIVAt(fd)
+}
+
+// lostFound returns the directory fd and the entry of lost+found, creating it
+// on first use. The caller must hold repairLock.
+func (ck *Checker) lostFound() (int, entry, error) {
+	if ck.lfFd >= 0 {
+		return ck.lfFd, ck.lfEntry, nil
+	}
+	cName := LostFound
+	if !ck.args.PlaintextNames {
+		iv, err := ck.nameTransform.ReadDirIVAt(ck.rootFd)
+		if err != nil {
+			return -1, entry{}, err
+		}
+		cName, err = ck.nameTransform.EncryptAndHashName(LostFound, iv)
+		if err != nil {
+			return -1, entry{}, err
+		}
+	}
+	err := unix.Mkdirat(ck.rootFd, cName, 0700)
+	created := err == nil
+	if err != nil && err != syscall.EEXIST {
+		return -1, entry{}, err
+	}
+	fd, err := syscallcompat.Openat(ck.rootFd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return -1, entry{}, err
+	}
+	if !ck.args.PlaintextNames && !ck.args.DeterministicNames {
+		if created {
+			err = nametransform.WriteDirIVAt(fd)
+		} else {
+			// An existing lost+found keeps its IV, it may hold entries
+			_, err = ck.nameTransform.ReadDirIVAt(fd)
+		}
+		if err != nil {
+			syscall.Close(fd)
+			return -1, entry{}, err
+		}
+	}
+	ck.lfFd = fd
+	ck.lfEntry = entry{pPath: LostFound, cPath: cName}
+	return ck.lfFd, ck.lfEntry, nil
+}
+
+// errInternalFile is returned by moveToLostFound for internal files
+var errInternalFile = errors.New("internal file, not moving it")
+
+// isInternal returns true if "e" is a file gocryptfs uses internally, like
+// gocryptfs.conf or the converted copy of a compressed file. These are not
+// checked and never moved to lost+found.
+func (ck *Checker) isInternal(e entry) bool {
+	name := filepath.Base(e.cPath)
+	if filepath.Dir(e.cPath) == "." && (name == configfile.ConfDefaultName || nametransform.IsReservedRootName(name)) {
+		return true
+	}
+	if ck.args.PlaintextNames {
+		return false
+	}
+	if !ck.args.DeterministicNames && name == nametransform.DirIVFilename {
+		return true
+	}
+	return nametransform.IsInternalName(name)
+}
+
+// moveToLostFound moves the entry "cName" in "dirfd" to lost+found, where it
+// is named after its inode number. It returns the new location.
+func (ck *Checker) moveToLostFound(dirfd int, cName string, e entry) (newDirfd int, newCName string, newEntry entry, err error) {
+	if ck.isInternal(e) {
+		err = errInternalFile
+		return
+	}
+	ck.repairLock.Lock()
+	defer ck.repairLock.Unlock()
+	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return
+	}
+	lfFd, lfEntry, err := ck.lostFound()
+	if err != nil {
+		return
+	}
+	var lfIV []byte
+	if !ck.args.PlaintextNames {
+		if lfIV, err = ck.nameTransform.ReadDirIVAt(lfFd); err != nil {
+			return
+		}
+	}
+	var name string
+	for i := 0; ; i++ {
+		name = fmt.Sprintf("#%d", st.Ino)
+		if i > 0 {
+			name = fmt.Sprintf("#%d.%d", st.Ino, i)
+		}
+		newCName = name
+		if !ck.args.PlaintextNames {
+			if newCName, err = ck.nameTransform.EncryptAndHashName(name, lfIV); err != nil {
+				return
+			}
+		}
+		_, err = syscallcompat.Fstatat2(lfFd, newCName, unix.AT_SYMLINK_NOFOLLOW)
+		if err == syscall.ENOENT {
+			break
+		} else if err != nil {
+			return
+		}
+	}
+	if nametransform.IsLongContent(newCName) {
+		if err = ck.nameTransform.WriteLongNameAt(lfFd, newCName, name); err != nil {
+			return
+		}
+	}
+	if err = syscallcompat.Renameat(dirfd, cName, lfFd, newCName); err != nil {
+		return
+	}
+	if ck.args.LongNames && nametransform.IsLongContent(cName) {
+		// The .name file may be missing, that may be why we are here
+		syscallcompat.Unlinkat(dirfd, cName+nametransform.LongNameSuffix, 0)
+	}
+	newEntry = entry{
+		pPath: filepath.Join(lfEntry.pPath, name),
+		cPath: filepath.Join(lfEntry.cPath, newCName),
+	}
+	tlog.Debug.Printf("fsck: moved %q to %q", e.cPath, newEntry.cPath)
+	return lfFd, newCName, newEntry, nil
+}
+
+// quarantine moves a file whose content cannot be repaired to lost+found.
+// Files that are already in lost+found are left alone.
+func (ck *Checker) quarantine(dirfd int, cName string, e entry) string {
+	ck.repairLock.Lock()
+	_, lfEntry, err := ck.lostFound()
+	ck.repairLock.Unlock()
+	if err != nil {
+		return repairFailed(e, err)
+	}
+	if filepath.Dir(e.cPath) == lfEntry.cPath {
+		return ""
+	}
+	_, _, newEntry, err := ck.moveToLostFound(dirfd, cName, e)
+	if err != nil {
+		return repairFailed(e, err)
+	}
+	return "moved to " + newEntry.pPath
+}
+
+// blockWriter repairs bad blocks of a single file. The file is opened for
+// writing on first use.
+type blockWriter struct {
+	dirfd int
+	cName string
+	e     entry
+	ce    *contentenc.ContentEnc
+	h     *contentenc.FileHeader
+	f     *os.File
+}
+
+func (w *blockWriter) open() error {
+	if w.f != nil {
+		return nil
+	}
+	fd, err := syscallcompat.Openat(w.dirfd, w.cName, syscall.O_WRONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	w.f = os.NewFile(uintptr(fd), w.cName)
+	return nil
+}
+
+// zeroFill replaces the bad block "blockNo" of length "blockLen" at
+// ciphertext offset "off" by an encrypted all-zero block. An incomplete last
+// block that does not even hold the block overhead is cut off.
+func (w *blockWriter) zeroFill(blockNo uint64, blockLen int, off uint64) string {
+	if err := w.open(); err != nil {
+		return repairFailed(w.e, err)
+	}
+	if uint64(blockLen) <= w.ce.BlockOverhead() {
+		if err := w.f.Truncate(int64(off)); err != nil {
+			return repairFailed(w.e, err)
+		}
+		return "truncated incomplete block"
+	}
+	zeros := make([]byte, uint64(blockLen)-w.ce.BlockOverhead())
+	block, err := w.ce.EncryptBlock(zeros, blockNo, w.h.ID)
+	if err != nil {
+		return repairFailed(w.e, err)
+	}
+	if _, err := w.f.WriteAt(block, int64(off)); err != nil {
+		return repairFailed(w.e, err)
+	}
+	return "zero-filled"
+}
+
+func (w *blockWriter) close() {
+	if w.f != nil {
+		w.f.Close()
+	}
+}
+
+// removeXattr deletes the extended attribute "cAttr" that cannot be decrypted
+func (ck *Checker) removeXattr(e entry, cAttr string) string {
+	if err := unix.Lremovexattr(ck.abs(e), cAttr); err != nil {
+		return repairFailed(e, err)
+	}
+	return "removed"
+}
@@ -0,0 +1,108 @@
+package offlinefsck
+
+// Entry types for Entry.Type
+const (
+	TypeDir     = "dir"
+	TypeFile    = "file"
+	TypeSymlink = "symlink"
+)
+
+// Entry is a directory, file or symlink that has been checked
+type Entry struct {
+	// Path is the relative plaintext path, see Problem.Path
+	Path string `json:"path"`
+	// CipherPath is the relative path in the encrypted directory
+	CipherPath string `json:"cipher_path"`
+	// Type is TypeDir, TypeFile or TypeSymlink. Empty for entries that
+	// only exist in the report because a problem was found there.
+	Type string `json:"type,omitempty"`
+	// Unchanged is set for files that were skipped because they are
+	// unchanged since the run that wrote PrevState
+	Unchanged bool `json:"unchanged,omitempty"`
+	// Problems found at this entry
+	Problems []ReportProblem `json:"problems,omitempty"`
+}
+
+// ReportProblem is a Problem in the Report
+type ReportProblem struct {
+	Class Class `json:"class"`
+	// Block is set for ClassBlock
+	Block    *uint64 `json:"block,omitempty"`
+	Error    string  `json:"error"`
+	Repaired string  `json:"repaired,omitempty"`
+}
+
+// ReportTotals summarizes the Report
+type ReportTotals struct {
+	Dirs      int           `json:"dirs"`
+	Files     int           `json:"files"`
+	Symlinks  int           `json:"symlinks"`
+	Unchanged int           `json:"unchanged"`
+	Problems  int           `json:"problems"`
+	Repaired  int           `json:"repaired"`
+	Skipped   int           `json:"skipped"`
+	ByClass   map[Class]int `json:"by_class"`
+}
+
+// Report is the machine-readable result of a check
+type Report struct {
+	Cipherdir string  `json:"cipherdir"`
+	Aborted   bool    `json:"aborted,omitempty"`
+	Entries   []Entry `json:"entries"`
+	// Skipped lists the relative ciphertext paths that could not be checked
+	// due to missing permissions
+	Skipped []string     `json:"skipped"`
+	Totals  ReportTotals `json:"totals"`
+}
+
+// NewReport builds the report from "entries", which have been collected via
+// the Checked callback, and the problems found by the Checker.
+func (ck *Checker) NewReport(entries []Entry) *Report {
+	ck.lock.Lock()
+	defer ck.lock.Unlock()
+	r := &Report{
+		Cipherdir: ck.args.Cipherdir,
+		Aborted:   ck.Aborted(),
+		Entries:   entries,
+		Skipped:   append([]string{}, ck.Skipped...),
+	}
+	r.Totals.ByClass = make(map[Class]int)
+	r.Totals.Skipped = len(ck.Skipped)
+	index := make(map[string]int, len(entries))
+	for i, e := range entries {
+		index[e.CipherPath] = i
+		switch e.Type {
+		case TypeDir:
+			r.Totals.Dirs++
+		case TypeFile:
+			r.Totals.Files++
+		case TypeSymlink:
+			r.Totals.Symlinks++
+		}
+		if e.Unchanged {
+			r.Totals.Unchanged++
+		}
+	}
+	for _, p := range ck.Problems {
+		rp := ReportProblem{Class: p.Class, Error: p.Err.Error(), Repaired: p.Repaired}
+		if p.Class == ClassBlock {
+			b := p.Block
+			rp.Block = &b
+		}
+		i, ok := index[p.CipherPath]
+		if !ok {
+			// Problem at an entry that was not checked, like an orphaned
+			// .name file or an entry that was moved to lost+found.
+			i = len(r.Entries)
+			index[p.CipherPath] = i
+			r.Entries = append(r.Entries, Entry{Path: p.Path, CipherPath: p.CipherPath})
+		}
+		r.Entries[i].Problems = append(r.Entries[i].Problems, rp)
+		r.Totals.Problems++
+		r.Totals.ByClass[p.Class]++
+		if p.Repaired != "" {
+			r.Totals.Repaired++
+		}
+	}
+	return r
+}
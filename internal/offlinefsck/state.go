@@ -0,0 +1,80 @@
+package offlinefsck
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// stateVersion is the version of the state file format
+const stateVersion = 1
+
+// FileState is what we remember about a file that was found clean
+type FileState struct {
+	Size  int64
+	Mtime int64 // nanoseconds
+	Ino   uint64
+}
+
+// State lists the files that were found clean, keyed by the relative
+// ciphertext path. It only contains ciphertext names and can be stored
+// unencrypted.
+type State struct {
+	Version int
+	Files   map[string]FileState
+}
+
+// NewState returns an empty State
+func NewState() *State {
+	return &State{Version: stateVersion, Files: make(map[string]FileState)}
+}
+
+// LoadState reads the state file "filename". A file that does not exist
+// yields an empty State.
+func LoadState(filename string) (*State, error) {
+	js, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return NewState(), nil
+	} else if err != nil {
+		return nil, err
+	}
+	s := NewState()
+	if err = json.Unmarshal(js, s); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	if s.Version != stateVersion {
+		return nil, fmt.Errorf("%s: unsupported version %d", filename, s.Version)
+	}
+	if s.Files == nil {
+		s.Files = make(map[string]FileState)
+	}
+	return s, nil
+}
+
+// Save writes the state to "filename.tmp" and renames it over "filename",
+// so an interrupted write does not lose the previous state.
+func (s *State) Save(filename string) error {
+	js, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err = os.WriteFile(tmp, js, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+func fileState(st *syscall.Stat_t) FileState {
+	// fuse.Attr hides the differences between Linux and macOS
+	var a fuse.Attr
+	a.FromStat(st)
+	return FileState{
+		Size:  int64(a.Size),
+		Mtime: int64(a.Mtime)*1e9 + int64(a.Mtimensec),
+		Ino:   a.Ino,
+	}
+}
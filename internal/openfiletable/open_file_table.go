@@ -8,6 +8,7 @@ import (
 	"sync"
 	"sync/atomic"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/v2/internal/inomap"
 )
 
@@ -45,6 +46,11 @@ type Entry struct {
 	ContentLock countingMutex
 	// ID is the file ID in the file header.
 	ID []byte
+	// Epoch is the key epoch in the file header. Protected by IDLock like ID.
+	Epoch uint32
+	// Index is the block index of a compressed file, nil for normal files.
+	// Protected by IDLock like ID.
+	Index *contentenc.BlockIndex
 	// IDLock must be taken before reading or writing the ID field in this struct,
 	// unless you have an exclusive lock on ContentLock.
 	IDLock sync.Mutex
@@ -101,3 +107,21 @@ func CountOpenFiles() int {
 	defer t.Unlock()
 	return len(t.entries)
 }
+
+// OpenFile is an entry in the list returned by List
+type OpenFile struct {
+	QIno     inomap.QIno
+	RefCount int
+}
+
+// List returns the entries that are currently in the table, in no particular
+// order.
+func List() []OpenFile {
+	t.Lock()
+	defer t.Unlock()
+	l := make([]OpenFile, 0, len(t.entries))
+	for qi, e := range t.entries {
+		l = append(l, OpenFile{QIno: qi, RefCount: e.refCount})
+	}
+	return l
+}
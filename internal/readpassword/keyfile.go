@@ -0,0 +1,68 @@
+package readpassword
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// GeneratedKeyfileLen is the size of the key files written by
+// GenerateKeyfile.
+const GeneratedKeyfileLen = 64
+
+// maxKeyfileLen limits how much we read from a key file. Key files are
+// usually 32 or 64 bytes, 1MiB leaves plenty of room.
+const maxKeyfileLen = 1024 * 1024
+
+// Keyfile reads the complete contents of the binary key file "path".
+// Contrary to passfiles, newlines are not special.
+func Keyfile(path string) ([]byte, error) {
+	tlog.Info.Printf("keyfile: reading from file %q", path)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("fatal: keyfile: could not open %q: %v", path, err)
+	}
+	defer f.Close()
+	// +1 so we can detect if maxKeyfileLen is exceeded
+	buf, err := ioutil.ReadAll(io.LimitReader(f, maxKeyfileLen+1))
+	if err != nil {
+		return nil, fmt.Errorf("fatal: keyfile: could not read from %q: %v", path, err)
+	}
+	if len(buf) == 0 {
+		return nil, fmt.Errorf("fatal: keyfile: %q is empty", path)
+	}
+	if len(buf) > maxKeyfileLen {
+		return nil, fmt.Errorf("fatal: keyfile: max key file length (%d bytes) exceeded", maxKeyfileLen)
+	}
+	return buf, nil
+}
+
+// GenerateKeyfile writes a new random key file to "path". The file must not
+// exist yet, and is only readable by its owner.
+func GenerateKeyfile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	if err != nil {
+		return fmt.Errorf("fatal: keyfile: could not create %q: %v", path, err)
+	}
+	key := cryptocore.RandBytes(GeneratedKeyfileLen)
+	_, err = f.Write(key)
+	for i := range key {
+		key[i] = 0
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("fatal: keyfile: could not write %q: %v", path, err)
+	}
+	tlog.Info.Printf("keyfile: wrote new key file %q", path)
+	return nil
+}
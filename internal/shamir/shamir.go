@@ -0,0 +1,207 @@
+// Package shamir implements Shamir's secret sharing over GF(2^8), used to
+// split the master key into shares so that no single person holds the full
+// recovery key.
+//
+// Shares are exchanged as text in this format:
+//
+//	<threshold>-<x>-<y, hex, in chunks of 8 digits>-<checksum>
+//
+// The checksum is the first four bytes of the SHA-256 hash of the secret. It
+// is the same in all shares and lets Combine() detect typos and shares that
+// belong to different secrets.
+package shamir
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+)
+
+// checksumLen is the length of the secret checksum in bytes
+const checksumLen = 4
+
+// exp and log tables for GF(2^8) with the AES polynomial x^8+x^4+x^3+x+1,
+// using 3 as the generator.
+var gfExp [510]byte
+var gfLog [256]byte
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = byte(i)
+		// Multiply by 3 = x*2 ^ x
+		x2 := x << 1
+		if x2&0x100 != 0 {
+			x2 ^= 0x11b
+		}
+		x = x2 ^ x
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if b == 0 {
+		panic("shamir: division by zero")
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// Share is one share of a secret
+type Share struct {
+	// Threshold is the number of shares needed to reconstruct the secret
+	Threshold int
+	// X is the x coordinate, 1...255
+	X byte
+	// Y holds the polynomials evaluated at X, one byte per secret byte
+	Y []byte
+	// Checksum is the first bytes of the SHA-256 hash of the secret
+	Checksum []byte
+}
+
+// String encodes the share in the text format described in the package
+// documentation.
+func (s *Share) String() string {
+	h := hex.EncodeToString(s.Y)
+	var chunks []string
+	for i := 0; i < len(h); i += 8 {
+		end := i + 8
+		if end > len(h) {
+			end = len(h)
+		}
+		chunks = append(chunks, h[i:end])
+	}
+	return fmt.Sprintf("%d-%d-%s-%s", s.Threshold, s.X, strings.Join(chunks, "-"), hex.EncodeToString(s.Checksum))
+}
+
+// Parse decodes a share in the text format. Whitespace is ignored.
+func Parse(text string) (*Share, error) {
+	text = strings.Join(strings.Fields(text), "")
+	parts := strings.Split(text, "-")
+	if len(parts) < 4 {
+		return nil, fmt.Errorf("share %q: too few fields", text)
+	}
+	threshold, err := strconv.Atoi(parts[0])
+	if err != nil || threshold < 2 || threshold > 255 {
+		return nil, fmt.Errorf("share %q: invalid threshold %q", text, parts[0])
+	}
+	x, err := strconv.Atoi(parts[1])
+	if err != nil || x < 1 || x > 255 {
+		return nil, fmt.Errorf("share %q: invalid x coordinate %q", text, parts[1])
+	}
+	y, err := hex.DecodeString(strings.Join(parts[2:len(parts)-1], ""))
+	if err != nil || len(y) == 0 {
+		return nil, fmt.Errorf("share %q: invalid hex data", text)
+	}
+	sum, err := hex.DecodeString(parts[len(parts)-1])
+	if err != nil || len(sum) != checksumLen {
+		return nil, fmt.Errorf("share %q: invalid checksum", text)
+	}
+	return &Share{Threshold: threshold, X: byte(x), Y: y, Checksum: sum}, nil
+}
+
+// Split splits "secret" into "n" shares. Any "threshold" of them are needed
+// to reconstruct the secret, fewer reveal nothing about it.
+func Split(secret []byte, n int, threshold int) ([]*Share, error) {
+	if threshold < 2 || n < threshold || n > 255 {
+		return nil, fmt.Errorf("invalid share parameters %d-of-%d: need 2 <= threshold <= n <= 255", threshold, n)
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("empty secret")
+	}
+	sum := checksum(secret)
+	shares := make([]*Share, n)
+	for i := range shares {
+		shares[i] = &Share{
+			Threshold: threshold,
+			X:         byte(i + 1),
+			Y:         make([]byte, len(secret)),
+			Checksum:  sum,
+		}
+	}
+	// One random polynomial of degree threshold-1 per secret byte. The
+	// constant term is the secret byte.
+	coeffs := make([]byte, threshold)
+	for b := range secret {
+		coeffs[0] = secret[b]
+		copy(coeffs[1:], cryptocore.RandBytes(threshold-1))
+		for _, s := range shares {
+			// Horner's method
+			var y byte
+			for c := threshold - 1; c >= 0; c-- {
+				y = gfMul(y, s.X) ^ coeffs[c]
+			}
+			s.Y[b] = y
+		}
+	}
+	for i := range coeffs {
+		coeffs[i] = 0
+	}
+	return shares, nil
+}
+
+// Combine reconstructs the secret from "shares". Returns an error if there
+// are fewer shares than the threshold, or if the checksum does not match.
+func Combine(shares []*Share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, fmt.Errorf("no shares")
+	}
+	threshold := shares[0].Threshold
+	if len(shares) < threshold {
+		return nil, fmt.Errorf("need %d shares, have %d", threshold, len(shares))
+	}
+	// More shares than needed do not help
+	shares = shares[:threshold]
+	seen := make(map[byte]bool)
+	for _, s := range shares {
+		if s.Threshold != threshold || len(s.Y) != len(shares[0].Y) ||
+			string(s.Checksum) != string(shares[0].Checksum) {
+			return nil, fmt.Errorf("share %d does not belong to the same secret as share %d", s.X, shares[0].X)
+		}
+		if seen[s.X] {
+			return nil, fmt.Errorf("share %d was given twice", s.X)
+		}
+		seen[s.X] = true
+	}
+	secret := make([]byte, len(shares[0].Y))
+	// Lagrange interpolation at x=0
+	for i, si := range shares {
+		// l_i(0) = prod_{j != i} x_j / (x_j - x_i)
+		var l byte = 1
+		for j, sj := range shares {
+			if i == j {
+				continue
+			}
+			l = gfMul(l, gfDiv(sj.X, sj.X^si.X))
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(l, si.Y[b])
+		}
+	}
+	if string(checksum(secret)) != string(shares[0].Checksum) {
+		for i := range secret {
+			secret[i] = 0
+		}
+		return nil, fmt.Errorf("checksum mismatch, at least one share is wrong")
+	}
+	return secret, nil
+}
+
+func checksum(secret []byte) []byte {
+	h := sha256.Sum256(secret)
+	return h[:checksumLen]
+}
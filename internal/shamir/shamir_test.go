@@ -0,0 +1,67 @@
+package shamir
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	shares, err := Split(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every subset of 3 shares works, also after a text round trip
+	for a := 0; a < 5; a++ {
+		for b := a + 1; b < 5; b++ {
+			for c := b + 1; c < 5; c++ {
+				var subset []*Share
+				for _, i := range []int{c, a, b} {
+					s, err := Parse(shares[i].String())
+					if err != nil {
+						t.Fatal(err)
+					}
+					subset = append(subset, s)
+				}
+				out, err := Combine(subset)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(out, secret) {
+					t.Errorf("shares %d %d %d: wrong secret %x", a, b, c, out)
+				}
+			}
+		}
+	}
+	// Two shares are not enough
+	if _, err := Combine(shares[:2]); err == nil {
+		t.Error("combining 2 of 3 shares should fail")
+	}
+	// The same share twice does not count
+	if _, err := Combine([]*Share{shares[0], shares[0], shares[1]}); err == nil {
+		t.Error("duplicate shares should fail")
+	}
+	// A typo is detected by the checksum
+	bad := *shares[1]
+	bad.Y = append([]byte{}, bad.Y...)
+	bad.Y[0] ^= 1
+	if _, err := Combine([]*Share{shares[0], &bad, shares[2]}); err == nil {
+		t.Error("corrupt share should fail")
+	}
+}
+
+func TestSplitInvalid(t *testing.T) {
+	for _, p := range [][2]int{{1, 1}, {2, 3}, {256, 2}} {
+		if _, err := Split([]byte("x"), p[0], p[1]); err == nil {
+			t.Errorf("Split with n=%d threshold=%d should fail", p[0], p[1])
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, s := range []string{"", "2-1-abcd", "1-1-abcd-00000000", "2-0-abcd-00000000", "2-1-xyz-00000000"} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("Parse(%q) should fail", s)
+		}
+	}
+}
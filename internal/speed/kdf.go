@@ -0,0 +1,38 @@
+package speed
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+)
+
+// RunKDF times the password hashes at a few cost settings to help with
+// picking "-scryptn" and the "-argon2id-*" parameters. This takes a few
+// seconds and up to 256 MiB of memory.
+func RunKDF() {
+	pw := []byte("speed test password")
+	for _, logN := range []int{10, 12, 14, configfile.ScryptDefaultLogN, 18} {
+		s := configfile.NewScryptKDF(logN)
+		name := fmt.Sprintf("scrypt logN=%d", logN)
+		printKDF(name, logN == configfile.ScryptDefaultLogN, func() { s.DeriveKey(pw) })
+	}
+	for _, m := range []uint32{16 * 1024, configfile.Argon2idDefaultMemory, 256 * 1024} {
+		a := configfile.NewArgon2idKDF(m, 0, 0)
+		name := fmt.Sprintf("argon2id m=%dMiB t=%d p=%d", a.Memory/1024, a.Iterations, a.Parallelism)
+		printKDF(name, m == configfile.Argon2idDefaultMemory, func() { a.DeriveKey(pw) })
+	}
+}
+
+// printKDF runs "f" once and prints how long it took.
+func printKDF(name string, isDefault bool, f func()) {
+	fmt.Printf("%-26s\t", name)
+	t0 := time.Now()
+	f()
+	fmt.Printf("%7d ms", time.Since(t0).Milliseconds())
+	if isDefault {
+		fmt.Printf("\t(default)\n")
+	} else {
+		fmt.Printf("\n")
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"golang.org/x/crypto/chacha20poly1305"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/gcmsiv"
 	"github.com/rfjakob/gocryptfs/v2/internal/siv_aead"
 	"github.com/rfjakob/gocryptfs/v2/internal/stupidgcm"
 )
@@ -26,6 +27,7 @@ const adLen = 24
 const gocryptfsBlockSize = 4096
 
 // Run - run the speed the test and print the results.
+// Also prints the time the password hashes take.
 func Run() {
 	cpu := cpuModelName()
 	if cpu == "" {
@@ -45,6 +47,7 @@ func Run() {
 		{name: cryptocore.BackendOpenSSL.String(), f: bStupidGCM, preferred: stupidgcm.PreferOpenSSLAES256GCM()},
 		{name: cryptocore.BackendGoGCM.String(), f: bGoGCM, preferred: !stupidgcm.PreferOpenSSLAES256GCM()},
 		{name: cryptocore.BackendAESSIV.String(), f: bAESSIV, preferred: false},
+		{name: cryptocore.BackendAESGCMSIV.String(), f: bAESGCMSIV, preferred: false},
 		{name: cryptocore.BackendXChaCha20Poly1305OpenSSL.String(), f: bStupidXchacha, preferred: stupidgcm.PreferOpenSSLXchacha20poly1305()},
 		{name: cryptocore.BackendXChaCha20Poly1305.String(), f: bXchacha20poly1305, preferred: !stupidgcm.PreferOpenSSLXchacha20poly1305()},
 	}
@@ -155,6 +158,12 @@ func bAESSIV(b *testing.B) {
 	bEncrypt(b, c)
 }
 
+// bAESGCMSIV benchmarks AES-GCM-SIV from internal/gcmsiv
+func bAESGCMSIV(b *testing.B) {
+	c := gcmsiv.New(randBytes(gcmsiv.KeyLen))
+	bEncrypt(b, c)
+}
+
 // bXchacha20poly1305 benchmarks XChaCha20 from golang.org/x/crypto/chacha20poly1305
 func bXchacha20poly1305(b *testing.B) {
 	c, _ := chacha20poly1305.NewX(randBytes(32))
@@ -8,6 +8,7 @@ import (
 
 	"golang.org/x/crypto/chacha20poly1305"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/gcmsiv"
 	"github.com/rfjakob/gocryptfs/v2/internal/siv_aead"
 	"github.com/rfjakob/gocryptfs/v2/internal/stupidgcm"
 )
@@ -66,6 +67,14 @@ func BenchmarkAESSIVDecrypt(b *testing.B) {
 	bEncrypt(b, siv_aead.New(randBytes(64)))
 }
 
+func BenchmarkAESGCMSIV(b *testing.B) {
+	bAESGCMSIV(b)
+}
+
+func BenchmarkAESGCMSIVDecrypt(b *testing.B) {
+	bDecrypt(b, gcmsiv.New(randBytes(gcmsiv.KeyLen)))
+}
+
 func BenchmarkXchacha(b *testing.B) {
 	bXchacha20poly1305(b)
 }
@@ -0,0 +1,51 @@
+package syscallcompat
+
+import (
+	"io"
+	"os"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// CopyOver copies the content of "src" over "dst" and syncs "dst". Unlike
+// renaming "src" over "dst", this keeps the inode, hard links and xattrs of
+// "dst". The space is allocated first, so running out of space does not
+// leave a half-copied file behind.
+func CopyOver(src *os.File, dst *os.File) error {
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	if err = EnospcPrealloc(int(dst.Fd()), 0, fi.Size()); err != nil {
+		return err
+	}
+	buf := make([]byte, fuse.MAX_KERNEL_WRITE)
+	for off := int64(0); ; {
+		n, err := src.ReadAt(buf, off)
+		if n > 0 {
+			if _, err2 := dst.WriteAt(buf[:n], off); err2 != nil {
+				return err2
+			}
+			off += int64(n)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	if err = dst.Truncate(fi.Size()); err != nil {
+		return err
+	}
+	return dst.Sync()
+}
+
+// SyncDir fsyncs the directory "dir" to persist a rename
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/fido2"
+	"github.com/rfjakob/gocryptfs/v2/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// unlockKeySlots decrypts the masterkey of a filesystem that uses key slots,
+// using the credential given on the command line (-keyfile, -fido2, or a
+// password). Returns the masterkey and the index of the matching key slot.
+func unlockKeySlots(args *argContainer, cf *configfile.ConfFile) ([]byte, int, error) {
+	if args.keyfile != "" {
+		secret, err := readpassword.Keyfile(args.keyfile)
+		if err != nil {
+			tlog.Fatal.Println(err)
+			return nil, -1, exitcodes.NewErr("", exitcodes.ReadPassword)
+		}
+		defer wipe(secret)
+		if hasKeySlotType(cf, configfile.KeySlotKeyfile) {
+			tlog.Info.Println("Decrypting master key")
+			masterkey, slot, err := cf.DecryptMasterKeySlots(configfile.KeySlotKeyfile, secret)
+			if err == nil || !hasKeySlotType(cf, configfile.KeySlotKeyfilePassword) {
+				return masterkey, slot, err
+			}
+		}
+		return unlockKeyfilePassword(args, cf, secret)
+	}
+	if args.fido2 != "" {
+		// fido2.Secret() exits when the credential is not on the token, so we
+		// cannot just try all FIDO2 slots.
+		slot := -1
+		for i, s := range cf.KeySlots {
+			if s.Type != configfile.KeySlotFIDO2 {
+				continue
+			}
+			if args.key_name != "" && args.key_name != s.Name {
+				continue
+			}
+			if slot >= 0 {
+				tlog.Fatal.Printf("There are multiple FIDO2 key slots; select one using -key-name.")
+				return nil, -1, exitcodes.NewErr("", exitcodes.Usage)
+			}
+			slot = i
+		}
+		if slot < 0 {
+			tlog.Fatal.Printf("No matching FIDO2 key slot found.")
+			return nil, -1, exitcodes.NewErr("", exitcodes.Usage)
+		}
+		p := cf.KeySlots[slot].FIDO2
+		secret := fido2.Secret(args.fido2, p.AssertOptions, p.CredentialID, p.HMACSalt)
+		tlog.Info.Println("Decrypting master key")
+		masterkey, err := cf.DecryptMasterKeySlot(slot, secret)
+		wipe(secret)
+		return masterkey, slot, err
+	}
+	pw, err := readpassword.Once([]string(args.extpass), []string(args.passfile), "")
+	if err != nil {
+		tlog.Fatal.Println(err)
+		return nil, -1, exitcodes.NewErr("", exitcodes.ReadPassword)
+	}
+	tlog.Info.Println("Decrypting master key")
+	masterkey, slot, err := cf.DecryptMasterKeySlots(configfile.KeySlotPassword, pw)
+	wipe(pw)
+	return masterkey, slot, err
+}
+
+// unlockKeyfilePassword tries the keyfile+password key slots using the key
+// file contents "keyfile" and a password read from the user.
+func unlockKeyfilePassword(args *argContainer, cf *configfile.ConfFile, keyfile []byte) ([]byte, int, error) {
+	if !hasKeySlotType(cf, configfile.KeySlotKeyfilePassword) {
+		return nil, -1, exitcodes.NewErr("No key slot for key files.", exitcodes.PasswordIncorrect)
+	}
+	pw, err := readpassword.Once([]string(args.extpass), []string(args.passfile), "")
+	if err != nil {
+		tlog.Fatal.Println(err)
+		return nil, -1, exitcodes.NewErr("", exitcodes.ReadPassword)
+	}
+	defer wipe(pw)
+	tlog.Info.Println("Decrypting master key")
+	for i, s := range cf.KeySlots {
+		if s.Type != configfile.KeySlotKeyfilePassword {
+			continue
+		}
+		masterkey, err := cf.DecryptMasterKeySlotPassword(i, keyfile, pw)
+		if err == nil {
+			return masterkey, i, nil
+		}
+	}
+	return nil, -1, exitcodes.NewErr("Key file or password incorrect.", exitcodes.PasswordIncorrect)
+}
+
+// hasKeySlotType returns true if "cf" has a key slot of type "slotType".
+func hasKeySlotType(cf *configfile.ConfFile, slotType string) bool {
+	for _, s := range cf.KeySlots {
+		if s.Type == slotType {
+			return true
+		}
+	}
+	return false
+}
+
+// passwdKeySlot returns the index of the key slot whose password "-passwd"
+// should change. Exits on error.
+func passwdKeySlot(args *argContainer, cf *configfile.ConfFile) int {
+	slot := args._keySlot
+	if args.key_name != "" {
+		slot = cf.KeySlotIndex(args.key_name)
+		if slot < 0 {
+			tlog.Fatal.Printf("Key slot %q does not exist", args.key_name)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if slot < 0 {
+		tlog.Fatal.Printf("Cannot determine which key slot to change; select one using -key-name.")
+		os.Exit(exitcodes.Usage)
+	}
+	if t := cf.KeySlots[slot].Type; t != configfile.KeySlotPassword {
+		tlog.Fatal.Printf("Key slot %q is of type %q. Only password key slots can be changed, use -add-key and -remove-key instead.",
+			cf.KeySlots[slot].Name, t)
+		os.Exit(exitcodes.Usage)
+	}
+	return slot
+}
+
+// addKey - add a key slot to the config file. The new key slot is protected
+// by the key file given by "-new-keyfile", the FIDO2 token given by
+// "-new-fido2", or by a password.
+// Does not return (calls os.Exit both on success and on error).
+func addKey(args *argContainer) {
+	if args.key_name == "" {
+		tlog.Fatal.Printf("-add-key needs a name for the new key slot, pass it using -key-name.")
+		os.Exit(exitcodes.Usage)
+	}
+	masterkey, cf, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	ks := configfile.KeySlotSecret{
+		Name:     args.key_name,
+		LogN:     args.scryptn,
+		Argon2id: argon2idArgs(args),
+	}
+	if args.new_keyfile != "" {
+		ks.Type = configfile.KeySlotKeyfile
+		ks.Secret, err = readpassword.Keyfile(args.new_keyfile)
+		if err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(exitcodes.ReadPassword)
+		}
+		if args.keyfile_password {
+			ks.Type = configfile.KeySlotKeyfilePassword
+			tlog.Info.Println("Please enter the password for the new key slot.")
+			ks.Password, err = readpassword.Twice([]string(args.extpass), []string(args.passfile))
+			if err != nil {
+				tlog.Fatal.Println(err)
+				os.Exit(exitcodes.ReadPassword)
+			}
+		}
+	} else if args.new_fido2 != "" {
+		ks.Type = configfile.KeySlotFIDO2
+		ks.FIDO2 = &configfile.FIDO2Params{
+			CredentialID:  fido2.Register(args.new_fido2, filepath.Base(args.cipherdir)),
+			HMACSalt:      cryptocore.RandBytes(32),
+			AssertOptions: args.fido2_assert_options,
+		}
+		ks.Secret = fido2.Secret(args.new_fido2, ks.FIDO2.AssertOptions, ks.FIDO2.CredentialID, ks.FIDO2.HMACSalt)
+	} else {
+		ks.Type = configfile.KeySlotPassword
+		tlog.Info.Println("Please enter the password for the new key slot.")
+		ks.Secret, err = readpassword.Twice([]string(args.extpass), []string(args.passfile))
+		if err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(exitcodes.ReadPassword)
+		}
+	}
+	err = cf.AddKeySlot(masterkey, &ks)
+	wipe(ks.Secret)
+	wipe(ks.Password)
+	wipe(masterkey)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		exitcodes.Exit(err)
+	}
+	if err = cf.WriteFile(); err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Key slot %q added."+tlog.ColorReset, args.key_name)
+}
+
+// removeKey - remove the key slot given by "-key-name" from the config file.
+// Unlocking with any key slot (or -masterkey) authorizes the removal.
+// Does not return (calls os.Exit both on success and on error).
+func removeKey(args *argContainer) {
+	if args.key_name == "" {
+		tlog.Fatal.Printf("-remove-key needs the name of the key slot, pass it using -key-name.")
+		os.Exit(exitcodes.Usage)
+	}
+	masterkey, cf, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	wipe(masterkey)
+	if !cf.IsFeatureFlagSet(configfile.FlagKeySlots) {
+		tlog.Fatal.Printf("This filesystem has no key slots.")
+		os.Exit(exitcodes.Usage)
+	}
+	if err = cf.RemoveKeySlot(args.key_name); err != nil {
+		tlog.Fatal.Println(err)
+		exitcodes.Exit(err)
+	}
+	if err = cf.WriteFile(); err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Key slot %q removed."+tlog.ColorReset, args.key_name)
+}
+
+// listKeys prints the key slots of the config file at "filename".
+// This is called when you pass the "-list-keys" option.
+func listKeys(filename string) {
+	cf, err := configfile.Load(filename)
+	if err != nil {
+		fmt.Printf("Loading config file failed: %v\n", err)
+		os.Exit(exitcodes.LoadConf)
+	}
+	if !cf.IsFeatureFlagSet(configfile.FlagKeySlots) {
+		t := configfile.KeySlotPassword
+		if cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
+			t = configfile.KeySlotFIDO2
+		} else if cf.IsFeatureFlagSet(configfile.FlagExternalKMS) {
+			t = "kms"
+		}
+		fmt.Printf("%-3s %-20s %s\n", "-", "(no key slots)", t)
+		return
+	}
+	for i, s := range cf.KeySlots {
+		fmt.Printf("%-3d %-20s %s\n", i, s.Name, s.Type)
+	}
+}
+
+// wipe overwrites "b" with zeros
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
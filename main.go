@@ -25,6 +25,7 @@ import (
 // loadConfig loads the config file `args.config` and decrypts the masterkey,
 // or gets via the `-masterkey` or `-zerokey` command line options, if specified.
 func loadConfig(args *argContainer) (masterkey []byte, cf *configfile.ConfFile, err error) {
+	args._keySlot = -1
 	// First check if the file can be read at all.
 	cf, err = configfile.Load(args.config)
 	if err != nil {
@@ -37,6 +38,38 @@ func loadConfig(args *argContainer) (masterkey []byte, cf *configfile.ConfFile,
 	if masterkey != nil {
 		return masterkey, cf, nil
 	}
+	if cf.IsFeatureFlagSet(configfile.FlagKeySlots) {
+		masterkey, args._keySlot, err = unlockKeySlots(args, cf)
+		if err != nil {
+			tlog.Fatal.Println(err)
+			return nil, nil, err
+		}
+		return masterkey, cf, nil
+	}
+	if args.keyfile != "" {
+		tlog.Fatal.Printf("This filesystem has no key slots; -keyfile cannot be used.")
+		return nil, nil, exitcodes.NewErr("", exitcodes.Usage)
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagExternalKMS) {
+		kms := *cf.KMS
+		if args.kms_endpoint != "" {
+			// Allow overriding the endpoint, for example when the key
+			// management service has moved.
+			kms.Endpoint = args.kms_endpoint
+		}
+		kp, err := configfile.NewKeyProvider(&kms)
+		if err != nil {
+			tlog.Fatal.Println(err)
+			return nil, nil, exitcodes.NewErr("", exitcodes.KMS)
+		}
+		tlog.Info.Printf("Unwrapping master key using KMS at %s", kms.Endpoint)
+		masterkey, err = cf.DecryptMasterKeyKMS(kp)
+		if err != nil {
+			tlog.Fatal.Println(err)
+			return nil, nil, err
+		}
+		return masterkey, cf, nil
+	}
 	var pw []byte
 	if cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
 		if args.fido2 == "" {
@@ -64,6 +97,53 @@ func loadConfig(args *argContainer) (masterkey []byte, cf *configfile.ConfFile,
 	return masterkey, cf, nil
 }
 
+// argon2idArgs returns the Argon2id cost parameters passed on the command
+// line, or nil if "-argon2id" was not passed.
+func argon2idArgs(args *argContainer) *configfile.Argon2idKDF {
+	if !args.argon2id {
+		return nil
+	}
+	return &configfile.Argon2idKDF{
+		Memory:      args.argon2id_memory * 1024,
+		Iterations:  args.argon2id_iterations,
+		Parallelism: args.argon2id_parallelism,
+	}
+}
+
+// passwordKDF selects the password hash for a password change. The current
+// password hash ("oldScrypt" or "oldArgon2id") and its cost parameters are
+// kept unless the user passed "-scryptn" or "-argon2id".
+// Returns the scrypt logN, or the Argon2id parameters if Argon2id is to be
+// used.
+func passwordKDF(args *argContainer, oldScrypt *configfile.ScryptKDF, oldArgon2id *configfile.Argon2idKDF) (int, *configfile.Argon2idKDF) {
+	if args._explicitScryptn {
+		return args.scryptn, nil
+	}
+	if !args.argon2id && oldArgon2id == nil {
+		return oldScrypt.LogN(), nil
+	}
+	a := configfile.Argon2idKDF{
+		Memory:      configfile.Argon2idDefaultMemory,
+		Iterations:  configfile.Argon2idDefaultIterations,
+		Parallelism: configfile.Argon2idDefaultParallelism,
+	}
+	if oldArgon2id != nil {
+		a = *oldArgon2id
+	}
+	if n := argon2idArgs(args); n != nil {
+		if n.Memory != 0 {
+			a.Memory = n.Memory
+		}
+		if n.Iterations != 0 {
+			a.Iterations = n.Iterations
+		}
+		if n.Parallelism != 0 {
+			a.Parallelism = n.Parallelism
+		}
+	}
+	return 0, &a
+}
+
 // changePassword - change the password of config file "filename"
 // Does not return (calls os.Exit both on success and on error).
 func changePassword(args *argContainer) {
@@ -82,17 +162,35 @@ func changePassword(args *argContainer) {
 			tlog.Fatal.Printf("Password change is not supported on FIDO2-enabled filesystems.")
 			os.Exit(exitcodes.Usage)
 		}
+		if confFile.IsFeatureFlagSet(configfile.FlagExternalKMS) {
+			tlog.Fatal.Printf("Password change is not supported on filesystems using an external KMS.")
+			os.Exit(exitcodes.Usage)
+		}
+		slot := -1
+		if confFile.IsFeatureFlagSet(configfile.FlagKeySlots) {
+			slot = passwdKeySlot(args, confFile)
+		}
 		tlog.Info.Println("Please enter your new password.")
 		newPw, err := readpassword.Twice([]string(args.extpass), []string(args.passfile))
 		if err != nil {
 			tlog.Fatal.Println(err)
 			os.Exit(exitcodes.ReadPassword)
 		}
-		logN := confFile.ScryptObject.LogN()
-		if args._explicitScryptn {
-			logN = args.scryptn
+		if slot >= 0 {
+			ks := &confFile.KeySlots[slot]
+			logN, argon2id := passwordKDF(args, ks.ScryptObject, ks.Argon2idObject)
+			if err = confFile.RekeySlot(slot, masterkey, newPw, logN, argon2id); err != nil {
+				tlog.Fatal.Println(err)
+				exitcodes.Exit(err)
+			}
+		} else {
+			logN, argon2id := passwordKDF(args, &confFile.ScryptObject, confFile.Argon2idObject)
+			if argon2id != nil {
+				confFile.EncryptKeyArgon2id(masterkey, newPw, *argon2id)
+			} else {
+				confFile.EncryptKey(masterkey, newPw, logN)
+			}
 		}
-		confFile.EncryptKey(masterkey, newPw, logN)
 		for i := range newPw {
 			newPw[i] = 0
 		}
@@ -102,8 +200,8 @@ func changePassword(args *argContainer) {
 		// masterkey and newPw run out of scope here
 	}
 	// Are we resetting the password without knowing the old one using
-	// "-masterkey"?
-	if args.masterkey != "" {
+	// "-masterkey" or "-masterkey-shares"?
+	if args.masterkey != "" || len(args.masterkey_shares) > 0 {
 		bak := args.config + ".bak"
 		err := os.Link(args.config, bak)
 		if err != nil {
@@ -143,7 +241,7 @@ func main() {
 	args := parseCliOpts(os.Args)
 	// Fork a child into the background if "-fg" is not set AND we are mounting
 	// a filesystem. The child will do all the work.
-	if !args.fg && flagSet.NArg() == 2 {
+	if !args.fg && flagSet.NArg() == 2 && !args.export {
 		ret := forkChild()
 		os.Exit(ret)
 	}
@@ -163,10 +261,15 @@ func main() {
 		helpLong()
 		os.Exit(0)
 	}
-	// "-speed"
-	if args.speed {
+	// "-speed" and "-speed-kdf"
+	if args.speed || args.speed_kdf {
 		printVersion()
-		speed.Run()
+		if args.speed {
+			speed.Run()
+		}
+		if args.speed_kdf {
+			speed.RunKDF()
+		}
 		os.Exit(0)
 	}
 	if args.wpanic {
@@ -196,14 +299,28 @@ func main() {
 	if args.quiet {
 		tlog.Info.Enabled = false
 	}
-	// "-reverse" implies "-aessiv"
+	// "-export" works on the reverse-mode view
+	if args.export {
+		args.reverse = true
+	}
+	// "-reverse" implies "-aessiv", unless "-gcmsiv" was passed
 	if args.reverse {
-		args.aessiv = true
+		args.aessiv = !args.gcmsiv
 	} else {
 		if args.exclude != nil {
 			tlog.Fatal.Printf("-exclude only works in reverse mode")
 			os.Exit(exitcodes.ExcludeError)
 		}
+		if args.excludeLargerThan != 0 || args.excludeSpecial || args.excludeOlderThan != "" ||
+			args.excludeNewerThan != "" || args.excludeIgnoreFiles {
+			tlog.Fatal.Printf("-exclude-larger-than, -exclude-special, -exclude-older-than, " +
+				"-exclude-newer-than and -exclude-ignore-files only work in reverse mode")
+			os.Exit(exitcodes.ExcludeError)
+		}
+		if args.writable || args.consistent_reads {
+			tlog.Fatal.Printf("-writable and -consistent-reads only work in reverse mode")
+			os.Exit(exitcodes.Usage)
+		}
 	}
 	// "-config"
 	if args.config != "" {
@@ -273,11 +390,20 @@ func main() {
 		return
 	}
 	if nOps > 1 {
-		tlog.Fatal.Printf("At most one of -info, -init, -passwd, -fsck is allowed")
+		tlog.Fatal.Printf("At most one of -info, -init, -passwd, -fsck, -add-key, -remove-key, -list-keys, -rotate-key, -rekey, -export-reader-key, -export is allowed")
 		os.Exit(exitcodes.Usage)
 	}
+	// "-export"
+	if args.export {
+		if flagSet.NArg() != 2 {
+			tlog.Fatal.Printf("Usage: %s -export [OPTIONS] PLAINDIR DESTDIR", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		exportTree(&args, flagSet.Arg(1))
+		os.Exit(0)
+	}
 	if flagSet.NArg() != 1 {
-		tlog.Fatal.Printf("The options -info, -init, -passwd, -fsck take exactly one argument, %d given",
+		tlog.Fatal.Printf("The options -info, -init, -passwd, -fsck, -add-key, -remove-key, -list-keys, -rotate-key, -rekey, -export-reader-key take exactly one argument, %d given",
 			flagSet.NArg())
 		os.Exit(exitcodes.Usage)
 	}
@@ -296,6 +422,35 @@ func main() {
 		changePassword(&args)
 		os.Exit(0)
 	}
+	// "-add-key"
+	if args.add_key {
+		addKey(&args)
+		os.Exit(0)
+	}
+	// "-remove-key"
+	if args.remove_key {
+		removeKey(&args)
+		os.Exit(0)
+	}
+	// "-list-keys"
+	if args.list_keys {
+		listKeys(args.config)
+		os.Exit(0)
+	}
+	// "-rotate-key"
+	if args.rotate_key {
+		rotateKey(&args)
+		os.Exit(0)
+	}
+	// "-rekey"
+	if args.rekey {
+		rekey(&args)
+		os.Exit(0)
+	}
+	// "-export-reader-key"
+	if args.export_reader_key {
+		exportReaderKey(&args)
+	}
 	// "-fsck"
 	if args.fsck {
 		code := fsck(&args)
@@ -2,12 +2,16 @@ package main
 
 import (
 	"encoding/hex"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/v2/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/v2/internal/shamir"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
@@ -50,6 +54,10 @@ func handleArgsMasterkey(args *argContainer) (masterkey []byte) {
 	if args.masterkey != "" {
 		return unhexMasterKey(args.masterkey, false)
 	}
+	// "-masterkey-shares=share1.txt -masterkey-shares=share2.txt"
+	if len(args.masterkey_shares) > 0 {
+		return combineMasterkeyShares(args.masterkey_shares)
+	}
 	// "-zerokey"
 	if args.zerokey {
 		tlog.Info.Printf("Using all-zero dummy master key.")
@@ -62,3 +70,90 @@ func handleArgsMasterkey(args *argContainer) (masterkey []byte) {
 	// the config file.
 	return nil
 }
+
+// combineMasterkeyShares reconstructs the master key from the Shamir shares in
+// the files "paths". The special path "stdin" prompts for shares until enough
+// have been entered.
+// Calls os.Exit on failure.
+func combineMasterkeyShares(paths []string) []byte {
+	var shares []*shamir.Share
+	for _, p := range paths {
+		if p == "stdin" {
+			for len(shares) == 0 || len(shares) < shares[0].Threshold {
+				in, err := readpassword.Once(nil, nil, fmt.Sprintf("Share %d", len(shares)+1))
+				if err != nil {
+					tlog.Fatal.Println(err)
+					os.Exit(exitcodes.ReadPassword)
+				}
+				shares = append(shares, parseShareOrExit(string(in)))
+			}
+			continue
+		}
+		buf, err := ioutil.ReadFile(p)
+		if err != nil {
+			tlog.Fatal.Printf("Could not read master key share: %v", err)
+			os.Exit(exitcodes.ReadPassword)
+		}
+		shares = append(shares, parseShareOrExit(string(buf)))
+	}
+	key, err := shamir.Combine(shares)
+	if err != nil {
+		tlog.Fatal.Printf("Could not reconstruct master key: %v", err)
+		os.Exit(exitcodes.MasterKey)
+	}
+	if len(key) != cryptocore.KeyLen {
+		tlog.Fatal.Printf("Master key has length %d but we require length %d", len(key), cryptocore.KeyLen)
+		os.Exit(exitcodes.MasterKey)
+	}
+	tlog.Info.Printf("Using master key reconstructed from %d shares.", len(shares))
+	return key
+}
+
+// parseShareOrExit parses a master key share. Calls os.Exit on failure.
+func parseShareOrExit(text string) *shamir.Share {
+	s, err := shamir.Parse(text)
+	if err != nil {
+		tlog.Fatal.Printf("Could not parse master key share: %v", err)
+		os.Exit(exitcodes.MasterKey)
+	}
+	return s
+}
+
+// splitMasterkey splits "key" into the Shamir shares requested by
+// "-masterkey-split" and writes them to "-masterkey-split-dir", or prints
+// them to the terminal.
+// Calls os.Exit on failure.
+func splitMasterkey(args *argContainer, key []byte) {
+	shares, err := shamir.Split(key, args._splitN, args._splitK)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.masterkey_split_dir == "" {
+		// Like tlog.PrintMasterkeyReminder, but the shares must not be
+		// suppressed, as there is no other copy of them.
+		fmt.Printf("\nYour master key has been split into %d shares. Any %d of them can reconstruct it.\n"+
+			"Give each share to a different person:\n\n", args._splitN, args._splitK)
+		for _, s := range shares {
+			fmt.Printf("    Share %d: %s\n", s.X, tlog.ColorGrey+s.String()+tlog.ColorReset)
+		}
+		fmt.Printf("\nThis message is only printed once.\n\n")
+		return
+	}
+	for _, s := range shares {
+		path := filepath.Join(args.masterkey_split_dir, fmt.Sprintf("gocryptfs-share-%d.txt", s.X))
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+		if err == nil {
+			_, err = f.WriteString(s.String() + "\n")
+			if err2 := f.Close(); err == nil {
+				err = err2
+			}
+		}
+		if err != nil {
+			tlog.Fatal.Printf("Could not write master key share: %v", err)
+			os.Exit(exitcodes.Init)
+		}
+	}
+	tlog.Info.Printf("Wrote %d master key shares to %q. Any %d of them can reconstruct the master key.",
+		args._splitN, args.masterkey_split_dir, args._splitK)
+}
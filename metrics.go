@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/metrics"
+	"github.com/rfjakob/gocryptfs/v2/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// openMetricsListener opens the listener for "-metrics", which is either
+// HOST:PORT or unix:PATH. There is no authentication, so HOST must be a
+// loopback address. An empty HOST means 127.0.0.1.
+func openMetricsListener(addr string) (net.Listener, error) {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		// We cd to / when daemonizing
+		path, _ = filepath.Abs(path)
+		return net.Listen("unix", path)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("refusing to listen on %q: not a loopback address", host)
+	}
+	return net.Listen("tcp", net.JoinHostPort(host, port))
+}
+
+// initMetrics registers the metrics that are maintained outside of
+// package metrics. The paths of the mount are left out, they are nobody's
+// business who can read the metrics.
+func initMetrics() {
+	metrics.SetInfo("version", GitVersion)
+	metrics.RegisterGaugeFunc("gocryptfs_open_files", "Open files.",
+		func() float64 { return float64(openfiletable.CountOpenFiles()) })
+	metrics.RegisterCounterFunc("gocryptfs_write_ops_total", "Write operations.",
+		func() float64 { return float64(openfiletable.WriteOpCount()) })
+}
+
+// serveMetrics serves the metrics on "l" until "l" is closed
+func serveMetrics(l net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.Write(w)
+	})
+	err := http.Serve(l, mux)
+	// Like the ctlsock Accept error, this triggers on exit
+	tlog.Info.Printf("metrics: %v", err)
+}
@@ -30,6 +30,7 @@ import (
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
 	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend_reverse"
+	"github.com/rfjakob/gocryptfs/v2/internal/metrics"
 	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/v2/internal/openfiletable"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
@@ -106,12 +107,44 @@ func doMount(args *argContainer) {
 			}
 		}()
 	}
+	// Same for the metrics listener
+	if args.metrics != "" {
+		l, err := openMetricsListener(args.metrics)
+		if err != nil {
+			tlog.Fatal.Printf("metrics: %v", err)
+			os.Exit(exitcodes.Metrics)
+		}
+		args._metricsListener = l
+		defer l.Close()
+	}
+	// "-rekey" refuses to run while we hold this lock
+	if !args.reverse {
+		lock, err := lockCipherdir(args.cipherdir, false)
+		if err == syscall.EWOULDBLOCK {
+			tlog.Fatal.Printf("%q is being rekeyed, try again when \"-rekey\" has finished", args.cipherdir)
+			os.Exit(exitcodes.CipherDir)
+		} else if err != nil {
+			tlog.Debug.Printf("lockCipherdir: %v", err)
+		} else {
+			defer lock.Close()
+		}
+	}
 	// Initialize gocryptfs (read config file, ask for password, ...)
 	fs, wipeKeys := initFuseFrontend(args)
 	// Try to wipe secret keys from memory after unmount
 	defer wipeKeys()
 	// Initialize go-fuse FUSE server
 	srv := initGoFuse(fs, args)
+	// We have opened the socket early so that we cannot fail here after
+	// asking the user for the password
+	var ctlSrv *ctlsocksrv.Server
+	if args._ctlsockFd != nil {
+		ctlSrv = ctlsocksrv.New(args._ctlsockFd, fs.(ctlsocksrv.Interface), newCtlMount(args, fs, srv))
+		go ctlSrv.Serve()
+	}
+	if args._metricsListener != nil {
+		go serveMetrics(args._metricsListener)
+	}
 	if x, ok := fs.(AfterUnmounter); ok {
 		defer x.AfterUnmount()
 	}
@@ -163,6 +196,10 @@ func doMount(args *argContainer) {
 	}
 	// Wait for unmount.
 	srv.Wait()
+	if ctlSrv != nil {
+		// Answer a ctlsock unmount request before we exit
+		ctlSrv.Drain()
+	}
 }
 
 // Based on the EncFS idle monitor:
@@ -230,16 +267,38 @@ func setOpenFileLimit() {
 	}
 }
 
-// initFuseFrontend - initialize gocryptfs/internal/fusefrontend
-// Calls os.Exit on errors
-func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys func()) {
+// initCrypto loads the master key and the config file and initializes the
+// content and name encryption. On error, it calls os.Exit and does not
+// return.
+func initCrypto(args *argContainer) (frontendArgs fusefrontend.Args, cEnc *contentenc.ContentEnc,
+	nameTransform *nametransform.NameTransform, cryptoBackend cryptocore.AEADTypeEnum) {
 	var err error
 	var confFile *configfile.ConfFile
 	// Get the masterkey from the command line if it was specified
 	masterkey := handleArgsMasterkey(args)
-	// Otherwise, load masterkey from config file (normal operation).
-	// Prompts the user for the password.
-	if masterkey == nil {
+	// Or the reader key of a "-write-auth" filesystem
+	readerKey := handleArgsReaderKey(args)
+	// keyConf supplies the key epochs and the write authentication public
+	// key. It is the config file, if there is one, even when "-masterkey" was
+	// used, as they are only stored there.
+	var keyConf *configfile.ConfFile
+	if masterkey != nil {
+		if cf, err := configfile.Load(args.config); err == nil && cf.IsFeatureFlagSet(configfile.FlagKeyEpochs) {
+			tlog.Info.Printf("Using the key epochs from the config file")
+			keyConf = cf
+		} else if err == nil && cf.IsFeatureFlagSet(configfile.FlagWriteAuth) {
+			tlog.Info.Printf("Using the write authentication key from the config file")
+			keyConf = cf
+		}
+	}
+	if readerKey != nil {
+		// The reader key does not unlock the config file, but the settings
+		// and the public key are still needed
+		confFile = loadWriteAuthConf(args)
+		keyConf = confFile
+	} else if masterkey == nil {
+		// Otherwise, load masterkey from config file (normal operation).
+		// Prompts the user for the password.
 		masterkey, confFile, err = loadConfig(args)
 		if err != nil {
 			if args._ctlsockFd != nil {
@@ -248,10 +307,11 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 			}
 			exitcodes.Exit(err)
 		}
+		keyConf = confFile
 	}
 	// Reconciliate CLI and config file arguments into a fusefrontend.Args struct
 	// that is passed to the filesystem implementation
-	cryptoBackend := cryptocore.BackendGoGCM
+	cryptoBackend = cryptocore.BackendGoGCM
 	IVBits := contentenc.DefaultIVBits
 	if args.openssl {
 		cryptoBackend = cryptocore.BackendOpenSSL
@@ -259,6 +319,9 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 	if args.aessiv {
 		cryptoBackend = cryptocore.BackendAESSIV
 	}
+	if args.gcmsiv {
+		cryptoBackend = cryptocore.BackendAESGCMSIV
+	}
 	if args.xchacha {
 		if args.openssl {
 			cryptoBackend = cryptocore.BackendXChaCha20Poly1305OpenSSL
@@ -272,7 +335,7 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 	if args._forceOwner != nil {
 		args.allow_other = true
 	}
-	frontendArgs := fusefrontend.Args{
+	frontendArgs = fusefrontend.Args{
 		Cipherdir:          args.cipherdir,
 		PlaintextNames:     args.plaintextnames,
 		LongNames:          args.longnames,
@@ -282,19 +345,29 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 		Exclude:            args.exclude,
 		ExcludeWildcard:    args.excludeWildcard,
 		ExcludeFrom:        args.excludeFrom,
+		ExcludeLargerThan:  args.excludeLargerThan,
+		ExcludeSpecial:     args.excludeSpecial,
+		ExcludeOlderThan:   args._excludeOlderThan,
+		ExcludeNewerThan:   args._excludeNewerThan,
+		ExcludeIgnoreFiles: args.excludeIgnoreFiles,
 		Suid:               args.suid,
 		KernelCache:        args.kernel_cache,
 		SharedStorage:      args.sharedstorage,
 		OneFileSystem:      args.one_file_system,
+		ConsistentReads:    args.consistent_reads,
+		Writable:           args.writable,
 		DeterministicNames: args.deterministic_names,
+		Compression:        args.compress,
 	}
 	// confFile is nil when "-zerokey" or "-masterkey" was used
 	if confFile != nil {
 		// Settings from the config file override command line args
 		frontendArgs.PlaintextNames = confFile.IsFeatureFlagSet(configfile.FlagPlaintextNames)
 		frontendArgs.DeterministicNames = !confFile.IsFeatureFlagSet(configfile.FlagDirIV)
+		frontendArgs.Compression = confFile.Compression
 		// Things that don't have to be in frontendArgs are only in args
 		args.longnamemax = confFile.LongNameMax
+		args.blocksize = uint32(confFile.PlainBS())
 		args.raw64 = confFile.IsFeatureFlagSet(configfile.FlagRaw64)
 		args.hkdf = confFile.IsFeatureFlagSet(configfile.FlagHKDF)
 		// Note: this will always return the non-openssl variant
@@ -304,8 +377,8 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 			os.Exit(exitcodes.DeprecatedFS)
 		}
 		IVBits = cryptoBackend.NonceSize * 8
-		if cryptoBackend != cryptocore.BackendAESSIV && args.reverse {
-			tlog.Fatal.Printf("AES-SIV is required by reverse mode, but not enabled in the config file")
+		if !cryptoBackend.MisuseResistant() && args.reverse {
+			tlog.Fatal.Printf("AES-SIV or AES-GCM-SIV is required by reverse mode, but not enabled in the config file")
 			os.Exit(exitcodes.Usage)
 		}
 		// Upgrade to OpenSSL variant if requested
@@ -324,33 +397,52 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 		frontendArgs.PreserveOwner = true
 	}
 
-	// Init crypto backend
-	cCore := cryptocore.New(masterkey, cryptoBackend, IVBits, args.hkdf)
-	cEnc := contentenc.New(cCore, contentenc.DefaultBS)
-	nameTransform := nametransform.New(cCore.EMECipher, frontendArgs.LongNames, args.longnamemax,
+	if keyConf != nil && args.reverse {
+		if keyConf.IsFeatureFlagSet(configfile.FlagWriteAuth) {
+			tlog.Fatal.Printf("Write authentication is not supported in reverse mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if keyConf.IsFeatureFlagSet(configfile.FlagKeyEpochs) {
+			tlog.Fatal.Printf("Key epochs are not supported in reverse mode")
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	// Init crypto backend. On "-write-auth" filesystems, file contents and
+	// names are encrypted using the reader key, and file contents are signed.
+	key := masterkey
+	if readerKey != nil {
+		key = readerKey
+	}
+	cEnc, cCore, err := configfile.NewContentEnc(keyConf, key, readerKey != nil, cryptoBackend,
+		IVBits, args.hkdf, uint64(args.blocksize))
+	if err != nil {
+		tlog.Fatal.Println(err)
+		exitcodes.Exit(err)
+	}
+	nameTransform = nametransform.New(cCore.EMECipher, frontendArgs.LongNames, args.longnamemax,
 		args.raw64, []string(args.badname), frontendArgs.DeterministicNames)
 	// After the crypto backend is initialized,
-	// we can purge the master key from memory.
-	for i := range masterkey {
-		masterkey[i] = 0
-	}
-	masterkey = nil
+	// we can purge the keys from memory.
+	wipe(key)
+	key = nil
+	return frontendArgs, cEnc, nameTransform, cryptoBackend
+}
+
+// initFuseFrontend - initialize gocryptfs/internal/fusefrontend
+// Calls os.Exit on errors
+func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys func()) {
+	frontendArgs, cEnc, nameTransform, cryptoBackend := initCrypto(args)
 	// Spawn fusefrontend
 	tlog.Debug.Printf("frontendArgs: %s", tlog.JSONDump(frontendArgs))
 	if args.reverse {
-		if cryptoBackend != cryptocore.BackendAESSIV {
-			log.Panic("reverse mode must use AES-SIV, everything else is insecure")
+		if !cryptoBackend.MisuseResistant() {
+			log.Panic("reverse mode must use AES-SIV or AES-GCM-SIV, everything else is insecure")
 		}
 		rootNode = fusefrontend_reverse.NewRootNode(frontendArgs, cEnc, nameTransform)
 	} else {
 		rootNode = fusefrontend.NewRootNode(frontendArgs, cEnc, nameTransform)
 	}
-	// We have opened the socket early so that we cannot fail here after
-	// asking the user for the password
-	if args._ctlsockFd != nil {
-		go ctlsocksrv.Serve(args._ctlsockFd, rootNode.(ctlsocksrv.Interface))
-	}
-	return rootNode, func() { cCore.Wipe() }
+	return rootNode, func() { cEnc.Wipe() }
 }
 
 // initGoFuse calls into go-fuse to mount `rootNode` on `args.mountpoint`.
@@ -441,8 +533,8 @@ func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
 		mOpts.Options = append(mOpts.Options, "volname="+volname)
 	}
 	// The kernel enforces read-only operation, we just have to pass "ro".
-	// Reverse mounts are always read-only.
-	if args.ro || args.reverse {
+	// Reverse mounts are read-only unless "-writable" was passed.
+	if args.ro || (args.reverse && !args.writable) {
 		mOpts.Options = append(mOpts.Options, "ro")
 	} else if args.rw {
 		mOpts.Options = append(mOpts.Options, "rw")
@@ -471,7 +563,20 @@ func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
 		tlog.Debug.Printf("Adding -ko mount options: %v", parts)
 		mOpts.Options = append(mOpts.Options, parts...)
 	}
-	srv, err := fs.Mount(args.mountpoint, rootNode, fuseOpts)
+	// Like fs.Mount(), but we have to enable latency recording before
+	// serving starts
+	srv, err := fuse.NewServer(fs.NewNodeFS(rootNode, fuseOpts), args.mountpoint, &fuseOpts.MountOptions)
+	if err == nil {
+		if args.metrics != "" || args.ctlsock != "" {
+			initMetrics()
+		}
+		// Latency recording costs a lock and two atomic ops per FUSE call
+		if args.metrics != "" {
+			srv.RecordLatencies(metrics.FuseLatencies)
+		}
+		go srv.Serve()
+		err = srv.WaitMount()
+	}
 	if err != nil {
 		tlog.Fatal.Printf("fs.Mount failed: %s", strings.TrimSpace(err.Error()))
 		if runtime.GOOS == "darwin" {
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// rekeyTmpName is the file in the root of CIPHERDIR that "-rekey" writes
+// the re-encrypted content to before it replaces the old file
+const rekeyTmpName = nametransform.RekeyPrefix + "tmp"
+
+// rekeyCopyName returns the name the re-encrypted copy of the hard-linked
+// file with inode number "ino" and file ID "id" has while it is copied over
+// the file. An interrupted copy is finished by the next "-rekey" run.
+func rekeyCopyName(ino uint64, id []byte) string {
+	return fmt.Sprintf("%s%d-%s", nametransform.RekeyPrefix, ino, hex.EncodeToString(id))
+}
+
+// lockCipherdir takes an flock(2) on CIPHERDIR that is held until the
+// returned file is closed. Mounts take a shared lock and "-rekey" takes an
+// exclusive one, so "-rekey" cannot run while the filesystem is mounted.
+func lockCipherdir(dir string, exclusive bool) (*os.File, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+	if err = unix.Flock(int(f.Fd()), how|unix.LOCK_NB); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// verifyMasterkey makes sure "masterkey" belongs to the filesystem before a
+// key epoch encrypted with it is written to the config file. A master key
+// passed with -masterkey, -zerokey or -masterkey-shares is not checked by
+// loadConfig. The content keys of existing epochs are authenticated, so they
+// serve as a check value. Filesystems without key epochs have none, and
+// their first epoch must be added by unlocking the config file.
+// Exits on error.
+func verifyMasterkey(args *argContainer, cf *configfile.ConfFile, masterkey []byte) {
+	if cf.IsFeatureFlagSet(configfile.FlagKeyEpochs) {
+		keys, err := cf.DecryptKeyEpochs(masterkey)
+		if err != nil {
+			tlog.Fatal.Println(err)
+			exitcodes.Exit(err)
+		}
+		for _, k := range keys {
+			wipe(k)
+		}
+		return
+	}
+	if args.masterkey != "" || args.zerokey || len(args.masterkey_shares) > 0 {
+		tlog.Fatal.Printf("The master key cannot be verified because this filesystem has no key epochs yet. " +
+			"Unlock it using the config file instead of -masterkey, -zerokey or -masterkey-shares.")
+		os.Exit(exitcodes.Usage)
+	}
+}
+
+// rotateKey - add a new key epoch to the config file. Files created after
+// the next mount use the new content key.
+// Does not return (calls os.Exit both on success and on error).
+func rotateKey(args *argContainer) {
+	masterkey, cf, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	if args.reverse {
+		tlog.Fatal.Printf("Key epochs are not supported in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagWriteAuth) {
+		tlog.Fatal.Printf("Key epochs are not supported on -write-auth filesystems")
+		os.Exit(exitcodes.Usage)
+	}
+	verifyMasterkey(args, cf, masterkey)
+	epoch := cf.AddKeyEpoch(masterkey)
+	wipe(masterkey)
+	if err = cf.WriteFile(); err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Added key epoch %d."+tlog.ColorReset, epoch)
+	tlog.Info.Printf(tlog.ColorGrey+"Files created after the next mount will use the new key. "+
+		"Run \"%s -rekey\" to rewrite existing files."+tlog.ColorReset, tlog.ProgramName)
+}
+
+// rekeyObj holds the state of a "-rekey" run
+type rekeyObj struct {
+	args   *argContainer
+	cEnc   *contentenc.ContentEnc
+	target uint32
+	// plaintextnames is set in the config file
+	plaintextnames bool
+	// Copies of hard-linked files left behind by an interrupted run, by
+	// inode number
+	pending map[uint64]rekeyPending
+	// Counters for the final summary
+	rewritten, errors int
+}
+
+// rekeyPending is a re-encrypted copy that was not completely copied over
+// the hard-linked file it belongs to
+type rekeyPending struct {
+	path  string
+	oldID string
+}
+
+// rekey - rewrite all files in CIPHERDIR that use an old key epoch using the
+// newest key epoch, then drop the content keys of the old epochs from the
+// config file. If the newest epoch has already been completed by an earlier
+// run, a new epoch is added first.
+// Refuses to run while the filesystem is mounted.
+// Does not return (calls os.Exit both on success and on error).
+func rekey(args *argContainer) {
+	if args.reverse {
+		tlog.Fatal.Printf("Key epochs are not supported in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	masterkey, cf, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagWriteAuth) {
+		tlog.Fatal.Printf("Key epochs are not supported on -write-auth filesystems")
+		os.Exit(exitcodes.Usage)
+	}
+	verifyMasterkey(args, cf, masterkey)
+	lock, err := lockCipherdir(args.cipherdir, true)
+	// The gocryptfs process of a filesystem that has just been unmounted
+	// may still be exiting
+	for i := 0; err == syscall.EWOULDBLOCK && i < 20; i++ {
+		time.Sleep(100 * time.Millisecond)
+		lock, err = lockCipherdir(args.cipherdir, true)
+	}
+	if err == syscall.EWOULDBLOCK {
+		tlog.Fatal.Printf("%q is mounted. Unmount it before running -rekey.", args.cipherdir)
+		os.Exit(exitcodes.Rekey)
+	} else if err != nil {
+		tlog.Warn.Printf("Cannot check if %q is mounted: %v. Make sure it is not.", args.cipherdir, err)
+	} else {
+		defer lock.Close()
+	}
+	backend, err := cf.ContentEncryption()
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.DeprecatedFS)
+	}
+	useHKDF := cf.IsFeatureFlagSet(configfile.FlagHKDF)
+	IVBits := backend.NonceSize * 8
+	cEnc, _, err := configfile.NewContentEnc(cf, masterkey, false, backend, IVBits, useHKDF, cf.PlainBS())
+	if err != nil {
+		tlog.Fatal.Println(err)
+		exitcodes.Exit(err)
+	}
+	if cf.NewestKeyEpoch() == 0 || cf.RetiredKeyEpoch == cf.NewestKeyEpoch() {
+		epoch := cf.AddKeyEpoch(masterkey)
+		// The config file must contain the new key before the first file uses it
+		if err = cf.WriteFile(); err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(exitcodes.WriteConf)
+		}
+		tlog.Info.Printf("Added key epoch %d", epoch)
+		keys, err := cf.DecryptKeyEpochs(masterkey)
+		if err != nil {
+			tlog.Fatal.Println(err)
+			exitcodes.Exit(err)
+		}
+		cEnc.AddKeyEpoch(epoch, cryptocore.New(keys[epoch], backend, IVBits, useHKDF))
+		for _, k := range keys {
+			wipe(k)
+		}
+	}
+	wipe(masterkey)
+	defer cEnc.Wipe()
+	r := rekeyObj{
+		args:           args,
+		cEnc:           cEnc,
+		target:         cEnc.WriteEpoch(),
+		plaintextnames: cf.IsFeatureFlagSet(configfile.FlagPlaintextNames),
+	}
+	if err = r.loadPending(); err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.Rekey)
+	}
+	tlog.Info.Printf("Rewriting files to key epoch %d", r.target)
+	err = filepath.Walk(args.cipherdir, r.visit)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.Rekey)
+	}
+	if r.errors > 0 {
+		tlog.Fatal.Printf("%d files could not be rewritten, keeping the old key epochs", r.errors)
+		os.Exit(exitcodes.Rekey)
+	}
+	// The files these copies belong to have been deleted
+	for _, p := range r.pending {
+		os.Remove(p.path)
+	}
+	cf.RetireKeyEpochs(r.target)
+	if err = cf.WriteFile(); err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Rewrote %d files, all files now use key epoch %d."+tlog.ColorReset,
+		r.rewritten, r.target)
+}
+
+// visit is the filepath.WalkFunc for rekey()
+func (r *rekeyObj) visit(path string, fi os.FileInfo, err error) error {
+	if filepath.Dir(path) == r.args.cipherdir && nametransform.IsReservedRootName(filepath.Base(path)) {
+		// Internal files. The copies in r.pending may have been removed
+		// since the directory was read.
+		return nil
+	}
+	if err != nil {
+		tlog.Warn.Printf("rekey: %v", err)
+		r.errors++
+		return nil
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+	name := fi.Name()
+	if filepath.Dir(path) == r.args.cipherdir {
+		if strings.HasPrefix(name, configfile.ConfDefaultName) {
+			// gocryptfs.conf and its backups
+			return nil
+		}
+	}
+	if path == r.args.config {
+		return nil
+	}
+	if !r.plaintextnames {
+		if name == nametransform.DirIVFilename || nametransform.NameType(name) == nametransform.LongNameFilename {
+			return nil
+		}
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		if p, ok := r.pending[uint64(st.Ino)]; ok {
+			delete(r.pending, uint64(st.Ino))
+			done, err := r.finishPending(path, p)
+			if err != nil {
+				tlog.Warn.Printf("rekey: %q: %v", path, err)
+				r.errors++
+				return nil
+			} else if done {
+				tlog.Info.Printf("rekey: %q: finished interrupted copy", path)
+				r.rewritten++
+				return nil
+			}
+			// The inode number has been reused, the file the copy belongs
+			// to is gone
+			os.Remove(p.path)
+		}
+	}
+	done, err := r.rekeyFile(path, fi)
+	if err != nil {
+		tlog.Warn.Printf("rekey: %q: %v", path, err)
+		r.errors++
+	} else if done {
+		r.rewritten++
+	}
+	return nil
+}
+
+// loadPending removes the temporary file of an interrupted run, and fills
+// r.pending with the copies of hard-linked files it left behind.
+func (r *rekeyObj) loadPending() error {
+	r.pending = make(map[uint64]rekeyPending)
+	entries, err := os.ReadDir(r.args.cipherdir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, nametransform.RekeyPrefix) {
+			continue
+		}
+		path := filepath.Join(r.args.cipherdir, name)
+		if name == rekeyTmpName {
+			// The old file was not touched yet
+			tlog.Info.Printf("rekey: removing stale temporary file %q", path)
+			os.Remove(path)
+			continue
+		}
+		parts := strings.Split(strings.TrimPrefix(name, nametransform.RekeyPrefix), "-")
+		if len(parts) != 2 {
+			continue
+		}
+		ino, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		r.pending[ino] = rekeyPending{path: path, oldID: parts[1]}
+	}
+	return nil
+}
+
+// finishPending copies the re-encrypted copy "p" over the file at "path"
+// if the file has the old or the new file ID. Otherwise, the inode number
+// has been reused and false is returned.
+func (r *rekeyObj) finishPending(path string, p rekeyPending) (bool, error) {
+	src, err := os.Open(p.path)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+	newHeader, err := readHeader(src)
+	if err != nil {
+		return false, err
+	}
+	dst, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer dst.Close()
+	h, err := readHeader(dst)
+	if err != nil {
+		return false, err
+	}
+	if id := hex.EncodeToString(h.ID); id != p.oldID && !bytes.Equal(h.ID, newHeader.ID) {
+		return false, nil
+	}
+	var st unix.Stat_t
+	if err = unix.Lstat(path, &st); err != nil {
+		return false, err
+	}
+	if err = copyOver(src, dst, path, &st); err != nil {
+		return false, err
+	}
+	os.Remove(p.path)
+	return true, nil
+}
+
+// readHeader reads and parses the file header of "f"
+func readHeader(f *os.File) (*contentenc.FileHeader, error) {
+	buf := make([]byte, contentenc.HeaderLen)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return nil, fmt.Errorf("reading header: %v", err)
+	}
+	return contentenc.ParseHeader(buf)
+}
+
+// copyOver copies "src" over "dst", the open file at "path", and restores
+// the timestamps from "st"
+func copyOver(src *os.File, dst *os.File, path string, st *unix.Stat_t) error {
+	if err := syscallcompat.CopyOver(src, dst); err != nil {
+		return err
+	}
+	return unix.UtimesNano(path, []unix.Timespec{st.Atim, st.Mtim})
+}
+
+// rekeyFile re-encrypts the file at "path" using the target epoch, if it
+// uses a different epoch. Holes are preserved. Returns true if the file was
+// rewritten.
+//
+// The new content is written to a temporary file. Files with one hard link
+// are replaced by renaming it over them, so a crash leaves either the old or
+// the new version. Renaming would break hard links, so for hard-linked files,
+// the temporary file is renamed to rekeyCopyName and then copied over the
+// file. A crash during the copy is fixed by the next run.
+func (r *rekeyObj) rekeyFile(path string, fi os.FileInfo) (bool, error) {
+	if fi.Size() == 0 {
+		// Empty files have no header
+		return false, nil
+	}
+	in, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+	buf := make([]byte, contentenc.HeaderLen)
+	if _, err = io.ReadFull(in, buf); err != nil {
+		return false, fmt.Errorf("reading header: %v", err)
+	}
+	oldHeader, err := contentenc.ParseHeader(buf)
+	if err != nil {
+		return false, err
+	}
+	if oldHeader.Epoch == r.target {
+		return false, nil
+	}
+	oldEnc, err := r.cEnc.ForEpoch(oldHeader.Epoch)
+	if err != nil {
+		return false, err
+	}
+	newEnc, err := r.cEnc.ForEpoch(r.target)
+	if err != nil {
+		return false, err
+	}
+	newHeader := contentenc.RandomHeaderEpoch(r.target)
+
+	tmp := filepath.Join(r.args.cipherdir, rekeyTmpName)
+	out, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+	if _, err = out.Write(newHeader.Pack()); err != nil {
+		return false, err
+	}
+	cipherBS := int(oldEnc.CipherBS())
+	cBlock := make([]byte, cipherBS)
+	allZero := make([]byte, cipherBS)
+	off := int64(contentenc.HeaderLen)
+	for blockNo := uint64(0); ; blockNo++ {
+		n, err := in.ReadAt(cBlock, off)
+		if n == 0 && err == io.EOF {
+			break
+		} else if err != nil && err != io.EOF {
+			return false, err
+		}
+		// Keep holes as holes
+		if !bytes.Equal(cBlock[:n], allZero[:n]) {
+			pBlock, err := oldEnc.DecryptBlock(cBlock[:n], blockNo, oldHeader.ID)
+			if err != nil {
+				return false, fmt.Errorf("block #%d: %v", blockNo, err)
+			}
+			cNew, err := newEnc.EncryptBlock(pBlock, blockNo, newHeader.ID)
+			if err != nil {
+				return false, err
+			}
+			if _, err = out.WriteAt(cNew, off); err != nil {
+				return false, err
+			}
+		}
+		off += int64(n)
+		if n < cipherBS {
+			break
+		}
+	}
+	// Restore trailing holes
+	if err = out.Truncate(fi.Size()); err != nil {
+		return false, err
+	}
+	if err = out.Sync(); err != nil {
+		return false, err
+	}
+	var st unix.Stat_t
+	if err = unix.Lstat(path, &st); err != nil {
+		return false, err
+	}
+	if st.Nlink > 1 {
+		name := filepath.Join(r.args.cipherdir, rekeyCopyName(uint64(st.Ino), oldHeader.ID))
+		if err = os.Rename(tmp, name); err != nil {
+			return false, err
+		}
+		if err = syscallcompat.SyncDir(r.args.cipherdir); err != nil {
+			os.Remove(name)
+			return false, err
+		}
+		dst, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			os.Remove(name)
+			return false, err
+		}
+		defer dst.Close()
+		if err = copyOver(out, dst, path, &st); err != nil {
+			return false, fmt.Errorf("copy failed, the new version is kept as %q "+
+				"and copied again by the next run: %v", name, err)
+		}
+		os.Remove(name)
+		return true, nil
+	}
+	if err = out.Chmod(fi.Mode().Perm()); err != nil {
+		return false, err
+	}
+	// Only root can give away files, ignore errors otherwise
+	out.Chown(int(st.Uid), int(st.Gid))
+	if err = os.Rename(tmp, path); err != nil {
+		return false, err
+	}
+	// Restore the timestamps
+	if err = unix.UtimesNano(path, []unix.Timespec{st.Atim, st.Mtim}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
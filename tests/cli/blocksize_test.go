@@ -0,0 +1,89 @@
+package cli
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Create a filesystem with 1 MiB blocks, check the ciphertext layout and
+// that partial writes into a large block work.
+func TestBlockSize(t *testing.T) {
+	const bs = 1024 * 1024
+	dir := test_helpers.InitFS(t, "-blocksize=1048576", "-plaintextnames")
+	mnt := dir + ".mnt"
+	_, cf, err := configfile.LoadAndDecrypt(dir+"/"+configfile.ConfDefaultName, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(configfile.FlagBlockSize) || cf.PlainBS() != bs {
+		t.Fatalf("wrong block size %d, flags %v", cf.BlockSize, cf.FeatureFlags)
+	}
+	content := make([]byte, bs+bs/2)
+	rand.Read(content)
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	if err := ioutil.WriteFile(mnt+"/foo", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Overwrite a few bytes in the middle of the first block
+	f, err := os.OpenFile(mnt+"/foo", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch := []byte("patched")
+	if _, err = f.WriteAt(patch, 12345); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	copy(content[12345:], patch)
+	test_helpers.UnmountPanic(mnt)
+	// Two blocks: one full and one half block, 32 bytes overhead each
+	fi, err := os.Stat(dir + "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(contentenc.HeaderLen + len(content) + 2*32); fi.Size() != want {
+		t.Errorf("ciphertext size %d, want %d", fi.Size(), want)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	got, err := ioutil.ReadFile(mnt + "/foo")
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("content mismatch: %v", err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	// Invalid block sizes are rejected
+	for _, v := range []string{"-blocksize=5000", "-blocksize=2048", "-blocksize=2097152"} {
+		if _, code := runGocryptfs("-q", "-init", "-extpass", "echo test", v, dir+".invalid"); code != exitcodes.Usage {
+			t.Errorf("%s: want exit code %d, got %d", v, exitcodes.Usage, code)
+		}
+	}
+}
+
+// Reverse mode honors the block size from the config file
+func TestBlockSizeReverse(t *testing.T) {
+	backingDir := test_helpers.InitFS(t, "-reverse", "-blocksize=65536")
+	mnt := backingDir + ".mnt"
+	mnt2 := backingDir + ".mnt2"
+	content := make([]byte, 200000)
+	rand.Read(content)
+	if err := ioutil.WriteFile(backingDir+"/foo", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, backingDir, mnt, "-reverse", "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	// Mount the encrypted view in forward mode
+	test_helpers.MountOrFatal(t, mnt, mnt2, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt2)
+	got, err := ioutil.ReadFile(mnt2 + "/foo")
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("content mismatch: %v", err)
+	}
+}
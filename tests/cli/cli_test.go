@@ -112,6 +112,55 @@ func TestInitMasterkey(t *testing.T) {
 	}
 }
 
+// Test -init -masterkey-split, and using the shares with -passwd and for
+// mounting
+func TestMasterkeySplit(t *testing.T) {
+	shareDir, err := ioutil.TempDir(test_helpers.TmpDir, "TestMasterkeySplit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := test_helpers.InitFS(t, "-masterkey-split", "2/3", "-masterkey-split-dir", shareDir)
+	mk, _, err := configfile.LoadAndDecrypt(dir+"/"+configfile.ConfDefaultName, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	share := func(i int) string {
+		return fmt.Sprintf("%s/gocryptfs-share-%d.txt", shareDir, i)
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	if err = ioutil.WriteFile(mnt+"/foo", []byte("bar"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	// One share is not enough
+	_, code := runGocryptfs("-q", "-passwd", "-masterkey-shares", share(3), dir)
+	if code != exitcodes.MasterKey {
+		t.Errorf("one share: want exit code %d, got %d", exitcodes.MasterKey, code)
+	}
+	// Any two shares reconstruct the master key
+	test_helpers.MountOrFatal(t, dir, mnt, "-masterkey-shares", share(1), "-masterkey-shares", share(3))
+	buf, err := ioutil.ReadFile(mnt + "/foo")
+	if err != nil || string(buf) != "bar" {
+		t.Errorf("err=%v content=%q", err, buf)
+	}
+	test_helpers.UnmountPanic(mnt)
+	// Reset the password using shares 2 and 3
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-passwd", "-masterkey-shares", share(3),
+		"-masterkey-shares", share(2), dir)
+	cmd.Stdin = strings.NewReader("newpasswd\nnewpasswd\n")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("-passwd -masterkey-shares failed: %v: %s", err, out)
+	}
+	mk2, _, err := configfile.LoadAndDecrypt(dir+"/"+configfile.ConfDefaultName, []byte("newpasswd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mk, mk2) {
+		t.Error("master key changed")
+	}
+}
+
 // testPasswd changes the password from "test" to "test" using
 // the -extpass method, then from "test" to "newpasswd" using the
 // stdin method.
@@ -320,6 +369,75 @@ func TestPasswdScryptn(t *testing.T) {
 	}
 }
 
+// Test -init -argon2id, and switching back and forth using -passwd
+func TestArgon2id(t *testing.T) {
+	// Not using InitFS() because it passes -scryptn
+	dir, err := ioutil.TempDir(test_helpers.TmpDir, "TestArgon2id.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, code := runGocryptfs("-q", "-init", "-extpass", "echo test", "-argon2id",
+		"-argon2id-memory=8", "-argon2id-iterations=1", dir)
+	if code != 0 {
+		t.Fatalf("-init -argon2id failed with code %d: %s", code, out)
+	}
+	passwd := func(extraArgs ...string) {
+		args := append([]string{"-q", "-passwd", "-extpass", "echo test"}, extraArgs...)
+		if out, code := runGocryptfs(append(args, dir)...); code != 0 {
+			t.Fatalf("-passwd %v failed with code %d: %s", extraArgs, code, out)
+		}
+	}
+	cf, err := configfile.Load(dir + "/gocryptfs.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(configfile.FlagArgon2id) || cf.Argon2idObject.Memory != 8*1024 ||
+		cf.Argon2idObject.Iterations != 1 {
+		t.Fatalf("wrong Argon2id parameters: %#v", cf.Argon2idObject)
+	}
+	// -passwd keeps Argon2id and its parameters
+	passwd()
+	cf, err = configfile.Load(dir + "/gocryptfs.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(configfile.FlagArgon2id) || cf.Argon2idObject.Memory != 8*1024 {
+		t.Fatalf("Argon2id parameters were not kept: %#v", cf.Argon2idObject)
+	}
+	// -argon2id and -scryptn conflict
+	if _, code := runGocryptfs("-q", "-passwd", "-extpass", "echo test", "-argon2id", "-scryptn=10", dir); code != exitcodes.Usage {
+		t.Errorf("want exit code %d, got %d", exitcodes.Usage, code)
+	}
+	// The cost parameters are not silently ignored without -argon2id
+	for _, flag := range []string{"-argon2id-memory=16", "-argon2id-iterations=1", "-argon2id-parallelism=1"} {
+		if _, code := runGocryptfs("-q", "-passwd", "-extpass", "echo test", flag, dir); code != exitcodes.Usage {
+			t.Errorf("%s without -argon2id: want exit code %d, got %d", flag, exitcodes.Usage, code)
+		}
+	}
+	// Memory costs that overflow when converted to KiB are rejected
+	if _, code := runGocryptfs("-q", "-passwd", "-extpass", "echo test", "-argon2id", "-argon2id-memory=4194304", dir); code != exitcodes.Usage {
+		t.Errorf("want exit code %d, got %d", exitcodes.Usage, code)
+	}
+	// -scryptn switches back to scrypt
+	passwd("-scryptn=10")
+	cf, err = configfile.Load(dir + "/gocryptfs.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagArgon2id) || cf.ScryptObject.LogN() != 10 {
+		t.Fatalf("not switched to scrypt: %v", cf.FeatureFlags)
+	}
+	// -argon2id switches to Argon2id again
+	passwd("-argon2id", "-argon2id-memory=16", "-argon2id-iterations=1")
+	cf, err = configfile.Load(dir + "/gocryptfs.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(configfile.FlagArgon2id) || cf.Argon2idObject.Memory != 16*1024 {
+		t.Fatalf("not switched to Argon2id: %#v", cf.Argon2idObject)
+	}
+}
+
 // Test -init & -config flag
 func TestInitConfig(t *testing.T) {
 	config := test_helpers.TmpDir + "/TestInitConfig.conf"
@@ -1033,3 +1151,17 @@ func TestMountCreat(t *testing.T) {
 		test_helpers.UnmountPanic(mnt)
 	}
 }
+
+// -writable and -consistent-reads only work in reverse mode
+func TestReverseOnlyFlags(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	if err := os.Mkdir(mnt, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, flag := range []string{"-writable", "-consistent-reads"} {
+		if _, code := runGocryptfs("-q", "-extpass", "echo test", flag, dir, mnt); code != exitcodes.Usage {
+			t.Errorf("%s: want exit code %d, got %d", flag, exitcodes.Usage, code)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package cli
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Reverse mode with -compress=lz4 presents smaller ciphertext files that can
+// be read, and modified, in forward mode.
+func TestCompressReverse(t *testing.T) {
+	backingDir := test_helpers.InitFS(t, "-reverse", "-compress=lz4")
+	mnt := backingDir + ".mnt"
+	_, cf, err := configfile.LoadAndDecrypt(backingDir+"/"+configfile.ConfReverseName, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(configfile.FlagCompression) || cf.Compression != contentenc.CompressionLZ4 {
+		t.Fatalf("compression not enabled: %q %v", cf.Compression, cf.FeatureFlags)
+	}
+	// Compressible text with a random block in the middle
+	var content []byte
+	for len(content) < 100000 {
+		content = append(content, []byte("The quick brown fox jumps over the lazy dog. ")...)
+	}
+	rand.Read(content[50000:54096])
+	files := map[string][]byte{
+		"text":  content,
+		"small": []byte("x"),
+		"empty": nil,
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(backingDir+"/"+name, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	test_helpers.MountOrFatal(t, backingDir, mnt, "-reverse", "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	// Copy the ciphertext, like a backup would
+	cipherCopy := backingDir + ".copy"
+	if err := os.Mkdir(cipherCopy, 0700); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(mnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for _, e := range entries {
+		data, err := ioutil.ReadFile(mnt + "/" + e.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(data)) != e.Size() {
+			t.Errorf("%s: stat says %d bytes, read %d", e.Name(), e.Size(), len(data))
+		}
+		total += e.Size()
+		if err := ioutil.WriteFile(cipherCopy+"/"+e.Name(), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if total > int64(len(content)/2) {
+		t.Errorf("ciphertext is not compressed: %d bytes", total)
+	}
+	if out, code := runGocryptfs("-fsck", "-extpass", "echo test", cipherCopy); code != 0 {
+		t.Errorf("fsck failed with code %d: %s", code, out)
+	}
+	// The largest ciphertext file is "text"
+	var cText string
+	var ino uint64
+	var max int64
+	for _, e := range entries {
+		if e.Size() > max {
+			cText, max = cipherCopy+"/"+e.Name(), e.Size()
+		}
+	}
+	if fi, err := os.Stat(cText); err != nil {
+		t.Fatal(err)
+	} else {
+		ino = fi.Sys().(*syscall.Stat_t).Ino
+	}
+	// Mount the copy in forward mode. Reads work, writes convert the file to
+	// the normal format.
+	mnt2 := cipherCopy + ".mnt"
+	test_helpers.MountOrFatal(t, cipherCopy, mnt2, "-extpass", "echo test")
+	for name := range files {
+		got, err := ioutil.ReadFile(mnt2 + "/" + name)
+		if err != nil || !bytes.Equal(got, files[name]) {
+			t.Errorf("%s: content mismatch: %v", name, err)
+		}
+	}
+	fi, err := os.Stat(mnt2 + "/text")
+	if err != nil || fi.Size() != int64(len(content)) {
+		t.Fatalf("wrong size: %v %v", fi, err)
+	}
+	f, err := os.OpenFile(mnt2+"/text", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 10)
+	if _, err = f.ReadAt(buf, 70000); err != nil || !bytes.Equal(buf, content[70000:70010]) {
+		t.Errorf("ReadAt: %v", err)
+	}
+	// No holes in compressed files
+	if off, err := syscall.Seek(int(f.Fd()), 0, 4 /* SEEK_HOLE */); err != nil || off != int64(len(content)) {
+		t.Errorf("SEEK_HOLE: off=%d err=%v", off, err)
+	}
+	if _, err = f.WriteAt([]byte("patched"), 12345); err != nil {
+		t.Fatal(err)
+	}
+	copy(content[12345:], "patched")
+	if err = f.Truncate(80000); err != nil {
+		t.Fatal(err)
+	}
+	content = content[:80000]
+	f.Close()
+	got, err := ioutil.ReadFile(mnt2 + "/text")
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("content mismatch after write: %v", err)
+	}
+	test_helpers.UnmountPanic(mnt2)
+	// The file was converted in place and the converted copy is gone
+	var st syscall.Stat_t
+	if err = syscall.Stat(cText, &st); err != nil || st.Ino != ino {
+		t.Errorf("inode changed: %d -> %d, err=%v", ino, st.Ino, err)
+	}
+	if m, _ := filepath.Glob(cipherCopy + "/gocryptfs.uncompress.*"); len(m) != 0 {
+		t.Errorf("converted copies left behind: %v", m)
+	}
+	// Simulate a crash while the converted copy was copied over the file:
+	// the next mount finishes the copy
+	converted, err := ioutil.ReadFile(cText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leftover := fmt.Sprintf("%s/gocryptfs.uncompress.%d-%x", cipherCopy, st.Ino, bytes.Repeat([]byte{1}, 16))
+	if err = ioutil.WriteFile(leftover, converted, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(leftover+".tmp", []byte("incomplete"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(cText, converted[:len(converted)/2], 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, cipherCopy, mnt2, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt2)
+	got, err = ioutil.ReadFile(mnt2 + "/text")
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("content mismatch after recovery: %v", err)
+	}
+	if m, _ := filepath.Glob(cipherCopy + "/gocryptfs.uncompress.*"); len(m) != 0 {
+		t.Errorf("converted copies left behind after recovery: %v", m)
+	}
+}
+
+// -compress needs -reverse at -init, and a known algorithm
+func TestCompressInvalid(t *testing.T) {
+	dir := test_helpers.TmpDir + "/" + t.Name()
+	for _, args := range [][]string{
+		{"-init", "-compress=lz4"},
+		{"-init", "-reverse", "-compress=foo"},
+	} {
+		args = append([]string{"-q", "-extpass", "echo test"}, args...)
+		if _, code := runGocryptfs(append(args, dir)...); code != exitcodes.Usage {
+			t.Errorf("%v: want exit code %d, got %d", args, exitcodes.Usage, code)
+		}
+	}
+}
+
+// With -plaintextnames, the names of the converted copies are reserved, and
+// files with the former name prefix are left alone
+func TestCompressPlaintextnames(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-reverse", "-plaintextnames", "-compress=lz4")
+	// The config file of a reverse filesystem works in forward mode, too
+	if err := os.Rename(dir+"/"+configfile.ConfReverseName, dir+"/"+configfile.ConfDefaultName); err != nil {
+		t.Fatal(err)
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	user := fmt.Sprintf("%s/.gocryptfs-uncompress-1-%x", mnt, bytes.Repeat([]byte{1}, 16))
+	if err := ioutil.WriteFile(user, []byte("user data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reserved := fmt.Sprintf("%s/gocryptfs.uncompress.1-%x", mnt, bytes.Repeat([]byte{1}, 16))
+	if err := ioutil.WriteFile(reserved, nil, 0600); !errors.Is(err, syscall.EPERM) {
+		t.Errorf("create: want EPERM, have %v", err)
+	}
+	if err := os.Rename(user, reserved); !errors.Is(err, syscall.EPERM) {
+		t.Errorf("rename: want EPERM, have %v", err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	if got, err := ioutil.ReadFile(user); err != nil || string(got) != "user data" {
+		t.Errorf("user file was touched: %v %q", err, got)
+	}
+}
@@ -0,0 +1,50 @@
+package cli
+
+import (
+	"os"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Create "-gcmsiv" filesystems in forward and reverse mode and check that
+// reverse mode does not fall back to AES-SIV
+func TestInitGCMSIV(t *testing.T) {
+	for _, reverse := range []bool{false, true} {
+		args := []string{"-gcmsiv"}
+		conf := configfile.ConfDefaultName
+		if reverse {
+			args = append(args, "-reverse")
+			conf = configfile.ConfReverseName
+		}
+		dir := test_helpers.InitFS(t, args...)
+		_, c, err := configfile.LoadAndDecrypt(dir+"/"+conf, testPw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.IsFeatureFlagSet(configfile.FlagAESSIV) {
+			t.Errorf("reverse=%v: AESSIV flag should be off", reverse)
+		}
+		if !c.IsFeatureFlagSet(configfile.FlagGCMIV128) || !c.IsFeatureFlagSet(configfile.FlagHKDF) {
+			t.Errorf("reverse=%v: GCMIV128 and HKDF flags should be on", reverse)
+		}
+		algo, err := c.ContentEncryption()
+		if err != nil || algo != cryptocore.BackendAESGCMSIV {
+			t.Errorf("reverse=%v: wrong content encryption %v, err=%v", reverse, algo, err)
+		}
+	}
+	// -gcmsiv cannot be combined with other content encryption algorithms
+	dir := test_helpers.TmpDir + "/TestInitGCMSIV.conflict"
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"-aessiv", "-xchacha"} {
+		if _, code := runGocryptfs("-q", "-init", "-extpass", "echo test", "-gcmsiv", v, dir); code != exitcodes.Usage {
+			t.Errorf("%s: want exit code %d, got %d", v, exitcodes.Usage, code)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package cli
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// runGocryptfs runs gocryptfs with "args" and returns the combined output
+// and the exit code.
+func runGocryptfs(args ...string) (string, int) {
+	cmd := exec.Command(test_helpers.GocryptfsBinary, args...)
+	out, err := cmd.CombinedOutput()
+	return string(out), test_helpers.ExtractCmdExitCode(err)
+}
+
+// Add a key file and a second password, remove the original password, and
+// check that exactly the remaining credentials unlock the filesystem.
+func TestKeySlots(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	keyfile := dir + ".key"
+	if err := ioutil.WriteFile(keyfile, bytes.Repeat([]byte{0xab}, 64), 0600); err != nil {
+		t.Fatal(err)
+	}
+	out, code := runGocryptfs("-q", "-add-key", "-key-name", "backup", "-extpass", "echo test",
+		"-new-keyfile", keyfile, dir)
+	if code != 0 {
+		t.Fatalf("-add-key keyfile failed with code %d: %s", code, out)
+	}
+	// Unlock using the key file, add a password for alice
+	out, code = runGocryptfs("-q", "-add-key", "-key-name", "alice", "-keyfile", keyfile,
+		"-extpass", "echo alice", "-scryptn=10", dir)
+	if code != 0 {
+		t.Fatalf("-add-key password failed with code %d: %s", code, out)
+	}
+	out, code = runGocryptfs("-list-keys", dir)
+	if code != 0 {
+		t.Fatal(out)
+	}
+	for _, want := range []string{"default", "backup", "alice"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("-list-keys output is missing %q: %s", want, out)
+		}
+	}
+	// Revoke the original password
+	out, code = runGocryptfs("-q", "-remove-key", "-key-name", "default", "-extpass", "echo alice", dir)
+	if code != 0 {
+		t.Fatalf("-remove-key failed with code %d: %s", code, out)
+	}
+	err := test_helpers.Mount(dir, mnt, false, "-extpass", "echo test")
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.PasswordIncorrect {
+		t.Errorf("revoked password: want exit code %d, got %d", exitcodes.PasswordIncorrect, code)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo alice")
+	test_helpers.UnmountPanic(mnt)
+	test_helpers.MountOrFatal(t, dir, mnt, "-keyfile", keyfile)
+	test_helpers.UnmountPanic(mnt)
+	// Change alice's password, authorized by the key file
+	out, code = runGocryptfs("-q", "-passwd", "-keyfile", keyfile, "-key-name", "alice",
+		"-extpass", "echo newalice", dir)
+	if code != 0 {
+		t.Fatalf("-passwd failed with code %d: %s", code, out)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo newalice")
+	test_helpers.UnmountPanic(mnt)
+	// The last key slot cannot be removed
+	out, code = runGocryptfs("-q", "-remove-key", "-key-name", "alice", "-keyfile", keyfile, dir)
+	if code != 0 {
+		t.Fatalf("-remove-key failed with code %d: %s", code, out)
+	}
+	out, code = runGocryptfs("-q", "-remove-key", "-key-name", "backup", "-keyfile", keyfile, dir)
+	if code != exitcodes.Usage {
+		t.Errorf("removing the last key slot: want exit code %d, got %d: %s", exitcodes.Usage, code, out)
+	}
+}
+
+// Test -init -keyfile -keyfile-generate, with and without -keyfile-password
+func TestInitKeyfile(t *testing.T) {
+	for _, withPw := range []bool{false, true} {
+		dir, err := ioutil.TempDir(test_helpers.TmpDir, "TestInitKeyfile.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		mnt := dir + ".mnt"
+		keyfile := dir + ".key"
+		args := []string{"-q", "-init", "-keyfile", keyfile, "-keyfile-generate"}
+		if withPw {
+			args = append(args, "-keyfile-password", "-extpass", "echo test", "-scryptn=10")
+		}
+		out, code := runGocryptfs(append(args, dir)...)
+		if code != 0 {
+			t.Fatalf("-init -keyfile failed with code %d: %s", code, out)
+		}
+		fi, err := os.Stat(keyfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != 64 || fi.Mode().Perm() != 0400 {
+			t.Errorf("generated key file: size=%d mode=%o", fi.Size(), fi.Mode().Perm())
+		}
+		// Refuses to overwrite an existing key file
+		dir2, _ := ioutil.TempDir(test_helpers.TmpDir, "TestInitKeyfile.")
+		if out, code := runGocryptfs("-q", "-init", "-keyfile", keyfile, "-keyfile-generate", dir2); code == 0 {
+			t.Errorf("-keyfile-generate overwrote an existing file: %s", out)
+		}
+		if withPw {
+			err = test_helpers.Mount(dir, mnt, false, "-keyfile", keyfile, "-extpass", "echo wrong")
+			if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.PasswordIncorrect {
+				t.Errorf("wrong password: want exit code %d, got %d", exitcodes.PasswordIncorrect, code)
+			}
+			test_helpers.MountOrFatal(t, dir, mnt, "-keyfile", keyfile, "-extpass", "echo test")
+		} else {
+			test_helpers.MountOrFatal(t, dir, mnt, "-keyfile", keyfile)
+		}
+		if err := ioutil.WriteFile(mnt+"/foo", []byte("bar"), 0600); err != nil {
+			t.Error(err)
+		}
+		test_helpers.UnmountPanic(mnt)
+	}
+}
@@ -0,0 +1,66 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Create a filesystem whose masterkey is wrapped by a stand-in KMS, mount it
+// without a password and check that it becomes unusable when the KMS loses
+// the key.
+func TestKMS(t *testing.T) {
+	kms := test_helpers.StartKMSStub(test_helpers.TmpDir + "/kms.sock")
+	defer kms.Close()
+
+	dir, err := ioutil.TempDir(test_helpers.TmpDir, "TestKMS.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-init",
+		"-kms-endpoint", kms.URL, "-kms-keyid", "fleet/1", dir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	cf, err := configfile.Load(dir + "/" + configfile.ConfDefaultName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(configfile.FlagExternalKMS) {
+		t.Error("ExternalKMS flag should be on")
+	}
+	if cf.KMS.KeyID != "fleet/1" || cf.KMS.Endpoint != kms.URL {
+		t.Errorf("wrong KMS params: %#v", cf.KMS)
+	}
+
+	pDir := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, pDir)
+	if err := ioutil.WriteFile(pDir+"/foo", []byte("bar"), 0600); err != nil {
+		t.Error(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	// Password change makes no sense without a password
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-passwd", "-extpass", "echo test", dir)
+	err = cmd.Run()
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.Usage {
+		t.Errorf("-passwd: want exit code %d, got %d", exitcodes.Usage, code)
+	}
+
+	// A KMS that does not know the key must not unlock the filesystem
+	kms.Close()
+	kms2 := test_helpers.StartKMSStub("")
+	defer kms2.Close()
+	err = test_helpers.Mount(dir, pDir, false, "-kms-endpoint", kms2.URL)
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.KMS {
+		t.Errorf("want exit code %d, got %d", exitcodes.KMS, code)
+	}
+}
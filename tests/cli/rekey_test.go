@@ -0,0 +1,241 @@
+package cli
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// headerEpoch returns the key epoch stored in the header of the encrypted
+// file "path"
+func headerEpoch(t *testing.T, path string) uint32 {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := contentenc.ParseHeader(buf[:contentenc.HeaderLen])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Version == contentenc.EpochVersion && binary.BigEndian.Uint32(h.ID) != h.Epoch {
+		t.Fatalf("epoch mismatch in %q", path)
+	}
+	return h.Epoch
+}
+
+// Rotate the content key while files exist, check that old and new files
+// stay readable, and rewrite everything with "-rekey".
+func TestRotateKeyRekey(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-plaintextnames")
+	mnt := dir + ".mnt"
+	content := []byte("written before the rotation")
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	if err := ioutil.WriteFile(mnt+"/old", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// A file with a hole in the middle
+	f, err := os.Create(mnt + "/sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt(content, 0)
+	f.WriteAt(content, 1024*1024)
+	f.Close()
+	test_helpers.UnmountPanic(mnt)
+	sparseMd5 := test_helpers.Md5fn(dir + "/sparse")
+
+	out, code := runGocryptfs("-q", "-rotate-key", "-extpass", "echo test", dir)
+	if code != 0 {
+		t.Fatalf("-rotate-key failed with code %d: %s", code, out)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	if err := ioutil.WriteFile(mnt+"/new", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	plainSparseMd5 := test_helpers.Md5fn(mnt + "/sparse")
+	test_helpers.UnmountPanic(mnt)
+	if e := headerEpoch(t, dir+"/old"); e != 0 {
+		t.Errorf("old file: want epoch 0, got %d", e)
+	}
+	if e := headerEpoch(t, dir+"/new"); e != 1 {
+		t.Errorf("new file: want epoch 1, got %d", e)
+	}
+
+	out, code = runGocryptfs("-q", "-rekey", "-extpass", "echo test", dir)
+	if code != 0 {
+		t.Fatalf("-rekey failed with code %d: %s", code, out)
+	}
+	for _, n := range []string{"old", "new", "sparse"} {
+		if e := headerEpoch(t, filepath.Join(dir, n)); e != 1 {
+			t.Errorf("%s: want epoch 1 after -rekey, got %d", n, e)
+		}
+	}
+	if test_helpers.Md5fn(dir+"/sparse") == sparseMd5 {
+		t.Error("sparse file was not rewritten")
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	for _, n := range []string{"old", "new"} {
+		buf, err := ioutil.ReadFile(filepath.Join(mnt, n))
+		if err != nil || string(buf) != string(content) {
+			t.Errorf("%s: err=%v content=%q", n, err, buf)
+		}
+	}
+	if m := test_helpers.Md5fn(mnt + "/sparse"); m != plainSparseMd5 {
+		t.Errorf("sparse file content changed: %s != %s", m, plainSparseMd5)
+	}
+	test_helpers.UnmountPanic(mnt)
+
+	// A second run starts a new epoch
+	out, code = runGocryptfs("-q", "-rekey", "-extpass", "echo test", dir)
+	if code != 0 {
+		t.Fatalf("second -rekey failed with code %d: %s", code, out)
+	}
+	if e := headerEpoch(t, dir+"/old"); e != 2 {
+		t.Errorf("old file: want epoch 2 after second -rekey, got %d", e)
+	}
+}
+
+// A wrong master key passed on the command line must not end up encrypting
+// a key epoch
+func TestRotateKeyWrongMasterkey(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-plaintextnames")
+	conf := filepath.Join(dir, "gocryptfs.conf")
+	before, err := ioutil.ReadFile(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(op string, wantCode int) {
+		t.Helper()
+		out, code := runGocryptfs("-q", op, "-zerokey", dir)
+		if code == 0 || (wantCode != 0 && code != wantCode) {
+			t.Errorf("%s -zerokey: want exit code %d, got %d: %s", op, wantCode, code, out)
+		}
+		after, err := ioutil.ReadFile(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(after) != string(before) {
+			t.Errorf("%s -zerokey modified the config file", op)
+		}
+	}
+	// No key epochs yet, the key cannot be verified
+	check("-rotate-key", exitcodes.Usage)
+	check("-rekey", exitcodes.Usage)
+	// With key epochs, the wrong key fails to decrypt them
+	if out, code := runGocryptfs("-q", "-rotate-key", "-extpass", "echo test", dir); code != 0 {
+		t.Fatalf("-rotate-key failed with code %d: %s", code, out)
+	}
+	if before, err = ioutil.ReadFile(conf); err != nil {
+		t.Fatal(err)
+	}
+	check("-rotate-key", 0)
+	check("-rekey", 0)
+}
+
+// Hard-linked files are rewritten in place and keep their links. An
+// interrupted copy is finished by the next run.
+func TestRekeyHardLink(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-plaintextnames")
+	mnt := dir + ".mnt"
+	content := []byte("hard-linked file")
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	for _, n := range []string{"a", "c", "d"} {
+		if err := ioutil.WriteFile(mnt+"/"+n, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, n := range []string{"a", "c"} {
+		if err := os.Link(mnt+"/"+n, mnt+"/"+n+".link"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Used to be the temporary file name of -rekey
+	if err := ioutil.WriteFile(mnt+"/user.gocryptfs-rekey.tmp", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	out, code := runGocryptfs("-q", "-rotate-key", "-extpass", "echo test", dir)
+	if code != 0 {
+		t.Fatalf("-rotate-key failed with code %d: %s", code, out)
+	}
+	// "-rekey" refuses to run while the filesystem is mounted
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	if err := ioutil.WriteFile(mnt+"/new", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	out, code = runGocryptfs("-q", "-rekey", "-extpass", "echo test", dir)
+	test_helpers.UnmountPanic(mnt)
+	if code != exitcodes.Rekey {
+		t.Fatalf("-rekey while mounted: want exit code %d, got %d: %s", exitcodes.Rekey, code, out)
+	}
+	// Simulate a crash while "c" was copied over "a": "new" has the same
+	// content encrypted with the new epoch
+	newVersion, err := ioutil.ReadFile(dir + "/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st syscall.Stat_t
+	if err = syscall.Stat(dir+"/c", &st); err != nil {
+		t.Fatal(err)
+	}
+	old, err := ioutil.ReadFile(dir + "/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := contentenc.ParseHeader(old[:contentenc.HeaderLen])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := fmt.Sprintf("%s/gocryptfs.rekey.%d-%x", dir, st.Ino, h.ID)
+	if err = ioutil.WriteFile(pending, newVersion, 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(dir+"/c", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt(newVersion[:contentenc.HeaderLen+10], 0)
+	f.Close()
+	// An interrupted write of the temporary file
+	if err = ioutil.WriteFile(dir+"/gocryptfs.rekey.tmp", []byte("incomplete"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	out, code = runGocryptfs("-q", "-rekey", "-extpass", "echo test", dir)
+	if code != 0 {
+		t.Fatalf("-rekey failed with code %d: %s", code, out)
+	}
+	for _, n := range []string{"a", "a.link", "c", "c.link", "d", "new", "user.gocryptfs-rekey.tmp"} {
+		if e := headerEpoch(t, filepath.Join(dir, n)); e != 1 {
+			t.Errorf("%s: want epoch 1 after -rekey, got %d", n, e)
+		}
+	}
+	if m, _ := filepath.Glob(dir + "/gocryptfs.rekey.*"); len(m) != 0 {
+		t.Errorf("temporary files left behind: %v", m)
+	}
+	var st2 syscall.Stat_t
+	if err = syscall.Stat(dir+"/c.link", &st2); err != nil || st2.Ino != st.Ino || st2.Nlink != 2 {
+		t.Errorf("hard link was broken: ino %d -> %d, nlink %d, err=%v", st.Ino, st2.Ino, st2.Nlink, err)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	for _, n := range []string{"a", "a.link", "c", "c.link", "d", "user.gocryptfs-rekey.tmp"} {
+		buf, err := ioutil.ReadFile(filepath.Join(mnt, n))
+		if err != nil || string(buf) != string(content) {
+			t.Errorf("%s: err=%v content=%q", n, err, buf)
+		}
+	}
+	if err = ioutil.WriteFile(mnt+"/gocryptfs.rekey.tmp", content, 0600); !errors.Is(err, syscall.EPERM) {
+		t.Errorf("creating a reserved name: want EPERM, have %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package cli
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Write a file with the password, then check that the exported reader key
+// can read it, cannot write, and detects tampering.
+func TestWriteAuth(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-write-auth", "-plaintextnames")
+	mnt := dir + ".mnt"
+	content := bytes.Repeat([]byte("signed content "), 1000)
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	if err := ioutil.WriteFile(mnt+"/foo", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(mnt+"/bar", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Growing a file and writing past the end must not create file holes,
+	// they would not pass the signature check
+	if err := ioutil.WriteFile(mnt+"/grown", []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(mnt+"/grown", 3*4096); err != nil {
+		t.Fatal(err)
+	}
+	g, err := os.OpenFile(mnt+"/grown", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = g.WriteAt([]byte("y"), 10*4096+1); err != nil {
+		t.Fatal(err)
+	}
+	g.Close()
+	test_helpers.UnmountPanic(mnt)
+	grown := make([]byte, 10*4096+2)
+	grown[0] = 'x'
+	grown[len(grown)-1] = 'y'
+	// Zero the second block of "foo": an all-zero block is not a file hole
+	// when blocks are signed
+	f, err := os.OpenFile(dir+"/foo", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Block size plus nonce, tag and signature
+	const cipherBS = 4096 + 16 + 16 + 64
+	f.WriteAt(make([]byte, cipherBS), 18+cipherBS)
+	f.Close()
+
+	out, code := runGocryptfs("-q", "-export-reader-key", "-extpass", "echo test", dir)
+	if code != 0 {
+		t.Fatalf("-export-reader-key failed with code %d: %s", code, out)
+	}
+	readerKey := strings.TrimSpace(out)
+	if len(readerKey) != 64 {
+		t.Fatalf("unexpected reader key %q", readerKey)
+	}
+	// Corrupt the last byte (part of the signature) of "bar"
+	f, err = os.OpenFile(dir+"/bar", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, _ := f.Stat()
+	buf := make([]byte, 1)
+	f.ReadAt(buf, fi.Size()-1)
+	buf[0] ^= 1
+	f.WriteAt(buf, fi.Size()-1)
+	f.Close()
+
+	test_helpers.MountOrFatal(t, dir, mnt, "-reader-key="+readerKey, "-wpanic=false")
+	got, err := ioutil.ReadFile(mnt + "/grown")
+	if err != nil || !bytes.Equal(got, grown) {
+		t.Errorf("reading the grown file with the reader key failed: %v", err)
+	}
+	if _, err = ioutil.ReadFile(mnt + "/foo"); err == nil {
+		t.Error("reading a file with a zeroed block should fail")
+	}
+	if _, err = ioutil.ReadFile(mnt + "/bar"); err == nil {
+		t.Error("reading a tampered file should fail")
+	}
+	if err = ioutil.WriteFile(mnt+"/new", content, 0600); err == nil {
+		t.Error("the reader key mount should be read-only")
+	}
+	test_helpers.UnmountPanic(mnt)
+
+	// The reader key is not the master key
+	if out, code := runGocryptfs("-q", "-masterkey="+readerKey, dir, mnt); code != exitcodes.PasswordIncorrect {
+		t.Errorf("-masterkey with the reader key: want exit code %d, got %d: %s", exitcodes.PasswordIncorrect, code, out)
+	}
+	// -write-auth filesystems have no key epochs
+	if _, code := runGocryptfs("-q", "-rotate-key", "-extpass", "echo test", dir); code != exitcodes.Usage {
+		t.Errorf("-rotate-key: want exit code %d, got %d", exitcodes.Usage, code)
+	}
+}
+
+// Filesystems without -write-auth have no reader key
+func TestWriteAuthMissing(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	if err := os.Mkdir(mnt, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, code := runGocryptfs("-q", "-export-reader-key", "-extpass", "echo test", dir); code != exitcodes.Usage {
+		t.Errorf("-export-reader-key: want exit code %d, got %d", exitcodes.Usage, code)
+	}
+	if _, code := runGocryptfs("-q", "-reader-key="+strings.Repeat("00", 32), dir, mnt); code != exitcodes.Usage {
+		t.Errorf("-reader-key: want exit code %d, got %d", exitcodes.Usage, code)
+	}
+}
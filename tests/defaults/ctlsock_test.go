@@ -1,9 +1,13 @@
 package defaults
 
 import (
+	"encoding/json"
+	"fmt"
+	"net"
 	"os"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/rfjakob/gocryptfs/v2/ctlsock"
 	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
@@ -96,3 +100,197 @@ func TestCtlSockDecryptCrash(t *testing.T) {
 	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
 	defer test_helpers.UnmountPanic(pDir)
 }
+
+// TestCtlSockCommands tests the versioned API
+func TestCtlSockCommands(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	mounted := true
+	defer func() {
+		if mounted {
+			test_helpers.UnmountPanic(pDir)
+		}
+	}()
+	query := func(cmd string) ctlsock.ResponseStruct {
+		req := ctlsock.RequestStruct{Version: ctlsock.CurrentVersion, Command: cmd}
+		resp := test_helpers.QueryCtlSock(t, sock, req)
+		if resp.ErrNo != 0 {
+			t.Fatalf("%s: %+v", cmd, resp)
+		}
+		if resp.Version != ctlsock.CurrentVersion {
+			t.Errorf("%s: wrong version %d", cmd, resp.Version)
+		}
+		return resp
+	}
+
+	resp := query(ctlsock.CmdStatus)
+	if resp.Status == nil || resp.Status.Cipherdir != cDir || resp.Status.Mountpoint != pDir ||
+		resp.Status.Reverse || resp.Status.PID == 0 {
+		t.Errorf("wrong status: %+v", resp.Status)
+	}
+
+	resp = query(ctlsock.CmdFeatureFlags)
+	found := false
+	for _, f := range resp.FeatureFlags {
+		if f == "HKDF" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("HKDF missing in feature flags: %v", resp.FeatureFlags)
+	}
+
+	f, err := os.Create(pDir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st syscall.Stat_t
+	resp = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{
+		Version: ctlsock.CurrentVersion, Command: ctlsock.CmdEncryptPath, Path: "file"})
+	cPath := resp.Result
+	if err := syscall.Stat(cDir+"/"+cPath, &st); err != nil {
+		t.Fatal(err)
+	}
+	resp = query(ctlsock.CmdOpenFiles)
+	found = false
+	for _, of := range resp.OpenFiles {
+		if of.Ino == st.Ino && of.RefCount == 1 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("file (ino %d) missing in open files: %+v", st.Ino, resp.OpenFiles)
+	}
+	f.Close()
+
+	query(ctlsock.CmdFlushDirCache)
+
+	resp = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{
+		Version: ctlsock.CurrentVersion, Command: ctlsock.CmdSetDebug, Debug: true})
+	if resp.ErrNo != 0 {
+		t.Fatal(resp)
+	}
+	if !query(ctlsock.CmdStatus).Status.Debug {
+		t.Error("debug logging was not enabled")
+	}
+	query(ctlsock.CmdSetDebug)
+	if query(ctlsock.CmdStatus).Status.Debug {
+		t.Error("debug logging was not disabled")
+	}
+
+	// Errors
+	for _, req := range []ctlsock.RequestStruct{
+		{Version: ctlsock.CurrentVersion, Command: "NoSuchCommand"},
+		{Version: ctlsock.CurrentVersion + 1, Command: ctlsock.CmdStatus},
+		{Version: ctlsock.CurrentVersion, Command: ctlsock.CmdStatus, EncryptPath: "file"},
+	} {
+		resp = test_helpers.QueryCtlSock(t, sock, req)
+		if resp.ErrNo == 0 {
+			t.Errorf("%+v: expected an error, got %+v", req, resp)
+		}
+	}
+
+	query(ctlsock.CmdUnmount)
+	mounted = false
+	if _, err := os.Stat(pDir + "/file"); !os.IsNotExist(err) {
+		t.Errorf("still mounted? err=%v", err)
+	}
+}
+
+// TestCtlSockBatch tests CmdEncryptPaths and CmdDecryptPaths
+func TestCtlSockBatch(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+
+	paths := []string{
+		"foo",
+		"foo/bar/baz",
+		"foo/bar/qux",
+		"123/" + test_helpers.X255 + "/456",
+	}
+	for _, p := range paths {
+		if err := os.MkdirAll(pDir+"/"+p, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	in := append(paths, "not-existing-dir/xyz", "/foo/", ".")
+	resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{
+		Version: ctlsock.CurrentVersion, Command: ctlsock.CmdEncryptPaths, Paths: in})
+	if resp.ErrNo != 0 || len(resp.Results) != len(in) {
+		t.Fatalf("bad response: %+v", resp)
+	}
+	// Compare with single requests
+	for i, p := range in {
+		single := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{EncryptPath: p})
+		want := ctlsock.PathResult{Result: single.Result, ErrNo: single.ErrNo,
+			ErrText: single.ErrText, WarnText: single.WarnText}
+		if resp.Results[i] != want {
+			t.Errorf("%q: batch=%+v single=%+v", p, resp.Results[i], want)
+		}
+	}
+	if resp.Results[4].ErrNo != int32(syscall.ENOENT) {
+		t.Errorf("wanted ENOENT, got %+v", resp.Results[4])
+	}
+	// Decrypt the results back
+	var cPaths []string
+	for _, r := range resp.Results[:len(paths)] {
+		cPaths = append(cPaths, r.Result)
+	}
+	resp = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{
+		Version: ctlsock.CurrentVersion, Command: ctlsock.CmdDecryptPaths, Paths: cPaths})
+	if resp.ErrNo != 0 || len(resp.Results) != len(paths) {
+		t.Fatalf("bad response: %+v", resp)
+	}
+	for i, r := range resp.Results {
+		if r.ErrNo != 0 || r.Result != paths[i] {
+			t.Errorf("want=%q got=%+v", paths[i], r)
+		}
+	}
+	// An empty batch is an error
+	resp = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{
+		Version: ctlsock.CurrentVersion, Command: ctlsock.CmdEncryptPaths})
+	if resp.ErrNo == 0 {
+		t.Errorf("expected an error, got %+v", resp)
+	}
+}
+
+// TestCtlSockPipelined sends several requests without waiting for the
+// responses
+func TestCtlSockPipelined(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	const n = 100
+	var reqs []byte
+	for i := 0; i < n; i++ {
+		reqs = append(reqs, fmt.Sprintf(`{"EncryptPath": "file%d"}`, i)...)
+	}
+	if _, err := conn.Write(reqs); err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(conn)
+	for i := 0; i < n; i++ {
+		var resp ctlsock.ResponseStruct
+		if err := dec.Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		want := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{EncryptPath: fmt.Sprintf("file%d", i)})
+		if resp.ErrNo != 0 || resp.Result != want.Result {
+			t.Errorf("response %d: want %+v, got %+v", i, want, resp)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package defaults
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// metricValue returns the value of the metric "name" in the text format
+// output "out", or -1 if it is missing
+func metricValue(out string, name string) float64 {
+	m := regexp.MustCompile("(?m)^" + regexp.QuoteMeta(name) + " (.*)$").FindStringSubmatch(out)
+	if m == nil {
+		return -1
+	}
+	v, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return -1
+	}
+	return v
+}
+
+// TestMetrics reads the metrics through the control socket and through
+// "-metrics unix:PATH"
+func TestMetrics(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	metricsSock := cDir + ".metrics"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-metrics=unix:"+metricsSock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+
+	data := make([]byte, 10000)
+	if err := os.WriteFile(pDir+"/file", data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.ReadFile(pDir + "/file"); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{
+		Version: ctlsock.CurrentVersion, Command: ctlsock.CmdMetrics})
+	if resp.ErrNo != 0 {
+		t.Fatal(resp)
+	}
+	out := resp.Metrics
+	if v := metricValue(out, "gocryptfs_written_bytes_total"); v < float64(len(data)) {
+		t.Errorf("gocryptfs_written_bytes_total=%v", v)
+	}
+	// 10000 bytes are 3 blocks
+	if v := metricValue(out, "gocryptfs_blocks_encrypted_total"); v < 3 {
+		t.Errorf("gocryptfs_blocks_encrypted_total=%v", v)
+	}
+	if v := metricValue(out, "gocryptfs_auth_failures_total"); v != 0 {
+		t.Errorf("gocryptfs_auth_failures_total=%v", v)
+	}
+	if v := metricValue(out, `gocryptfs_fuse_op_duration_seconds_count{op="WRITE"}`); v < 1 {
+		t.Errorf("WRITE latency count=%v", v)
+	}
+
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", metricsSock)
+		},
+	}}
+	r, err := client.Get("http://gocryptfs/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := metricValue(string(body), "gocryptfs_written_bytes_total"); v < float64(len(data)) {
+		t.Errorf("HTTP: gocryptfs_written_bytes_total=%v\n%s", v, body)
+	}
+}
+
+// TestMetricsPublicAddress checks that "-metrics" refuses to listen on an
+// address that is reachable from the network
+func TestMetricsPublicAddress(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	if err := os.Mkdir(pDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-extpass", "echo test", "-metrics=0.0.0.0:0", cDir, pDir)
+	if code := test_helpers.ExtractCmdExitCode(cmd.Run()); code != exitcodes.Metrics {
+		t.Errorf("want exit code %d, got %d", exitcodes.Metrics, code)
+	}
+}
@@ -1,7 +1,10 @@
 package fsck
 
 import (
+	"bytes"
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"os"
 	"os/exec"
 	"runtime"
@@ -12,7 +15,10 @@ import (
 
 	"github.com/pkg/xattr"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/offlinefsck"
 	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
 )
 
@@ -137,3 +143,561 @@ func TestTerabyteFile(t *testing.T) {
 	cmd.Wait()
 	timer.Stop()
 }
+
+// runFsckOffline runs "gocryptfs -fsck -offline" on "dir" and returns the
+// output and the exit code.
+func runFsckOffline(t *testing.T, dir string) (string, int) {
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-offline", "-extpass", "echo test", dir)
+	outBin, err := cmd.CombinedOutput()
+	return string(outBin), test_helpers.ExtractCmdExitCode(err)
+}
+
+// runFsckRepair runs "gocryptfs -fsck -repair" on "dir" and returns the
+// output and the exit code.
+func runFsckRepair(t *testing.T, dir string, extraArgs ...string) (string, int) {
+	args := []string{"-fsck", "-repair", "-extpass", "echo test"}
+	args = append(args, extraArgs...)
+	args = append(args, dir)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, args...)
+	outBin, err := cmd.CombinedOutput()
+	return string(outBin), test_helpers.ExtractCmdExitCode(err)
+}
+
+// The offline checker finds the same problems in broken_fs_v1.4, and
+// attributes them to the plaintext path
+func TestBrokenFsV14Offline(t *testing.T) {
+	out, code := runFsckOffline(t, "broken_fs_v1.4")
+	t.Log(out)
+	if code != exitcodes.FsckErrors {
+		t.Errorf("wrong exit code, have=%d want=%d", code, exitcodes.FsckErrors)
+	}
+	for _, want := range []string{
+		`"corrupt_file" (vDKs8a7UtM3PmEKk9wlPcA): bad block 0`,
+		`"corrupt_file_2" (qOA8a4yuvgbMFpz7277R8A): header:`,
+		`"missing_diriv" (K2m0E6qzIfoLkVZJanoUiQ): diriv:`,
+		`"invalid_file_name.3" (invalid_file_name.3): name:`,
+		`"corrupt_symlink" (s-P7PcQDUcVkoeMDnC3EYA): symlink:`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing in output: %s", want)
+		}
+	}
+}
+
+func TestExampleFsesOffline(t *testing.T) {
+	entries, err := os.ReadDir("../example_filesystems")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() || strings.Contains(e.Name(), "reverse") || e.Name() == "content" {
+			continue
+		}
+		out, code := runFsckOffline(t, "../example_filesystems/"+e.Name())
+		if code == exitcodes.DeprecatedFS {
+			continue
+		}
+		if code != 0 {
+			t.Log(out)
+			t.Errorf("%s: fsck returned code %d but fs should be clean", e.Name(), code)
+		}
+	}
+}
+
+// Orphaned .name files, and long name files without .name file, are found
+// offline
+func TestLongNamesOffline(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	for _, n := range []string{"a", "b"} {
+		if err := os.WriteFile(pDir+"/"+strings.Repeat(n, 200), []byte("foo"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	test_helpers.UnmountPanic(pDir)
+	if out, code := runFsckOffline(t, cDir); code != 0 {
+		t.Fatalf("clean fs: code %d: %s", code, out)
+	}
+	entries, err := os.ReadDir(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var long []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "gocryptfs.longname.") && !strings.HasSuffix(e.Name(), ".name") {
+			long = append(long, e.Name())
+		}
+	}
+	if len(long) != 2 {
+		t.Fatalf("expected 2 long names, have %v", long)
+	}
+	// Orphan the first .name file, and lose the second one
+	os.Remove(cDir + "/" + long[0])
+	os.Remove(cDir + "/" + long[1] + ".name")
+	out, code := runFsckOffline(t, cDir)
+	t.Log(out)
+	if code != exitcodes.FsckErrors {
+		t.Errorf("wrong exit code, have=%d want=%d", code, exitcodes.FsckErrors)
+	}
+	if !strings.Contains(out, "orphaned .name file") || !strings.Contains(out, long[1]+"): longname:") {
+		t.Error("long name problems not reported")
+	}
+	// -repair deletes the orphaned .name file and moves the other file to
+	// lost+found
+	out, code = runFsckRepair(t, cDir)
+	t.Log(out)
+	if code != exitcodes.FsckErrors {
+		t.Errorf("repair: wrong exit code, have=%d want=%d", code, exitcodes.FsckErrors)
+	}
+	if out, code := runFsckOffline(t, cDir); code != 0 {
+		t.Errorf("not clean after repair: code %d: %s", code, out)
+	}
+	if _, err := os.Stat(cDir + "/" + long[0] + ".name"); !os.IsNotExist(err) {
+		t.Errorf("orphaned .name file still exists: %v", err)
+	}
+}
+
+// internalFiles creates the internal files gocryptfs may leave behind in
+// the root directory of "cDir" and its subdirectory "sub", and returns their
+// paths
+func internalFiles(t *testing.T, cDir string, sub string) []string {
+	id := strings.Repeat("ab", 16)
+	paths := []string{
+		cDir + "/gocryptfs.uncompress.1-" + id,
+		cDir + "/gocryptfs.uncompress.1-" + id + ".tmp",
+		cDir + "/gocryptfs.rekey.tmp",
+		cDir + "/gocryptfs.rekey.1-" + id,
+		cDir + "/" + sub + "/" + nametransform.DirIVTmpName,
+		cDir + "/" + sub + "/.gocryptfs-restore-journal",
+	}
+	for _, p := range paths {
+		if err := os.WriteFile(p, []byte("internal"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return paths
+}
+
+// Internal files are not reported as undecryptable names
+func TestInternalFilesOffline(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	if err := os.Mkdir(pDir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+	internalFiles(t, cDir, encryptedSubdir(t, cDir))
+	if out, code := runFsckOffline(t, cDir); code != 0 {
+		t.Errorf("internal files were reported: code %d: %s", code, out)
+	}
+}
+
+// -repair never moves internal files to lost+found
+func TestInternalFilesRepair(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	if err := os.Mkdir(pDir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+	paths := internalFiles(t, cDir, encryptedSubdir(t, cDir))
+	if out, code := runFsckRepair(t, cDir); code != 0 {
+		t.Errorf("code %d: %s", code, out)
+	}
+	for _, p := range paths {
+		if _, err := os.Stat(p); err != nil {
+			t.Error(err)
+		}
+	}
+	// No lost+found next to "dir"
+	entries, err := os.ReadDir(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs := 0
+	for _, e := range entries {
+		if e.IsDir() {
+			dirs++
+		}
+	}
+	if dirs != 1 {
+		t.Errorf("want 1 directory, have %d", dirs)
+	}
+}
+
+// After repairing broken_fs_v1.4, only the quarantined files in lost+found
+// are still reported
+func TestBrokenFsV14Repair(t *testing.T) {
+	dir := test_helpers.TmpDir + "/TestBrokenFsV14Repair"
+	if out, err := exec.Command("cp", "-a", "broken_fs_v1.4", dir).CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	xattr.Set(dir+"/CMyUifVTjW5fsgXonWBT_RDkvLkdGrLttkZ45T3Oi3A",
+		"user.gocryptfs.0a5e7yWl0SGUGeWB0Sy2K0",
+		dec64("QHUMDTgbnl8Sv_A2dFQic_G2vN4_gmDna3651JAhF7OZ-YI"))
+	out, code := runFsckRepair(t, dir)
+	t.Log(out)
+	if code != exitcodes.FsckErrors {
+		t.Errorf("wrong exit code, have=%d want=%d", code, exitcodes.FsckErrors)
+	}
+	for _, want := range []string{
+		`"corrupt_file" (vDKs8a7UtM3PmEKk9wlPcA): bad block 0: cipher: message authentication failed [repaired: zero-filled]`,
+		`"corrupt_file_2" (qOA8a4yuvgbMFpz7277R8A): header:`,
+		`"diriv_too_short" (trqecbMNXdzLqzpk7fSfKw): diriv: wanted 16 bytes, got 3 [repaired: created new gocryptfs.diriv]`,
+		`"diriv_too_long" (yrwcjj2qoC4IYvhw9sbfRg): diriv: wanted 16 bytes, got 17 [repaired: truncated gocryptfs.diriv]`,
+		`[repaired: moved to lost+found/#`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing in output: %s", want)
+		}
+	}
+	out, code = runFsckOffline(t, dir)
+	t.Log(out)
+	if code != exitcodes.FsckErrors {
+		t.Errorf("wrong exit code, have=%d want=%d", code, exitcodes.FsckErrors)
+	}
+	for _, l := range strings.Split(out, "\n") {
+		if strings.HasPrefix(l, `fsck: "`) && !strings.HasPrefix(l, `fsck: "lost+found/#`) &&
+			!strings.HasPrefix(l, `fsck: "missing_diriv"`) {
+			t.Errorf("not repaired: %s", l)
+		}
+	}
+	// Without a backup, a non-empty directory without gocryptfs.diriv is
+	// left alone
+	if _, err := os.Stat(dir + "/K2m0E6qzIfoLkVZJanoUiQ/mWEr9JLch2FW40qhbnPgpg"); err != nil {
+		t.Errorf("entry of missing_diriv was moved: %v", err)
+	}
+	if _, err := os.Stat(dir + "/K2m0E6qzIfoLkVZJanoUiQ/" + nametransform.DirIVFilename); !os.IsNotExist(err) {
+		t.Errorf("missing_diriv got a new gocryptfs.diriv: %v", err)
+	}
+	if fi, err := os.Stat(dir + "/yrwcjj2qoC4IYvhw9sbfRg/" + nametransform.DirIVFilename); err != nil || fi.Size() != nametransform.DirIVLen {
+		t.Errorf("diriv_too_long was not truncated: %v", err)
+	}
+}
+
+// encryptedSubdir returns the name of the single directory in "cDir"
+func encryptedSubdir(t *testing.T, cDir string) string {
+	entries, err := os.ReadDir(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			return e.Name()
+		}
+	}
+	t.Fatalf("no directory in %q", cDir)
+	return ""
+}
+
+// A lost gocryptfs.diriv file is restored from a backup copy
+func TestRepairDirIVFromBackup(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	if err := os.Mkdir(pDir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pDir+"/dir/file", []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+	backup := cDir + ".backup"
+	if out, err := exec.Command("cp", "-a", cDir, backup).CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	diriv := cDir + "/" + encryptedSubdir(t, cDir) + "/" + nametransform.DirIVFilename
+	if err := syscall.Unlink(diriv); err != nil {
+		t.Fatal(err)
+	}
+	out, code := runFsckRepair(t, cDir, "-repair-from", backup)
+	t.Log(out)
+	if code != exitcodes.FsckErrors || !strings.Contains(out, "[repaired: restored gocryptfs.diriv from backup]") {
+		t.Errorf("diriv was not restored, code %d", code)
+	}
+	if out, code := runFsckOffline(t, cDir); code != 0 {
+		t.Errorf("not clean after repair: code %d: %s", code, out)
+	}
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	content, err := os.ReadFile(pDir + "/dir/file")
+	if err != nil || string(content) != "hello" {
+		t.Errorf("content=%q err=%v", content, err)
+	}
+}
+
+// A block that fails authentication is zero-filled, the other blocks are
+// kept
+func TestRepairBlock(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	content := bytes.Repeat([]byte("a"), 3*contentenc.DefaultBS)
+	if err := os.WriteFile(pDir+"/file", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+	entries, err := os.ReadDir(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cFile string
+	for _, e := range entries {
+		if e.Type().IsRegular() && e.Name() != nametransform.DirIVFilename && e.Name() != "gocryptfs.conf" {
+			cFile = cDir + "/" + e.Name()
+		}
+	}
+	f, err := os.OpenFile(cFile, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flip a byte in block 1. Ciphertext blocks have 32 bytes of IV and tag.
+	off := int64(contentenc.HeaderLen + (contentenc.DefaultBS + 32) + 100)
+	buf := make([]byte, 1)
+	f.ReadAt(buf, off)
+	buf[0]++
+	f.WriteAt(buf, off)
+	f.Close()
+	out, code := runFsckRepair(t, cDir)
+	t.Log(out)
+	if code != exitcodes.FsckErrors || !strings.Contains(out, "bad block 1") {
+		t.Errorf("bad block not reported, code %d", code)
+	}
+	if out, code := runFsckOffline(t, cDir); code != 0 {
+		t.Errorf("not clean after repair: code %d: %s", code, out)
+	}
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	have, err := os.ReadFile(pDir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte{}, content...)
+	copy(want[contentenc.DefaultBS:], make([]byte, contentenc.DefaultBS))
+	if !bytes.Equal(have, want) {
+		t.Error("wrong content after repair")
+	}
+}
+
+// Sparse files are skipped quickly
+func TestTerabyteFileOffline(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skipf("Only linux supports SEEK_DATA")
+	}
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	f, err := os.Create(pDir + "/veryBigFile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte("foobar"), 1024*1024*1024*1024)
+	f.Close()
+	test_helpers.UnmountPanic(pDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if out, code := runFsckOffline(t, cDir); code != 0 {
+		t.Errorf("code %d: %s", code, out)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("fsck took %v", d)
+	}
+}
+
+// runFsckJSON runs "gocryptfs -fsck -offline -json" on "dir" and returns the parsed
+// report and the exit code.
+func runFsckJSON(t *testing.T, dir string, extraArgs ...string) (*offlinefsck.Report, int) {
+	args := []string{"-fsck", "-offline", "-json", "-extpass", "echo test"}
+	args = append(args, extraArgs...)
+	args = append(args, dir)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, args...)
+	cmd.Stderr = os.Stderr
+	outBin, err := cmd.Output()
+	code := test_helpers.ExtractCmdExitCode(err)
+	var r offlinefsck.Report
+	if err := json.Unmarshal(outBin, &r); err != nil {
+		t.Fatalf("invalid json: %v\n%s", err, outBin)
+	}
+	return &r, code
+}
+
+// -json and -fsck-state do not silently switch to offline mode
+func TestOfflineOnlyFlags(t *testing.T) {
+	for _, flag := range []string{"-json", "-fsck-state=/dev/null"} {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-fsck", flag, "-extpass", "echo test", "broken_fs_v1.4")
+		out, err := cmd.CombinedOutput()
+		if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.Usage {
+			t.Errorf("%s: want exit code %d, got %d: %s", flag, exitcodes.Usage, code, out)
+		}
+	}
+}
+
+func TestBrokenFsV14JSON(t *testing.T) {
+	r, code := runFsckJSON(t, "broken_fs_v1.4")
+	if code != exitcodes.FsckErrors {
+		t.Errorf("wrong exit code, have=%d want=%d", code, exitcodes.FsckErrors)
+	}
+	if r.Totals.ByClass[offlinefsck.ClassBlock] != 1 || r.Totals.ByClass[offlinefsck.ClassDirIV] != 3 ||
+		r.Totals.ByClass[offlinefsck.ClassName] != 3 || r.Totals.ByClass[offlinefsck.ClassHeader] != 3 {
+		t.Errorf("wrong totals: %#v", r.Totals)
+	}
+	found := false
+	for _, e := range r.Entries {
+		if e.Path == "corrupt_file" {
+			found = true
+			if e.CipherPath != "vDKs8a7UtM3PmEKk9wlPcA" || e.Type != offlinefsck.TypeFile || len(e.Problems) != 1 ||
+				e.Problems[0].Block == nil || *e.Problems[0].Block != 0 {
+				t.Errorf("wrong entry: %#v", e)
+			}
+		}
+	}
+	if !found {
+		t.Error("corrupt_file missing in report")
+	}
+}
+
+// With -fsck-state, unchanged files are skipped, modified files are checked
+// again
+func TestIncrementalState(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	for _, n := range []string{"a", "b"} {
+		if err := os.WriteFile(pDir+"/"+n, bytes.Repeat([]byte(n), 10000), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	test_helpers.UnmountPanic(pDir)
+	state := cDir + ".state"
+	r, code := runFsckJSON(t, cDir, "-fsck-state", state)
+	if code != 0 || r.Totals.Files != 2 || r.Totals.Unchanged != 0 {
+		t.Fatalf("first run: code %d, totals %#v", code, r.Totals)
+	}
+	r, code = runFsckJSON(t, cDir, "-fsck-state", state)
+	if code != 0 || r.Totals.Files != 2 || r.Totals.Unchanged != 2 {
+		t.Fatalf("second run: code %d, totals %#v", code, r.Totals)
+	}
+	// Corrupt one file. This changes its mtime.
+	var cFile string
+	for _, e := range r.Entries {
+		if e.Path == "a" {
+			cFile = cDir + "/" + e.CipherPath
+		}
+	}
+	f, err := os.OpenFile(cFile, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("xxx"), 100)
+	f.Close()
+	r, code = runFsckJSON(t, cDir, "-fsck-state", state)
+	if code != exitcodes.FsckErrors || r.Totals.Unchanged != 1 || r.Totals.ByClass[offlinefsck.ClassBlock] != 1 {
+		t.Errorf("third run: code %d, totals %#v", code, r.Totals)
+	}
+	// Files with problems are not recorded in the state file, so they are
+	// checked again
+	r, code = runFsckJSON(t, cDir, "-fsck-state", state)
+	if code != exitcodes.FsckErrors || r.Totals.Unchanged != 1 {
+		t.Errorf("fourth run: code %d, totals %#v", code, r.Totals)
+	}
+}
+
+// All links of a hard-linked file are recorded in the state file, so the
+// file is still unchanged when the first link is gone
+func TestIncrementalStateHardLink(t *testing.T) {
+	cDir := test_helpers.InitFS(t, "-plaintextnames")
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	if err := os.WriteFile(pDir+"/a", []byte("hard-linked"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(pDir+"/a", pDir+"/b"); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+	state := cDir + ".state"
+	if _, code := runFsckJSON(t, cDir, "-fsck-state", state); code != 0 {
+		t.Fatalf("first run: code %d", code)
+	}
+	s, err := offlinefsck.LoadState(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Files) != 2 {
+		t.Errorf("want both links in the state file, have %v", s.Files)
+	}
+	if err = os.Remove(cDir + "/a"); err != nil {
+		t.Fatal(err)
+	}
+	r, code := runFsckJSON(t, cDir, "-fsck-state", state)
+	if code != 0 || r.Totals.Unchanged != 1 {
+		t.Errorf("second run: code %d, totals %#v", code, r.Totals)
+	}
+}
+
+// With -jobs, mitigated corruptions found by parallel workers are
+// attributed to the right file, and hard-linked files are checked once
+func TestParallel(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	const n = 20
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("%s/file%02d", pDir, i)
+		if err := os.WriteFile(name, bytes.Repeat([]byte{byte(i)}, 100000), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Link(name, name+".link"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	test_helpers.UnmountPanic(pDir)
+	// Put an xattr with an invalid name on every other file
+	r, _ := runFsckJSON(t, cDir)
+	if r.Totals.Files != n {
+		t.Fatalf("hard links were checked twice: %d files", r.Totals.Files)
+	}
+	var corrupt []string
+	for _, e := range r.Entries {
+		if e.Type != offlinefsck.TypeFile {
+			continue
+		}
+		// Only one of the hard links is listed
+		name := strings.TrimSuffix(e.Path, ".link")
+		var i int
+		fmt.Sscanf(name, "file%02d", &i)
+		if i%2 == 0 {
+			if err := xattr.LSet(cDir+"/"+e.CipherPath, "user.gocryptfs.invalid!", []byte("x")); err != nil {
+				t.Skip(err)
+			}
+			corrupt = append(corrupt, name)
+		}
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-jobs", "8", "-extpass", "echo test", cDir)
+	outBin, err := cmd.CombinedOutput()
+	out := string(outBin)
+	t.Log(out)
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.FsckErrors {
+		t.Errorf("wrong exit code, have=%d want=%d", code, exitcodes.FsckErrors)
+	}
+	if c := strings.Count(out, "corrupt xattr name on file"); c != len(corrupt) {
+		t.Errorf("have %d xattr corruptions, want %d", c, len(corrupt))
+	}
+	for _, name := range corrupt {
+		// The file may have been checked under the name of its hard link
+		if !strings.Contains(out, fmt.Sprintf("corrupt xattr name on file %q", name)) &&
+			!strings.Contains(out, fmt.Sprintf("corrupt xattr name on file %q", name+".link")) {
+			t.Errorf("%q not reported", name)
+		}
+	}
+	// The offline checker gives the same result
+	r, code := runFsckJSON(t, cDir, "-jobs", "8")
+	if code != exitcodes.FsckErrors || r.Totals.ByClass[offlinefsck.ClassXattr] != len(corrupt) {
+		t.Errorf("offline: code %d, totals %#v", code, r.Totals)
+	}
+}
@@ -70,6 +70,8 @@ var matrix = []testcaseMatrix{
 	// Test xchacha with and without openssl
 	{false, "true", false, true, []string{"-xchacha"}},
 	{false, "false", false, true, []string{"-xchacha"}},
+	// AES-GCM-SIV (does not use openssl either)
+	{false, "auto", false, true, []string{"-gcmsiv"}},
 }
 
 // This is the entry point for the tests
@@ -0,0 +1,66 @@
+package reverse_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// TestConsistentReads checks that with -consistent-reads, reading a file that
+// has been modified after it was opened fails with EIO
+func TestConsistentReads(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-reverse")
+	mnt := dir + ".mnt"
+	// The modified file is logged with a warning, which must not panic
+	test_helpers.MountOrFatal(t, dir, mnt, "-reverse", "-extpass", "echo test", "-consistent-reads", "-wpanic=false")
+	defer test_helpers.UnmountPanic(mnt)
+
+	// Big enough that the second read is not served from the page cache
+	const fileSize = 1024 * 1024
+	fn := filepath.Join(dir, "foo")
+	if err := ioutil.WriteFile(fn, make([]byte, fileSize), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var cName string
+	entries, err := ioutil.ReadDir(mnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Mode().IsRegular() && e.Size() > fileSize {
+			cName = e.Name()
+		}
+	}
+	if cName == "" {
+		t.Fatalf("ciphertext file not found in %v", entries)
+	}
+	f, err := os.Open(filepath.Join(mnt, cName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 100)
+	if _, err = f.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	// Append to the plaintext file behind our back
+	pf, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pf.Write([]byte("x"))
+	pf.Close()
+	_, err = f.ReadAt(buf, fileSize-1000)
+	if !errors.Is(err, syscall.EIO) {
+		t.Errorf("read after modification should fail with EIO, got %v", err)
+	}
+	// Opening the file again pins the new version
+	if _, err = ioutil.ReadFile(filepath.Join(mnt, cName)); err != nil {
+		t.Errorf("fresh open should work, got %v", err)
+	}
+}
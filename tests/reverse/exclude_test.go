@@ -2,10 +2,15 @@ package reverse_test
 
 import (
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"strconv"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
 	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
 )
@@ -155,3 +160,76 @@ func TestExcludeAllOnlyDir1(t *testing.T) {
 	}
 	doTestExcludeTestFs(t, "-exclude-wildcard", patterns, visible, hidden)
 }
+
+// TestExcludeByAttr tests -exclude-larger-than, -exclude-special,
+// -exclude-older-than, -exclude-newer-than and -exclude-ignore-files
+func TestExcludeByAttr(t *testing.T) {
+	args := []string{"-reverse"}
+	if plaintextnames {
+		args = append(args, "-plaintextnames")
+	}
+	pDir := test_helpers.InitFS(t, args...)
+	old := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	future := time.Now().Add(24 * time.Hour)
+	files := []struct {
+		path  string
+		size  int
+		mtime time.Time
+	}{
+		{"small", 1000, time.Now()},
+		{"big", 1001, time.Now()},
+		{"old", 0, old},
+		{"future", 0, future},
+		{"x.tmp", 0, time.Now()},
+		{"dir/x.tmp", 0, time.Now()},
+		{"dir/x.log", 0, time.Now()},
+		{"dir/.gocryptfs-ignore", 0, time.Now()},
+		{"x.log", 0, time.Now()},
+	}
+	if err := os.Mkdir(filepath.Join(pDir, "dir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		path := filepath.Join(pDir, f.path)
+		if err := ioutil.WriteFile(path, make([]byte, f.size), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, f.mtime, f.mtime)
+	}
+	if err := ioutil.WriteFile(filepath.Join(pDir, "dir/.gocryptfs-ignore"), []byte("*.log\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(pDir, ".gocryptfs-ignore"), []byte("*.tmp\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(pDir, "fifo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The config file is older than the -exclude-older-than time, but must
+	// stay visible
+	os.Chtimes(filepath.Join(pDir, configfile.ConfReverseName), old, old)
+
+	mnt := pDir + ".mnt"
+	sock := mnt + ".sock"
+	test_helpers.MountOrFatal(t, pDir, mnt, "-reverse", "-extpass", "echo test", "-ctlsock", sock,
+		"-exclude-larger-than", "1000", "-exclude-special", "-exclude-older-than", "2010-01-01",
+		"-exclude-newer-than", "@"+strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10),
+		"-exclude-ignore-files")
+	defer test_helpers.UnmountPanic(mnt)
+
+	visible := []string{"small", "dir", "x.log", "dir/.gocryptfs-ignore", ".gocryptfs-ignore"}
+	hidden := []string{"big", "old", "future", "fifo", "x.tmp", "dir/x.tmp", "dir/x.log"}
+	for _, v := range encryptExcludeTestPaths(t, sock, visible) {
+		if !test_helpers.VerifyExistence(t, mnt+"/"+v) {
+			t.Errorf("File %q is hidden, but should be visible", v)
+		}
+	}
+	for _, v := range encryptExcludeTestPaths(t, sock, hidden) {
+		if test_helpers.VerifyExistence(t, mnt+"/"+v) {
+			t.Errorf("File %q is visible, but should be hidden", v)
+		}
+	}
+	if !test_helpers.VerifyExistence(t, mnt+"/"+configfile.ConfDefaultName) {
+		t.Errorf("%s is hidden", configfile.ConfDefaultName)
+	}
+}
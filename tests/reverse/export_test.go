@@ -0,0 +1,253 @@
+package reverse_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/xattr"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// runExport runs "gocryptfs -export dirA dest" and returns the exit code
+func runExport(t *testing.T, dest string) int {
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-export", "-extpass", "echo test", dirA, dest)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return test_helpers.ExtractCmdExitCode(cmd.Run())
+}
+
+// compareTrees checks that "have" contains exactly what the reverse mount
+// "want" presents: the same names, file contents, symlink targets,
+// permissions and mtimes.
+func compareTrees(t *testing.T, want string, have string) {
+	seen := make(map[string]bool)
+	filepath.Walk(want, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		rel, _ := filepath.Rel(want, path)
+		if !fi.Mode().IsRegular() && !fi.IsDir() && fi.Mode()&os.ModeSymlink == 0 {
+			// Special files are not exported
+			return nil
+		}
+		seen[rel] = true
+		fi2, err := os.Lstat(filepath.Join(have, rel))
+		if err != nil {
+			t.Errorf("%q: %v", rel, err)
+			return nil
+		}
+		if rel != "." && (fi.Mode() != fi2.Mode() || !fi.ModTime().Equal(fi2.ModTime())) {
+			t.Errorf("%q: mode or mtime differ: want %v %v, have %v %v", rel, fi.Mode(), fi.ModTime(), fi2.Mode(), fi2.ModTime())
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			l1, _ := os.Readlink(path)
+			l2, _ := os.Readlink(filepath.Join(have, rel))
+			if l1 != l2 {
+				t.Errorf("%q: symlink target differs: want %q, have %q", rel, l1, l2)
+			}
+		} else if fi.Mode().IsRegular() {
+			c1, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Error(err)
+			}
+			c2, err := ioutil.ReadFile(filepath.Join(have, rel))
+			if err != nil {
+				t.Error(err)
+			}
+			if !bytes.Equal(c1, c2) {
+				t.Errorf("%q: content differs (%d vs %d bytes)", rel, len(c1), len(c2))
+			}
+		}
+		return nil
+	})
+	filepath.Walk(have, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(have, path)
+		if !seen[rel] {
+			t.Errorf("%q: not in the reverse mount", rel)
+		}
+		return nil
+	})
+}
+
+// TestExport checks that "-export" writes the same ciphertext the reverse
+// mount presents, and that a second run only updates what has changed.
+func TestExport(t *testing.T) {
+	pDir := filepath.Join(dirA, t.Name())
+	if err := os.Mkdir(pDir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]int{"empty": 0, "small": 100, "oneblock": 4096, "twoblocks": 5000, "big": 300000, x240: 10}
+	for name, size := range files {
+		if err := ioutil.WriteFile(filepath.Join(pDir, name), bytes.Repeat([]byte("a"), size), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(pDir, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(pDir, "sub", "file"), []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../small", filepath.Join(pDir, "sub", "link")); err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	if code := runExport(t, dest); code != 0 {
+		t.Fatalf("export failed with exit code %d", code)
+	}
+	compareTrees(t, dirB, dest)
+
+	// Change a file, delete one, and check that unchanged files are kept
+	var stBefore syscall.Stat_t
+	var cSmall string
+	// Find the ciphertext of "small" through its size
+	filepath.Walk(dest, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() && fi.Size() == 18+100+32 {
+			cSmall = path
+		}
+		return nil
+	})
+	if cSmall == "" {
+		t.Fatal("ciphertext of \"small\" not found")
+	}
+	syscall.Stat(cSmall, &stBefore)
+	if err := ioutil.WriteFile(filepath.Join(pDir, "twoblocks"), []byte("changed"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	// The mtime may not have changed within the timestamp granularity
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(pDir, "twoblocks"), future, future)
+	if err := os.Remove(filepath.Join(pDir, "big")); err != nil {
+		t.Fatal(err)
+	}
+	if code := runExport(t, dest); code != 0 {
+		t.Fatalf("second export failed with exit code %d", code)
+	}
+	compareTrees(t, dirB, dest)
+	var stAfter syscall.Stat_t
+	syscall.Stat(cSmall, &stAfter)
+	if stBefore.Ino != stAfter.Ino {
+		t.Errorf("unchanged file was rewritten")
+	}
+	os.RemoveAll(pDir)
+}
+
+// TestExportRefuse checks that "-export" does not touch a directory that
+// does not look like an earlier export.
+func TestExportRefuse(t *testing.T) {
+	dest := t.TempDir()
+	canary := filepath.Join(dest, "important")
+	if err := ioutil.WriteFile(canary, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if code := runExport(t, dest); code != exitcodes.Export {
+		t.Errorf("wrong exit code: want %d, have %d", exitcodes.Export, code)
+	}
+	if _, err := os.Stat(canary); err != nil {
+		t.Error(err)
+	}
+	// Exporting into the plaintext directory itself would recurse
+	if code := runExport(t, dirA); code != exitcodes.Export {
+		t.Errorf("wrong exit code: want %d, have %d", exitcodes.Export, code)
+	}
+}
+
+// compareXattrs checks that the files and directories in "have" have the
+// same xattrs as in the reverse mount "want". Returns the number of xattrs
+// found.
+func compareXattrs(t *testing.T, want string, have string) (n int) {
+	filepath.Walk(want, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !(fi.Mode().IsRegular() || fi.IsDir()) {
+			return nil
+		}
+		rel, _ := filepath.Rel(want, path)
+		get := func(p string) map[string]string {
+			out := make(map[string]string)
+			names, err := xattr.LList(p)
+			if err != nil {
+				t.Errorf("%q: %v", rel, err)
+			}
+			for _, n := range names {
+				v, err := xattr.LGet(p, n)
+				if err != nil {
+					t.Errorf("%q: %s: %v", rel, n, err)
+				}
+				out[n] = string(v)
+			}
+			return out
+		}
+		if w, h := get(path), get(filepath.Join(have, rel)); !reflect.DeepEqual(w, h) {
+			t.Errorf("%q: xattrs differ: want %v, have %v", rel, w, h)
+		} else {
+			n += len(h)
+		}
+		return nil
+	})
+	return n
+}
+
+// TestExportXattr checks that "-export" copies the encrypted xattrs and
+// updates them on the next run
+func TestExportXattr(t *testing.T) {
+	if !xattrSupported(dirA) {
+		t.Skip()
+	}
+	pDir := filepath.Join(dirA, t.Name())
+	if err := os.Mkdir(pDir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pDir)
+	file := filepath.Join(pDir, "file")
+	if err := ioutil.WriteFile(file, []byte("content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{pDir, file} {
+		if err := xattr.LSet(p, "user.a", []byte("value a")); err != nil {
+			t.Fatal(err)
+		}
+		if err := xattr.LSet(p, "user.empty", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Read-only files get their xattrs too
+	if err := os.Chmod(file, 0400); err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	if !xattrSupported(dest) {
+		t.Skip()
+	}
+	if code := runExport(t, dest); code != 0 {
+		t.Fatalf("export failed with exit code %d", code)
+	}
+	if n := compareXattrs(t, dirB, dest); n != 4 {
+		t.Errorf("want 4 xattrs, have %d", n)
+	}
+	// Changed and removed xattrs of an otherwise unchanged file
+	if err := xattr.LRemove(file, "user.a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := xattr.LSet(file, "user.b", []byte("value b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := xattr.LSet(pDir, "user.a", []byte("new value")); err != nil {
+		t.Fatal(err)
+	}
+	if code := runExport(t, dest); code != 0 {
+		t.Fatalf("second export failed with exit code %d", code)
+	}
+	compareXattrs(t, dirB, dest)
+}
@@ -34,10 +34,12 @@ func TestMain(m *testing.M) {
 	testcases := []struct {
 		plaintextnames      bool
 		deterministic_names bool
+		gcmsiv              bool
 	}{
-		{false, false},
-		{true, false},
-		{false, true},
+		{false, false, false},
+		{true, false, false},
+		{false, true, false},
+		{false, false, true},
 	}
 	for i, tc := range testcases {
 		argsA := []string{"-reverse"}
@@ -47,6 +49,9 @@ func TestMain(m *testing.M) {
 		} else if tc.deterministic_names {
 			argsA = append(argsA, "-deterministic-names")
 		}
+		if tc.gcmsiv {
+			argsA = append(argsA, "-gcmsiv")
+		}
 		dirA = test_helpers.InitFS(nil, argsA...)
 		dirB = test_helpers.TmpDir + "/b"
 		dirC = test_helpers.TmpDir + "/c"
@@ -0,0 +1,306 @@
+package reverse_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// findByMtime returns the path of the regular file below "dir" that has
+// the modification time "mtime"
+func findByMtime(t *testing.T, dir string, mtime time.Time) string {
+	var out string
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() && fi.ModTime().Equal(mtime) {
+			out = path
+		}
+		return nil
+	})
+	if out == "" {
+		t.Fatalf("no file with mtime %v in %q", mtime, dir)
+	}
+	return out
+}
+
+// waitSettled waits until no staged files are left below "dir". Staged files
+// are decrypted when the kernel releases them, which happens asynchronously
+// after close().
+func waitSettled(t *testing.T, dir string) {
+	t.Helper()
+	var left []string
+	for i := 0; i < 100; i++ {
+		left = nil
+		filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err == nil && strings.HasPrefix(fi.Name(), ".gocryptfs-restore-") {
+				left = append(left, path)
+			}
+			return nil
+		})
+		if len(left) == 0 {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Errorf("left behind: %q", left)
+}
+
+// TestWritable backs up the ciphertext of a reverse mount, and restores it
+// by copying it into an empty "-writable" reverse mount.
+func TestWritable(t *testing.T) {
+	// Use a fresh reverse mount, so that the backup does not depend on what
+	// other tests have done in dirA
+	args := []string{"-reverse"}
+	if plaintextnames {
+		args = append(args, "-plaintextnames")
+	} else if deterministic_names {
+		args = append(args, "-deterministic-names")
+	}
+	pDir := test_helpers.InitFS(t, args...)
+	files := map[string]int{"empty": 0, "small": 100, "twoblocks": 5000, "big": 300000, x240: 10}
+	for name, size := range files {
+		if err := ioutil.WriteFile(filepath.Join(pDir, name), bytes.Repeat([]byte("a"), size), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A long directory name, with a long file name inside
+	longDir := filepath.Join(pDir, strings.Repeat("d", 240))
+	if err := os.Mkdir(longDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(longDir, x240), []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../small", filepath.Join(longDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	// Two files we can find in the backup through their mtime
+	mtimeA := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	mtimeB := time.Date(2002, 1, 1, 0, 0, 0, 0, time.UTC)
+	for name, mtime := range map[string]time.Time{"a": mtimeA, "b": mtimeB} {
+		fn := filepath.Join(pDir, name)
+		if err := ioutil.WriteFile(fn, []byte("content of "+name), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(fn, mtime, mtime)
+	}
+	cDir := pDir + ".mnt"
+	test_helpers.MountOrFatal(t, pDir, cDir, "-reverse", "-extpass", "echo test")
+	backup := t.TempDir()
+	out, err := exec.Command("cp", "-a", cDir+"/.", backup).CombinedOutput()
+	test_helpers.UnmountPanic(cDir)
+	if err != nil {
+		t.Fatalf("backup failed: %v\n%s", err, out)
+	}
+
+	// Restore into an empty directory that uses the same config file
+	restored := t.TempDir()
+	if out, err := exec.Command("cp", "-a", filepath.Join(pDir, configfile.ConfReverseName), restored).CombinedOutput(); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	mnt := restored + ".mnt"
+	// Writing wrong content to a virtual file is logged with a warning
+	test_helpers.MountOrFatal(t, restored, mnt, "-reverse", "-writable", "-extpass", "echo test", "-wpanic=false")
+	defer test_helpers.UnmountPanic(mnt)
+	if out, err := exec.Command("cp", "-a", backup+"/.", mnt).CombinedOutput(); err != nil {
+		t.Fatalf("restore failed: %v\n%s", err, out)
+	}
+	waitSettled(t, restored)
+	compareTrees(t, pDir, restored)
+
+	cA := findByMtime(t, backup, mtimeA)
+	cB := findByMtime(t, backup, mtimeB)
+	rel, _ := filepath.Rel(backup, cA)
+	mntA := filepath.Join(mnt, rel)
+	contentA, err := ioutil.ReadFile(cA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contentB, err := ioutil.ReadFile(cB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkA := func(want string) {
+		t.Helper()
+		waitSettled(t, restored)
+		have, err := ioutil.ReadFile(filepath.Join(restored, "a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(have) != want {
+			t.Errorf("want %q, have %q", want, have)
+		}
+	}
+
+	// Opening a file for writing without writing to it reads the ciphertext
+	// and leaves the plaintext alone
+	f, err := os.OpenFile(mntA, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, contentA) {
+		t.Errorf("reading a file opened for writing: want %d bytes of ciphertext, have %d bytes", len(contentA), len(have))
+	}
+	checkA("content of a")
+
+	// Overwriting a file replaces the plaintext
+	if err = ioutil.WriteFile(mntA, contentB, 0600); err != nil {
+		t.Fatal(err)
+	}
+	checkA("content of b")
+
+	// rsync writes to a temporary file and renames it. Put the ciphertext
+	// of "a" back in place.
+	tmp := filepath.Join(filepath.Dir(mntA), ".a.XyZ123")
+	if err = ioutil.WriteFile(tmp, contentA, 0600); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Lstat(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len(contentA)) {
+		t.Errorf("staged file: want size %d, have %d", len(contentA), fi.Size())
+	}
+	// RENAME_NOREPLACE must not replace the existing file
+	err = syscallcompat.Renameat2(unix.AT_FDCWD, tmp, unix.AT_FDCWD, mntA, syscallcompat.RENAME_NOREPLACE)
+	if err != syscall.EEXIST {
+		t.Errorf("RENAME_NOREPLACE: want EEXIST, have %v", err)
+	}
+	if err = os.Rename(tmp, mntA); err != nil {
+		t.Fatal(err)
+	}
+	checkA("content of a")
+
+	// Ciphertext that cannot be decrypted stays staged, and the copy can be
+	// retried
+	corrupt := append([]byte{}, contentB...)
+	corrupt[len(corrupt)-1] ^= 1
+	if err = ioutil.WriteFile(mntA, corrupt, 0600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	have, err = ioutil.ReadFile(mntA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, corrupt) {
+		t.Errorf("staged copy of corrupt ciphertext is gone")
+	}
+	if err = ioutil.WriteFile(mntA, contentB, 0600); err != nil {
+		t.Fatal(err)
+	}
+	checkA("content of b")
+
+	// The config file cannot be deleted
+	if err = syscall.Unlink(filepath.Join(mnt, configfile.ConfDefaultName)); err != syscall.EPERM {
+		t.Errorf("unlinking gocryptfs.conf: want EPERM, have %v", err)
+	}
+	// Virtual files only accept their own content
+	if !plaintextnames && !deterministic_names {
+		err = ioutil.WriteFile(filepath.Join(mnt, nametransform.DirIVFilename), []byte("0123456789abcdef"), 0400)
+		if !errors.Is(err, syscall.EINVAL) {
+			t.Errorf("overwriting gocryptfs.diriv: want EINVAL, have %v", err)
+		}
+	}
+}
+
+// TestWritableReadOnly checks that a reverse mount without -writable
+// cannot be written to
+func TestWritableReadOnly(t *testing.T) {
+	err := ioutil.WriteFile(filepath.Join(dirB, "foo"), nil, 0600)
+	if !errors.Is(err, syscall.EROFS) {
+		t.Errorf("want EROFS, have %v", err)
+	}
+}
+
+// TestWritableJournal checks that the staged entries of an unfinished
+// restore are hidden in a read-only mount, and shown again in the next
+// "-writable" mount
+func TestWritableJournal(t *testing.T) {
+	args := []string{"-reverse"}
+	if plaintextnames {
+		args = append(args, "-plaintextnames")
+	} else if deterministic_names {
+		args = append(args, "-deterministic-names")
+	}
+	pDir := test_helpers.InitFS(t, args...)
+	// What a -writable mount leaves behind when it is unmounted while "XyZ.tmp"
+	// cannot be decrypted yet
+	hidden := ".gocryptfs-restore-0123456789abcdef"
+	staged := []byte("ciphertext of XyZ.tmp")
+	if err := ioutil.WriteFile(filepath.Join(pDir, hidden), staged, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(pDir, hidden+".tmp"), []byte("interrupted"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	journal := filepath.Join(pDir, ".gocryptfs-restore-journal")
+	if err := ioutil.WriteFile(journal, []byte(`{"XyZ.tmp":"`+hidden+`"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// A normal file that happens to have the prefix
+	if err := ioutil.WriteFile(filepath.Join(pDir, ".gocryptfs-restore-user"), []byte("user data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Visible are gocryptfs.conf, gocryptfs.diriv and the user file
+	want := 3
+	if plaintextnames || deterministic_names {
+		want = 2
+	}
+	cDir := pDir + ".mnt"
+	test_helpers.MountOrFatal(t, pDir, cDir, "-reverse", "-extpass", "echo test", "-wpanic=false")
+	entries, err := ioutil.ReadDir(cDir)
+	test_helpers.UnmountPanic(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != want {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("read-only mount: want %d entries, have %q", want, names)
+	}
+
+	// Settling fails after reading the staged file, as it holds no real
+	// ciphertext, and is reported with a warning
+	test_helpers.MountOrFatal(t, pDir, cDir, "-reverse", "-writable", "-extpass", "echo test", "-wpanic=false")
+	defer test_helpers.UnmountPanic(cDir)
+	have, err := ioutil.ReadFile(filepath.Join(cDir, "XyZ.tmp"))
+	if err != nil || !bytes.Equal(have, staged) {
+		t.Errorf("staged file: %v %q", err, have)
+	}
+	if _, err = os.Stat(filepath.Join(pDir, hidden+".tmp")); !os.IsNotExist(err) {
+		t.Errorf("interrupted decryption was not cleaned up: %v", err)
+	}
+	if err = os.Remove(filepath.Join(cDir, "XyZ.tmp")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{hidden, ".gocryptfs-restore-journal"} {
+		if _, err = os.Stat(filepath.Join(pDir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s: want ENOENT, have %v", name, err)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(pDir, ".gocryptfs-restore-user")); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,9 +1,11 @@
 package reverse_test
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"testing"
 
@@ -23,8 +25,6 @@ func xattrSupported(path string) bool {
 }
 
 func TestXattrList(t *testing.T) {
-	t.Skip("TODO: not implemented yet in reverse mode")
-
 	if !xattrSupported(dirA) {
 		t.Skip()
 	}
@@ -35,7 +35,7 @@ func TestXattrList(t *testing.T) {
 	}
 	val := []byte("xxxxxxxxyyyyyyyyyyyyyyyzzzzzzzzzzzzz")
 	num := 20
-	var namesA map[string]string
+	namesA := make(map[string]string)
 	for i := 1; i <= num; i++ {
 		attr := fmt.Sprintf("user.TestXattrList.%02d", i)
 		err = xattr.LSet(fnA, attr, val)
@@ -44,23 +44,88 @@ func TestXattrList(t *testing.T) {
 		}
 		namesA[attr] = string(val)
 	}
+	// Empty values are allowed
+	err = xattr.LSet(fnA, "user.TestXattrList.empty", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	namesA["user.TestXattrList.empty"] = ""
 	fnC := filepath.Join(dirC, t.Name())
 	tmp, err := xattr.LList(fnC)
 	if err != nil {
 		t.Fatal(err)
 	}
-	var namesC map[string]string
+	namesC := make(map[string]string)
 	for _, n := range tmp {
-		namesC[n] = string(val)
+		v, err := xattr.LGet(fnC, n)
+		if err != nil {
+			t.Fatalf("%s: %v", n, err)
+		}
+		namesC[n] = string(v)
 	}
 	if len(namesA) != len(namesC) {
 		t.Errorf("wrong number of names, want=%d have=%d", len(namesA), len(namesC))
 	}
-	for i := range namesC {
+	for i := range namesA {
 		valA := namesA[i]
-		valC := namesC[i]
-		if valC != valA {
+		valC, ok := namesC[i]
+		if !ok || valC != valA {
 			t.Errorf("mismatch on attr %q: valA = %q, valC = %q", i, valA, valC)
 		}
 	}
 }
+
+// TestXattrEncrypted checks that the names and values are encrypted in the
+// reverse mount, and that the values are stable
+func TestXattrEncrypted(t *testing.T) {
+	if !xattrSupported(dirA) {
+		t.Skip()
+	}
+	fnA := filepath.Join(dirA, t.Name())
+	if err := ioutil.WriteFile(fnA, nil, 0700); err != nil {
+		t.Fatal(err)
+	}
+	val := []byte("secret value")
+	if err := xattr.LSet(fnA, "user.secret", val); err != nil {
+		t.Fatal(err)
+	}
+	// Find the ciphertext file through the C mount's view of B
+	entries, err := ioutil.ReadDir(dirB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cNames []string
+	for _, e := range entries {
+		if e.Mode().IsRegular() && e.Size() == 0 && e.Name() != "gocryptfs.conf" {
+			names, err := xattr.LList(filepath.Join(dirB, e.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(names) == 1 {
+				cNames = append(cNames, e.Name())
+			}
+		}
+	}
+	if len(cNames) != 1 {
+		t.Fatalf("expected exactly one file with one xattr in %s, got %v", dirB, cNames)
+	}
+	fnB := filepath.Join(dirB, cNames[0])
+	names, _ := xattr.LList(fnB)
+	if !strings.HasPrefix(names[0], "user.gocryptfs.") || strings.Contains(names[0], "secret") {
+		t.Errorf("xattr name not encrypted: %q", names[0])
+	}
+	v1, err := xattr.LGet(fnB, names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(v1, val) {
+		t.Errorf("xattr value not encrypted: %q", v1)
+	}
+	v2, err := xattr.LGet(fnB, names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v1, v2) {
+		t.Errorf("xattr value is not deterministic")
+	}
+}
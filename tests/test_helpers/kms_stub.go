@@ -0,0 +1,120 @@
+package test_helpers
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// KMSStub is a stand-in for an external key management service. It speaks
+// the wrap/unwrap protocol used by "gocryptfs -kms-endpoint" and keeps its
+// key encryption keys in memory.
+type KMSStub struct {
+	// URL is the value to pass to "-kms-endpoint"
+	URL      string
+	listener net.Listener
+	server   *http.Server
+	mu       sync.Mutex
+	keys     map[string]cipher.AEAD
+	// Requests counts the handled wrap and unwrap requests
+	Requests int
+}
+
+// StartKMSStub starts a KMSStub listening on an HTTP port on localhost, or,
+// if "socketPath" is not empty, on a Unix socket at "socketPath".
+func StartKMSStub(socketPath string) *KMSStub {
+	s := &KMSStub{keys: make(map[string]cipher.AEAD)}
+	var err error
+	if socketPath != "" {
+		s.listener, err = net.Listen("unix", socketPath)
+		s.URL = "unix:" + socketPath
+	} else {
+		s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+		if err == nil {
+			s.URL = "http://" + s.listener.Addr().String()
+		}
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/wrap", s.handle)
+	mux.HandleFunc("/unwrap", s.handle)
+	s.server = &http.Server{Handler: mux}
+	go s.server.Serve(s.listener)
+	return s
+}
+
+// Close stops the KMSStub. All keys are lost.
+func (s *KMSStub) Close() {
+	s.server.Close()
+}
+
+func (s *KMSStub) aead(keyID string) cipher.AEAD {
+	a := s.keys[keyID]
+	if a != nil {
+		return a
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Panic(err)
+	}
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		log.Panic(err)
+	}
+	a, err = cipher.NewGCM(b)
+	if err != nil {
+		log.Panic(err)
+	}
+	s.keys[keyID] = a
+	return a
+}
+
+func (s *KMSStub) handle(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		KeyID      string
+		Plaintext  []byte
+		Ciphertext []byte
+	}
+	var resp struct {
+		Plaintext  []byte `json:",omitempty"`
+		Ciphertext []byte `json:",omitempty"`
+		Error      string `json:",omitempty"`
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Requests++
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		resp.Error = err.Error()
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	a := s.aead(req.KeyID)
+	if r.URL.Path == "/wrap" {
+		nonce := make([]byte, a.NonceSize())
+		rand.Read(nonce)
+		resp.Ciphertext = a.Seal(nonce, nonce, req.Plaintext, []byte(req.KeyID))
+	} else {
+		var err error
+		if len(req.Ciphertext) < a.NonceSize() {
+			resp.Error = "ciphertext too short"
+		} else {
+			n := a.NonceSize()
+			resp.Plaintext, err = a.Open(nil, req.Ciphertext[:n], req.Ciphertext[n:], []byte(req.KeyID))
+			if err != nil {
+				resp.Error = err.Error()
+			}
+		}
+		if resp.Error != "" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// handleArgsReaderKey gets the reader key from "-reader-key" (hex string on
+// the command line or "stdin") and returns it in binary. Returns nil if
+// "-reader-key" was not passed.
+// Calls os.Exit on failure.
+func handleArgsReaderKey(args *argContainer) []byte {
+	if args.reader_key == "" {
+		return nil
+	}
+	h := args.reader_key
+	if h == "stdin" {
+		in, err := readpassword.Once(nil, nil, "Reader key")
+		if err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(exitcodes.ReadPassword)
+		}
+		h = string(in)
+	}
+	key, err := hex.DecodeString(strings.Replace(h, "-", "", -1))
+	if err != nil {
+		tlog.Fatal.Printf("Could not parse reader key: %v", err)
+		os.Exit(exitcodes.MasterKey)
+	}
+	if len(key) != cryptocore.KeyLen {
+		tlog.Fatal.Printf("Reader key has length %d but we require length %d", len(key), cryptocore.KeyLen)
+		os.Exit(exitcodes.MasterKey)
+	}
+	tlog.Info.Printf("Using reader key, mounting read-only.")
+	return key
+}
+
+// loadWriteAuthConf loads the config file of a filesystem that was created
+// with "-write-auth", without decrypting the master key.
+// Calls os.Exit on failure.
+func loadWriteAuthConf(args *argContainer) *configfile.ConfFile {
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.LoadConf)
+	}
+	if !cf.IsFeatureFlagSet(configfile.FlagWriteAuth) {
+		tlog.Fatal.Printf("The filesystem was not created with -write-auth, it has no reader key")
+		os.Exit(exitcodes.Usage)
+	}
+	return cf
+}
+
+// exportReaderKey - print the reader key of a "-write-auth" filesystem to
+// stdout. The reader key can decrypt, but not write, the filesystem.
+// Does not return (calls os.Exit both on success and on error).
+func exportReaderKey(args *argContainer) {
+	// Only the key goes to stdout, so it can be redirected to a file
+	tlog.Info.Enabled = false
+	loadWriteAuthConf(args)
+	masterkey, cf, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	readerKey, wa, err := cf.WriteAuthKeys(masterkey)
+	wipe(masterkey)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		exitcodes.Exit(err)
+	}
+	wipe(wa.PrivateKey)
+	fmt.Println(hex.EncodeToString(readerKey))
+	wipe(readerKey)
+	os.Exit(0)
+}